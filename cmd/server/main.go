@@ -3,134 +3,169 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/fallenkarma/wasatext/internal/config"
 	"github.com/fallenkarma/wasatext/internal/handlers"
+	"github.com/fallenkarma/wasatext/internal/health"
+	"github.com/fallenkarma/wasatext/internal/linkpreview"
+	"github.com/fallenkarma/wasatext/internal/logging"
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
 	"github.com/fallenkarma/wasatext/internal/repository/postgres"
+	"github.com/fallenkarma/wasatext/internal/repository/sqlite"
 	"github.com/fallenkarma/wasatext/internal/service"
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
+	"github.com/fallenkarma/wasatext/internal/tracing"
 	"github.com/rs/cors"
 )
 
+// Set at build time with -ldflags "-X main.commit=<git SHA> -X main.buildTime=<RFC 3339 time>"
+var (
+	commit    string
+	buildTime string
+)
+
 func main() {
-	err := godotenv.Load()
+	cfg, err := config.Load()
 	if err != nil {
-		log.Println("Warning: Error loading .env file:", err)
-	} else {
-		log.Println("Successfully loaded .env file")
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-    // Get environment variables
-    port := os.Getenv("SERVER_PORT")
-    if port == "" {
-        port = "8080" // Default port if not specified
-    }
-    
-    dbConnectionString := os.Getenv("DB_CONNECTION_STRING")
-	log.Print("DB_CONNECTION_STRING: ", dbConnectionString)
-
-	const UPLOADS_BASE_PATH = "/app/uploads"
-	repo,err := postgres.NewPostgresRepository(dbConnectionString,UPLOADS_BASE_PATH)
+	// The log package writes through the same JSON logger, at the info level
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	slog.SetDefault(logging.New(os.Stderr, level))
+	slog.Info("Configuration loaded", "config", cfg)
+
+	// "server migrate ..." manages the schema and exits instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if cfg.Database.Driver != "postgres" {
+			log.Fatalf("The migrate command only applies to postgres, %s migrates at startup", cfg.Database.Driver)
+		}
+		runMigrate(cfg.Database.ConnectionString, os.Args[2:], slog.Default())
+		return
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.OTLPEndpoint)
 	if err != nil {
-		log.Fatalf("Connection to database failed: %v", err)
+		log.Fatalf("Tracing setup failed: %v", err)
 	}
 
+	// The readiness checks of the storage, the uploads directory being checked last
+	probes := health.NewChecker()
+	var uploadsDir string
+
+	var repo repository.Repository
+	switch driver := cfg.Database.Driver; driver {
+	case "postgres":
+		pg, err := postgres.NewPostgresRepository(cfg.Database.ConnectionString, cfg.Uploads.Path, slog.Default())
+		if err != nil {
+			log.Fatalf("Connection to database failed: %v", err)
+		}
+		metrics.RegisterDBStats(driver, pg.DB())
+		probes.Add("database", pg.Ping)
+		probes.Add("migrations", pg.CheckMigrations)
+		uploadsDir = pg.UploadPath()
+		repo = pg
+	case "sqlite":
+		lite, err := sqlite.NewSQLiteRepository(cfg.Database.ConnectionString, cfg.Uploads.Path, slog.Default())
+		if err != nil {
+			log.Fatalf("Opening the database failed: %v", err)
+		}
+		metrics.RegisterDBStats(driver, lite.DB())
+		probes.Add("database", lite.Ping)
+		probes.Add("migrations", lite.CheckMigrations)
+		uploadsDir = lite.UploadPath()
+		repo = lite
+	case "memory":
+		slog.Warn("Using the in-memory repository, data will be lost on restart")
+		mem := memory.NewMemoryRepository(cfg.Uploads.Path)
+		uploadsDir = mem.UploadPath()
+		repo = mem
+	}
+	probes.Add("uploads", health.WritableDir(uploadsDir))
+
+	// "server repair-direct" merges the duplicated direct conversations and exits
+	if len(os.Args) > 1 && os.Args[1] == "repair-direct" {
+		runRepairDirect(repo, slog.Default())
+		return
+	}
+
+	// Start the background worker fetching link previews
+	previews := linkpreview.NewWorker(repo, linkpreview.NewFetcher(), 100, slog.Default())
+	previews.Start(2)
+
 	// Initialize service with repository
-	svc := service.New(repo)
+	svc := service.New(repo, previews)
 
-	// Initialize handlers with service
-	handler := handlers.New(svc)
+	// Initialize handlers with the traced service
+	handler := handlers.New(service.WithTracing(svc))
 
 	// Initialize router
-	r := mux.NewRouter()
-
-	 // --- NEW: Static File Server for Uploads ---
-    // This serves files from the UPLOADS_BASE_PATH on the /uploads/ endpoint.
-    // So if a file is saved at /app/uploads/user_photos/user123_12345.jpg
-    // it will be accessible at http://your-backend-ip:port/uploads/user_photos/user123_12345.jpg
-    fileServer := http.FileServer(http.Dir(UPLOADS_BASE_PATH))
-    r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", fileServer))
-
-	
-	// Add API prefix
-	apiRouter := r.PathPrefix("/api").Subrouter()
-
-	// Public routes (no auth required)
-	apiRouter.HandleFunc("/session", handler.Login).Methods("POST")
-
-	// Protected routes (auth required)
-	protected := apiRouter.NewRoute().Subrouter()
-	protected.Use(handler.AuthMiddleware)
-
-	// User routes
-	protected.HandleFunc("/users", handler.GetUsers).Methods("GET")
-	protected.HandleFunc("/users/me", handler.GetMyUser).Methods("GET")
-	protected.HandleFunc("/users/me/username", handler.SetMyUserName).Methods("PUT")
-	protected.HandleFunc("/users/me/photo", handler.SetMyPhoto).Methods("PUT")
-
-	// Conversation routes
-	protected.HandleFunc("/conversations", handler.CreateConversation).Methods("POST")
-	protected.HandleFunc("/conversations", handler.GetMyConversations).Methods("GET")
-	protected.HandleFunc("/conversations/{id}", handler.GetConversation).Methods("GET")
-
-	// Message routes
-	protected.HandleFunc("/messages", handler.SendMessage).Methods("POST")
-	protected.HandleFunc("/messages/forward", handler.ForwardMessage).Methods("POST")
-	protected.HandleFunc("/messages/{id}/reaction", handler.CommentMessage).Methods("POST")
-	protected.HandleFunc("/messages/{id}/reaction", handler.UncommentMessage).Methods("DELETE")
-	protected.HandleFunc("/messages/{id}", handler.DeleteMessage).Methods("DELETE")
-	protected.HandleFunc("/messages/{id}", handler.UpdateMessage).Methods("PUT")
-
-	// Group routes
-	protected.HandleFunc("/groups/{id}/members", handler.AddToGroup).Methods("POST")
-	protected.HandleFunc("/groups/{id}/leave", handler.LeaveGroup).Methods("POST")
-	protected.HandleFunc("/groups/{id}/name", handler.SetGroupName).Methods("PUT")
-	protected.HandleFunc("/groups/{id}/photo", handler.SetGroupPhoto).Methods("PUT")
+	// Rate limits are kept in memory, per server
+	limiter := handlers.NewRateLimiter(ratelimit.NewMemoryStore())
+	r := newRouter(handler, limiter, cfg.RateLimits, probes, health.ReadBuildInfo(commit, buildTime), cfg.Uploads.Path)
 
 	crs := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:4173"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Idempotency-Key", handlers.RequestIDHeader},
+		ExposedHeaders:   []string{handlers.RequestIDHeader, handlers.NextCursorHeader},
 		AllowCredentials: true,
 	})
 
 	// Wrap the router with CORS handler
-	handlerWithCORS := crs.Handler(r)	
+	handlerWithCORS := crs.Handler(r)
 
 	// Create server
 	srv := &http.Server{
-		Addr:         ":" + port,
+		Addr:         ":" + strconv.Itoa(cfg.Server.Port),
 		Handler:      handlerWithCORS,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
 
 	// Start server in a goroutine
 	go func() {
-		log.Println("Starting server on :" + port)
+		slog.Info("Starting server", "addr", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed: %v", err)
 		}
 	}()
 
-	// Wait for interrupt signal
+	// Wait for an interrupt, or the termination signal of the orchestrators
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
+	// Report unready from now on, and keep serving for the shutdown delay so that the
+	// load balancers notice it before the listener closes
+	probes.Drain()
+	if delay := cfg.Server.ShutdownDelay; delay > 0 {
+		slog.Info("Draining before shutdown", "delay", delay)
+		time.Sleep(delay)
+	}
+
 	// Create a deadline to wait for
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
 
 	// Gracefully shutdown the server
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server shutdown failed: %v", err)
 	}
-	log.Println("Server gracefully stopped")
-}
\ No newline at end of file
+	previews.Stop()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("Flushing the traces failed", "error", err)
+	}
+	slog.Info("Server gracefully stopped")
+}
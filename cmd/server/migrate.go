@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+
+	"github.com/fallenkarma/wasatext/internal/repository/postgres"
+)
+
+// runMigrate implements the "migrate up|down [steps]|status" subcommand, logging what
+// it did to logger
+func runMigrate(dbConnectionString string, args []string, logger *slog.Logger) {
+	if len(args) == 0 {
+		log.Fatal("Usage: server migrate up|down [steps]|status")
+	}
+
+	db, err := postgres.Open(dbConnectionString)
+	if err != nil {
+		log.Fatalf("Connection to database failed: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := postgres.MigrateUp(ctx, db)
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		logger.Info("Applied migrations", "count", applied)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				log.Fatalf("Invalid number of steps: %s", args[1])
+			}
+		}
+		rolledBack, err := postgres.MigrateDown(ctx, db, steps)
+		if err != nil {
+			log.Fatalf("Rollback failed: %v", err)
+		}
+		logger.Info("Rolled back migrations", "count", rolledBack)
+
+	case "status":
+		status, err := postgres.GetMigrationStatus(ctx, db)
+		if err != nil {
+			log.Fatalf("Failed to get migration status: %v", err)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-24s %s\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		log.Fatalf("Unknown migrate command: %s", args[0])
+	}
+}
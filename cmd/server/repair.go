@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// directConversationRepairer is implemented by the SQL repositories, whose databases
+// may hold direct conversations duplicated before they had a unique key
+type directConversationRepairer interface {
+	MergeDuplicateDirectConversations(ctx context.Context) (int, error)
+}
+
+// runRepairDirect implements the "repair-direct" subcommand, logging what it did to logger
+func runRepairDirect(repo repository.Repository, logger *slog.Logger) {
+	repairer, ok := repo.(directConversationRepairer)
+	if !ok {
+		logger.Info("Nothing to repair, this storage never held duplicated direct conversations")
+		return
+	}
+
+	merged, err := repairer.MergeDuplicateDirectConversations(context.Background())
+	if err != nil {
+		log.Fatalf("Repair failed: %v", err)
+	}
+	logger.Info("Merged duplicated direct conversations", "count", merged)
+}
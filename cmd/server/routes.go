@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/fallenkarma/wasatext/internal/config"
+	"github.com/fallenkarma/wasatext/internal/handlers"
+	"github.com/fallenkarma/wasatext/internal/health"
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/gorilla/mux"
+)
+
+// newRouter registers the API routes of handler, limited by limiter to limits, the probes
+// of the orchestrators answered by probes and build, and the uploaded files found in uploadsPath
+func newRouter(handler *handlers.Handler, limiter *handlers.RateLimiter, limits config.RateLimits,
+	probes *health.Checker, build health.BuildInfo, uploadsPath string) *mux.Router {
+	r := mux.NewRouter()
+
+	// The rate limits of the routes open to abuse, uploads counting multipart requests only
+	login := limiter.PerIP("login", limits.Login)
+	messages := limiter.PerUser("messages", limits.Messages)
+	reactions := limiter.PerUser("reactions", limits.Reactions)
+	uploads := handlers.UploadsOnly(limiter.PerUser("uploads", limits.Uploads))
+
+	// Every request gets an ID, a span, a line in the access log and its share of the metrics
+	r.Use(handlers.RequestIDMiddleware, handlers.TracingMiddleware, handlers.AccessLogMiddleware, handlers.MetricsMiddleware)
+
+	// Metrics in the Prometheus text format
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	// Liveness, readiness and build info
+	r.HandleFunc("/healthz", probes.Live).Methods("GET")
+	r.HandleFunc("/readyz", probes.Ready).Methods("GET")
+	r.HandleFunc("/version", health.Version(build)).Methods("GET")
+
+	// Static file server for uploads: a file saved at <uploadsPath>/user_photos/user123_12345.jpg
+	// is served at /uploads/user_photos/user123_12345.jpg
+	fileServer := http.FileServer(http.Dir(uploadsPath))
+	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", fileServer))
+
+	// Add API prefix
+	apiRouter := r.PathPrefix("/api").Subrouter()
+
+	// Public routes (no auth required)
+	apiRouter.Handle("/session", login(http.HandlerFunc(handler.Login))).Methods("POST")
+
+	// Protected routes (auth required)
+	protected := apiRouter.NewRoute().Subrouter()
+	protected.Use(handler.AuthMiddleware)
+
+	// User routes
+	protected.HandleFunc("/users", handler.GetUsers).Methods("GET")
+	protected.HandleFunc("/users/me", handler.GetMyUser).Methods("GET")
+	protected.HandleFunc("/users/me", handler.UpdateMyProfile).Methods("PATCH")
+	protected.HandleFunc("/users/me/mentions", handler.GetMyMentions).Methods("GET")
+	protected.HandleFunc("/users/me/username", handler.SetMyUserName).Methods("PUT")
+	protected.Handle("/users/me/photo", uploads(http.HandlerFunc(handler.SetMyPhoto))).Methods("PUT")
+	protected.HandleFunc("/users/me/privacy", handler.SetMyPrivacy).Methods("PUT")
+	protected.HandleFunc("/users/me/heartbeat", handler.Heartbeat).Methods("POST")
+	protected.HandleFunc("/users/{id}", handler.GetUserProfile).Methods("GET")
+	protected.HandleFunc("/users/{id}/presence", handler.GetUserPresence).Methods("GET")
+	protected.HandleFunc("/users/{id}/block", handler.BlockUser).Methods("POST")
+	protected.HandleFunc("/users/{id}/block", handler.UnblockUser).Methods("DELETE")
+	protected.HandleFunc("/users/{id}/report", handler.ReportUser).Methods("POST")
+
+	// Conversation routes
+	protected.HandleFunc("/conversations", handler.CreateConversation).Methods("POST")
+	protected.HandleFunc("/conversations", handler.GetMyConversations).Methods("GET")
+	protected.HandleFunc("/conversations/{id}", handler.GetConversation).Methods("GET")
+	protected.HandleFunc("/conversations/{id}/typing", handler.SetTyping).Methods("POST")
+	protected.HandleFunc("/conversations/{id}/archive", handler.ArchiveConversation).Methods("POST")
+	protected.HandleFunc("/conversations/{id}/archive", handler.UnarchiveConversation).Methods("DELETE")
+	protected.HandleFunc("/conversations/{id}/mute", handler.MuteConversation).Methods("POST")
+	protected.HandleFunc("/conversations/{id}/mute", handler.UnmuteConversation).Methods("DELETE")
+	protected.HandleFunc("/conversations/{id}/pin", handler.PinConversation).Methods("POST")
+	protected.HandleFunc("/conversations/{id}/pin", handler.UnpinConversation).Methods("DELETE")
+
+	// Message routes
+	protected.Handle("/messages", messages(uploads(http.HandlerFunc(handler.SendMessage)))).Methods("POST")
+	protected.Handle("/messages/forward", messages(http.HandlerFunc(handler.ForwardMessage))).Methods("POST")
+	protected.Handle("/messages/{id}/reaction", reactions(http.HandlerFunc(handler.CommentMessage))).Methods("POST")
+	protected.HandleFunc("/messages/{id}/reaction", handler.UncommentMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}", handler.DeleteMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}", handler.UpdateMessage).Methods("PUT")
+	protected.HandleFunc("/messages/{id}/report", handler.ReportMessage).Methods("POST")
+
+	// Group routes
+	protected.HandleFunc("/groups/{id}/members", handler.AddToGroup).Methods("POST")
+	protected.HandleFunc("/groups/{id}/leave", handler.LeaveGroup).Methods("POST")
+	protected.HandleFunc("/groups/{id}/name", handler.SetGroupName).Methods("PUT")
+	protected.Handle("/groups/{id}/photo", uploads(http.HandlerFunc(handler.SetGroupPhoto))).Methods("PUT")
+
+	// Moderation routes, restricted to moderators by the service
+	protected.HandleFunc("/moderation/reports", handler.GetReports).Methods("GET")
+	protected.HandleFunc("/moderation/reports/{id}/close", handler.CloseReport).Methods("POST")
+	protected.HandleFunc("/moderation/messages/{id}/hidden", handler.HideMessage).Methods("POST")
+	protected.HandleFunc("/moderation/messages/{id}/hidden", handler.UnhideMessage).Methods("DELETE")
+	protected.HandleFunc("/moderation/users/{id}/suspension", handler.SuspendUser).Methods("POST")
+	protected.HandleFunc("/moderation/users/{id}/suspension", handler.UnsuspendUser).Methods("DELETE")
+	protected.HandleFunc("/moderation/actions", handler.GetModerationLog).Methods("GET")
+
+	return r
+}
@@ -0,0 +1,942 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/config"
+	"github.com/fallenkarma/wasatext/internal/handlers"
+	"github.com/fallenkarma/wasatext/internal/health"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
+	"github.com/fallenkarma/wasatext/internal/service"
+	"github.com/fallenkarma/wasatext/internal/tracing"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMain(m *testing.M) {
+	// The handlers log every request, which only clutters the test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// moderatorRepo grants the moderator role to one user, which the repositories
+// otherwise leave to the database administrator
+type moderatorRepo struct {
+	repository.Repository
+	moderatorID string
+}
+
+func (r *moderatorRepo) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	user, err := r.Repository.GetUserByID(ctx, id)
+	if user != nil && user.ID == r.moderatorID {
+		user.Role = models.Moderator
+	}
+	return user, err
+}
+
+func (r *moderatorRepo) WithTx(ctx context.Context, fn func(repo repository.Repository) error) error {
+	return r.Repository.WithTx(ctx, func(tx repository.Repository) error {
+		return fn(&moderatorRepo{Repository: tx, moderatorID: r.moderatorID})
+	})
+}
+
+// fixture is a small world in which alice created a group with bob, bob sent a
+// message to the group, alice answered and reported bob's message, and bob reacted
+// to the answer. carol is in no conversation, and mod is a moderator who takes part
+// in no conversation either. dave, blocked by bob, carol and mod, is only there to
+// be added to the group and unblocked.
+type fixture struct {
+	router *mux.Router
+	ids    map[string]string
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	return newLimitedFixture(t, config.RateLimits{})
+}
+
+// newLimitedFixture returns a fixture whose routes are rate limited to limits
+func newLimitedFixture(t *testing.T, limits config.RateLimits) *fixture {
+	t.Helper()
+	ctx := context.Background()
+	mem := memory.NewMemoryRepository(t.TempDir())
+
+	ids := make(map[string]string)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "mod"} {
+		user, err := mem.CreateUser(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = user.ID
+	}
+	repo := &moderatorRepo{Repository: mem, moderatorID: ids["mod"]}
+	svc := service.New(repo, nil)
+
+	group, err := svc.CreateGroupConversation(ctx, "group", ids["alice"], []string{ids["bob"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["group"] = group.ID
+	direct, _, err := svc.CreateDirectConversation(ctx, ids["alice"], ids["bob"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["direct"] = direct.ID
+
+	msg, err := svc.SendTextMessage(ctx, ids["bob"], group.ID, "hello", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["message"] = msg.ID
+	answer, err := svc.SendTextMessage(ctx, ids["alice"], group.ID, "hi bob", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["answer"] = answer.ID
+	report, err := svc.ReportMessage(ctx, ids["alice"], msg.ID, models.SpamReason, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["report"] = report.ID
+	if err := svc.AddReaction(ctx, ids["bob"], answer.ID, "👋"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bob", "carol", "mod"} {
+		if err := svc.BlockUser(ctx, ids[name], ids["dave"]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &fixture{router: newRouter(handlers.New(service.WithTracing(svc)), handlers.NewRateLimiter(ratelimit.NewMemoryStore()),
+		limits, health.NewChecker(), health.BuildInfo{}, t.TempDir()), ids: ids}
+}
+
+// expand replaces the {name} placeholders of s with the fixture IDs
+func (f *fixture) expand(s string) string {
+	for name, id := range f.ids {
+		s = strings.ReplaceAll(s, "{"+name+"}", id)
+	}
+	return s
+}
+
+// do sends a request as the given user, a body starting with "photo" being sent as
+// a multipart form whose other fields are given after it, as in "photo conversationId={group}"
+func (f *fixture) do(t *testing.T, user, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var r *http.Request
+	if fields := strings.Fields(body); len(fields) > 0 && fields[0] == "photo" {
+		var buf bytes.Buffer
+		form := multipart.NewWriter(&buf)
+		for _, field := range fields[1:] {
+			name, value, _ := strings.Cut(field, "=")
+			form.WriteField(name, f.expand(value))
+		}
+		part, err := form.CreateFormFile("photo", "photo.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("not really a jpeg"))
+		form.Close()
+		r = httptest.NewRequest(method, f.expand(path), &buf)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+	} else {
+		r = httptest.NewRequest(method, f.expand(path), strings.NewReader(f.expand(body)))
+		if body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+	}
+	r.Header.Set("Authorization", "Bearer "+f.ids[user])
+
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, r)
+	return w
+}
+
+// TestAuthorizationMatrix sends a request to every API route as bob, a participant of the
+// group, carol, who takes part in no conversation, and mod, a moderator
+func TestAuthorizationMatrix(t *testing.T) {
+	tests := []struct {
+		method string
+		route  string // as registered in newRouter
+		path   string
+		body   string
+		// expected statuses of bob, carol, mod and alice, the admin of the group
+		participant, outsider, moderator, groupAdmin int
+	}{
+		{"POST", "/api/session", "/api/session", `{"name":"erin"}`, 201, 201, 201, 201},
+
+		{"GET", "/api/users", "/api/users", "", 200, 200, 200, 200},
+		{"GET", "/api/users/me", "/api/users/me", "", 200, 200, 200, 200},
+		{"PATCH", "/api/users/me", "/api/users/me", `{"bio":"hi"}`, 200, 200, 200, 200},
+		{"GET", "/api/users/me/mentions", "/api/users/me/mentions", "", 200, 200, 200, 200},
+		{"PUT", "/api/users/me/username", "/api/users/me/username", `{"name":"renamed"}`, 200, 200, 200, 200},
+		{"PUT", "/api/users/me/photo", "/api/users/me/photo", "photo", 200, 200, 200, 200},
+		{"PUT", "/api/users/me/privacy", "/api/users/me/privacy", `{"hideLastSeen":true}`, 200, 200, 200, 200},
+		{"POST", "/api/users/me/heartbeat", "/api/users/me/heartbeat", `{"status":"away"}`, 204, 204, 204, 204},
+		{"GET", "/api/users/{id}", "/api/users/{alice}", "", 200, 200, 200, 200},
+		{"GET", "/api/users/{id}/presence", "/api/users/{alice}/presence", "", 200, 200, 200, 200},
+		{"POST", "/api/users/{id}/block", "/api/users/{alice}/block", "", 204, 204, 204, 400},
+		{"DELETE", "/api/users/{id}/block", "/api/users/{dave}/block", "", 204, 204, 204, 404},
+		{"POST", "/api/users/{id}/report", "/api/users/{alice}/report", `{"reason":"spam"}`, 201, 201, 201, 400},
+
+		// bob already has a direct conversation with alice
+		{"POST", "/api/conversations", "/api/conversations", `{"participants":["{alice}"],"type":"direct"}`, 200, 201, 201, 200},
+		{"GET", "/api/conversations", "/api/conversations", "", 200, 200, 200, 200},
+		{"GET", "/api/conversations/{id}", "/api/conversations/{group}", "", 200, 403, 403, 200},
+		{"POST", "/api/conversations/{id}/typing", "/api/conversations/{group}/typing", `{"typing":true}`, 204, 403, 403, 204},
+		{"POST", "/api/conversations/{id}/archive", "/api/conversations/{group}/archive", "", 204, 403, 403, 204},
+		{"DELETE", "/api/conversations/{id}/archive", "/api/conversations/{group}/archive", "", 204, 403, 403, 204},
+		{"POST", "/api/conversations/{id}/mute", "/api/conversations/{group}/mute", `{"until":"2999-01-01T00:00:00Z"}`, 204, 403, 403, 204},
+		{"DELETE", "/api/conversations/{id}/mute", "/api/conversations/{group}/mute", "", 204, 403, 403, 204},
+		{"POST", "/api/conversations/{id}/pin", "/api/conversations/{group}/pin", `{"position":1}`, 204, 403, 403, 204},
+		{"DELETE", "/api/conversations/{id}/pin", "/api/conversations/{group}/pin", "", 204, 403, 403, 204},
+
+		{"POST", "/api/messages", "/api/messages", `{"conversationId":"{group}","content":"hey"}`, 201, 403, 403, 201},
+		{"POST", "/api/messages", "/api/messages", "photo conversationId={group}", 201, 403, 403, 201},
+		{"POST", "/api/messages/forward", "/api/messages/forward", `{"messageId":"{answer}","targetConversationId":"{direct}"}`, 200, 403, 403, 200},
+		{"POST", "/api/messages/{id}/reaction", "/api/messages/{answer}/reaction", `{"emoji":"👍"}`, 200, 403, 403, 200},
+		{"DELETE", "/api/messages/{id}/reaction", "/api/messages/{answer}/reaction", "", 200, 403, 403, 404},
+		{"DELETE", "/api/messages/{id}", "/api/messages/{message}", "", 204, 403, 403, 403},
+		{"PUT", "/api/messages/{id}", "/api/messages/{message}", `{"content":"edited"}`, 204, 403, 403, 403},
+		{"POST", "/api/messages/{id}/report", "/api/messages/{answer}/report", `{"reason":"spam"}`, 201, 403, 403, 403},
+
+		{"POST", "/api/groups/{id}/members", "/api/groups/{group}/members", `{"userId":"{dave}"}`, 200, 403, 403, 200},
+		{"POST", "/api/groups/{id}/leave", "/api/groups/{group}/leave", "", 200, 403, 403, 200},
+		{"PUT", "/api/groups/{id}/name", "/api/groups/{group}/name", `{"name":"renamed"}`, 200, 403, 403, 200},
+		{"PUT", "/api/groups/{id}/photo", "/api/groups/{group}/photo", "photo", 200, 403, 403, 200},
+
+		{"GET", "/api/moderation/reports", "/api/moderation/reports", "", 403, 403, 200, 403},
+		{"POST", "/api/moderation/reports/{id}/close", "/api/moderation/reports/{report}/close", `{"status":"resolved"}`, 403, 403, 200, 403},
+		{"POST", "/api/moderation/messages/{id}/hidden", "/api/moderation/messages/{message}/hidden", "", 403, 403, 204, 403},
+		{"DELETE", "/api/moderation/messages/{id}/hidden", "/api/moderation/messages/{message}/hidden", "", 403, 403, 204, 403},
+		{"POST", "/api/moderation/users/{id}/suspension", "/api/moderation/users/{alice}/suspension", "", 403, 403, 204, 403},
+		{"DELETE", "/api/moderation/users/{id}/suspension", "/api/moderation/users/{alice}/suspension", "", 403, 403, 204, 403},
+		{"GET", "/api/moderation/actions", "/api/moderation/actions", "", 403, 403, 200, 403},
+	}
+
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		covered[tt.method+" "+tt.route] = true
+		for _, actor := range []struct {
+			user string
+			want int
+		}{{"bob", tt.participant}, {"carol", tt.outsider}, {"mod", tt.moderator}, {"alice", tt.groupAdmin}} {
+			t.Run(tt.method+" "+tt.path+" as "+actor.user, func(t *testing.T) {
+				// Every request gets a fresh fixture, so that none depends on the previous ones
+				f := newFixture(t)
+				w := f.do(t, actor.user, tt.method, tt.path, tt.body)
+				if w.Code != actor.want {
+					t.Errorf("status = %d, want %d, body: %s", w.Code, actor.want, w.Body)
+				}
+			})
+		}
+	}
+
+	// Every API route must appear in the matrix
+	var missing []string
+	err := newFixture(t).router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if !covered[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(missing)
+	for _, route := range missing {
+		t.Errorf("route %s is not covered by the matrix", route)
+	}
+}
+
+// TestModifyingMessages checks that senders can no longer change their messages once
+// they left the conversation or a moderator hid them
+func TestModifyingMessages(t *testing.T) {
+	f := newFixture(t)
+
+	if w := f.do(t, "bob", "POST", "/api/groups/{group}/leave", ""); w.Code != http.StatusOK {
+		t.Fatalf("bob leaving the group status = %d, body: %s", w.Code, w.Body)
+	}
+	if w := f.do(t, "mod", "POST", "/api/moderation/messages/{answer}/hidden", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("hiding the answer status = %d, body: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		user, method, path, body string
+		want                     int
+	}{
+		{"bob", "PUT", "/api/messages/{message}", `{"content":"edited"}`, http.StatusForbidden},
+		{"bob", "DELETE", "/api/messages/{message}", "", http.StatusForbidden},
+		{"alice", "PUT", "/api/messages/{answer}", `{"content":"edited"}`, http.StatusNotFound},
+		{"alice", "DELETE", "/api/messages/{answer}", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := f.do(t, tt.user, tt.method, tt.path, tt.body); w.Code != tt.want {
+			t.Errorf("%s %s as %s status = %d, want %d, body: %s", tt.method, tt.path, tt.user, w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+// TestMissingAndConflictingRecords checks that the errors of the repository about
+// records that are missing or already there are not unexpected errors
+func TestMissingAndConflictingRecords(t *testing.T) {
+	tests := []struct {
+		user, method, path, body string
+		want                     int
+	}{
+		{"alice", "POST", "/api/groups/{group}/members", `{"userId":"{bob}"}`, http.StatusConflict},
+		{"alice", "DELETE", "/api/users/{dave}/block", "", http.StatusNotFound},
+		{"alice", "DELETE", "/api/messages/{message}/reaction", "", http.StatusNotFound},
+		{"mod", "POST", "/api/moderation/reports/nope/close", `{"status":"resolved"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			f := newFixture(t)
+			if w := f.do(t, tt.user, tt.method, tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+// TestTracing follows a request from the trace of the client to the span of the
+// service method serving it
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracing.NewProvider(recorder))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	if _, err := tracing.Setup(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFixture(t)
+	recorder.Reset()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, user := range []string{"bob", "carol"} {
+		r := httptest.NewRequest("GET", f.expand("/api/conversations/{group}"), nil)
+		r.Header.Set("Authorization", "Bearer "+f.ids[user])
+		r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		f.router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	var requests, methods []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "GET /api/conversations/{id}":
+			requests = append(requests, span)
+		case "Service.GetConversation":
+			methods = append(methods, span)
+		}
+	}
+	if len(requests) != 2 || len(methods) != 2 {
+		t.Fatalf("got %d request and %d method spans, want 2 of each", len(requests), len(methods))
+	}
+
+	for i, span := range methods {
+		request := requests[i]
+		if request.SpanContext().TraceID().String() != traceID {
+			t.Errorf("request trace = %s, want the one of the traceparent header", request.SpanContext().TraceID())
+		}
+		if span.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("the method span is not a child of the request span")
+		}
+		attrs := make(map[string]string)
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		if attrs[string(tracing.ConversationIDKey)] != f.ids["group"] {
+			t.Errorf("attributes = %v, want the conversation ID", attrs)
+		}
+	}
+
+	// carol takes no part in the group: the method fails, the request does not
+	if methods[0].Status().Code == codes.Error || methods[1].Status().Code != codes.Error {
+		t.Errorf("method statuses = %v and %v, want unset then error", methods[0].Status(), methods[1].Status())
+	}
+	if requests[1].Status().Code == codes.Error {
+		t.Errorf("a 403 response marks the request span as failed")
+	}
+}
+
+// TestRateLimits checks every limited route against a limit of one request
+func TestRateLimits(t *testing.T) {
+	once := ratelimit.Every(1, time.Hour)
+	tests := []struct {
+		rule   string
+		method string
+		path   string
+		bodies []string // the first one is allowed, the others are over the limit
+	}{
+		{"login", "POST", "/api/session", []string{`{"name": "erin"}`, `{"name": "frank"}`}},
+		{"messages", "POST", "/api/messages", []string{`{"conversationId": "{group}", "content": "one"}`, `{"messageId": "{message}", "conversationId": "{direct}"}`}},
+		{"reactions", "POST", "/api/messages/{message}/reaction", []string{`{"emoji": "👍"}`, `{"emoji": "🎉"}`}},
+		{"uploads", "PUT", "/api/users/me/photo", []string{"photo", "photo"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			limits := config.RateLimits{}
+			switch tt.rule {
+			case "login":
+				limits.Login = once
+			case "messages":
+				limits.Messages = once
+			case "reactions":
+				limits.Reactions = once
+			case "uploads":
+				limits.Uploads = once
+			}
+			f := newLimitedFixture(t, limits)
+
+			path := tt.path
+			for i, body := range tt.bodies {
+				// Forwarding shares the limit of sending
+				if tt.rule == "messages" && i > 0 {
+					path = "/api/messages/forward"
+				}
+				w := f.do(t, "alice", tt.method, path, body)
+				if i == 0 && w.Code >= 300 {
+					t.Fatalf("first request status = %d, body: %s", w.Code, w.Body)
+				}
+				if i > 0 && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "") {
+					t.Errorf("request %d status = %d, Retry-After %q, want 429 with Retry-After", i+1, w.Code, w.Header().Get("Retry-After"))
+				}
+			}
+
+			// The other users keep their own limits, the login one being per address
+			if tt.rule != "login" {
+				if w := f.do(t, "bob", tt.method, tt.path, tt.bodies[0]); w.Code == http.StatusTooManyRequests {
+					t.Errorf("bob limited by the requests of alice")
+				}
+			}
+		})
+	}
+
+	// Text messages don't count as uploads
+	f := newLimitedFixture(t, config.RateLimits{Uploads: once})
+	for i := 0; i < 2; i++ {
+		if w := f.do(t, "alice", "POST", "/api/messages", `{"conversationId": "{group}", "content": "text"}`); w.Code >= 300 {
+			t.Errorf("text message %d status = %d, body: %s", i+1, w.Code, w.Body)
+		}
+	}
+}
+
+// TestIdempotentSends retries sends with the same client message ID, which must answer
+// the message sent the first time rather than sending another one
+func TestIdempotentSends(t *testing.T) {
+	f := newFixture(t)
+
+	countMessages := func(t *testing.T) int {
+		t.Helper()
+		w := f.do(t, "alice", "GET", "/api/conversations/{group}", "")
+		var conv models.Conversation
+		if err := json.NewDecoder(w.Body).Decode(&conv); err != nil {
+			t.Fatalf("decoding the conversation: %v", err)
+		}
+		return len(conv.Messages)
+	}
+	sentID := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		t.Helper()
+		if w.Code != http.StatusCreated {
+			t.Fatalf("status = %d, want 201, body: %s", w.Code, w.Body)
+		}
+		var msg models.Message
+		if err := json.NewDecoder(w.Body).Decode(&msg); err != nil {
+			t.Fatalf("decoding the message: %v", err)
+		}
+		return msg.ID
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"text", `{"conversationId": "{group}", "content": "once", "clientMessageId": "text-1"}`},
+		{"photo", "photo conversationId={group} clientMessageId=photo-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := sentID(t, f.do(t, "alice", "POST", "/api/messages", tt.body))
+			count := countMessages(t)
+			if retry := sentID(t, f.do(t, "alice", "POST", "/api/messages", tt.body)); retry != first {
+				t.Errorf("retry answered message %s, want %s", retry, first)
+			}
+			if got := countMessages(t); got != count {
+				t.Errorf("%d messages after the retry, want %d", got, count)
+			}
+		})
+	}
+
+	// The header works as the body field, and must agree with it
+	send := func(key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/messages", strings.NewReader(f.expand(body)))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer "+f.ids["alice"])
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		f.router.ServeHTTP(w, r)
+		return w
+	}
+	first := sentID(t, send("header-1", `{"conversationId": "{group}", "content": "header"}`))
+	if retry := sentID(t, send("header-1", `{"conversationId": "{group}", "content": "header"}`)); retry != first {
+		t.Errorf("retry with the header answered message %s, want %s", retry, first)
+	}
+	if w := send("header-1", `{"conversationId": "{group}", "content": "header", "clientMessageId": "other"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("differing header and body status = %d, want 400", w.Code)
+	}
+
+	// Reusing a key elsewhere is a client bug, not a retry
+	if w := send("header-1", `{"conversationId": "{direct}", "content": "header"}`); w.Code != http.StatusConflict {
+		t.Errorf("key reused in another conversation status = %d, want 409", w.Code)
+	}
+	if w := send("bad\nkey", `{"conversationId": "{group}", "content": "header"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid key status = %d, want 400", w.Code)
+	}
+
+	// Keys belong to their sender: bob may use the same one
+	r := httptest.NewRequest("POST", "/api/messages", strings.NewReader(f.expand(`{"conversationId": "{group}", "content": "bob"}`)))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+f.ids["bob"])
+	r.Header.Set("Idempotency-Key", "header-1")
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, r)
+	if id := sentID(t, w); id == first {
+		t.Errorf("bob got back the message of alice")
+	}
+}
+
+// TestReplies checks that replies show the message they answer, which must be in the
+// same conversation
+func TestReplies(t *testing.T) {
+	f := newFixture(t)
+
+	w := f.do(t, "alice", "POST", "/api/messages", `{"conversationId": "{group}", "content": "sure", "replyTo": "{message}"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("reply status = %d, body: %s", w.Code, w.Body)
+	}
+	var reply models.Message
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ReplyPreview == nil || reply.ReplyPreview.Content != "hello" || reply.ReplyPreview.Sender.Name != "bob" {
+		t.Errorf("replyPreview = %+v, want bob's hello", reply.ReplyPreview)
+	}
+
+	for _, body := range []string{
+		`{"conversationId": "{direct}", "content": "sure", "replyTo": "{message}"}`,
+		`{"conversationId": "{group}", "content": "sure", "replyTo": "missing"}`,
+		"photo conversationId={direct} replyTo={message}",
+	} {
+		if w := f.do(t, "alice", "POST", "/api/messages", body); w.Code != http.StatusBadRequest {
+			t.Errorf("reply %s status = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+// TestConversationSettings archives, mutes and pins conversations, which changes the
+// conversation lists of the user only
+func TestConversationSettings(t *testing.T) {
+	f := newFixture(t)
+
+	list := func(t *testing.T, user, query string) []models.Conversation {
+		t.Helper()
+		w := f.do(t, user, "GET", "/api/conversations"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/conversations%s status = %d, body: %s", query, w.Code, w.Body)
+		}
+		var convs []models.Conversation
+		if err := json.NewDecoder(w.Body).Decode(&convs); err != nil {
+			t.Fatal(err)
+		}
+		return convs
+	}
+	ids := func(convs []models.Conversation) string {
+		var names []string
+		for _, conv := range convs {
+			for name, id := range f.ids {
+				if id == conv.ID {
+					names = append(names, name)
+				}
+			}
+		}
+		return strings.Join(names, " ")
+	}
+	must := func(t *testing.T, method, path, body string) {
+		t.Helper()
+		if w := f.do(t, "alice", method, path, body); w.Code != http.StatusNoContent {
+			t.Fatalf("%s %s status = %d, body: %s", method, path, w.Code, w.Body)
+		}
+	}
+
+	// The group is the most recently active, until the direct conversation is pinned
+	if got := ids(list(t, "alice", "")); got != "group direct" {
+		t.Fatalf("conversations = %s, want group direct", got)
+	}
+	must(t, "POST", "/api/conversations/{direct}/pin", "")
+	convs := list(t, "alice", "")
+	if got := ids(convs); got != "direct group" {
+		t.Errorf("conversations after pinning = %s, want direct group", got)
+	}
+	if s := convs[0].Settings; s == nil || s.PinPosition == nil || *s.PinPosition != 1 {
+		t.Errorf("settings of the pinned conversation = %+v, want pin position 1", s)
+	}
+	if got := ids(list(t, "bob", "")); got != "group direct" {
+		t.Errorf("bob's conversations = %s, want group direct", got)
+	}
+
+	// Archiving moves the group to the archived list
+	must(t, "POST", "/api/conversations/{group}/archive", "")
+	if got := ids(list(t, "alice", "")); got != "direct" {
+		t.Errorf("conversations after archiving = %s, want direct", got)
+	}
+	if got := ids(list(t, "alice", "?archived=true")); got != "group" {
+		t.Errorf("archived conversations = %s, want group", got)
+	}
+
+	// A message brings it back, unless it is muted
+	must(t, "POST", "/api/conversations/{group}/mute", `{"until":"`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`)
+	if w := f.do(t, "bob", "POST", "/api/messages", `{"conversationId":"{group}","content":"psst"}`); w.Code != http.StatusCreated {
+		t.Fatalf("send status = %d", w.Code)
+	}
+	if got := ids(list(t, "alice", "?archived=true")); got != "group" {
+		t.Errorf("archived conversations after a message while muted = %s, want group", got)
+	}
+	must(t, "DELETE", "/api/conversations/{group}/mute", "")
+	if w := f.do(t, "bob", "POST", "/api/messages", `{"conversationId":"{group}","content":"hello?"}`); w.Code != http.StatusCreated {
+		t.Fatalf("send status = %d", w.Code)
+	}
+	if got := ids(list(t, "alice", "")); got != "direct group" {
+		t.Errorf("conversations after a message once unmuted = %s, want direct group", got)
+	}
+
+	for _, tt := range []struct{ method, path, body string }{
+		{"GET", "/api/conversations?archived=maybe", ""},
+		{"POST", "/api/conversations/{group}/mute", `{"until":"2000-01-01T00:00:00Z"}`},
+		{"POST", "/api/conversations/{group}/pin", `{"position":0}`},
+	} {
+		if w := f.do(t, "alice", tt.method, tt.path, tt.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s %s status = %d, want 400", tt.method, tt.path, tt.body, w.Code)
+		}
+	}
+}
+
+func TestDirectConversationNames(t *testing.T) {
+	f := newFixture(t)
+
+	// Each participant sees the direct conversation named after the other one
+	for user, want := range map[string]string{"alice": "bob", "bob": "alice"} {
+		w := f.do(t, user, "GET", "/api/conversations/{direct}", "")
+		var conv models.Conversation
+		if err := json.NewDecoder(w.Body).Decode(&conv); err != nil {
+			t.Fatal(err)
+		}
+		if conv.Name != want {
+			t.Errorf("name of the direct conversation seen by %s = %q, want %q", user, conv.Name, want)
+		}
+	}
+	w := f.do(t, "bob", "POST", "/api/conversations", `{"participants":["{alice}"],"type":"direct"}`)
+	var conv models.Conversation
+	if err := json.NewDecoder(w.Body).Decode(&conv); err != nil {
+		t.Fatal(err)
+	}
+	if conv.Name != "alice" {
+		t.Errorf("name of the direct conversation started by bob = %q, want alice", conv.Name)
+	}
+}
+
+func TestConversationFilters(t *testing.T) {
+	f := newFixture(t)
+
+	list := func(t *testing.T, query string) (string, string) {
+		t.Helper()
+		w := f.do(t, "alice", "GET", "/api/conversations"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/conversations%s status = %d, body: %s", query, w.Code, w.Body)
+		}
+		var convs []models.Conversation
+		if err := json.NewDecoder(w.Body).Decode(&convs); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, conv := range convs {
+			for name, id := range f.ids {
+				if id == conv.ID {
+					names = append(names, name)
+				}
+			}
+		}
+		return strings.Join(names, " "), w.Header().Get(handlers.NextCursorHeader)
+	}
+
+	for _, tt := range []struct{ query, want string }{
+		{"", "group direct"},
+		{"?type=direct", "direct"},
+		{"?unread=true", "group"},
+		{"?q=GRO", "group"},
+		{"?q=bob", "group direct"},
+		{"?q=alice", ""},
+	} {
+		if got, next := list(t, tt.query); got != tt.want || next != "" {
+			t.Errorf("conversations%s = %q, next = %q, want %q on a single page", tt.query, got, next, tt.want)
+		}
+	}
+
+	// The cursor of the next page comes in a header, missing on the last page
+	first, next := list(t, "?limit=1")
+	if first != "group" || next == "" {
+		t.Fatalf("first page = %q, next = %q, want group and a cursor", first, next)
+	}
+	if second, next := list(t, "?limit=1&cursor="+url.QueryEscape(next)); second != "direct" || next != "" {
+		t.Errorf("second page = %q, next = %q, want direct and no cursor", second, next)
+	}
+
+	for _, query := range []string{"?type=channel", "?unread=maybe", "?limit=0", "?limit=101", "?limit=ten", "?cursor=nonsense"} {
+		if w := f.do(t, "alice", "GET", "/api/conversations"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /api/conversations%s status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestUserDirectory(t *testing.T) {
+	f := newFixture(t)
+
+	search := func(t *testing.T, user, query string) models.UserPage {
+		t.Helper()
+		w := f.do(t, user, "GET", "/api/users"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/users%s status = %d, body: %s", query, w.Code, w.Body)
+		}
+		var page models.UserPage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	names := func(page models.UserPage) string {
+		var names []string
+		for _, u := range page.Users {
+			names = append(names, u.Name)
+		}
+		return strings.Join(names, " ")
+	}
+
+	// The caller and the users they blocked are left out
+	if got := names(search(t, "bob", "")); got != "alice carol mod" {
+		t.Errorf("bob's directory = %q, want alice carol mod", got)
+	}
+	// The users who blocked the caller are left out too
+	if got := names(search(t, "dave", "?q=A")); got != "alice" {
+		t.Errorf("dave's directory matching a = %q, want alice only", got)
+	}
+	if page := search(t, "alice", "?q=nobody"); page.Users == nil || len(page.Users) != 0 || page.HasMore {
+		t.Errorf("directory matching nobody = %+v, want an empty list", page)
+	}
+
+	first := search(t, "alice", "?limit=2")
+	if got := names(first); got != "bob carol" || !first.HasMore || first.NextCursor == "" {
+		t.Fatalf("first page = %q, hasMore = %v, want bob carol and more", got, first.HasMore)
+	}
+	second := search(t, "alice", "?limit=2&cursor="+url.QueryEscape(first.NextCursor))
+	if got := names(second); got != "dave mod" || second.HasMore || second.NextCursor != "" {
+		t.Errorf("second page = %q, hasMore = %v, want dave mod and no more", got, second.HasMore)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=101", "?limit=ten", "?cursor=nonsense"} {
+		if w := f.do(t, "alice", "GET", "/api/users"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /api/users%s status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	f := newFixture(t)
+
+	presence := func(t *testing.T, user, target string) models.Presence {
+		t.Helper()
+		w := f.do(t, user, "GET", "/api/users/{"+target+"}/presence", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET presence of %s status = %d, body: %s", target, w.Code, w.Body)
+		}
+		var p models.Presence
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// Asking is an activity of bob, who is then online
+	if p := presence(t, "bob", "alice"); p.Status != models.Offline || p.LastSeen != nil {
+		t.Errorf("presence of an unseen alice = %+v, want offline with no last seen time", p)
+	}
+	if p := presence(t, "alice", "bob"); p.Status != models.Online || p.LastSeen == nil {
+		t.Errorf("presence of bob to alice = %+v, want online with a last seen time", p)
+	}
+	// bob blocked dave, who sees him as if he had never been seen
+	if p := presence(t, "dave", "bob"); p.Status != models.Offline || p.LastSeen != nil {
+		t.Errorf("presence of bob to dave = %+v, want offline with no last seen time", p)
+	}
+
+	// So do the participants of a conversation with a user who blocked them
+	if w := f.do(t, "alice", "POST", "/api/users/{bob}/block", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("alice blocking bob status = %d, body: %s", w.Code, w.Body)
+	}
+	if w := f.do(t, "alice", "POST", "/api/conversations/{group}/typing", `{"typing":true}`); w.Code != http.StatusNoContent {
+		t.Fatalf("alice typing status = %d, body: %s", w.Code, w.Body)
+	}
+	checkGroup := func(t *testing.T, what string, conv models.Conversation) {
+		t.Helper()
+		for _, p := range conv.Participants {
+			if p.ID == f.ids["alice"] && (p.Presence == nil || p.Presence.Status != models.Offline || p.Presence.LastSeen != nil) {
+				t.Errorf("presence of alice in %s = %+v, want offline with no last seen time", what, p.Presence)
+			}
+		}
+		if len(conv.Typing) != 0 {
+			t.Errorf("typing in %s = %v, want nobody", what, conv.Typing)
+		}
+	}
+	w := f.do(t, "bob", "GET", "/api/conversations/{group}", "")
+	var conv models.Conversation
+	if err := json.NewDecoder(w.Body).Decode(&conv); err != nil {
+		t.Fatal(err)
+	}
+	checkGroup(t, "the group", conv)
+	w = f.do(t, "bob", "GET", "/api/conversations", "")
+	var convs []models.Conversation
+	if err := json.NewDecoder(w.Body).Decode(&convs); err != nil {
+		t.Fatal(err)
+	}
+	for _, conv := range convs {
+		if conv.ID == f.ids["group"] {
+			checkGroup(t, "the list", conv)
+		}
+	}
+	// carol, whom alice didn't block, still sees her online
+	if p := presence(t, "carol", "alice"); p.Status != models.Online {
+		t.Errorf("presence of alice to carol = %+v, want online", p)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	f := newFixture(t)
+
+	get := func(t *testing.T, user, path string) map[string]interface{} {
+		t.Helper()
+		w := f.do(t, user, "GET", path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, body: %s", path, w.Code, w.Body)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// Others see the same public projection of alice wherever she is shown
+	public := func(t *testing.T, what string, user map[string]interface{}) {
+		t.Helper()
+		for _, field := range []string{"role", "suspendedAt", "hideLastSeen"} {
+			if _, ok := user[field]; ok {
+				t.Errorf("%s = %v, want no %s", what, user, field)
+			}
+		}
+	}
+	if w := f.do(t, "alice", "PUT", "/api/users/me/privacy", `{"hideLastSeen":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT /api/users/me/privacy status = %d, body: %s", w.Code, w.Body)
+	}
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w := f.do(t, "alice", "PATCH", "/api/users/me",
+		`{"name":"alice_b","displayName":"  Alice B. ","bio":"Hello!","statusText":"On holiday","statusExpiresAt":"`+until+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH /api/users/me status = %d, body: %s", w.Code, w.Body)
+	}
+	var me models.User
+	if err := json.NewDecoder(w.Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	if me.Name != "alice_b" || me.DisplayName != "Alice B." || me.Bio != "Hello!" || me.StatusText != "On holiday" || me.StatusExpiresAt == nil {
+		t.Errorf("updated user = %+v, want the new name and profile", me)
+	}
+
+	// Others see the profile, without the account settings
+	profile := get(t, "bob", "/api/users/{alice}")
+	if profile["name"] != "alice_b" || profile["displayName"] != "Alice B." || profile["statusText"] != "On holiday" {
+		t.Errorf("profile seen by bob = %v, want alice's profile", profile)
+	}
+	public(t, "profile seen by bob", profile)
+	for _, u := range get(t, "bob", "/api/users?q=alice")["users"].([]interface{}) {
+		public(t, "search result seen by bob", u.(map[string]interface{}))
+	}
+
+	// The profile comes with the participants and the message senders
+	conv := get(t, "bob", "/api/conversations/{group}")
+	for _, p := range conv["participants"].([]interface{}) {
+		if p := p.(map[string]interface{}); p["id"] == f.ids["alice"] && p["displayName"] != "Alice B." {
+			t.Errorf("participant alice = %v, want her display name", p)
+		}
+	}
+	for _, m := range conv["messages"].([]interface{}) {
+		sender := m.(map[string]interface{})["sender"].(map[string]interface{})
+		if sender["id"] == f.ids["alice"] && sender["bio"] != "Hello!" {
+			t.Errorf("sender alice = %v, want her bio", sender)
+		}
+		public(t, "sender seen by bob", sender)
+	}
+
+	// Fields left out are kept, and clearing the status clears its expiry
+	if w := f.do(t, "alice", "PATCH", "/api/users/me", `{"statusText":""}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH /api/users/me status = %d, body: %s", w.Code, w.Body)
+	}
+	profile = get(t, "alice", "/api/users/me")
+	if profile["bio"] != "Hello!" || profile["statusText"] != nil || profile["statusExpiresAt"] != nil {
+		t.Errorf("profile after clearing the status = %v, want the bio only", profile)
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"PATCH", "/api/users/me", `{"displayName":"` + strings.Repeat("x", 65) + `"}`, 400},
+		{"PATCH", "/api/users/me", `{"statusText":"away","statusExpiresAt":"2000-01-01T00:00:00Z"}`, 400},
+		{"PATCH", "/api/users/me", `{"statusExpiresAt":"` + until + `"}`, 400},
+		{"PATCH", "/api/users/me", `{"name":"bob"}`, 409},
+		{"PATCH", "/api/users/me", `not json`, 400},
+		{"GET", "/api/users/nobody", "", 404},
+	} {
+		if w := f.do(t, "alice", tt.method, tt.path, tt.body); w.Code != tt.want {
+			t.Errorf("%s %s %s status = %d, want %d", tt.method, tt.path, tt.body, w.Code, tt.want)
+		}
+	}
+}
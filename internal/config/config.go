@@ -0,0 +1,349 @@
+// Package config loads the settings of the server from, by increasing precedence,
+// their defaults, an optional YAML file, the .env file and the environment, and
+// validates them before anything starts.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/logging"
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable giving the path of the YAML file
+const FileEnv = "CONFIG_FILE"
+
+// Config holds the settings of the server
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Database Database `yaml:"database"`
+	Uploads  Uploads  `yaml:"uploads"`
+	CORS     CORS     `yaml:"cors"`
+	Log      Log      `yaml:"log"`
+	Tracing  Tracing  `yaml:"tracing"`
+
+	RateLimits RateLimits `yaml:"rate_limits"`
+}
+
+// Server holds the settings of the HTTP server
+type Server struct {
+	Port         int           `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout bounds the wait for the requests in flight on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ShutdownDelay keeps serving, reported unready, before shutting down, so that
+	// the load balancers notice it before the listener closes
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+}
+
+// Database holds the settings of the storage
+type Database struct {
+	// Driver is "postgres", "sqlite", whose connection string is the path of the
+	// database file, or "memory", which keeps everything in memory and is meant for
+	// demos. When empty it is guessed from the connection string.
+	Driver           string `yaml:"driver"`
+	ConnectionString string `yaml:"connection_string"`
+}
+
+// Uploads holds the settings of the uploaded photos
+type Uploads struct {
+	// Path is the directory the photos are stored in and served from
+	Path string `yaml:"path"`
+}
+
+// CORS holds the settings of the cross-origin requests
+type CORS struct {
+	// AllowedOrigins are the origins of the web UI, "*" allowing any
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// Log holds the settings of the logger
+type Log struct {
+	// Level is one of debug, info, warn and error
+	Level string `yaml:"level"`
+}
+
+// Tracing holds the settings of the OpenTelemetry traces
+type Tracing struct {
+	// OTLPEndpoint, such as http://localhost:4318, enables the export of the
+	// traces over OTLP/HTTP
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+// RateLimits holds the limits of the routes open to abuse, written n/period, such as
+// 10/1m for 10 requests per minute, or off
+type RateLimits struct {
+	// Login limits the sessions opened, and so the users created, per client address
+	Login ratelimit.Limit `yaml:"login"`
+	// Messages limits the messages sent or forwarded per user
+	Messages ratelimit.Limit `yaml:"messages"`
+	// Reactions limits the reactions added per user
+	Reactions ratelimit.Limit `yaml:"reactions"`
+	// Uploads limits the photos uploaded per user, as profile, group or message photos
+	Uploads ratelimit.Limit `yaml:"uploads"`
+}
+
+// Default returns the settings used when nothing overrides them
+func Default() Config {
+	return Config{
+		Server: Server{
+			Port:            8080,
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    15 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			ShutdownTimeout: 15 * time.Second,
+		},
+		Uploads: Uploads{Path: "/app/uploads"},
+		CORS:    CORS{AllowedOrigins: []string{"http://localhost:4173"}},
+		Log:     Log{Level: "info"},
+		RateLimits: RateLimits{
+			Login:     ratelimit.Every(10, time.Minute),
+			Messages:  ratelimit.Every(60, time.Minute),
+			Reactions: ratelimit.Every(120, time.Minute),
+			Uploads:   ratelimit.Every(30, time.Hour),
+		},
+	}
+}
+
+// Load loads the .env file into the environment, without overriding the variables
+// already set, then returns the validated settings
+func Load() (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("loading .env: %w", err)
+	}
+	return load(os.LookupEnv)
+}
+
+// load reads the YAML file named by CONFIG_FILE, if any, over the defaults, then the
+// variables of lookup over it
+func load(lookup func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+
+	if path, ok := lookup(FileEnv); ok && path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading the config file: %w", err)
+		}
+		defer f.Close()
+
+		// Misspelled settings are errors rather than silently ignored
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(lookup); err != nil {
+		return nil, err
+	}
+
+	if cfg.Database.Driver == "" {
+		cfg.Database.Driver = guessDriver(cfg.Database.ConnectionString)
+	}
+	if cfg.Database.Driver == "sqlite" && cfg.Database.ConnectionString == "" {
+		cfg.Database.ConnectionString = "wasatext.db"
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// applyEnv overrides the settings with the environment variables that are set
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := lookup(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid duration %q", name, v))
+				return
+			}
+			*dst = d
+		}
+	}
+
+	if v, ok := lookup("SERVER_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SERVER_PORT: invalid port %q", v))
+		} else {
+			c.Server.Port = port
+		}
+	}
+	duration("SERVER_READ_TIMEOUT", &c.Server.ReadTimeout)
+	duration("SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	duration("SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	duration("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	duration("SHUTDOWN_DELAY", &c.Server.ShutdownDelay)
+	str("DB_DRIVER", &c.Database.Driver)
+	str("DB_CONNECTION_STRING", &c.Database.ConnectionString)
+	str("UPLOADS_PATH", &c.Uploads.Path)
+	if v, ok := lookup("CORS_ALLOWED_ORIGINS"); ok {
+		c.CORS.AllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.CORS.AllowedOrigins = append(c.CORS.AllowedOrigins, origin)
+			}
+		}
+	}
+	str("LOG_LEVEL", &c.Log.Level)
+	str("OTEL_EXPORTER_OTLP_ENDPOINT", &c.Tracing.OTLPEndpoint)
+	rateLimit := func(name string, dst *ratelimit.Limit) {
+		if v, ok := lookup(name); ok {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+	rateLimit("RATE_LIMIT_LOGIN", &c.RateLimits.Login)
+	rateLimit("RATE_LIMIT_MESSAGES", &c.RateLimits.Messages)
+	rateLimit("RATE_LIMIT_REACTIONS", &c.RateLimits.Reactions)
+	rateLimit("RATE_LIMIT_UPLOADS", &c.RateLimits.Uploads)
+
+	return errors.Join(errs...)
+}
+
+// guessDriver returns the driver of a connection string, postgres unless it names a file
+func guessDriver(connectionString string) string {
+	if strings.HasPrefix(connectionString, "sqlite://") || strings.HasPrefix(connectionString, "file:") {
+		return "sqlite"
+	}
+	return "postgres"
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		invalid("server port %d is not between 1 and 65535", c.Server.Port)
+	}
+	for _, timeout := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"read_timeout", c.Server.ReadTimeout},
+		{"write_timeout", c.Server.WriteTimeout},
+		{"idle_timeout", c.Server.IdleTimeout},
+		{"shutdown_timeout", c.Server.ShutdownTimeout},
+	} {
+		if timeout.d <= 0 {
+			invalid("server %s must be positive, got %s", timeout.name, timeout.d)
+		}
+	}
+	if c.Server.ShutdownDelay < 0 {
+		invalid("server shutdown_delay must not be negative, got %s", c.Server.ShutdownDelay)
+	}
+
+	switch c.Database.Driver {
+	case "postgres":
+		if c.Database.ConnectionString == "" {
+			invalid("database connection_string is required by the postgres driver")
+		}
+	case "sqlite", "memory":
+	default:
+		invalid("unknown database driver %q, want postgres, sqlite or memory", c.Database.Driver)
+	}
+
+	if c.Uploads.Path == "" {
+		invalid("uploads path is required")
+	}
+
+	if len(c.CORS.AllowedOrigins) == 0 {
+		invalid("cors allowed_origins must list at least one origin")
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			invalid("cors origin %q is not a scheme://host[:port] origin", origin)
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		invalid("log level: %v", err)
+	}
+
+	if c.Tracing.OTLPEndpoint != "" {
+		u, err := url.Parse(c.Tracing.OTLPEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("tracing otlp_endpoint %q is not an http or https URL", logging.RedactDSN(c.Tracing.OTLPEndpoint))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the settings with the credentials hidden
+func (c Config) Redacted() Config {
+	c.Database.ConnectionString = logging.RedactDSN(c.Database.ConnectionString)
+	c.Tracing.OTLPEndpoint = logging.RedactDSN(c.Tracing.OTLPEndpoint)
+	c.CORS.AllowedOrigins = append([]string(nil), c.CORS.AllowedOrigins...)
+	return c
+}
+
+// String prints the settings one per line, with the credentials hidden
+func (c Config) String() string {
+	var b strings.Builder
+	for _, group := range c.LogValue().Group() {
+		for _, attr := range group.Value.Group() {
+			fmt.Fprintf(&b, "%s.%s: %v\n", group.Key, attr.Key, attr.Value)
+		}
+	}
+	return b.String()
+}
+
+// LogValue logs the settings as groups of attributes, with the credentials hidden
+func (c Config) LogValue() slog.Value {
+	r := c.Redacted()
+	return slog.GroupValue(
+		slog.Group("server",
+			slog.Int("port", r.Server.Port),
+			slog.String("read_timeout", r.Server.ReadTimeout.String()),
+			slog.String("write_timeout", r.Server.WriteTimeout.String()),
+			slog.String("idle_timeout", r.Server.IdleTimeout.String()),
+			slog.String("shutdown_timeout", r.Server.ShutdownTimeout.String()),
+			slog.String("shutdown_delay", r.Server.ShutdownDelay.String()),
+		),
+		slog.Group("database",
+			slog.String("driver", r.Database.Driver),
+			slog.String("connection_string", r.Database.ConnectionString),
+		),
+		slog.Group("uploads", slog.String("path", r.Uploads.Path)),
+		slog.Group("cors", slog.Any("allowed_origins", r.CORS.AllowedOrigins)),
+		slog.Group("log", slog.String("level", r.Log.Level)),
+		slog.Group("tracing", slog.String("otlp_endpoint", r.Tracing.OTLPEndpoint)),
+		slog.Group("rate_limits",
+			slog.String("login", r.RateLimits.Login.String()),
+			slog.String("messages", r.RateLimits.Messages.String()),
+			slog.String("reactions", r.RateLimits.Reactions.String()),
+			slog.String("uploads", r.RateLimits.Uploads.String()),
+		),
+	)
+}
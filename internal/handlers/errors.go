@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/fallenkarma/wasatext/internal/service"
+)
+
+// problem is an RFC 7807 problem details body
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// respondWithError writes an application/problem+json error response
+func respondWithError(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	body := problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Error encoding problem response", "error", err)
+	}
+}
+
+// errorStatus returns the HTTP status code matching the kind of a service error
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrValidation):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrConflict):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// respondWithServiceError writes the problem response matching an error returned by the
+// service. Unexpected errors may reveal internals, their message is only logged by the caller.
+func respondWithServiceError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	detail := err.Error()
+	if status == http.StatusInternalServerError {
+		detail = "An unexpected error occurred"
+	}
+	respondWithError(w, status, detail)
+}
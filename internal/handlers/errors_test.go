@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
+	"github.com/fallenkarma/wasatext/internal/service"
+	"github.com/gorilla/mux"
+)
+
+func TestRespondWithServiceError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantDetail string
+	}{
+		{"not found", fmt.Errorf("message %w", service.ErrNotFound), http.StatusNotFound, "message not found"},
+		{"forbidden", fmt.Errorf("%w: only the sender can delete a message", service.ErrForbidden), http.StatusForbidden, "not allowed: only the sender can delete a message"},
+		{"blocked", service.ErrBlocked, http.StatusForbidden, service.ErrBlocked.Error()},
+		{"not moderator", service.ErrNotModerator, http.StatusForbidden, service.ErrNotModerator.Error()},
+		{"validation", fmt.Errorf("%w: unknown report reason", service.ErrValidation), http.StatusBadRequest, "invalid request: unknown report reason"},
+		{"conflict", fmt.Errorf("%w: username already taken", service.ErrConflict), http.StatusConflict, "conflict: username already taken"},
+		{"wrapped twice", fmt.Errorf("sending: %w", fmt.Errorf("conversation %w", service.ErrNotFound)), http.StatusNotFound, "sending: conversation not found"},
+		{"unexpected", errors.New("pq: connection refused"), http.StatusInternalServerError, "An unexpected error occurred"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			respondWithServiceError(w, tt.err)
+
+			got := decodeProblem(t, w)
+			if w.Code != tt.wantStatus || got.Status != tt.wantStatus {
+				t.Errorf("status = %d, body status = %d, want %d", w.Code, got.Status, tt.wantStatus)
+			}
+			if got.Detail != tt.wantDetail {
+				t.Errorf("detail = %q, want %q", got.Detail, tt.wantDetail)
+			}
+			if got.Title != http.StatusText(tt.wantStatus) || got.Type != "about:blank" {
+				t.Errorf("type, title = %q, %q, want about:blank, %q", got.Type, got.Title, http.StatusText(tt.wantStatus))
+			}
+		})
+	}
+}
+
+func TestGetMissingConversation(t *testing.T) {
+	h := New(service.New(memory.NewMemoryRepository(t.TempDir()), nil))
+	router := mux.NewRouter()
+	router.Handle("/conversations/{id}", h.AuthMiddleware(http.HandlerFunc(h.GetConversation)))
+
+	login, err := h.service.Login(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/conversations/missing", nil)
+	r.Header.Set("Authorization", "Bearer "+login.Id)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := decodeProblem(t, w); got.Detail != "conversation not found" {
+		t.Errorf("detail = %q, want conversation not found", got.Detail)
+	}
+}
+
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) problem {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+	var p problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("decoding the problem: %v", err)
+	}
+	return p
+}
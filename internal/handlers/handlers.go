@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 
+	"github.com/fallenkarma/wasatext/internal/logging"
 	"github.com/fallenkarma/wasatext/internal/models"
 	"github.com/fallenkarma/wasatext/internal/service"
 	"github.com/gorilla/mux"
@@ -17,12 +18,11 @@ import (
 
 // Handler defines the HTTP handlers for the API
 type Handler struct {
-	service *service.Service
+	service service.Service
 }
 
 // New creates a new Handler
-func New(svc *service.Service) *Handler {
-	log.Println("Initializing API handlers")
+func New(svc service.Service) *Handler {
 	return &Handler{
 		service: svc,
 	}
@@ -34,47 +34,15 @@ func extractToken(r *http.Request) string {
 	if bearerToken == "" {
 		return ""
 	}
-	
+
 	// Remove "Bearer " prefix if present
 	return strings.TrimPrefix(bearerToken, "Bearer ")
 }
 
-// logRequest logs information about an incoming request
-func logRequest(handler string, r *http.Request, userID string) {
-	log.Printf("[%s] %s %s | UserID: %s | IP: %s | User-Agent: %s", 
-		handler, 
-		r.Method, 
-		r.URL.Path, 
-		userID,
-		r.RemoteAddr,
-		r.UserAgent(),
-	)
-}
-
-// logRequestWithDuration logs information about a request and its duration
-func logRequestWithDuration(handler string, r *http.Request, userID string, start time.Time, statusCode int) {
-	duration := time.Since(start)
-	log.Printf("[%s] %s %s | UserID: %s | Status: %d | Duration: %s | IP: %s", 
-		handler, 
-		r.Method, 
-		r.URL.Path, 
-		userID,
-		statusCode,
-		duration,
-		r.RemoteAddr,
-	)
-}
-
-// logError logs an error with request context
-func logError(handler string, r *http.Request, userID string, err error, msg string) {
-	log.Printf("[ERROR][%s] %s %s | UserID: %s | %s: %v",
-		handler,
-		r.Method,
-		r.URL.Path,
-		userID,
-		msg,
-		err,
-	)
+// logError logs why a handler failed. The access log reports the failed request,
+// at a level depending on its status.
+func logError(r *http.Request, handler string, err error, msg string) {
+	slog.WarnContext(r.Context(), msg, "handler", handler, "error", err)
 }
 
 // AuthMiddleware handles authentication for protected endpoints
@@ -83,34 +51,46 @@ func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 		// Extract token from request
 		token := extractToken(r)
 		if token == "" {
-			log.Printf("[AuthMiddleware] %s %s | No token provided | IP: %s", r.Method, r.URL.Path, r.RemoteAddr)
-			http.Error(w, "Unauthorized: No token provided", http.StatusUnauthorized)
+			respondWithError(w, http.StatusUnauthorized, "No token provided")
 			return
 		}
 
 		// Verify token by checking if the user exists
 		// In a real system, you would validate against JWT or other token mechanism
-		start := time.Now()
+		// The token is a credential, it is never logged
 		user, err := h.service.GetUser(r.Context(), token)
 		if err != nil || user == nil {
-			log.Printf("[AuthMiddleware] %s %s | Invalid token | Token: %s | IP: %s | Error: %v", 
-				r.Method, r.URL.Path, token, r.RemoteAddr, err)
-			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to verify token", "error", err)
+			}
+			respondWithError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+
+		// Every line logged from now on for the request names the user
+		logging.AddAttrs(r.Context(), slog.String("user_id", user.ID))
+
+		if user.SuspendedAt != nil {
+			slog.InfoContext(r.Context(), "Suspended user refused")
+			respondWithError(w, http.StatusForbidden, "Account suspended")
 			return
 		}
-		
-		log.Printf("[AuthMiddleware] %s %s | User authenticated | UserID: %s | Duration: %s", 
-			r.Method, r.URL.Path, token, time.Since(start))
+
+		// Any authenticated request counts as activity for the presence
+		h.service.TouchPresence(token)
 
 		// Add user ID to context for use in handlers
-		ctx := context.WithValue(r.Context(), "userID", token)
+		ctx := context.WithValue(r.Context(), userIDKey{}, token)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// userIDKey is the context key of the authenticated user ID
+type userIDKey struct{}
+
 // getUserIDFromContext extracts the user ID from the request context
 func getUserIDFromContext(r *http.Request) string {
-	if userID, ok := r.Context().Value("userID").(string); ok {
+	if userID, ok := r.Context().Value(userIDKey{}).(string); ok {
 		return userID
 	}
 	return ""
@@ -122,146 +102,283 @@ func respondWithJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.WriteHeader(status)
 	if data != nil {
 		if err := json.NewEncoder(w).Encode(data); err != nil {
-			log.Printf("Error encoding JSON response: %v", err)
+			slog.Error("Error encoding JSON response", "error", err)
 		}
 	}
 }
 
-// respondWithError writes an error response
-func respondWithError(w http.ResponseWriter, status int, message string) {
-	respondWithJSON(w, status, map[string]string{"error": message})
-}
-
 // Login handles user login/creation
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 	handlerName := "Login"
-	start := time.Now()
-	
+
 	var req models.LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logError(handlerName, r, "", err, "Invalid request payload")
+		logError(r, handlerName, err, "Invalid request payload")
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	log.Printf("[%s] Login attempt | Username: %s | IP: %s", handlerName, req.Name, r.RemoteAddr)
-	
+	slog.DebugContext(r.Context(), "Login attempt", "username", req.Name)
+
 	response, err := h.service.Login(r.Context(), req.Name)
 	if err != nil {
-		logError(handlerName, r, "", err, "Login failed")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Login failed")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Login successful | UserID: %s | Username: %s | Duration: %s", 
-		handlerName, response.Id, req.Name, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "Login successful", "user_id", response.Id, "username", req.Name)
+
 	respondWithJSON(w, http.StatusCreated, response)
 }
 
+// GetUsers searches the user directory, a page at a time
 func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
 	handlerName := "GetUsers"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
+	query := r.URL.Query()
+	filter := models.UserFilter{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Cursor: query.Get("cursor"),
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit parameter, want a positive number")
+			return
+		}
+	}
 
-	users, err := h.service.GetAllUsers(r.Context())
+	page, err := h.service.SearchUsers(r.Context(), userID, filter)
 	if err != nil {
-		logError(handlerName, r, userID, err, "Failed to get users")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Failed to search users")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Retrieved users | UserID: %s | Count: %d | Duration: %s", 
-		handlerName, userID, len(users), time.Since(start))
-	
-	respondWithJSON(w, http.StatusOK, users)
+	slog.InfoContext(r.Context(), "Searched users", "count", len(page.Users), "hasMore", page.HasMore)
+
+	respondWithJSON(w, http.StatusOK, page)
 }
 
 func (h *Handler) GetMyUser(w http.ResponseWriter, r *http.Request) {
 	handlerName := "GetMyUser"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
-
 	users, err := h.service.GetUser(r.Context(), userID)
 	if err != nil {
-		logError(handlerName, r, userID, err, "Failed to get users")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Failed to get users")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Retrieved user | UserID: %s | Duration: %s", 
-		handlerName, userID, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "Retrieved user")
+
 	respondWithJSON(w, http.StatusOK, users)
 }
 
+// GetMyMentions returns the messages in which the authenticated user was mentioned
+func (h *Handler) GetMyMentions(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetMyMentions"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	messages, err := h.service.GetMentions(r.Context(), userID)
+	if err != nil {
+		logError(r, handlerName, err, "Failed to get mentions")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Retrieved mentions", "count", len(messages))
+
+	respondWithJSON(w, http.StatusOK, messages)
+}
+
+// Heartbeat records that the authenticated user is still connected
+func (h *Handler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	handlerName := "Heartbeat"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	// The body is optional, an empty one means online
+	var req models.HeartbeatRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logError(r, handlerName, err, "Invalid request payload")
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+
+	if err := h.service.Heartbeat(r.Context(), userID, req.Status); err != nil {
+		logError(r, handlerName, err, "Invalid heartbeat")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// GetUserPresence returns the presence of a user
+func (h *Handler) GetUserPresence(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetUserPresence"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	targetID := vars["id"]
+
+	presence, err := h.service.GetPresence(r.Context(), userID, targetID)
+	if err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to get presence of user: %s", targetID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Retrieved presence", "target_id", targetID, "status", presence.Status)
+
+	respondWithJSON(w, http.StatusOK, presence)
+}
+
+// SetMyPrivacy handles updating the user's privacy settings
+func (h *Handler) SetMyPrivacy(w http.ResponseWriter, r *http.Request) {
+	handlerName := "SetMyPrivacy"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	var req models.PrivacySettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := h.service.UpdatePrivacySettings(r.Context(), userID, req.HideLastSeen); err != nil {
+		logError(r, handlerName, err, "Failed to update privacy settings")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// BlockUser blocks a user for the authenticated user
+func (h *Handler) BlockUser(w http.ResponseWriter, r *http.Request) {
+	handlerName := "BlockUser"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	blockedID := vars["id"]
+
+	if err := h.service.BlockUser(r.Context(), userID, blockedID); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to block user: %s", blockedID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User blocked", "blocked_id", blockedID)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// UnblockUser unblocks a user for the authenticated user
+func (h *Handler) UnblockUser(w http.ResponseWriter, r *http.Request) {
+	handlerName := "UnblockUser"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	blockedID := vars["id"]
+
+	if err := h.service.UnblockUser(r.Context(), userID, blockedID); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to unblock user: %s", blockedID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User unblocked", "blocked_id", blockedID)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
 
 // SetMyUserName handles updating the user's name
 func (h *Handler) SetMyUserName(w http.ResponseWriter, r *http.Request) {
 	handlerName := "SetMyUserName"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
-	
 	var req models.UpdateUsernameRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logError(handlerName, r, userID, err, "Invalid request payload")
+		logError(r, handlerName, err, "Invalid request payload")
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	log.Printf("[%s] Username update | UserID: %s | New name: %s", handlerName, userID, req.Name)
-	
+	slog.DebugContext(r.Context(), "Username update", "new_name", req.Name)
+
 	if err := h.service.UpdateUsername(r.Context(), userID, req.Name); err != nil {
-		logError(handlerName, r, userID, err, "Failed to update username")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Failed to update username")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	logRequestWithDuration(handlerName, r, userID, start, http.StatusOK)
 	respondWithJSON(w, http.StatusOK, nil)
 }
 
 // SetMyPhoto handles setting the user's profile photo
 func (h *Handler) SetMyPhoto(w http.ResponseWriter, r *http.Request) {
 	handlerName := "SetMyPhoto"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
-
 	// Parse multipart form
 	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB max
-		logError(handlerName, r, userID, err, "Could not parse multipart form")
+		logError(r, handlerName, err, "Could not parse multipart form")
 		respondWithError(w, http.StatusBadRequest, "Could not parse multipart form")
 		return
 	}
@@ -269,148 +386,198 @@ func (h *Handler) SetMyPhoto(w http.ResponseWriter, r *http.Request) {
 	// Get file from form
 	file, fileHeader, err := r.FormFile("photo")
 	if err != nil {
-		logError(handlerName, r, userID, err, "Invalid file")
+		logError(r, handlerName, err, "Invalid file")
 		respondWithError(w, http.StatusBadRequest, "Invalid file")
 		return
 	}
 	defer file.Close()
 
-	log.Printf("[%s] Processing profile photo | UserID: %s | File size: %d bytes | File name: %s", 
-		handlerName, userID, fileHeader.Size, fileHeader.Filename)
+	slog.DebugContext(r.Context(), "Processing profile photo",
+		"file_size", fileHeader.Size, "file_name", fileHeader.Filename)
 
 	// Save photo
 	photoURL, err := h.service.SetUserPhoto(r.Context(), userID, file)
 	if err != nil {
-		logError(handlerName, r, userID, err, "Failed to save profile photo")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Failed to save profile photo")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Profile photo updated | UserID: %s | Photo URL: %s | Duration: %s", 
-		handlerName, userID, photoURL, time.Since(start))
-		
+	slog.InfoContext(r.Context(), "Profile photo updated", "photo_url", photoURL)
+
 	respondWithJSON(w, http.StatusOK, map[string]string{"photo": photoURL})
 }
 
 // CreateConversation handles creating a new conversation
 func (h *Handler) CreateConversation(w http.ResponseWriter, r *http.Request) {
 	handlerName := "CreateConversation"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
-	
 	var req models.CreateConversationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logError(handlerName, r, userID, err, "Invalid request payload")
+		logError(r, handlerName, err, "Invalid request payload")
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	log.Printf("type: %s", req.Type)
 
 	// Validate request
 	if len(req.Participants) == 0 {
-		log.Printf("[%s] Invalid request: no participants | UserID: %s", handlerName, userID)
+		slog.DebugContext(r.Context(), "Invalid request: no participants")
 		respondWithError(w, http.StatusBadRequest, "At least one participant is required")
 		return
 	}
 
-	log.Printf("[%s] Creating conversation | Type: %s | UserID: %s | Participants: %d | Name: %s", 
-		handlerName, req.Type, userID, len(req.Participants), req.Name)
+	slog.DebugContext(r.Context(), "Creating conversation",
+		"type", req.Type, "participants", len(req.Participants), "name", req.Name)
 
 	// Create the conversation
-	conversation, err := h.service.CreateConversation(r.Context(), userID, req.Participants, req.Type, req.Name)
+	conversation, created, err := h.service.CreateConversation(r.Context(), userID, req.Participants, req.Type, req.Name)
 	if err != nil {
-		logError(handlerName, r, userID, err, "Failed to create conversation")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Failed to create conversation")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Conversation created | ConversationID: %s | UserID: %s | Type: %s | Participants: %d | Duration: %s", 
-		handlerName, conversation.ID, userID, req.Type, len(conversation.Participants), time.Since(start))
-	
+	// Asking again for a direct conversation returns the existing one
+	if !created {
+		slog.InfoContext(r.Context(), "Conversation already exists",
+			"conversation_id", conversation.ID, "type", req.Type)
+		respondWithJSON(w, http.StatusOK, conversation)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Conversation created",
+		"conversation_id", conversation.ID, "type", req.Type, "participants", len(conversation.Participants))
+
 	respondWithJSON(w, http.StatusCreated, conversation)
 }
 
 // GetMyConversations returns all conversations for the authenticated user
 func (h *Handler) GetMyConversations(w http.ResponseWriter, r *http.Request) {
 	handlerName := "GetMyConversations"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
+	filter, err := conversationFilter(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	conversations, err := h.service.GetConversations(r.Context(), userID)
+	conversations, next, err := h.service.GetConversations(r.Context(), userID, filter)
 	if err != nil {
-		logError(handlerName, r, userID, err, "Failed to get conversations")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Failed to get conversations")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Retrieved conversations | UserID: %s | Count: %d | Duration: %s", 
-		handlerName, userID, len(conversations), time.Since(start))
-	
+	// The body stays a plain list, the cursor of the next page goes in a header
+	if next != "" {
+		w.Header().Set(NextCursorHeader, next)
+	}
+
+	slog.InfoContext(r.Context(), "Retrieved conversations", "count", len(conversations))
+
 	respondWithJSON(w, http.StatusOK, conversations)
 }
 
+// NextCursorHeader carries the cursor of the next page of a list, absent on the last page
+const NextCursorHeader = "X-Next-Cursor"
+
+// conversationFilter reads the filter of the conversation list from the query string:
+// archived, q, type, unread, limit and cursor
+func conversationFilter(r *http.Request) (models.ConversationFilter, error) {
+	query := r.URL.Query()
+	filter := models.ConversationFilter{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Type:   models.ConversationType(query.Get("type")),
+		Cursor: query.Get("cursor"),
+	}
+
+	// The archived conversations are listed apart, with ?archived=true
+	var err error
+	if value := query.Get("archived"); value != "" {
+		if filter.Archived, err = strconv.ParseBool(value); err != nil {
+			return filter, errors.New("Invalid archived parameter, want true or false")
+		}
+	}
+	if value := query.Get("unread"); value != "" {
+		if filter.Unread, err = strconv.ParseBool(value); err != nil {
+			return filter, errors.New("Invalid unread parameter, want true or false")
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 {
+			return filter, errors.New("Invalid limit parameter, want a positive number")
+		}
+	}
+	return filter, nil
+}
+
 // GetConversation returns a specific conversation
 func (h *Handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 	handlerName := "GetConversation"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	conversationID := vars["id"]
-	
-	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Retrieving conversation | UserID: %s | ConversationID: %s", 
-		handlerName, userID, conversationID)
 
-	conversation, err := h.service.GetConversation(r.Context(), conversationID)
+	slog.DebugContext(r.Context(), "Retrieving conversation", "conversation_id", conversationID)
+
+	conversation, err := h.service.GetConversation(r.Context(), conversationID, userID)
 	if err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get conversation ID: %s", conversationID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, fmt.Sprintf("Failed to get conversation ID: %s", conversationID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	// Check if user is a participant in this conversation
-	isParticipant := false
-	for _, participant := range conversation.Participants {
-		if participant.ID == userID {
-			isParticipant = true
-			break
-		}
+	slog.InfoContext(r.Context(), "Conversation retrieved",
+		"conversation_id", conversationID, "participants", len(conversation.Participants), "messages", len(conversation.Messages))
+
+	respondWithJSON(w, http.StatusOK, conversation)
+}
+
+// SetTyping notifies the other participants that the user is typing in a conversation
+func (h *Handler) SetTyping(w http.ResponseWriter, r *http.Request) {
+	handlerName := "SetTyping"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
 	}
 
-	if !isParticipant {
-		log.Printf("[%s] Access denied | UserID: %s | ConversationID: %s | Not a participant", 
-			handlerName, userID, conversationID)
-		respondWithError(w, http.StatusForbidden, "Not a participant in this conversation")
+	vars := mux.Vars(r)
+	conversationID := vars["id"]
+
+	var req models.TypingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	log.Printf("[%s] Conversation retrieved | UserID: %s | ConversationID: %s | Participants: %d | Messages: %d | Duration: %s", 
-		handlerName, userID, conversationID, len(conversation.Participants), len(conversation.Messages), time.Since(start))
-	
-	respondWithJSON(w, http.StatusOK, conversation)
+	if err := h.service.SetTyping(r.Context(), userID, conversationID, req.Typing); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to set typing in conversation: %s", conversationID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
 const MAX_PHOTO_SIZE = 10 * 1024 * 1024 // 10 MB
@@ -418,17 +585,13 @@ const MAX_PHOTO_SIZE = 10 * 1024 * 1024 // 10 MB
 // SendMessage handles sending a new message
 func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 	handlerName := "SendMessage"
-	start := time.Now()
 
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
-
 	// Determine the content type of the request
 	contentType := r.Header.Get("Content-Type")
 
@@ -438,6 +601,10 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 	var replyToID string
 	var messageType models.MessageType // To store the determined message type
 
+	// Retries of the same send carry the same key, in the Idempotency-Key header or
+	// the clientMessageId of the body, and get back the message sent the first time
+	clientMessageID := r.Header.Get("Idempotency-Key")
+
 	if isMultipartFormData(contentType) {
 		// Handle multipart/form-data (for photo messages)
 		messageType = models.PhotoMessage // Assume photo message if multipart
@@ -446,7 +613,7 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 		// Max memory 10MB for parsed form values and files
 		err = r.ParseMultipartForm(MAX_PHOTO_SIZE)
 		if err != nil {
-			logError(handlerName, r, userID, err, "Failed to parse multipart form")
+			logError(r, handlerName, err, "Failed to parse multipart form")
 			respondWithError(w, http.StatusBadRequest, "Failed to parse multipart form: "+err.Error())
 			return
 		}
@@ -454,7 +621,7 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 		// Get conversation ID from form field
 		conversationID = r.FormValue("conversationId")
 		if conversationID == "" {
-			logError(handlerName, r, userID, errors.New("missing conversationId form field"), "Missing conversation ID for photo message")
+			logError(r, handlerName, errors.New("missing conversationId form field"), "Missing conversation ID for photo message")
 			respondWithError(w, http.StatusBadRequest, "Missing conversation ID")
 			return
 		}
@@ -462,22 +629,28 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 		// Get replyTo ID from form field (optional)
 		replyToID = r.FormValue("replyTo") // This will be "" if not provided
 
+		if clientMessageID, err = idempotencyKey(clientMessageID, r.FormValue("clientMessageId")); err != nil {
+			logError(r, handlerName, err, "Conflicting idempotency keys")
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
 		// Get the photo file
 		file, _, fileErr := r.FormFile("photo") // "photo" is the expected field name for the file
 		if fileErr != nil {
 			if fileErr == http.ErrMissingFile {
-				logError(handlerName, r, userID, fileErr, "Missing photo file in request")
+				logError(r, handlerName, fileErr, "Missing photo file in request")
 				respondWithError(w, http.StatusBadRequest, "Missing photo file")
 			} else {
-				logError(handlerName, r, userID, fileErr, "Error getting photo file")
-				respondWithError(w, http.StatusInternalServerError, "Error getting photo file: "+fileErr.Error())
+				logError(r, handlerName, fileErr, "Error getting photo file")
+				respondWithError(w, http.StatusBadRequest, "Invalid photo file")
 			}
 			return
 		}
 		defer file.Close() // Ensure the file is closed
 
 		// Call the service to send the photo message
-		newMsg, err = h.service.SendPhotoMessage(r.Context(), userID, conversationID, file, replyToID)
+		newMsg, err = h.service.SendPhotoMessage(r.Context(), userID, conversationID, file, replyToID, clientMessageID)
 
 	} else if isApplicationJSON(contentType) {
 		// Handle application/json (for text messages)
@@ -485,7 +658,7 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 
 		var msg models.Message
 		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-			logError(handlerName, r, userID, err, "Invalid request payload")
+			logError(r, handlerName, err, "Invalid request payload")
 			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 			return
 		}
@@ -493,35 +666,53 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 		// Extract conversation ID and message content
 		conversationID = msg.ConversationID
 		content := msg.Content
-		
-        // Handle replyTo ID - ensure it's a string, even if the model uses *string
-        if msg.ReplyTo != nil {
-            replyToID = *msg.ReplyTo
-        } else {
-            replyToID = ""
-        }
+
+		// Handle replyTo ID - ensure it's a string, even if the model uses *string
+		if msg.ReplyTo != nil {
+			replyToID = *msg.ReplyTo
+		} else {
+			replyToID = ""
+		}
+
+		if clientMessageID, err = idempotencyKey(clientMessageID, msg.ClientMessageID); err != nil {
+			logError(r, handlerName, err, "Conflicting idempotency keys")
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
 		// Call the service to send the text message
-		newMsg, err = h.service.SendTextMessage(r.Context(), userID, conversationID, content, &replyToID)
+		newMsg, err = h.service.SendTextMessage(r.Context(), userID, conversationID, content, &replyToID, clientMessageID)
 
 	} else {
 		// Unsupported content type
-		logError(handlerName, r, userID, nil, fmt.Sprintf("Unsupported content type: %s", contentType))
+		logError(r, handlerName, nil, fmt.Sprintf("Unsupported content type: %s", contentType))
 		respondWithError(w, http.StatusBadRequest, "Unsupported content type. Expected application/json or multipart/form-data")
 		return
 	}
 
 	if err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to send %s message to conversation: %s", messageType, conversationID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, fmt.Sprintf("Failed to send %s message to conversation: %s", messageType, conversationID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] %s message sent | UserID: %s | ConvID: %s | MessageID: %s | Duration: %s",
-		handlerName, messageType, userID, newMsg.ID, time.Since(start)) // Use newMsg.ID for the message ID
+	slog.InfoContext(r.Context(), "Message sent",
+		"type", messageType, "conversation_id", conversationID, "message_id", newMsg.ID)
 	respondWithJSON(w, http.StatusCreated, newMsg)
 }
 
+// idempotencyKey returns the key of a send given in the Idempotency-Key header or in
+// the body, failing when both are given and differ
+func idempotencyKey(header, body string) (string, error) {
+	if header != "" && body != "" && header != body {
+		return "", errors.New("Idempotency-Key header and clientMessageId differ")
+	}
+	if header != "" {
+		return header, nil
+	}
+	return body, nil
+}
+
 // Helper functions to check content type (add these if you don't have them)
 func isMultipartFormData(contentType string) bool {
 	return len(contentType) >= len("multipart/form-data") && contentType[:len("multipart/form-data")] == "multipart/form-data"
@@ -534,146 +725,126 @@ func isApplicationJSON(contentType string) bool {
 // ForwardMessage handles forwarding a message to another conversation
 func (h *Handler) ForwardMessage(w http.ResponseWriter, r *http.Request) {
 	handlerName := "ForwardMessage"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
-	logRequest(handlerName, r, userID)
-	
 	var req models.ForwardMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logError(handlerName, r, userID, err, "Invalid request payload")
+		logError(r, handlerName, err, "Invalid request payload")
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	log.Printf("[%s] Forwarding message | UserID: %s | MessageID: %s | TargetConvID: %s", 
-		handlerName, userID, req.MessageID, req.TargetConversationID)
+	slog.DebugContext(r.Context(), "Forwarding message",
+		"message_id", req.MessageID, "target_conversation_id", req.TargetConversationID)
 
 	if err := h.service.ForwardMessage(r.Context(), userID, req.MessageID, req.TargetConversationID); err != nil {
-		logError(handlerName, r, userID, err, "Failed to forward message")
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, "Failed to forward message")
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Message forwarded | UserID: %s | MessageID: %s | TargetConvID: %s | Duration: %s", 
-		handlerName, userID, req.MessageID, req.TargetConversationID, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "Message forwarded",
+		"message_id", req.MessageID, "target_conversation_id", req.TargetConversationID)
+
 	respondWithJSON(w, http.StatusOK, nil)
 }
 
 // CommentMessage adds a reaction to a message
 func (h *Handler) CommentMessage(w http.ResponseWriter, r *http.Request) {
 	handlerName := "CommentMessage"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	messageID := vars["id"]
-	
-	logRequest(handlerName, r, userID)
 
 	var reaction models.Reaction
 	if err := json.NewDecoder(r.Body).Decode(&reaction); err != nil {
-		logError(handlerName, r, userID, err, "Invalid request payload")
+		logError(r, handlerName, err, "Invalid request payload")
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	log.Printf("[%s] Adding reaction | UserID: %s | MessageID: %s | Emoji: %s", 
-		handlerName, userID, messageID, reaction.Emoji)
+	slog.DebugContext(r.Context(), "Adding reaction", "message_id", messageID, "emoji", reaction.Emoji)
 
 	if err := h.service.AddReaction(r.Context(), userID, messageID, reaction.Emoji); err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to add reaction to message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, fmt.Sprintf("Failed to add reaction to message: %s", messageID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Reaction added | UserID: %s | MessageID: %s | Emoji: %s | Duration: %s", 
-		handlerName, userID, messageID, reaction.Emoji, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "Reaction added", "message_id", messageID, "emoji", reaction.Emoji)
+
 	respondWithJSON(w, http.StatusOK, nil)
 }
 
 // UncommentMessage removes a reaction from a message
 func (h *Handler) UncommentMessage(w http.ResponseWriter, r *http.Request) {
 	handlerName := "UncommentMessage"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	messageID := vars["id"]
-	
-	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Removing reaction | UserID: %s | MessageID: %s", handlerName, userID, messageID)
+
+	slog.DebugContext(r.Context(), "Removing reaction", "message_id", messageID)
 
 	if err := h.service.RemoveReaction(r.Context(), userID, messageID); err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to remove reaction from message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, fmt.Sprintf("Failed to remove reaction from message: %s", messageID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Reaction removed | UserID: %s | MessageID: %s | Duration: %s", 
-		handlerName, userID, messageID, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "Reaction removed", "message_id", messageID)
+
 	respondWithJSON(w, http.StatusOK, nil)
 }
 
 // DeleteMessage deletes a message
 func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 	handlerName := "DeleteMessage"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	messageID := vars["id"]
-	
-	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Deleting message | UserID: %s | MessageID: %s", handlerName, userID, messageID)
+
+	slog.DebugContext(r.Context(), "Deleting message", "message_id", messageID)
 
 	if err := h.service.DeleteMessage(r.Context(), userID, messageID); err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to delete message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, fmt.Sprintf("Failed to delete message: %s", messageID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Message deleted | UserID: %s | MessageID: %s | Duration: %s", 
-		handlerName, userID, messageID, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "Message deleted", "message_id", messageID)
+
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
 // UpdateMessage updates a message
 func (h *Handler) UpdateMessage(w http.ResponseWriter, r *http.Request) {
 	handlerName := "UpdateMessage"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
@@ -686,112 +857,76 @@ func (h *Handler) UpdateMessage(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	
-	logRequest(handlerName, r, userID)
-	log.Printf("[%s] Updating message | UserID: %s | MessageID: %s", handlerName, userID, messageID)
+
+	slog.DebugContext(r.Context(), "Updating message", "message_id", messageID)
 
 	if err := h.service.UpdateMessage(r.Context(), userID, messageID, req.Content); err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to update message: %s", messageID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, fmt.Sprintf("Failed to update message: %s", messageID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] Message updated | UserID: %s | MessageID: %s | Duration: %s", 
-		handlerName, userID, messageID, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "Message updated", "message_id", messageID)
+
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
 // AddToGroup adds a user to a group conversation
 func (h *Handler) AddToGroup(w http.ResponseWriter, r *http.Request) {
 	handlerName := "AddToGroup"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	groupID := vars["id"]
-	
-	logRequest(handlerName, r, userID)
 
 	var req models.AddToGroupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logError(handlerName, r, userID, err, "Invalid request payload")
+		logError(r, handlerName, err, "Invalid request payload")
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	log.Printf("[%s] Adding user to group | RequestedBy: %s | GroupID: %s | NewUserID: %s", 
-		handlerName, userID, groupID, req.UserID)
-
-	// Check if the user is in the group (to verify they have permission)
-	group, err := h.service.GetConversation(r.Context(), groupID)
-	if err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to get group: %s", groupID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	// Verify user is in the group
-	isInGroup := false
-	for _, participant := range group.Participants {
-		if participant.ID == userID {
-			isInGroup = true
-			break
-		}
-	}
+	slog.DebugContext(r.Context(), "Adding user to group", "group_id", groupID, "new_user_id", req.UserID)
 
-	if !isInGroup {
-		log.Printf("[%s] Permission denied | UserID: %s | GroupID: %s | Not in group", 
-			handlerName, userID, groupID)
-		respondWithError(w, http.StatusForbidden, "You must be in the group to add members")
+	if err := h.service.AddToGroup(r.Context(), groupID, req.UserID, userID); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to add user %s to group %s", req.UserID, groupID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	if err := h.service.AddToGroup(r.Context(), groupID, req.UserID); err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to add user %s to group %s", req.UserID, groupID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
+	slog.InfoContext(r.Context(), "User added to group", "group_id", groupID, "added_user_id", req.UserID)
 
-	log.Printf("[%s] User added to group | RequestedBy: %s | GroupID: %s | AddedUserID: %s | Duration: %s", 
-		handlerName, userID, groupID, req.UserID, time.Since(start))
-	
 	respondWithJSON(w, http.StatusOK, nil)
 }
 
 // LeaveGroup handles a user leaving a group conversation
 func (h *Handler) LeaveGroup(w http.ResponseWriter, r *http.Request) {
 	handlerName := "LeaveGroup"
-	start := time.Now()
-	
+
 	userID := getUserIDFromContext(r)
 	if userID == "" {
-		log.Printf("[%s] %s %s | Not authenticated | IP: %s", handlerName, r.Method, r.URL.Path, r.RemoteAddr)
 		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	vars := mux.Vars(r)
 	groupID := vars["id"]
-	
-	logRequest(handlerName, r, userID)
-	log.Printf("[%s] User leaving group | UserID: %s | GroupID: %s", handlerName, userID, groupID)
+
+	slog.DebugContext(r.Context(), "User leaving group", "group_id", groupID)
 
 	if err := h.service.LeaveGroup(r.Context(), groupID, userID); err != nil {
-		logError(handlerName, r, userID, err, fmt.Sprintf("Failed to leave group: %s", groupID))
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		logError(r, handlerName, err, fmt.Sprintf("Failed to leave group: %s", groupID))
+		respondWithServiceError(w, err)
 		return
 	}
 
-	log.Printf("[%s] User left group | UserID: %s | GroupID: %s | Duration: %s", 
-		handlerName, userID, groupID, time.Since(start))
-	
+	slog.InfoContext(r.Context(), "User left group", "group_id", groupID)
+
 	respondWithJSON(w, http.StatusOK, nil)
 }
 
@@ -812,29 +947,8 @@ func (h *Handler) SetGroupName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the user is in the group (to verify they have permission)
-	group, err := h.service.GetConversation(r.Context(), groupID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	// Verify user is in the group
-	isInGroup := false
-	for _, participant := range group.Participants {
-		if participant.ID == userID {
-			isInGroup = true
-			break
-		}
-	}
-
-	if !isInGroup {
-		respondWithError(w, http.StatusForbidden, "You must be in the group to change its name")
-		return
-	}
-
-	if err := h.service.SetGroupName(r.Context(), groupID, req.Name); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := h.service.SetGroupName(r.Context(), groupID, req.Name, userID); err != nil {
+		respondWithServiceError(w, err)
 		return
 	}
 
@@ -866,33 +980,12 @@ func (h *Handler) SetGroupPhoto(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Check if the user is in the group (to verify they have permission)
-	group, err := h.service.GetConversation(r.Context(), groupID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	// Verify user is in the group
-	isInGroup := false
-	for _, participant := range group.Participants {
-		if participant.ID == userID {
-			isInGroup = true
-			break
-		}
-	}
-
-	if !isInGroup {
-		respondWithError(w, http.StatusForbidden, "You must be in the group to change its photo")
-		return
-	}
-
 	// Save photo
-	photoURL, err := h.service.SetGroupPhoto(r.Context(), groupID, file)
+	photoURL, err := h.service.SetGroupPhoto(r.Context(), groupID, file, userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, map[string]string{"photo": photoURL})
-}
\ No newline at end of file
+}
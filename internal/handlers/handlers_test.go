@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/service"
+	"github.com/gorilla/mux"
+)
+
+func TestMain(m *testing.M) {
+	// The handlers log every request, which only clutters the test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// mockService implements service.Service with the methods a test sets, the
+// others panic through the nil embedded interface
+type mockService struct {
+	service.Service
+	users              map[string]*models.User
+	createConversation func(creatorID string, participantIDs []string, convType models.ConversationType, name string) (*models.Conversation, bool, error)
+	addToGroup         func(groupID, userID, currentUserID string) error
+}
+
+func (m *mockService) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	return m.users[userID], nil
+}
+
+func (m *mockService) TouchPresence(userID string) {}
+
+func (m *mockService) CreateConversation(ctx context.Context, creatorID string, participantIDs []string, convType models.ConversationType, name string) (*models.Conversation, bool, error) {
+	return m.createConversation(creatorID, participantIDs, convType, name)
+}
+
+func (m *mockService) AddToGroup(ctx context.Context, groupID, userID, currentUserID string) error {
+	return m.addToGroup(groupID, userID, currentUserID)
+}
+
+// serve routes an authenticated request by alice through a router of the handlers
+func serve(svc *mockService, method, path, body string) *httptest.ResponseRecorder {
+	if svc.users == nil {
+		svc.users = map[string]*models.User{"alice": {ID: "alice", Name: "alice"}}
+	}
+	h := New(svc)
+
+	router := mux.NewRouter()
+	protected := router.NewRoute().Subrouter()
+	protected.Use(h.AuthMiddleware)
+	protected.HandleFunc("/conversations", h.CreateConversation).Methods("POST")
+	protected.HandleFunc("/groups/{id}/members", h.AddToGroup).Methods("POST")
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer alice")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestCreateConversationStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		created    bool
+		err        error
+		wantStatus int
+	}{
+		{"new conversation", true, nil, http.StatusCreated},
+		{"existing direct conversation", false, nil, http.StatusOK},
+		{"blocked", false, service.ErrBlocked, http.StatusForbidden},
+		{"missing user", false, fmt.Errorf("user bob %w", service.ErrNotFound), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockService{
+				createConversation: func(creatorID string, participantIDs []string, convType models.ConversationType, name string) (*models.Conversation, bool, error) {
+					if creatorID != "alice" || len(participantIDs) != 1 || participantIDs[0] != "bob" || convType != models.DirectConversation {
+						return nil, false, errors.New("unexpected arguments")
+					}
+					if tt.err != nil {
+						return nil, false, tt.err
+					}
+					return &models.Conversation{ID: "conv", Type: convType}, tt.created, nil
+				},
+			}
+
+			w := serve(svc, "POST", "/conversations", `{"type": "direct", "participants": ["bob"]}`)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestAddToGroupPassesTheAuthenticatedUser(t *testing.T) {
+	var gotGroup, gotUser, gotCurrent string
+	svc := &mockService{
+		addToGroup: func(groupID, userID, currentUserID string) error {
+			gotGroup, gotUser, gotCurrent = groupID, userID, currentUserID
+			return nil
+		},
+	}
+
+	w := serve(svc, "POST", "/groups/g1/members", `{"userId": "bob"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if gotGroup != "g1" || gotUser != "bob" || gotCurrent != "alice" {
+		t.Errorf("AddToGroup(%q, %q, %q), want g1, bob, alice", gotGroup, gotUser, gotCurrent)
+	}
+}
+
+func TestAuthMiddlewareRejectsUnknownToken(t *testing.T) {
+	svc := &mockService{users: map[string]*models.User{}}
+
+	w := serve(svc, "POST", "/groups/g1/members", `{"userId": "bob"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/logging"
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/tracing"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the ID of a request, given by the client or a proxy, or
+// generated by the server, and sent back in the response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware gives every request an ID, added to the lines logged while
+// serving it. The incoming X-Request-ID is kept when it is a reasonable one.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		ctx := logging.NewContext(r.Context(), slog.String("request_id", requestID))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID accepts the non-empty IDs made of printable ASCII characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID returns the ID RequestIDMiddleware gave to the request
+func RequestID(r *http.Request) string {
+	if v, ok := logging.Attr(r.Context(), "request_id"); ok {
+		return v.String()
+	}
+	return ""
+}
+
+// statusRecorder remembers the status and the size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// statusCode returns the status of the response, 200 when the handler wrote nothing
+func (w *statusRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// AccessLogMiddleware logs one line per request once it is served: errors for
+// the 5xx responses, warnings for the 4xx ones and information for the others
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.statusCode()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		slog.LogAttrs(r.Context(), level, "request served",
+			slog.String("method", r.Method),
+			slog.String("route", routeTemplate(r)),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
+
+// MetricsMiddleware counts the requests and observes their duration, by route template
+// rather than path so that the IDs in the paths don't multiply the series
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		metrics.ObserveRequest(r.Method, routeTemplate(r), rec.statusCode(), time.Since(start))
+	})
+}
+
+// TracingMiddleware serves every request in a server span named after its route,
+// continuing the trace of the W3C traceparent header when the client sent one
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r)
+		ctx, span := tracing.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+
+		// The log lines of the request point to its trace
+		if span.SpanContext().IsValid() {
+			logging.AddAttrs(ctx, slog.String("trace_id", span.SpanContext().TraceID().String()))
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.statusCode()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// routeTemplate returns the path template of the mux route serving r, if any
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, _ := route.GetPathTemplate()
+	return template
+}
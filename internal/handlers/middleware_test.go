@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/logging"
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// captureLogs sends the default logger to the returned buffer until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.New(&buf, slog.LevelDebug))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// serveLogged routes a request through the request ID, access log and auth
+// middlewares to a handler logging one line
+func serveLogged(r *http.Request) *httptest.ResponseRecorder {
+	h := New(&mockService{users: map[string]*models.User{"alice": {ID: "alice", Name: "alice"}}})
+
+	router := mux.NewRouter()
+	router.Use(RequestIDMiddleware, AccessLogMiddleware, MetricsMiddleware)
+	protected := router.NewRoute().Subrouter()
+	protected.Use(h.AuthMiddleware)
+	protected.HandleFunc("/conversations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "handled")
+		respondWithJSON(w, http.StatusOK, nil)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// logLines decodes the JSON lines of buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]any
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"given", "req-123", true},
+		{"missing", "", false},
+		{"with spaces", "req 123", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			r := httptest.NewRequest("GET", "/conversations/c1", nil)
+			r.Header.Set("Authorization", "Bearer alice")
+			if tt.incoming != "" {
+				r.Header.Set(RequestIDHeader, tt.incoming)
+			}
+
+			w := serveLogged(r)
+			requestID := w.Header().Get(RequestIDHeader)
+			if tt.keep && requestID != tt.incoming {
+				t.Errorf("request ID = %q, want %q", requestID, tt.incoming)
+			}
+			if !tt.keep && (requestID == "" || requestID == tt.incoming) {
+				t.Errorf("request ID = %q, want a generated one", requestID)
+			}
+
+			// Both the handler line and the access log line carry the request and the user
+			lines := logLines(t, logs)
+			if len(lines) != 2 {
+				t.Fatalf("got %d log lines, want 2: %s", len(lines), logs)
+			}
+			for _, line := range lines {
+				if line["request_id"] != requestID || line["user_id"] != "alice" {
+					t.Errorf("line %v, want request_id %s and user_id alice", line, requestID)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLogs(t)
+	r := httptest.NewRequest("GET", "/conversations/c1", nil)
+	r.Header.Set("Authorization", "Bearer unknown")
+
+	w := serveLogged(r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	lines := logLines(t, logs)
+	access := lines[len(lines)-1]
+	want := map[string]any{
+		"level":  "WARN",
+		"msg":    "request served",
+		"method": "GET",
+		"route":  "/conversations/{id}",
+		"path":   "/conversations/c1",
+		"status": float64(http.StatusUnauthorized),
+	}
+	for key, value := range want {
+		if access[key] != value {
+			t.Errorf("%s = %v, want %v", key, access[key], value)
+		}
+	}
+
+	// The bearer token is never logged
+	if strings.Contains(logs.String(), "unknown") {
+		t.Errorf("the logs contain the token: %s", logs)
+	}
+}
+
+func TestMetricsByRouteTemplate(t *testing.T) {
+	captureLogs(t)
+	served := metrics.HTTPRequests.WithLabelValues("GET", "/conversations/{id}", "200")
+	before := testutil.ToFloat64(served)
+
+	for _, id := range []string{"c1", "c2"} {
+		r := httptest.NewRequest("GET", "/conversations/"+id, nil)
+		r.Header.Set("Authorization", "Bearer alice")
+		serveLogged(r)
+	}
+
+	if got := testutil.ToFloat64(served) - before; got != 2 {
+		t.Errorf("requests counted = %v, want 2 under the route template", got)
+	}
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// ReportMessage reports a message to the moderators
+func (h *Handler) ReportMessage(w http.ResponseWriter, r *http.Request) {
+	handlerName := "ReportMessage"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	var req models.ReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	report, err := h.service.ReportMessage(r.Context(), userID, messageID, req.Reason, req.Details)
+	if err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to report message: %s", messageID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Message reported",
+		"message_id", messageID, "report_id", report.ID, "reason", report.Reason)
+
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+// ReportUser reports a user to the moderators
+func (h *Handler) ReportUser(w http.ResponseWriter, r *http.Request) {
+	handlerName := "ReportUser"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	reportedID := vars["id"]
+
+	var req models.ReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	report, err := h.service.ReportUser(r.Context(), userID, reportedID, req.Reason, req.Details)
+	if err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to report user: %s", reportedID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User reported",
+		"reported_id", reportedID, "report_id", report.ID, "reason", report.Reason)
+
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+// GetReports lists the reports of the moderation queue, filtered by the status query parameter
+func (h *Handler) GetReports(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetReports"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	status := models.ReportStatus(r.URL.Query().Get("status"))
+	reports, err := h.service.GetReports(r.Context(), userID, status)
+	if err != nil {
+		logError(r, handlerName, err, "Failed to get reports")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Retrieved reports", "status", status, "count", len(reports))
+
+	respondWithJSON(w, http.StatusOK, reports)
+}
+
+// CloseReport marks a report as resolved or dismissed
+func (h *Handler) CloseReport(w http.ResponseWriter, r *http.Request) {
+	handlerName := "CloseReport"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	reportID := vars["id"]
+
+	var req models.ResolveReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := h.service.CloseReport(r.Context(), userID, reportID, req.Status, req.Reason); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to close report: %s", reportID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Report closed", "report_id", reportID, "status", req.Status)
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// HideMessage hides a message from the participants of its conversation
+func (h *Handler) HideMessage(w http.ResponseWriter, r *http.Request) {
+	h.setMessageHidden(w, r, "HideMessage", true)
+}
+
+// UnhideMessage shows a hidden message again
+func (h *Handler) UnhideMessage(w http.ResponseWriter, r *http.Request) {
+	h.setMessageHidden(w, r, "UnhideMessage", false)
+}
+
+func (h *Handler) setMessageHidden(w http.ResponseWriter, r *http.Request, handlerName string, hidden bool) {
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+
+	req, ok := decodeModerationRequest(w, r, handlerName, userID)
+	if !ok {
+		return
+	}
+
+	if err := h.service.SetMessageHidden(r.Context(), userID, messageID, hidden, req.Reason, req.ReportID); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to change visibility of message: %s", messageID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Message visibility changed", "message_id", messageID, "hidden", hidden)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// SuspendUser suspends a user
+func (h *Handler) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserSuspended(w, r, "SuspendUser", true)
+}
+
+// UnsuspendUser reinstates a suspended user
+func (h *Handler) UnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserSuspended(w, r, "UnsuspendUser", false)
+}
+
+func (h *Handler) setUserSuspended(w http.ResponseWriter, r *http.Request, handlerName string, suspended bool) {
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	vars := mux.Vars(r)
+	targetID := vars["id"]
+
+	req, ok := decodeModerationRequest(w, r, handlerName, userID)
+	if !ok {
+		return
+	}
+
+	if err := h.service.SetUserSuspended(r.Context(), userID, targetID, suspended, req.Reason, req.ReportID); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to change suspension of user: %s", targetID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User suspension changed",
+		"target_id", targetID, "suspended", suspended)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// decodeModerationRequest decodes the optional body of a moderator action
+func decodeModerationRequest(w http.ResponseWriter, r *http.Request, handlerName, userID string) (models.ModerationRequest, bool) {
+	var req models.ModerationRequest
+	if r.ContentLength == 0 {
+		return req, true
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return req, false
+	}
+	return req, true
+}
+
+// GetModerationLog returns the audit log of moderator actions
+func (h *Handler) GetModerationLog(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetModerationLog"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	actions, err := h.service.GetModerationLog(r.Context(), userID)
+	if err != nil {
+		logError(r, handlerName, err, "Failed to get moderation log")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Retrieved moderation log", "count", len(actions))
+
+	respondWithJSON(w, http.StatusOK, actions)
+}
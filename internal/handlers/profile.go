@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// GetUserProfile returns the name, photo and profile of a user
+func (h *Handler) GetUserProfile(w http.ResponseWriter, r *http.Request) {
+	handlerName := "GetUserProfile"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	targetID := mux.Vars(r)["id"]
+
+	user, err := h.service.GetUserProfile(r.Context(), userID, targetID)
+	if err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to get profile of user: %s", targetID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Retrieved profile", "target_id", targetID)
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// UpdateMyProfile changes the name and profile fields given by the authenticated user
+func (h *Handler) UpdateMyProfile(w http.ResponseWriter, r *http.Request) {
+	handlerName := "UpdateMyProfile"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	var req models.UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	user, err := h.service.UpdateProfile(r.Context(), userID, req)
+	if err != nil {
+		logError(r, handlerName, err, "Failed to update profile")
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Profile updated")
+
+	respondWithJSON(w, http.StatusOK, user)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"log/slog"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
+)
+
+// RateLimiter refuses the requests going over their rate limits with 429 Too Many
+// Requests, telling the client when to retry in the Retry-After header
+type RateLimiter struct {
+	store ratelimit.Store
+}
+
+// NewRateLimiter returns a rate limiter keeping its buckets in store
+func NewRateLimiter(store ratelimit.Store) *RateLimiter {
+	return &RateLimiter{store: store}
+}
+
+// PerIP limits the requests of each client address, for the routes served without
+// authentication. The address is the one of the connection: X-Forwarded-For is not
+// trusted, since clients could set it to dodge the limit.
+func (l *RateLimiter) PerIP(rule string, limit ratelimit.Limit) func(http.Handler) http.Handler {
+	return l.middleware(rule, limit, clientIP)
+}
+
+// PerUser limits the requests of each authenticated user. It must run after AuthMiddleware.
+func (l *RateLimiter) PerUser(rule string, limit ratelimit.Limit) func(http.Handler) http.Handler {
+	return l.middleware(rule, limit, getUserIDFromContext)
+}
+
+// middleware limits the requests of rule sharing the same key
+func (l *RateLimiter) middleware(rule string, limit ratelimit.Limit, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit.Unlimited() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := l.store.Allow(r.Context(), rule+":"+key(r), limit)
+			if err != nil {
+				// Better to serve without a limit than not to serve at all
+				slog.WarnContext(r.Context(), "Rate limit store failed", "rule", rule, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !res.Allowed {
+				metrics.RateLimited.WithLabelValues(rule).Inc()
+				seconds := int(math.Ceil(res.RetryAfter.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				respondWithError(w, http.StatusTooManyRequests, "Too many requests, retry in "+strconv.Itoa(seconds)+"s")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UploadsOnly applies limit to the multipart requests only, the ones uploading a
+// photo, and lets the others through untouched
+func UploadsOnly(limit func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		limited := limit(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+				limited.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the address of the client connection, without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/ratelimit"
+)
+
+// failingStore is a rate limit store that is down
+type failingStore struct{}
+
+func (failingStore) Allow(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("store unavailable")
+}
+
+// serveLimited sends a request from addr, with the given content type, through mw
+func serveLimited(mw func(http.Handler) http.Handler, addr, contentType string) *httptest.ResponseRecorder {
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = addr
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	mw := NewRateLimiter(ratelimit.NewMemoryStore()).PerIP("login", ratelimit.Every(2, time.Minute))
+
+	for i := 0; i < 2; i++ {
+		if w := serveLimited(mw, "192.0.2.1:1234", ""); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d, want %d", i+1, w.Code, http.StatusNoContent)
+		}
+	}
+
+	// Another port of the same address shares the limit
+	w := serveLimited(mw, "192.0.2.1:5678", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	var body problem
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Status != http.StatusTooManyRequests {
+		t.Errorf("body = %+v, %v, want a 429 problem", body, err)
+	}
+
+	// Other addresses are not affected
+	if w := serveLimited(mw, "192.0.2.2:1234", ""); w.Code != http.StatusNoContent {
+		t.Errorf("other address status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestRateLimitUploadsOnly(t *testing.T) {
+	mw := UploadsOnly(NewRateLimiter(ratelimit.NewMemoryStore()).PerIP("uploads", ratelimit.Every(1, time.Hour)))
+
+	if w := serveLimited(mw, "192.0.2.1:1234", "multipart/form-data; boundary=x"); w.Code != http.StatusNoContent {
+		t.Fatalf("first upload status = %d", w.Code)
+	}
+	if w := serveLimited(mw, "192.0.2.1:1234", "multipart/form-data; boundary=x"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second upload status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	// Text messages are not uploads
+	if w := serveLimited(mw, "192.0.2.1:1234", "application/json"); w.Code != http.StatusNoContent {
+		t.Errorf("JSON request status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestRateLimitStoreFailure(t *testing.T) {
+	captureLogs(t)
+	mw := NewRateLimiter(failingStore{}).PerIP("login", ratelimit.Every(1, time.Minute))
+
+	// Requests are served without limit while the store is down
+	for i := 0; i < 3; i++ {
+		if w := serveLimited(mw, "192.0.2.1:1234", ""); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d, want %d", i+1, w.Code, http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// ArchiveConversation archives a conversation for the authenticated user
+func (h *Handler) ArchiveConversation(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, "ArchiveConversation", true)
+}
+
+// UnarchiveConversation brings a conversation back from the archives of the authenticated user
+func (h *Handler) UnarchiveConversation(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, "UnarchiveConversation", false)
+}
+
+func (h *Handler) setArchived(w http.ResponseWriter, r *http.Request, handlerName string, archived bool) {
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	conversationID := mux.Vars(r)["id"]
+
+	if err := h.service.SetConversationArchived(r.Context(), userID, conversationID, archived); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to set archived in conversation: %s", conversationID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Conversation archived", "conversation_id", conversationID, "archived", archived)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// MuteConversation mutes a conversation for the authenticated user until the given time
+func (h *Handler) MuteConversation(w http.ResponseWriter, r *http.Request) {
+	handlerName := "MuteConversation"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	conversationID := mux.Vars(r)["id"]
+
+	var req models.MuteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := h.service.SetConversationMuted(r.Context(), userID, conversationID, &req.Until); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to mute conversation: %s", conversationID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Conversation muted", "conversation_id", conversationID, "until", req.Until)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// UnmuteConversation unmutes a conversation for the authenticated user
+func (h *Handler) UnmuteConversation(w http.ResponseWriter, r *http.Request) {
+	handlerName := "UnmuteConversation"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	conversationID := mux.Vars(r)["id"]
+
+	if err := h.service.SetConversationMuted(r.Context(), userID, conversationID, nil); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to unmute conversation: %s", conversationID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Conversation unmuted", "conversation_id", conversationID)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// PinConversation pins a conversation to the top of the list of the authenticated user,
+// at the position given in the optional body
+func (h *Handler) PinConversation(w http.ResponseWriter, r *http.Request) {
+	handlerName := "PinConversation"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	conversationID := mux.Vars(r)["id"]
+
+	var req models.PinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logError(r, handlerName, err, "Invalid request payload")
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := h.service.SetConversationPinned(r.Context(), userID, conversationID, true, req.Position); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to pin conversation: %s", conversationID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Conversation pinned", "conversation_id", conversationID)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// UnpinConversation unpins a conversation for the authenticated user
+func (h *Handler) UnpinConversation(w http.ResponseWriter, r *http.Request) {
+	handlerName := "UnpinConversation"
+
+	userID := getUserIDFromContext(r)
+	if userID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated")
+		return
+	}
+
+	conversationID := mux.Vars(r)["id"]
+
+	if err := h.service.SetConversationPinned(r.Context(), userID, conversationID, false, nil); err != nil {
+		logError(r, handlerName, err, fmt.Sprintf("Failed to unpin conversation: %s", conversationID))
+		respondWithServiceError(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Conversation unpinned", "conversation_id", conversationID)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
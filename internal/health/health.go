@@ -0,0 +1,159 @@
+// Package health serves the probes of the orchestrators running the server: liveness,
+// readiness and the build the server was made from.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkTimeout bounds how long the readiness checks of one probe may take
+const checkTimeout = 2 * time.Second
+
+// check is a named condition the server needs to serve requests
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Checker runs the readiness checks of the server. Once drained, the server is
+// reported unready whatever the checks say, so that no new traffic is sent to it
+// while it finishes serving the requests in flight.
+type Checker struct {
+	mu       sync.Mutex
+	checks   []check
+	draining atomic.Bool
+}
+
+// NewChecker returns a checker without checks, ready until drained
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add adds a readiness check, failing when run returns an error
+func (c *Checker) Add(name string, run func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, run: run})
+}
+
+// Drain marks the server as shutting down
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Status is the body of the health probes
+type Status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Live answers that the process is up, without checking its dependencies
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, Status{Status: "ok"})
+}
+
+// Ready runs the checks and answers 200 when all of them pass, 503 otherwise
+// or when the server is draining
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	if c.draining.Load() {
+		respond(w, http.StatusServiceUnavailable, Status{Status: "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.Unlock()
+
+	status := Status{Status: "ok", Checks: make(map[string]string, len(checks))}
+	code := http.StatusOK
+	for _, ch := range checks {
+		if err := ch.run(ctx); err != nil {
+			slog.WarnContext(ctx, "Readiness check failed", "check", ch.name, "error", err)
+			status.Checks[ch.name] = err.Error()
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		status.Checks[ch.name] = "ok"
+	}
+	respond(w, code, status)
+}
+
+// WritableDir returns a check creating and removing a file in dir, creating dir
+// first if needed, as storing an upload does
+func WritableDir(dir string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+		name := f.Name()
+		if err := f.Close(); err != nil {
+			os.Remove(name)
+			return err
+		}
+		return os.Remove(name)
+	}
+}
+
+// BuildInfo describes the build of the server
+type BuildInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// ReadBuildInfo returns the build info of the server. The commit and build time are
+// the ones set with -ldflags at build time, or else the ones of the version control
+// stamped by the go command, or "unknown".
+func ReadBuildInfo(commit, buildTime string) BuildInfo {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && buildTime == "":
+				buildTime = setting.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if buildTime == "" {
+		buildTime = "unknown"
+	}
+	return BuildInfo{Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+}
+
+// Version answers the build info of the server
+func Version(info BuildInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, info)
+	}
+}
+
+// respond writes data as JSON, never cached since probes are about the present
+func respond(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		slog.Error("Error encoding JSON response", "error", err)
+	}
+}
@@ -0,0 +1,86 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// probe calls handler and decodes the JSON it answers
+func probe(t *testing.T, handler http.HandlerFunc) (int, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON %q: %v", w.Body, err)
+	}
+	return w.Code, body
+}
+
+func TestReady(t *testing.T) {
+	c := NewChecker()
+	c.Add("database", func(ctx context.Context) error { return nil })
+	uploads := filepath.Join(t.TempDir(), "uploads")
+	c.Add("uploads", WritableDir(uploads))
+
+	code, body := probe(t, c.Ready)
+	if code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("ready = %d %v, want 200 ok", code, body)
+	}
+	// The check leaves nothing behind
+	if entries, err := os.ReadDir(uploads); err != nil || len(entries) != 0 {
+		t.Errorf("uploads directory entries = %v, %v, want none", entries, err)
+	}
+
+	c.Add("migrations", func(ctx context.Context) error { return errors.New("pending migrations: 0008_archive") })
+	code, body = probe(t, c.Ready)
+	checks, _ := body["checks"].(map[string]any)
+	if code != http.StatusServiceUnavailable || body["status"] != "unavailable" {
+		t.Errorf("ready = %d %v, want 503 unavailable", code, body)
+	}
+	if checks["database"] != "ok" || checks["migrations"] != "pending migrations: 0008_archive" {
+		t.Errorf("checks = %v, want the failing one explained", checks)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c := NewChecker()
+	c.Drain()
+
+	if code, body := probe(t, c.Ready); code != http.StatusServiceUnavailable || body["status"] != "draining" {
+		t.Errorf("ready = %d %v, want 503 draining", code, body)
+	}
+	// The process is still alive while draining
+	if code, _ := probe(t, c.Live); code != http.StatusOK {
+		t.Errorf("live = %d, want 200", code)
+	}
+}
+
+func TestWritableDirFailure(t *testing.T) {
+	// A file where the directory should be
+	path := filepath.Join(t.TempDir(), "uploads")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritableDir(path)(context.Background()); err == nil {
+		t.Error("WritableDir() succeeded on a file")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	code, body := probe(t, Version(ReadBuildInfo("0123abc", "2026-01-02T03:04:05Z")))
+	if code != http.StatusOK || body["commit"] != "0123abc" || body["buildTime"] != "2026-01-02T03:04:05Z" || body["goVersion"] == "" {
+		t.Errorf("version = %d %v", code, body)
+	}
+
+	// Without -ldflags nor version control stamps, as in tests
+	if info := ReadBuildInfo("", ""); info.Commit == "" || info.BuildTime == "" {
+		t.Errorf("ReadBuildInfo() = %+v, want unknown rather than empty", info)
+	}
+}
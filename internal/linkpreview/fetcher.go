@@ -0,0 +1,283 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// DefaultTimeout bounds the whole fetch of a page, redirects included
+	DefaultTimeout = 5 * time.Second
+
+	// DefaultMaxBytes is the maximum number of bytes read from a page
+	DefaultMaxBytes = 512 * 1024
+
+	maxRedirects         = 3
+	maxTitleLength       = 300
+	maxDescriptionLength = 1000
+)
+
+// ErrBlockedAddress is returned when a URL resolves to an address the fetcher must not reach
+var ErrBlockedAddress = errors.New("address is not allowed")
+
+// blockedNetworks are the ranges a preview must never be fetched from, on top of
+// the loopback, private, link-local and multicast ranges checked in isBlocked
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // "This" network
+	"100.64.0.0/10",   // Carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // TEST-NET-1
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // TEST-NET-2
+	"203.0.113.0/24",  // TEST-NET-3
+	"240.0.0.0/4",     // Reserved
+	"64:ff9b::/96",    // NAT64
+	"2001:db8::/32",   // Documentation
+)
+
+// urlPattern matches the http(s) URLs in a message content
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// ExtractURL returns the first http(s) URL in a message content, or an empty string
+func ExtractURL(content string) string {
+	u := urlPattern.FindString(content)
+	// Trailing punctuation is most likely part of the sentence, not of the URL
+	return strings.TrimRight(u, ".,;:!?)]}'")
+}
+
+// Fetcher downloads pages and extracts their preview metadata.
+// It refuses to connect to private, loopback and otherwise internal addresses.
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+
+	// allowPrivate disables the address checks, it is only meant for tests
+	allowPrivate bool
+}
+
+// NewFetcher creates a new Fetcher
+func NewFetcher() *Fetcher {
+	f := &Fetcher{maxBytes: DefaultMaxBytes}
+
+	dialer := &net.Dialer{
+		Timeout: DefaultTimeout,
+		// The check runs on the resolved address of every connection, redirects included
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if f.allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlocked(ip) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+
+	f.client = &http.Client{
+		Timeout: DefaultTimeout,
+		Transport: &http.Transport{
+			Proxy:                 nil, // Never go through a proxy, which could reach internal hosts for us
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   DefaultTimeout,
+			ResponseHeaderTimeout: DefaultTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			return checkScheme(req.URL)
+		},
+	}
+
+	return f
+}
+
+// Fetch downloads a page and returns its preview
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*models.LinkPreview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkScheme(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "WASAText-LinkPreview/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return nil, fmt.Errorf("unsupported content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	preview := parseHTML(io.LimitReader(resp.Body, f.maxBytes), resp.Request.URL)
+	preview.URL = rawURL
+	preview.FetchedAt = time.Now()
+
+	return &preview, nil
+}
+
+// parseHTML extracts the Open Graph metadata of a page, falling back to its
+// <title> and description meta tag. Only the <head> of the page is read.
+func parseHTML(r io.Reader, base *url.URL) models.LinkPreview {
+	var preview models.LinkPreview
+	var title, description strings.Builder
+	inTitle := false
+
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			switch token.DataAtom {
+			case atom.Title:
+				inTitle = tt == html.StartTagToken
+			case atom.Meta:
+				key, content := metaAttributes(token)
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "description":
+					if description.Len() == 0 {
+						description.WriteString(content)
+					}
+				case "og:image", "og:image:url":
+					if preview.ImageURL == "" {
+						preview.ImageURL = resolveURL(base, content)
+					}
+				}
+			case atom.Body:
+				break loop
+			}
+		case html.EndTagToken:
+			switch z.Token().DataAtom {
+			case atom.Title:
+				inTitle = false
+			case atom.Head:
+				break loop
+			}
+		case html.TextToken:
+			if inTitle {
+				title.Write(z.Text())
+			}
+		}
+	}
+
+	if preview.Title == "" {
+		preview.Title = title.String()
+	}
+	if preview.Description == "" {
+		preview.Description = description.String()
+	}
+	preview.Title = truncate(strings.Join(strings.Fields(preview.Title), " "), maxTitleLength)
+	preview.Description = truncate(strings.Join(strings.Fields(preview.Description), " "), maxDescriptionLength)
+
+	return preview
+}
+
+// metaAttributes returns the property (or name) and the content of a <meta> tag
+func metaAttributes(token html.Token) (string, string) {
+	var key, content string
+	for _, attr := range token.Attr {
+		switch strings.ToLower(attr.Key) {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(attr.Val)
+			}
+		case "content":
+			content = attr.Val
+		}
+	}
+	return key, content
+}
+
+// resolveURL resolves a possibly relative image URL against the page URL
+func resolveURL(base *url.URL, ref string) string {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil || checkScheme(u) != nil {
+		return ""
+	}
+	return u.String()
+}
+
+// checkScheme only lets http and https URLs through
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// isBlocked reports whether ip belongs to a range a preview must not be fetched from
+func isBlocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max])
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,195 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestFetcher returns a Fetcher allowed to reach the local httptest servers
+func newTestFetcher() *Fetcher {
+	f := NewFetcher()
+	f.allowPrivate = true
+	return f
+}
+
+func TestFetchOpenGraph(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<!DOCTYPE html><html><head>
+			<title>Fallback title</title>
+			<meta property="og:title" content="Open Graph title">
+			<meta property="og:description" content="Open Graph description">
+			<meta property="og:image" content="/images/cover.png">
+			</head><body><p>Hello</p></body></html>`))
+	}))
+	defer srv.Close()
+
+	preview, err := newTestFetcher().Fetch(context.Background(), srv.URL+"/article")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+
+	if preview.URL != srv.URL+"/article" {
+		t.Errorf("URL = %q, want %q", preview.URL, srv.URL+"/article")
+	}
+	if preview.Title != "Open Graph title" {
+		t.Errorf("Title = %q, want %q", preview.Title, "Open Graph title")
+	}
+	if preview.Description != "Open Graph description" {
+		t.Errorf("Description = %q, want %q", preview.Description, "Open Graph description")
+	}
+	if preview.ImageURL != srv.URL+"/images/cover.png" {
+		t.Errorf("ImageURL = %q, want %q", preview.ImageURL, srv.URL+"/images/cover.png")
+	}
+	if preview.FetchedAt.IsZero() {
+		t.Error("FetchedAt is not set")
+	}
+}
+
+func TestFetchFallsBackToHTMLTitle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>
+			Plain   title
+			</title><meta name="description" content="Plain description"></head></html>`))
+	}))
+	defer srv.Close()
+
+	preview, err := newTestFetcher().Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+
+	if preview.Title != "Plain title" {
+		t.Errorf("Title = %q, want %q", preview.Title, "Plain title")
+	}
+	if preview.Description != "Plain description" {
+		t.Errorf("Description = %q, want %q", preview.Description, "Plain description")
+	}
+}
+
+func TestFetchReadsAtMostMaxBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><!--" + strings.Repeat("x", 4096) + "--><title>Too far</title></head></html>"))
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher()
+	f.maxBytes = 1024
+	preview, err := f.Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if preview.Title != "" {
+		t.Errorf("Title = %q, want the title past the limit to be ignored", preview.Title)
+	}
+}
+
+func TestFetchRejectsNonHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("binary"))
+	}))
+	defer srv.Close()
+
+	if _, err := newTestFetcher().Fetch(context.Background(), srv.URL); err == nil {
+		t.Error("Fetch() error = nil, want an error for a non HTML page")
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	defer srv.Close()
+
+	_, err := NewFetcher().Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrBlockedAddress)
+	}
+}
+
+func TestFetchBlocksRedirectsToPrivateAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the internal server")
+	}))
+	defer internal.Close()
+
+	public := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusFound))
+	defer public.Close()
+
+	// Only the first hop is allowed to reach a loopback address
+	f := NewFetcher()
+	transport := f.client.Transport.(*http.Transport)
+	dial := transport.DialContext
+	first := true
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if first {
+			first = false
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+
+	_, err := f.Fetch(context.Background(), public.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrBlockedAddress)
+	}
+}
+
+func TestFetchRejectsUnsupportedSchemes(t *testing.T) {
+	for _, u := range []string{"file:///etc/passwd", "ftp://example.com/file", "gopher://example.com"} {
+		if _, err := NewFetcher().Fetch(context.Background(), u); err == nil {
+			t.Errorf("Fetch(%q) error = nil, want an error", u)
+		}
+	}
+}
+
+func TestIsBlocked(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::1", false},
+	}
+	for _, tt := range tests {
+		if got := isBlocked(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isBlocked(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestExtractURL(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"no links here", ""},
+		{"look at https://example.com/a?b=c.", "https://example.com/a?b=c"},
+		{"(see http://example.com/page)", "http://example.com/page"},
+		{"first https://one.example second https://two.example", "https://one.example"},
+		{"ftp://example.com is not previewed", ""},
+	}
+	for _, tt := range tests {
+		if got := ExtractURL(tt.content); got != tt.want {
+			t.Errorf("ExtractURL(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package linkpreview
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// DefaultCacheTTL is how long a fetched preview is reused before fetching the URL again
+const DefaultCacheTTL = 24 * time.Hour
+
+// job is a request to attach the preview of url to a message
+type job struct {
+	messageID string
+	url       string
+}
+
+// Store is the storage of the worker: the cached previews and the messages they
+// are attached to
+type Store interface {
+	repository.LinkPreviewRepository
+
+	// GetMessageByID retrieves a message by its ID
+	GetMessageByID(ctx context.Context, id string) (*models.Message, error)
+}
+
+// Worker unfurls the links of messages in the background
+type Worker struct {
+	store    Store
+	fetcher  *Fetcher
+	logger   *slog.Logger
+	cacheTTL time.Duration
+	jobs     chan job
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex // guards stopped and the closing of jobs
+	stopped bool
+}
+
+// NewWorker creates a new Worker with a queue of queueSize pending links, logging
+// its failures to logger
+func NewWorker(store Store, fetcher *Fetcher, queueSize int, logger *slog.Logger) *Worker {
+	return &Worker{
+		store:    store,
+		fetcher:  fetcher,
+		logger:   logger.With("component", "linkpreview"),
+		cacheTTL: DefaultCacheTTL,
+		jobs:     make(chan job, queueSize),
+	}
+}
+
+// Start starts n goroutines processing the queued links
+func (w *Worker) Start(n int) {
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for j := range w.jobs {
+				w.process(j)
+			}
+		}()
+	}
+}
+
+// Stop stops accepting links and waits for the queued ones to be processed
+func (w *Worker) Stop() {
+	w.mu.Lock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.jobs)
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+// Enqueue queues the preview of url for a message. It never blocks: when the
+// queue is full, or the worker is stopped, the link is dropped and false is returned.
+func (w *Worker) Enqueue(messageID, url string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		w.logger.Warn("Worker stopped, dropping link", "message_id", messageID)
+		return false
+	}
+	select {
+	case w.jobs <- job{messageID: messageID, url: url}:
+		return true
+	default:
+		w.logger.Warn("Queue full, dropping link", "message_id", messageID)
+		return false
+	}
+}
+
+// process attaches the preview of a link to its message, fetching it unless cached
+func (w *Worker) process(j job) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*DefaultTimeout)
+	defer cancel()
+
+	preview, err := w.store.GetLinkPreview(ctx, j.url)
+	if err != nil {
+		w.logger.Error("Failed to read cache", "url", j.url, "error", err)
+		return
+	}
+
+	if preview == nil || time.Since(preview.FetchedAt) > w.cacheTTL {
+		preview, err = w.fetcher.Fetch(ctx, j.url)
+		if err != nil {
+			w.logger.Warn("Failed to fetch", "url", j.url, "error", err)
+			return
+		}
+		if err := w.store.SaveLinkPreview(ctx, *preview); err != nil {
+			w.logger.Error("Failed to save preview", "url", j.url, "error", err)
+			return
+		}
+	}
+
+	// The message may have been deleted or edited while the link was fetched
+	msg, err := w.store.GetMessageByID(ctx, j.messageID)
+	if err != nil {
+		w.logger.Error("Failed to reload message", "message_id", j.messageID, "error", err)
+		return
+	}
+	if msg == nil || msg.DeletedAt != nil || !strings.Contains(msg.Content, j.url) {
+		return
+	}
+
+	if err := w.store.SetMessageLinkPreview(ctx, j.messageID, j.url); err != nil {
+		w.logger.Error("Failed to attach preview", "message_id", j.messageID, "error", err)
+	}
+}
@@ -0,0 +1,186 @@
+package linkpreview
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// fakeStore is an in-memory Store
+type fakeStore struct {
+	mu       sync.Mutex
+	previews map[string]models.LinkPreview
+	messages map[string]string
+	posted   map[string]models.Message
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		previews: make(map[string]models.LinkPreview),
+		messages: make(map[string]string),
+		posted:   make(map[string]models.Message),
+	}
+}
+
+// post stores a message with the given content
+func (s *fakeStore) post(id, content string) {
+	s.posted[id] = models.Message{ID: id, Content: content}
+}
+
+func (s *fakeStore) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.posted[id]
+	if !ok {
+		return nil, nil
+	}
+	return &msg, nil
+}
+
+func (s *fakeStore) GetLinkPreview(ctx context.Context, url string) (*models.LinkPreview, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	preview, ok := s.previews[url]
+	if !ok {
+		return nil, nil
+	}
+	return &preview, nil
+}
+
+func (s *fakeStore) SaveLinkPreview(ctx context.Context, preview models.LinkPreview) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.previews[preview.URL] = preview
+	return nil
+}
+
+func (s *fakeStore) SetMessageLinkPreview(ctx context.Context, messageID, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[messageID] = url
+	return nil
+}
+
+func TestWorkerAttachesAndCachesPreviews(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><meta property="og:title" content="Shared page"></head></html>`))
+	}))
+	defer srv.Close()
+
+	store := newFakeStore()
+	store.post("message-1", "look at "+srv.URL)
+	store.post("message-2", srv.URL)
+	w := NewWorker(store, newTestFetcher(), 10, slog.New(slog.DiscardHandler))
+	w.Start(1)
+	w.Enqueue("message-1", srv.URL)
+	w.Enqueue("message-2", srv.URL)
+	w.Stop()
+
+	for _, id := range []string{"message-1", "message-2"} {
+		if got := store.messages[id]; got != srv.URL {
+			t.Errorf("preview of %s = %q, want %q", id, got, srv.URL)
+		}
+	}
+	if got := store.previews[srv.URL].Title; got != "Shared page" {
+		t.Errorf("cached title = %q, want %q", got, "Shared page")
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("page fetched %d times, want 1", got)
+	}
+}
+
+func TestWorkerRefreshesExpiredPreviews(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Fresh</title></head></html>`))
+	}))
+	defer srv.Close()
+
+	store := newFakeStore()
+	store.previews[srv.URL] = models.LinkPreview{URL: srv.URL, Title: "Stale", FetchedAt: time.Now().Add(-2 * DefaultCacheTTL)}
+	store.post("message-1", srv.URL)
+
+	w := NewWorker(store, newTestFetcher(), 10, slog.New(slog.DiscardHandler))
+	w.Start(1)
+	w.Enqueue("message-1", srv.URL)
+	w.Stop()
+
+	if got := store.previews[srv.URL].Title; got != "Fresh" {
+		t.Errorf("cached title = %q, want %q", got, "Fresh")
+	}
+}
+
+func TestWorkerSkipsFailedFetches(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	store := newFakeStore()
+	store.post("message-1", srv.URL)
+	w := NewWorker(store, newTestFetcher(), 10, slog.New(slog.DiscardHandler))
+	w.Start(1)
+	w.Enqueue("message-1", srv.URL)
+	w.Stop()
+
+	if _, ok := store.messages["message-1"]; ok {
+		t.Error("a preview was attached for a page that could not be fetched")
+	}
+}
+
+func TestWorkerSkipsStaleMessages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>Page</title></head></html>`))
+	}))
+	defer srv.Close()
+
+	deletedAt := time.Now()
+	store := newFakeStore()
+	store.post("edited", "no link anymore")
+	store.posted["deleted"] = models.Message{ID: "deleted", Content: srv.URL, DeletedAt: &deletedAt}
+
+	w := NewWorker(store, newTestFetcher(), 10, slog.New(slog.DiscardHandler))
+	w.Start(1)
+	w.Enqueue("edited", srv.URL)
+	w.Enqueue("deleted", srv.URL)
+	w.Enqueue("missing", srv.URL)
+	w.Stop()
+
+	for _, id := range []string{"edited", "deleted", "missing"} {
+		if _, ok := store.messages[id]; ok {
+			t.Errorf("a preview was attached to the %s message", id)
+		}
+	}
+}
+
+func TestEnqueueDropsWhenQueueIsFull(t *testing.T) {
+	w := NewWorker(newFakeStore(), newTestFetcher(), 1, slog.New(slog.DiscardHandler))
+
+	if !w.Enqueue("message-1", "https://example.com") {
+		t.Fatal("Enqueue() = false, want true with an empty queue")
+	}
+	if w.Enqueue("message-2", "https://example.com") {
+		t.Error("Enqueue() = true, want false with a full queue")
+	}
+}
+
+func TestEnqueueAfterStop(t *testing.T) {
+	w := NewWorker(newFakeStore(), newTestFetcher(), 1, slog.New(slog.DiscardHandler))
+	w.Start(1)
+	w.Stop()
+
+	if w.Enqueue("message-1", "https://example.com") {
+		t.Error("Enqueue() = true, want false once the worker is stopped")
+	}
+	// Stopping again does nothing
+	w.Stop()
+}
@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// logLine logs one line with the given context and returns it decoded
+func logLine(t *testing.T, ctx context.Context, args ...any) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	New(&buf, slog.LevelInfo).InfoContext(ctx, "test", args...)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", buf.String(), err)
+	}
+	return line
+}
+
+func TestRedaction(t *testing.T) {
+	line := logLine(t, context.Background(),
+		"Authorization", "Bearer abc", "token", "abc", "header", "bearer abc", "user_id", "alice")
+
+	for key, want := range map[string]string{
+		"Authorization": Redacted,
+		"token":         Redacted,
+		"header":        "Bearer " + Redacted,
+		"user_id":       "alice",
+	} {
+		if line[key] != want {
+			t.Errorf("%s = %v, want %q", key, line[key], want)
+		}
+	}
+}
+
+func TestRedactDSN(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{"postgres://wasa:secret@db:5432/wasatext?sslmode=disable", "postgres://wasa:" + Redacted + "@db:5432/wasatext?sslmode=disable"},
+		{"postgres://db:5432/wasatext", "postgres://db:5432/wasatext"},
+		{"host=db user=wasa password=secret dbname=wasatext", "host=db user=wasa password=" + Redacted + " dbname=wasatext"},
+		{"host=db password='two words' dbname=wasatext", "host=db password=" + Redacted + " dbname=wasatext"},
+		{"wasatext.db", "wasatext.db"},
+	}
+	for _, tt := range tests {
+		if got := RedactDSN(tt.dsn); got != tt.want {
+			t.Errorf("RedactDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+		if strings.Contains(RedactDSN(tt.dsn), "secret") {
+			t.Errorf("RedactDSN(%q) leaks the password", tt.dsn)
+		}
+	}
+}
+
+func TestContextAttrs(t *testing.T) {
+	ctx := NewContext(context.Background(), slog.String("request_id", "req-1"))
+
+	// Attributes added through a derived context reach the lines of the original one
+	derived := context.WithValue(ctx, struct{}{}, "derived")
+	AddAttrs(derived, slog.String("user_id", "alice"))
+
+	line := logLine(t, ctx)
+	if line["request_id"] != "req-1" || line["user_id"] != "alice" {
+		t.Errorf("line = %v, want request_id req-1 and user_id alice", line)
+	}
+	if v, ok := Attr(derived, "request_id"); !ok || v.String() != "req-1" {
+		t.Errorf("Attr(request_id) = %v, %t, want req-1", v, ok)
+	}
+
+	// Without NewContext, AddAttrs does nothing
+	AddAttrs(context.Background(), slog.String("user_id", "alice"))
+	if line := logLine(t, context.Background()); line["user_id"] != nil {
+		t.Errorf("user_id = %v, want none", line["user_id"])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"WARN", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", slog.LevelInfo, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.s)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v, error %t", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
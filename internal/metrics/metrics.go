@@ -0,0 +1,107 @@
+// Package metrics defines the Prometheus metrics of the server and serves them in
+// the Prometheus text format.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds the metrics of the server, along with the Go runtime and process ones
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts the served requests by method, mux route template and status
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_http_requests_total",
+		Help: "HTTP requests served, by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPRequestDuration observes how long the requests took to serve
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wasatext_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// DBQueryDuration observes the SQL statements, by driver and kind of statement
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wasatext_db_query_duration_seconds",
+		Help:    "Time taken by SQL statements, by driver and operation (select, insert, update, delete or other).",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"driver", "operation"})
+
+	// MessagesSent counts the messages sent, forwarded ones included, by type
+	MessagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_messages_sent_total",
+		Help: "Messages sent, forwarded ones included, by type.",
+	}, []string{"type"})
+
+	// UploadBytes counts the bytes of the uploaded photos, by kind of photo
+	UploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_upload_bytes_total",
+		Help: "Bytes of uploaded photos stored, by kind (user_photos, group_photos or message_photos).",
+	}, []string{"kind"})
+
+	// RateLimited counts the requests refused for going over a rate limit, by rule
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wasatext_rate_limited_requests_total",
+		Help: "Requests refused with 429 Too Many Requests, by rate limit rule.",
+	}, []string{"rule"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		DBQueryDuration,
+		MessagesSent,
+		UploadBytes,
+		RateLimited,
+	)
+}
+
+// Handler serves the metrics of Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// RegisterDBStats exports the connection pool statistics of db, such as the open and
+// in use connections and the time spent waiting for one, labelled with the driver
+func RegisterDBStats(driver string, db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, driver))
+}
+
+// ObserveRequest records a served HTTP request
+func ObserveRequest(method, route string, status int, duration time.Duration) {
+	HTTPRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	HTTPRequestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// ObserveQuery records the duration of an SQL statement started at start. It is
+// meant to be deferred.
+func ObserveQuery(driver, query string, start time.Time) {
+	DBQueryDuration.WithLabelValues(driver, operation(query)).Observe(time.Since(start).Seconds())
+}
+
+// operation returns the kind of an SQL statement, the labels being bounded to a few values
+func operation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch op := strings.ToLower(fields[0]); op {
+	case "select", "insert", "update", "delete":
+		return op
+	}
+	return "other"
+}
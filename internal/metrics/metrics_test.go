@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOperation(t *testing.T) {
+	tests := map[string]string{
+		"SELECT id FROM users":                     "select",
+		"\n\t\tinsert INTO users (id) VALUES ($1)": "insert",
+		"UPDATE users SET name = $1":               "update",
+		"DELETE FROM users":                        "delete",
+		"CREATE TABLE t (id TEXT)":                 "other",
+		"":                                         "other",
+	}
+	for query, want := range tests {
+		if got := operation(query); got != want {
+			t.Errorf("operation(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ObserveRequest("GET", "/api/conversations/{id}", 200, 30*time.Millisecond)
+	ObserveQuery("postgres", "SELECT 1", time.Now())
+	MessagesSent.WithLabelValues("text").Inc()
+	UploadBytes.WithLabelValues("user_photos").Add(1024)
+	if err := RegisterDBStats("sqlite", &sql.DB{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`wasatext_http_requests_total{method="GET",route="/api/conversations/{id}",status="200"} 1`,
+		`wasatext_http_request_duration_seconds_bucket{method="GET",route="/api/conversations/{id}",le="0.05"} 1`,
+		`wasatext_db_query_duration_seconds_count{driver="postgres",operation="select"} 1`,
+		`wasatext_messages_sent_total{type="text"} 1`,
+		`wasatext_upload_bytes_total{kind="user_photos"} 1024`,
+		`go_sql_open_connections{db_name="sqlite"} 0`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the metrics miss %s", want)
+		}
+	}
+
+	if got := testutil.ToFloat64(MessagesSent.WithLabelValues("text")); got != 1 {
+		t.Errorf("messages sent = %v, want 1", got)
+	}
+}
@@ -1,14 +1,72 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
 // User represents a WASAText user
 type User struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	PhotoURL string `json:"photo,omitempty"`
+	ID   string `json:"id"`
+	Name string `json:"name"` // Unique handle the user logs in with and is mentioned by
+	Profile
+	PhotoURL     string     `json:"photo,omitempty"`
+	HideLastSeen bool       `json:"hideLastSeen,omitempty"` // Privacy setting hiding the last seen time from others
+	Role         UserRole   `json:"role,omitempty"`
+	SuspendedAt  *time.Time `json:"suspendedAt,omitempty"` // Set while a moderator suspended the user
+}
+
+// Public returns what the other users see of a user: their handle, photo and profile,
+// without their role, suspension or privacy settings
+func (u User) Public() User {
+	return User{ID: u.ID, Name: u.Name, PhotoURL: u.PhotoURL, Profile: u.Profile}
+}
+
+// Profile is what users tell the others about themselves
+type Profile struct {
+	DisplayName     string     `json:"displayName,omitempty"` // Free-form, shown instead of the handle when set
+	Bio             string     `json:"bio,omitempty"`
+	StatusText      string     `json:"statusText,omitempty"`      // Custom status message
+	StatusExpiresAt *time.Time `json:"statusExpiresAt,omitempty"` // When the status ends, never when nil
+}
+
+// Profile limits, in characters
+const (
+	MaxDisplayNameLength = 64
+	MaxBioLength         = 280
+	MaxStatusTextLength  = 100
+)
+
+// Current returns the profile as it stands at now, without the status once it expired
+func (p Profile) Current(now time.Time) Profile {
+	if p.StatusExpiresAt != nil && !p.StatusExpiresAt.After(now) {
+		p.StatusText = ""
+		p.StatusExpiresAt = nil
+	}
+	return p
+}
+
+// UserRole defines the role of a user in the whole application
+type UserRole string
+
+const (
+	RegularUser UserRole = "user"
+	Moderator   UserRole = "moderator"
+)
+
+// PresenceStatus defines whether a user is currently connected
+type PresenceStatus string
+
+const (
+	Online  PresenceStatus = "online"
+	Away    PresenceStatus = "away"
+	Offline PresenceStatus = "offline"
+)
+
+// Presence represents the online state of a user
+type Presence struct {
+	Status   PresenceStatus `json:"status"`
+	LastSeen *time.Time     `json:"lastSeen,omitempty"` // Omitted when unknown or hidden by the user
 }
 
 // MessageType defines the type of message
@@ -30,16 +88,49 @@ const (
 
 // Message represents a message in WASAText
 type Message struct {
-	ID         			  string        `json:"id"`
-	ConversationID        string        `json:"conversationId"`
-	Sender    			  User          `json:"sender"`
-	Timestamp 			  time.Time     `json:"timestamp"`
-	Content   			  string        `json:"content"`
-	Type      			  MessageType   `json:"type"`
-	Status    			  MessageStatus `json:"status"`
-	ReplyTo   			  *string       `json:"replyTo,omitempty"` // ID of message being replied to
-	DeletedAt 			  *time.Time	`json:"deletedAt,omitempty"` // Timestamp when the message was deleted
-	Reactions 			  []Reaction    `json:"reactions,omitempty"` // Reactions to the message
+	ID              string        `json:"id"`
+	ConversationID  string        `json:"conversationId"`
+	Sender          User          `json:"sender"`
+	Timestamp       time.Time     `json:"timestamp"`
+	Content         string        `json:"content"`
+	Type            MessageType   `json:"type"`
+	Status          MessageStatus `json:"status"`
+	ReplyTo         *string       `json:"replyTo,omitempty"`         // ID of message being replied to
+	DeletedAt       *time.Time    `json:"deletedAt,omitempty"`       // Timestamp when the message was deleted
+	HiddenAt        *time.Time    `json:"hiddenAt,omitempty"`        // Timestamp when a moderator hid the message
+	Reactions       []Reaction    `json:"reactions,omitempty"`       // Reactions to the message
+	Mentions        []Mention     `json:"mentions,omitempty"`        // Users mentioned in the content
+	LinkPreview     *LinkPreview  `json:"linkPreview,omitempty"`     // Preview of the first URL in the content
+	ClientMessageID string        `json:"clientMessageId,omitempty"` // ID given by the sender's client to send it once
+	ReplyPreview    *ReplyPreview `json:"replyPreview,omitempty"`    // Summary of the message replied to
+}
+
+// ReplyPreviewLength is the number of characters of the content kept in a ReplyPreview
+const ReplyPreviewLength = 100
+
+// ReplyPreview summarizes the message a reply answers, for clients to show it above the reply
+type ReplyPreview struct {
+	Sender  User        `json:"sender"` // ID and name only
+	Type    MessageType `json:"type"`
+	Content string      `json:"content"` // First characters, empty when the message was deleted or hidden
+}
+
+// LinkPreview represents the Open Graph/HTML metadata of a URL found in a message
+type LinkPreview struct {
+	URL         string    `json:"url"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	ImageURL    string    `json:"image,omitempty"`
+	FetchedAt   time.Time `json:"-"`
+}
+
+// Mention represents an @name reference inside a text message.
+// Offset and Length are expressed in characters (Unicode code points) of the content.
+type Mention struct {
+	UserID string `json:"userId,omitempty"` // Empty when the mention is @all
+	All    bool   `json:"all,omitempty"`    // True for an @all mention
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
 }
 
 // Reaction represents a user's reaction to a message
@@ -59,26 +150,77 @@ const (
 
 // Conversation represents a chat conversation
 type Conversation struct {
-	ID           string          `json:"id"`
-	Name         string          `json:"name"`
-	Type         ConversationType `json:"type"`
-	PhotoURL     string          `json:"photo,omitempty"`
-	Participants []Participant        `json:"participants"`
-	LastMessage  *Message        `json:"lastMessage,omitempty"`
-	Messages     []Message       `json:"messages,omitempty"`
+	ID           string                `json:"id"`
+	Name         string                `json:"name"`
+	Type         ConversationType      `json:"type"`
+	PhotoURL     string                `json:"photo,omitempty"`
+	Participants []Participant         `json:"participants"`
+	LastMessage  *Message              `json:"lastMessage,omitempty"`
+	Messages     []Message             `json:"messages,omitempty"`
+	Typing       []string              `json:"typing,omitempty"`   // IDs of the other participants currently typing
+	Settings     *ConversationSettings `json:"settings,omitempty"` // Preferences of the user viewing it
+}
+
+// ConversationFilter selects the conversations listed to a user, a page at a time
+type ConversationFilter struct {
+	Archived bool             // The archived conversations instead of the others
+	Query    string           // Matched against the conversation name and the names of the other participants
+	Type     ConversationType // Any type when empty
+	Unread   bool             // Only the conversations with messages the user has not read
+	Limit    int              // Conversations per page, all of them when 0
+	Cursor   string           // Where the previous page ended, empty for the first page
+}
+
+// ConversationSettings are the preferences of a participant for a conversation
+type ConversationSettings struct {
+	Archived    bool       `json:"archived"`
+	MutedUntil  *time.Time `json:"mutedUntil,omitempty"`  // Notifications are off until then
+	PinPosition *int       `json:"pinPosition,omitempty"` // Set when pinned to the top, the lowest first
+}
+
+// MutedAt reports whether the conversation is muted at the given time
+func (s ConversationSettings) MutedAt(t time.Time) bool {
+	return s.MutedUntil != nil && s.MutedUntil.After(t)
 }
 
 type Participant struct {
-    ID   string `json:"id"`
-    Name string `json:"name"`
-	PhotoURL string `json:"photo,omitempty"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Profile
+	PhotoURL     string               `json:"photo,omitempty"`
+	Role         ParticipantRole      `json:"role,omitempty"`
+	Presence     *Presence            `json:"presence,omitempty"`
+	HideLastSeen bool                 `json:"-"`
+	Settings     ConversationSettings `json:"-"` // Shown to the participant only, as Conversation.Settings
 }
 
+// ParticipantRole defines the role of a participant in a conversation
+type ParticipantRole string
+
+const (
+	MemberRole ParticipantRole = "member"
+	AdminRole  ParticipantRole = "admin"
+)
+
 // CreateConversationRequest represents the request to create a new conversation
 type CreateConversationRequest struct {
-	Participants []string `json:"participants"` // UserIDs of participants (excluding the creator)
+	Participants []string         `json:"participants"` // UserIDs of participants (excluding the creator)
 	Type         ConversationType `json:"type"`
-	Name         string          `json:"name"`
+	Name         string           `json:"name"`
+}
+
+// UserFilter selects the users of the directory, a page at a time
+type UserFilter struct {
+	Query  string // Found in the user name, exact and prefix matches first
+	Limit  int    // Users per page
+	Cursor string // Where the previous page ended, empty for the first page
+}
+
+// UserPage is a page of the user directory
+type UserPage struct {
+	Users      []User `json:"users"`
+	HasMore    bool   `json:"hasMore"`
+	NextCursor string `json:"nextCursor,omitempty"` // Cursor of the next page when HasMore
 }
 
 // LoginRequest represents the login request body
@@ -96,6 +238,125 @@ type UpdateUsernameRequest struct {
 	Name string `json:"name"`
 }
 
+// UpdateProfileRequest represents the update profile request body. The fields left
+// out are not changed.
+type UpdateProfileRequest struct {
+	Name            *string    `json:"name"`
+	DisplayName     *string    `json:"displayName"`
+	Bio             *string    `json:"bio"`
+	StatusText      *string    `json:"statusText"`
+	StatusExpiresAt *time.Time `json:"statusExpiresAt"` // Only along statusText, which never expires without it
+}
+
+// HeartbeatRequest represents the presence heartbeat request body
+type HeartbeatRequest struct {
+	Status PresenceStatus `json:"status"` // online or away, online when empty
+}
+
+// TypingRequest represents the typing notification request body
+type TypingRequest struct {
+	Typing bool `json:"typing"`
+}
+
+// MuteRequest represents the mute conversation request body
+type MuteRequest struct {
+	Until time.Time `json:"until"`
+}
+
+// PinRequest represents the pin conversation request body
+type PinRequest struct {
+	Position *int `json:"position,omitempty"` // After the other pinned conversations when empty
+}
+
+// PrivacySettingsRequest represents the privacy settings request body
+type PrivacySettingsRequest struct {
+	HideLastSeen bool `json:"hideLastSeen"`
+}
+
+// ReportReason defines why some content was reported
+type ReportReason string
+
+const (
+	SpamReason          ReportReason = "spam"
+	HarassmentReason    ReportReason = "harassment"
+	InappropriateReason ReportReason = "inappropriate"
+	OtherReason         ReportReason = "other"
+)
+
+// ReportTargetType defines the kind of content a report is about
+type ReportTargetType string
+
+const (
+	MessageReport ReportTargetType = "message"
+	UserReport    ReportTargetType = "user"
+)
+
+// ReportStatus defines the state of a report in the moderation queue
+type ReportStatus string
+
+const (
+	OpenReport      ReportStatus = "open"
+	ResolvedReport  ReportStatus = "resolved"
+	DismissedReport ReportStatus = "dismissed"
+)
+
+// Report represents a user's report of a message or of another user
+type Report struct {
+	ID         string           `json:"id"`
+	ReporterID string           `json:"reporterId"`
+	TargetType ReportTargetType `json:"targetType"`
+	MessageID  string           `json:"messageId,omitempty"`
+	UserID     string           `json:"userId"` // Reported user, the sender for a message report
+	Reason     ReportReason     `json:"reason"`
+	Details    string           `json:"details,omitempty"`
+	Snapshot   json.RawMessage  `json:"snapshot,omitempty"` // Reported content as it was when reported
+	Status     ReportStatus     `json:"status"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	ResolvedAt *time.Time       `json:"resolvedAt,omitempty"`
+	ResolvedBy string           `json:"resolvedBy,omitempty"`
+}
+
+// ModerationActionType defines what a moderator did
+type ModerationActionType string
+
+const (
+	HideMessageAction   ModerationActionType = "hide_message"
+	UnhideMessageAction ModerationActionType = "unhide_message"
+	SuspendUserAction   ModerationActionType = "suspend_user"
+	UnsuspendUserAction ModerationActionType = "unsuspend_user"
+	ResolveReportAction ModerationActionType = "resolve_report"
+	DismissReportAction ModerationActionType = "dismiss_report"
+)
+
+// ModerationAction represents an entry of the moderation audit log
+type ModerationAction struct {
+	ID          string               `json:"id"`
+	ModeratorID string               `json:"moderatorId"`
+	Action      ModerationActionType `json:"action"`
+	TargetID    string               `json:"targetId"` // Message, user or report the action applies to
+	ReportID    string               `json:"reportId,omitempty"`
+	Reason      string               `json:"reason,omitempty"`
+	CreatedAt   time.Time            `json:"createdAt"`
+}
+
+// ReportRequest represents the request to report a message or a user
+type ReportRequest struct {
+	Reason  ReportReason `json:"reason"`
+	Details string       `json:"details"`
+}
+
+// ModerationRequest represents the request body of a moderator action
+type ModerationRequest struct {
+	Reason   string `json:"reason"`
+	ReportID string `json:"reportId"` // Optional report the action answers
+}
+
+// ResolveReportRequest represents the request to close a report
+type ResolveReportRequest struct {
+	Status ReportStatus `json:"status"` // resolved or dismissed
+	Reason string       `json:"reason"`
+}
+
 // AddToGroupRequest represents the request to add a user to a group
 type AddToGroupRequest struct {
 	UserID string `json:"userId"`
@@ -107,11 +368,11 @@ type SetGroupNameRequest struct {
 }
 
 type UpdateMessageRequest struct {
-	Content   string `json:"content"`
+	Content string `json:"content"`
 }
 
 // ForwardMessageRequest represents the request to forward a message
 type ForwardMessageRequest struct {
 	MessageID            string `json:"messageId"`
 	TargetConversationID string `json:"targetConversationId"`
-}
\ No newline at end of file
+}
@@ -0,0 +1,123 @@
+package presence
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+const (
+	// OnlineTimeout is how long a user stays online after their last activity
+	OnlineTimeout = 60 * time.Second
+
+	// TypingTimeout is how long a typing notification lasts unless renewed
+	TypingTimeout = 5 * time.Second
+)
+
+// Tracker keeps the ephemeral presence and typing state of users in memory
+type Tracker struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	away     map[string]bool
+	typing   map[string]map[string]time.Time // conversation ID -> user ID -> expiry
+	now      func() time.Time
+}
+
+// NewTracker creates a new Tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		lastSeen: make(map[string]time.Time),
+		away:     make(map[string]bool),
+		typing:   make(map[string]map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// Touch records activity of a user, keeping the away state set by their last heartbeat
+func (t *Tracker) Touch(userID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastSeen[userID] = t.now()
+}
+
+// Heartbeat records activity of a user along with whether they are away
+func (t *Tracker) Heartbeat(userID string, away bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastSeen[userID] = t.now()
+	if away {
+		t.away[userID] = true
+	} else {
+		delete(t.away, userID)
+	}
+}
+
+// Presence returns the presence of a user. Users not seen since the server
+// started are offline with an unknown last seen time.
+func (t *Tracker) Presence(userID string) models.Presence {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lastSeen, ok := t.lastSeen[userID]
+	if !ok {
+		return models.Presence{Status: models.Offline}
+	}
+
+	presence := models.Presence{Status: models.Offline, LastSeen: &lastSeen}
+	if t.now().Sub(lastSeen) < OnlineTimeout {
+		presence.Status = models.Online
+		if t.away[userID] {
+			presence.Status = models.Away
+		}
+	}
+	return presence
+}
+
+// SetTyping starts or stops the typing state of a user in a conversation
+func (t *Tracker) SetTyping(conversationID, userID string, typing bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	users := t.typing[conversationID]
+	if !typing {
+		delete(users, userID)
+		if len(users) == 0 {
+			delete(t.typing, conversationID)
+		}
+		return
+	}
+
+	if users == nil {
+		users = make(map[string]time.Time)
+		t.typing[conversationID] = users
+	}
+	users[userID] = t.now().Add(TypingTimeout)
+}
+
+// Typing returns the IDs of the users currently typing in a conversation, except excludeID
+func (t *Tracker) Typing(conversationID, excludeID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var userIDs []string
+	for userID, expiry := range t.typing[conversationID] {
+		if !now.Before(expiry) {
+			delete(t.typing[conversationID], userID)
+			continue
+		}
+		if userID != excludeID {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	if len(t.typing[conversationID]) == 0 {
+		delete(t.typing, conversationID)
+	}
+
+	sort.Strings(userIDs)
+	return userIDs
+}
@@ -0,0 +1,96 @@
+package presence
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// clock is a settable time for the tracker
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTracker returns a tracker telling the time with c
+func newTracker(c *clock) *Tracker {
+	t := NewTracker()
+	t.now = c.now
+	return t
+}
+
+func TestPresence(t *testing.T) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tr := newTracker(c)
+
+	if got := tr.Presence("alice"); got.Status != models.Offline || got.LastSeen != nil {
+		t.Errorf("presence of an unseen user = %+v, want offline with no last seen time", got)
+	}
+
+	seen := c.t
+	tr.Touch("alice")
+	if got := tr.Presence("alice"); got.Status != models.Online || !got.LastSeen.Equal(seen) {
+		t.Errorf("presence after activity = %+v, want online, seen at %v", got, seen)
+	}
+
+	// A heartbeat sets the away state, which the activity then keeps
+	c.advance(10 * time.Second)
+	tr.Heartbeat("alice", true)
+	c.advance(10 * time.Second)
+	tr.Touch("alice")
+	if got := tr.Presence("alice"); got.Status != models.Away {
+		t.Errorf("status after an away heartbeat = %s, want away", got.Status)
+	}
+	tr.Heartbeat("alice", false)
+	if got := tr.Presence("alice"); got.Status != models.Online {
+		t.Errorf("status after an online heartbeat = %s, want online", got.Status)
+	}
+
+	// Without activity the user goes offline, keeping their last seen time
+	seen = c.t
+	c.advance(OnlineTimeout - time.Second)
+	if got := tr.Presence("alice"); got.Status != models.Online {
+		t.Errorf("status just before the timeout = %s, want online", got.Status)
+	}
+	c.advance(time.Second)
+	if got := tr.Presence("alice"); got.Status != models.Offline || !got.LastSeen.Equal(seen) {
+		t.Errorf("presence after the timeout = %+v, want offline, seen at %v", got, seen)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tr := newTracker(c)
+
+	tr.SetTyping("conv", "bob", true)
+	tr.SetTyping("conv", "alice", true)
+	tr.SetTyping("other", "carol", true)
+	if got, want := tr.Typing("conv", ""), []string{"alice", "bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Typing() = %v, want %v", got, want)
+	}
+	if got, want := tr.Typing("conv", "alice"), []string{"bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Typing() excluding alice = %v, want %v", got, want)
+	}
+
+	// Renewing the notification pushes its expiry back, stopping it ends it at once
+	c.advance(TypingTimeout - time.Second)
+	tr.SetTyping("conv", "bob", true)
+	tr.SetTyping("other", "carol", false)
+	c.advance(time.Second)
+	if got, want := tr.Typing("conv", ""), []string{"bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Typing() after alice's timeout = %v, want %v", got, want)
+	}
+	if got := tr.Typing("other", ""); got != nil {
+		t.Errorf("Typing() after carol stopped = %v, want none", got)
+	}
+
+	c.advance(TypingTimeout)
+	if got := tr.Typing("conv", ""); got != nil {
+		t.Errorf("Typing() after every timeout = %v, want none", got)
+	}
+	if len(tr.typing) != 0 {
+		t.Errorf("%d conversations left in the typing state, want none", len(tr.typing))
+	}
+}
@@ -0,0 +1,162 @@
+// Package ratelimit limits how often a client may do something, with token buckets
+// kept in a Store. MemoryStore keeps them in the memory of one server; servers
+// sharing their limits would use a Store backed by a shared database instead.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Burst events at once, refilled at Burst per Period. The zero Limit
+// allows everything.
+type Limit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// Every returns the limit of n events per period
+func Every(n int, period time.Duration) Limit {
+	return Limit{Burst: n, Period: period}
+}
+
+// Unlimited reports whether l allows everything
+func (l Limit) Unlimited() bool {
+	return l.Burst <= 0 || l.Period <= 0
+}
+
+// interval returns the time taken to refill one token
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Burst)
+}
+
+// String formats l as n/period, such as 10/1m0s, or off when unlimited
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Burst, l.Period)
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText parses a limit written n/period, such as 10/1m, or off
+func (l *Limit) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if s == "off" || s == "0" {
+		*l = Limit{}
+		return nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("invalid rate limit %q, want n/period such as 10/1m, or off", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid rate limit %q: the count must be a positive integer", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid rate limit %q: the period must be a positive duration", s)
+	}
+	*l = Every(n, d)
+	return nil
+}
+
+// Result is the outcome of an event checked against a limit
+type Result struct {
+	Allowed bool
+	// Remaining is the number of events still allowed at once
+	Remaining int
+	// RetryAfter is the wait before the next event is allowed, when refused
+	RetryAfter time.Duration
+}
+
+// Store keeps the token buckets of the limited clients
+type Store interface {
+	// Allow takes a token from the bucket of key, filled according to limit
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// bucket is a token bucket, filled up to the burst of its limit
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// period is the time the bucket takes to fill up from empty
+	period time.Duration
+}
+
+// MemoryStore keeps the buckets in memory. The full ones are forgotten from time
+// to time, since a new bucket would be just as full.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// sweepInterval is how often MemoryStore forgets its full buckets
+const sweepInterval = time.Minute
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Allow implements Store.Allow
+func (s *MemoryStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.Unlimited() {
+		return Result{Allowed: true, Remaining: math.MaxInt}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.swept) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.period = limit.Period
+	b.refill(now, limit)
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) * float64(limit.interval()))
+		return Result{RetryAfter: wait}, nil
+	}
+	b.tokens--
+	return Result{Allowed: true, Remaining: int(b.tokens)}, nil
+}
+
+// refill adds the tokens earned since the bucket was last updated
+func (b *bucket) refill(now time.Time, limit Limit) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+float64(elapsed)/float64(limit.interval()))
+		b.updated = now
+	}
+}
+
+// sweep forgets the buckets idle long enough to be full again
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.updated) >= b.period {
+			delete(s.buckets, key)
+		}
+	}
+	s.swept = now
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// clock is a settable time for the store
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newStore returns a store telling the time with c
+func newStore(c *clock) *MemoryStore {
+	s := NewMemoryStore()
+	s.now = c.now
+	return s
+}
+
+// allow takes a token from the bucket of key
+func allow(s *MemoryStore, key string, l Limit) Result {
+	res, _ := s.Allow(context.Background(), key, l)
+	return res
+}
+
+func TestTokenBucket(t *testing.T) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newStore(c)
+	limit := Every(3, time.Minute)
+
+	// The burst is allowed at once, then refused until a token is back
+	for i := 2; i >= 0; i-- {
+		if res := allow(s, "alice", limit); !res.Allowed || res.Remaining != i {
+			t.Fatalf("event %d = %+v, want allowed with %d remaining", 3-i, res, i)
+		}
+	}
+	res := allow(s, "alice", limit)
+	if res.Allowed || res.RetryAfter != 20*time.Second {
+		t.Fatalf("event over the burst = %+v, want refused for 20s", res)
+	}
+
+	// Other keys have their own bucket
+	if res := allow(s, "bob", limit); !res.Allowed {
+		t.Errorf("bob refused: %+v", res)
+	}
+
+	c.advance(10 * time.Second)
+	if res := allow(s, "alice", limit); res.Allowed || res.RetryAfter != 10*time.Second {
+		t.Errorf("after 10s = %+v, want refused for 10s more", res)
+	}
+	c.advance(10 * time.Second)
+	if res := allow(s, "alice", limit); !res.Allowed {
+		t.Errorf("after 20s = %+v, want allowed", res)
+	}
+
+	// Unlimited limits allow everything
+	for i := 0; i < 10; i++ {
+		if res := allow(s, "alice", Limit{}); !res.Allowed {
+			t.Fatalf("unlimited event refused: %+v", res)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newStore(c)
+	allow(s, "login:1.2.3.4", Every(10, time.Minute))
+	allow(s, "uploads:alice", Every(30, time.Hour))
+
+	// The login bucket is full again, the uploads one is not
+	c.advance(2 * time.Minute)
+	allow(s, "messages:bob", Every(60, time.Minute))
+	if _, ok := s.buckets["login:1.2.3.4"]; ok {
+		t.Error("the full bucket was kept")
+	}
+	if _, ok := s.buckets["uploads:alice"]; !ok {
+		t.Error("the refilling bucket was forgotten")
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    Limit
+		wantErr bool
+	}{
+		{"10/1m", Every(10, time.Minute), false},
+		{" 30/1h ", Every(30, time.Hour), false},
+		{"off", Limit{}, false},
+		{"0", Limit{}, false},
+		{"10", Limit{}, true},
+		{"-1/1m", Limit{}, true},
+		{"10/minute", Limit{}, true},
+		{"10/0s", Limit{}, true},
+	}
+	for _, tt := range tests {
+		var got Limit
+		err := got.UnmarshalText([]byte(tt.text))
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("UnmarshalText(%q) = %v, %v, want %v, error %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	if s := Every(10, time.Minute).String(); s != "10/1m0s" {
+		t.Errorf("String() = %q", s)
+	}
+}
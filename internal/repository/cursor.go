@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor was not made by EncodeCursor
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// EncodeCursor encodes the position where a page ends as an opaque string, which
+// clients send back as is to get the next page
+func EncodeCursor(position interface{}) string {
+	data, err := json.Marshal(position)
+	if err != nil {
+		panic(err) // positions are plain structs
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor decodes a cursor made by EncodeCursor into position
+func DecodeCursor(cursor string, position interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, position); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// ConversationCursor is the position of the last conversation of a page, in the
+// order of GetConversationsByUserID
+type ConversationCursor struct {
+	PinPosition  *int      `json:"p,omitempty"`
+	LastActivity time.Time `json:"t"`
+	ID           string    `json:"id"`
+}
+
+// DecodeConversationCursor decodes the cursor of a conversation page
+func DecodeConversationCursor(cursor string) (ConversationCursor, error) {
+	var position ConversationCursor
+	if err := DecodeCursor(cursor, &position); err != nil {
+		return position, err
+	}
+	if position.ID == "" || position.LastActivity.IsZero() {
+		return position, ErrInvalidCursor
+	}
+	return position, nil
+}
+
+// UserCursor is the position of the last user of a page, in the order of SearchUsers
+type UserCursor struct {
+	Rank int    `json:"r"` // 0 for an exact match, 1 for a prefix match, 2 for the others
+	Name string `json:"n"`
+}
+
+// DecodeUserCursor decodes the cursor of a user page
+func DecodeUserCursor(cursor string) (UserCursor, error) {
+	var position UserCursor
+	if err := DecodeCursor(cursor, &position); err != nil {
+		return position, err
+	}
+	if position.Name == "" || position.Rank < 0 || position.Rank > 2 {
+		return position, ErrInvalidCursor
+	}
+	return position, nil
+}
@@ -0,0 +1,13 @@
+package repository
+
+import "errors"
+
+// Kinds of the errors returned by the repositories for a missing or conflicting
+// record. Errors are wrapped with %w around one of them, so the service keeps their kind.
+var (
+	// ErrNotFound is returned when the record an operation changes does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when an operation conflicts with the stored records
+	ErrConflict = errors.New("conflict")
+)
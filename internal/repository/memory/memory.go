@@ -0,0 +1,1305 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/uploads"
+	"github.com/google/uuid"
+)
+
+// conversation is a stored conversation, without its participants and messages
+type conversation struct {
+	id           string
+	name         string
+	convType     models.ConversationType
+	photoURL     string
+	lastActivity time.Time
+	seq          int
+}
+
+// participant is the membership of a user in a conversation
+type participant struct {
+	userID   string
+	role     models.ParticipantRole
+	settings models.ConversationSettings // never modified in place, only replaced
+}
+
+// message is a stored message. Only the sender ID of msg is set, the rest of the
+// sender is read from the users when the message is returned.
+type message struct {
+	msg            models.Message
+	linkPreviewURL string
+	seq            int
+}
+
+// MemoryRepository implements the Repository interface keeping everything in
+// memory. It is meant for tests and demos: its content is lost on restart.
+type MemoryRepository struct {
+	mu         sync.RWMutex
+	uploadPath string
+	seq        int
+	undo       *undoLog // set on the repository a transaction works on
+
+	users         map[string]*models.User
+	conversations map[string]*conversation
+	participants  map[string][]participant // conversation ID -> participants, in joining order
+	messages      map[string]*message
+	reactions     map[string][]models.Reaction // message ID -> reactions
+	linkPreviews  map[string]models.LinkPreview
+	blocks        map[string]map[string]bool // blocker ID -> blocked IDs
+	reports       map[string]*models.Report
+	reportOrder   []string
+	actions       []models.ModerationAction
+}
+
+// NewMemoryRepository creates a new, empty MemoryRepository. Uploaded photos are
+// still written to disk, under uploadPath.
+func NewMemoryRepository(uploadPath string) *MemoryRepository {
+	return &MemoryRepository{
+		uploadPath:    uploadPath,
+		users:         make(map[string]*models.User),
+		conversations: make(map[string]*conversation),
+		participants:  make(map[string][]participant),
+		messages:      make(map[string]*message),
+		reactions:     make(map[string][]models.Reaction),
+		linkPreviews:  make(map[string]models.LinkPreview),
+		blocks:        make(map[string]map[string]bool),
+		reports:       make(map[string]*models.Report),
+	}
+}
+
+// UploadPath returns the directory the uploaded photos are stored in
+func (r *MemoryRepository) UploadPath() string {
+	return r.uploadPath
+}
+
+// nextSeq returns an increasing number used to order rows created at the same time
+func (r *MemoryRepository) nextSeq() int {
+	r.seq++
+	return r.seq
+}
+
+// CreateUser implements UserRepository.CreateUser
+func (r *MemoryRepository) CreateUser(ctx context.Context, name string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Return the user with this name if it already exists
+	if user := r.userByName(name); user != nil {
+		u := copyUser(*user)
+		return &u, nil
+	}
+
+	user := &models.User{
+		ID:   uuid.New().String(),
+		Name: name,
+		Role: models.RegularUser,
+	}
+	r.keepUser(user.ID)
+	r.users[user.ID] = user
+
+	u := copyUser(*user)
+	return &u, nil
+}
+
+// userByName finds a user by name, the caller must hold the lock
+func (r *MemoryRepository) userByName(name string) *models.User {
+	for _, user := range r.users {
+		if user.Name == name {
+			return user
+		}
+	}
+	return nil
+}
+
+// GetUserByID implements UserRepository.GetUserByID
+func (r *MemoryRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, nil
+	}
+
+	u := currentUser(user)
+	return &u, nil
+}
+
+// GetUserByName implements UserRepository.GetUserByName
+func (r *MemoryRepository) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user := r.userByName(name)
+	if user == nil {
+		return nil, nil
+	}
+
+	u := currentUser(user)
+	return &u, nil
+}
+
+// UpdateUsername implements UserRepository.UpdateUsername
+func (r *MemoryRepository) UpdateUsername(ctx context.Context, userID string, newName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Check if name is already in use
+	if existingUser := r.userByName(newName); existingUser != nil && existingUser.ID != userID {
+		return fmt.Errorf("%w: username already in use", repository.ErrConflict)
+	}
+
+	if user, ok := r.users[userID]; ok {
+		r.keepUser(userID)
+		user.Name = newName
+	}
+	return nil
+}
+
+// SaveUserPhoto implements UserRepository.SaveUserPhoto
+func (r *MemoryRepository) SaveUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error) {
+	relativePath, err := uploads.SavePhoto(r.uploadPath, uploads.UserPhotos, userID, photo)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.users[userID]; ok {
+		r.keepUser(userID)
+		user.PhotoURL = relativePath
+	}
+	return relativePath, nil
+}
+
+// SearchUsers implements UserRepository.SearchUsers
+func (r *MemoryRepository) SearchUsers(ctx context.Context, viewerID string, filter models.UserFilter) ([]models.User, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var after *repository.UserCursor
+	if filter.Cursor != "" {
+		cursor, err := repository.DecodeUserCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &cursor
+	}
+
+	query := strings.ToLower(filter.Query)
+	var matched []repository.UserCursor
+	ids := make(map[string]string)
+	for id, user := range r.users {
+		name := strings.ToLower(user.Name)
+		if id == viewerID || r.blocks[viewerID][id] || r.blocks[id][viewerID] || !strings.Contains(name, query) {
+			continue
+		}
+		position := repository.UserCursor{Rank: 2, Name: user.Name}
+		if name == query {
+			position.Rank = 0
+		} else if strings.HasPrefix(name, query) {
+			position.Rank = 1
+		}
+		if after != nil && !userBefore(*after, position) {
+			continue
+		}
+		matched = append(matched, position)
+		ids[user.Name] = id
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return userBefore(matched[i], matched[j])
+	})
+
+	var next string
+	if filter.Limit > 0 && len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+		next = repository.EncodeCursor(matched[len(matched)-1])
+	}
+
+	var users []models.User
+	for _, position := range matched {
+		users = append(users, currentUser(r.users[ids[position.Name]]))
+	}
+	return users, next, nil
+}
+
+// userBefore tells whether a comes before b in the order of SearchUsers
+func userBefore(a, b repository.UserCursor) bool {
+	if a.Rank != b.Rank {
+		return a.Rank < b.Rank
+	}
+	return a.Name < b.Name
+}
+
+// UpdatePrivacySettings implements UserRepository.UpdatePrivacySettings
+func (r *MemoryRepository) UpdatePrivacySettings(ctx context.Context, userID string, hideLastSeen bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.users[userID]; ok {
+		r.keepUser(userID)
+		user.HideLastSeen = hideLastSeen
+	}
+	return nil
+}
+
+// UpdateProfile implements UserRepository.UpdateProfile
+func (r *MemoryRepository) UpdateProfile(ctx context.Context, userID string, profile models.Profile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.users[userID]; ok {
+		r.keepUser(userID)
+		user.Profile = copyProfile(profile)
+	}
+	return nil
+}
+
+// CreateDirectConversation implements ConversationRepository.CreateDirectConversation
+func (r *MemoryRepository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, bool, error) {
+	r.mu.Lock()
+
+	// Return the direct conversation between these users if it already exists
+	for id, conv := range r.conversations {
+		if conv.convType == models.DirectConversation && r.isParticipant(id, userID1) && r.isParticipant(id, userID2) {
+			r.mu.Unlock()
+			conv, err := r.GetConversationByID(ctx, id)
+			return conv, false, err
+		}
+	}
+
+	if err := r.checkUsersExist(userID1, userID2); err != nil {
+		r.mu.Unlock()
+		return nil, false, err
+	}
+
+	id := r.createConversation("", models.DirectConversation)
+	r.keepParticipants(id)
+	r.participants[id] = []participant{
+		{userID: userID1, role: models.MemberRole},
+		{userID: userID2, role: models.MemberRole},
+	}
+	r.mu.Unlock()
+
+	conv, err := r.GetConversationByID(ctx, id)
+	return conv, true, err
+}
+
+// CreateGroupConversation implements ConversationRepository.CreateGroupConversation
+func (r *MemoryRepository) CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error) {
+	r.mu.Lock()
+
+	if err := r.checkUsersExist(participants...); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+
+	id := r.createConversation(name, models.GroupConversation)
+	r.keepParticipants(id)
+
+	// Add participants, the creator being the group admin
+	seen := make(map[string]bool)
+	for _, userID := range participants {
+		if seen[userID] {
+			delete(r.conversations, id)
+			delete(r.participants, id)
+			r.mu.Unlock()
+			return nil, errors.New("duplicate participant")
+		}
+		seen[userID] = true
+
+		role := models.MemberRole
+		if userID == creatorID {
+			role = models.AdminRole
+		}
+		r.participants[id] = append(r.participants[id], participant{userID: userID, role: role})
+	}
+	r.mu.Unlock()
+
+	return r.GetConversationByID(ctx, id)
+}
+
+// createConversation stores a new conversation and returns its ID, the caller must hold the lock
+func (r *MemoryRepository) createConversation(name string, convType models.ConversationType) string {
+	id := uuid.New().String()
+	r.keepConversation(id)
+	r.conversations[id] = &conversation{
+		id:           id,
+		name:         name,
+		convType:     convType,
+		lastActivity: time.Now(),
+		seq:          r.nextSeq(),
+	}
+	return id
+}
+
+// checkUsersExist fails like a foreign key would when a user does not exist, the caller must hold the lock
+func (r *MemoryRepository) checkUsersExist(userIDs ...string) error {
+	for _, userID := range userIDs {
+		if _, ok := r.users[userID]; !ok {
+			return fmt.Errorf("user %w", repository.ErrNotFound)
+		}
+	}
+	return nil
+}
+
+// isParticipant reports whether a user is in a conversation, the caller must hold the lock
+func (r *MemoryRepository) isParticipant(conversationID, userID string) bool {
+	for _, p := range r.participants[conversationID] {
+		if p.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetConversationByID implements ConversationRepository.GetConversationByID
+func (r *MemoryRepository) GetConversationByID(ctx context.Context, id string) (*models.Conversation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.conversationByID(ctx, id), nil
+}
+
+// conversationByID builds a conversation with its participants and messages, the caller must hold the lock
+func (r *MemoryRepository) conversationByID(ctx context.Context, id string) *models.Conversation {
+	stored, ok := r.conversations[id]
+	if !ok {
+		return nil
+	}
+
+	conv := r.conversationSummary(stored)
+	conv.Messages = r.messagesWhere(func(m *message) bool {
+		return m.msg.ConversationID == id
+	}, false)
+
+	// Set the last message if there are any messages
+	if len(conv.Messages) > 0 {
+		lastMsg := conv.Messages[len(conv.Messages)-1]
+		conv.LastMessage = &lastMsg
+	}
+
+	return &conv
+}
+
+// conversationSummary builds a conversation with its participants but without its messages,
+// the caller must hold the lock
+func (r *MemoryRepository) conversationSummary(stored *conversation) models.Conversation {
+	conv := models.Conversation{
+		ID:       stored.id,
+		Name:     stored.name,
+		Type:     stored.convType,
+		PhotoURL: stored.photoURL,
+	}
+
+	for _, p := range r.participants[stored.id] {
+		user := r.users[p.userID]
+		conv.Participants = append(conv.Participants, models.Participant{
+			ID:           user.ID,
+			Name:         user.Name,
+			Profile:      copyProfile(user.Profile).Current(time.Now()),
+			PhotoURL:     user.PhotoURL,
+			Role:         p.role,
+			HideLastSeen: user.HideLastSeen,
+			Settings:     copySettings(p.settings),
+		})
+	}
+	return conv
+}
+
+// listPosition is where a conversation stands in the list of a user
+type listPosition struct {
+	pinPosition  *int
+	lastActivity time.Time
+	seq          int
+}
+
+// before tells whether a comes before b in the list: pinned first by position, then
+// the most recently active first
+func (a listPosition) before(b listPosition) bool {
+	if (a.pinPosition == nil) != (b.pinPosition == nil) {
+		return a.pinPosition != nil
+	}
+	if a.pinPosition != nil && *a.pinPosition != *b.pinPosition {
+		return *a.pinPosition < *b.pinPosition
+	}
+	if !a.lastActivity.Equal(b.lastActivity) {
+		return a.lastActivity.After(b.lastActivity)
+	}
+	return a.seq > b.seq
+}
+
+// GetConversationsByUserID implements ConversationRepository.GetConversationsByUserID
+func (r *MemoryRepository) GetConversationsByUserID(ctx context.Context, userID string, filter models.ConversationFilter) ([]models.Conversation, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var after *listPosition
+	if filter.Cursor != "" {
+		cursor, err := repository.DecodeConversationCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &listPosition{pinPosition: cursor.PinPosition, lastActivity: cursor.LastActivity}
+		if conv, ok := r.conversations[cursor.ID]; ok {
+			after.seq = conv.seq
+		}
+	}
+
+	var stored []*conversation
+	positions := make(map[string]listPosition)
+	for id, conv := range r.conversations {
+		settings, ok := r.settings(id, userID)
+		if !ok || settings.Archived != filter.Archived || !r.matches(conv, userID, filter) {
+			continue
+		}
+		position := listPosition{pinPosition: settings.PinPosition, lastActivity: conv.lastActivity, seq: conv.seq}
+		if after != nil && !after.before(position) {
+			continue
+		}
+		stored = append(stored, conv)
+		positions[id] = position
+	}
+
+	sort.Slice(stored, func(i, j int) bool {
+		return positions[stored[i].id].before(positions[stored[j].id])
+	})
+
+	var next string
+	if filter.Limit > 0 && len(stored) > filter.Limit {
+		stored = stored[:filter.Limit]
+		last := stored[len(stored)-1]
+		next = repository.EncodeCursor(repository.ConversationCursor{
+			PinPosition:  positions[last.id].pinPosition,
+			LastActivity: last.lastActivity,
+			ID:           last.id,
+		})
+	}
+
+	// The last message of each conversation of the page, in a single pass over the messages
+	last := make(map[string]*message, len(stored))
+	for _, conv := range stored {
+		last[conv.id] = nil
+	}
+	for _, m := range r.messages {
+		latest, ok := last[m.msg.ConversationID]
+		if !ok {
+			continue
+		}
+		if latest == nil || m.msg.Timestamp.After(latest.msg.Timestamp) ||
+			(m.msg.Timestamp.Equal(latest.msg.Timestamp) && m.seq > latest.seq) {
+			last[m.msg.ConversationID] = m
+		}
+	}
+	lastMessages := make(map[string]models.Message, len(stored))
+	for _, msg := range r.messagesWhere(func(m *message) bool {
+		return last[m.msg.ConversationID] == m
+	}, false) {
+		lastMessages[msg.ConversationID] = msg
+	}
+
+	var conversations []models.Conversation
+	for _, c := range stored {
+		conv := r.conversationSummary(c)
+		if msg, ok := lastMessages[conv.ID]; ok {
+			conv.LastMessage = &msg
+		}
+		conversations = append(conversations, conv)
+	}
+	return conversations, next, nil
+}
+
+// matches tells whether a conversation of the user passes the query, type and unread
+// conditions of filter. The caller must hold the lock.
+func (r *MemoryRepository) matches(conv *conversation, userID string, filter models.ConversationFilter) bool {
+	if filter.Type != "" && conv.convType != filter.Type {
+		return false
+	}
+	if filter.Query != "" {
+		// The user's own name would match all of their conversations
+		query := strings.ToLower(filter.Query)
+		found := strings.Contains(strings.ToLower(conv.name), query)
+		for _, p := range r.participants[conv.id] {
+			if p.userID != userID && strings.Contains(strings.ToLower(r.users[p.userID].Name), query) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Unread {
+		for _, m := range r.messages {
+			if m.msg.ConversationID == conv.id && m.msg.Sender.ID != userID && m.msg.Status != models.Read &&
+				m.msg.DeletedAt == nil && m.msg.HiddenAt == nil {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// settings returns the settings of a participant, false when the user is not one.
+// The caller must hold the lock.
+func (r *MemoryRepository) settings(conversationID, userID string) (models.ConversationSettings, bool) {
+	for _, p := range r.participants[conversationID] {
+		if p.userID == userID {
+			return p.settings, true
+		}
+	}
+	return models.ConversationSettings{}, false
+}
+
+// UpdateConversationSettings implements ConversationRepository.UpdateConversationSettings
+func (r *MemoryRepository) UpdateConversationSettings(ctx context.Context, conversationID, userID string, settings models.ConversationSettings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keepParticipants(conversationID)
+	for i, p := range r.participants[conversationID] {
+		if p.userID == userID {
+			r.participants[conversationID][i].settings = copySettings(settings)
+		}
+	}
+	return nil
+}
+
+// GetLastPinPosition implements ConversationRepository.GetLastPinPosition
+func (r *MemoryRepository) GetLastPinPosition(ctx context.Context, userID string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	last := 0
+	for _, participants := range r.participants {
+		for _, p := range participants {
+			if p.userID == userID && p.settings.PinPosition != nil && *p.settings.PinPosition > last {
+				last = *p.settings.PinPosition
+			}
+		}
+	}
+	return last, nil
+}
+
+// group returns a stored group conversation, the caller must hold the lock
+func (r *MemoryRepository) group(groupID string) (*conversation, error) {
+	conv, ok := r.conversations[groupID]
+	if !ok {
+		return nil, fmt.Errorf("conversation %w", repository.ErrNotFound)
+	}
+	if conv.convType != models.GroupConversation {
+		return nil, errors.New("conversation is not a group")
+	}
+	return conv, nil
+}
+
+// AddUserToGroup implements ConversationRepository.AddUserToGroup
+func (r *MemoryRepository) AddUserToGroup(ctx context.Context, groupID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.group(groupID); err != nil {
+		return err
+	}
+	if r.isParticipant(groupID, userID) {
+		return fmt.Errorf("%w: user is already in the group", repository.ErrConflict)
+	}
+	if err := r.checkUsersExist(userID); err != nil {
+		return err
+	}
+
+	r.keepParticipants(groupID)
+	r.participants[groupID] = append(r.participants[groupID], participant{userID: userID, role: models.MemberRole})
+	return nil
+}
+
+// RemoveUserFromGroup implements ConversationRepository.RemoveUserFromGroup
+func (r *MemoryRepository) RemoveUserFromGroup(ctx context.Context, groupID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.group(groupID); err != nil {
+		return err
+	}
+
+	participants := r.participants[groupID]
+	for i, p := range participants {
+		if p.userID == userID {
+			r.keepParticipants(groupID)
+			r.participants[groupID] = append(participants[:i:i], participants[i+1:]...)
+			r.keepAdmin(groupID)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: user is not in the group", repository.ErrNotFound)
+}
+
+// keepAdmin makes the member who joined a group first its admin when it has none left.
+// The caller must hold the lock.
+func (r *MemoryRepository) keepAdmin(groupID string) {
+	participants := r.participants[groupID]
+	for _, p := range participants {
+		if p.role == models.AdminRole {
+			return
+		}
+	}
+	if len(participants) > 0 {
+		participants[0].role = models.AdminRole
+	}
+}
+
+// UpdateGroupName implements ConversationRepository.UpdateGroupName
+func (r *MemoryRepository) UpdateGroupName(ctx context.Context, groupID, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, err := r.group(groupID)
+	if err != nil {
+		return err
+	}
+	r.keepConversation(groupID)
+	conv.name = name
+	return nil
+}
+
+// SaveGroupPhoto implements ConversationRepository.SaveGroupPhoto
+func (r *MemoryRepository) SaveGroupPhoto(ctx context.Context, groupID string, photo multipart.File) (string, error) {
+	r.mu.RLock()
+	_, err := r.group(groupID)
+	r.mu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	relativePath, err := uploads.SavePhoto(r.uploadPath, uploads.GroupPhotos, groupID, photo)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if conv, ok := r.conversations[groupID]; ok {
+		r.keepConversation(groupID)
+		conv.photoURL = relativePath
+	}
+	return relativePath, nil
+}
+
+// CreateMessage implements MessageRepository.CreateMessage
+func (r *MemoryRepository) CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conv, ok := r.conversations[conversationID]
+	if !ok {
+		return nil, fmt.Errorf("conversation %w", repository.ErrNotFound)
+	}
+	if err := r.checkUsersExist(msg.Sender.ID); err != nil {
+		return nil, err
+	}
+
+	msg.ID = uuid.New().String()
+	// As the unique index of the databases
+	if msg.ClientMessageID != "" {
+		for _, m := range r.messages {
+			if m.msg.Sender.ID == msg.Sender.ID && m.msg.ClientMessageID == msg.ClientMessageID {
+				return nil, errors.New("client message ID already used by the sender")
+			}
+		}
+	}
+	msg.ConversationID = conversationID
+
+	// If no timestamp provided, use current time
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	stored := copyMessage(msg)
+	stored.Sender = models.User{ID: msg.Sender.ID}
+	stored.Reactions = nil
+	stored.LinkPreview = nil
+	stored.ReplyPreview = nil
+	stored.Mentions = sortedMentions(msg.Mentions)
+	r.keepMessage(msg.ID)
+	r.messages[msg.ID] = &message{msg: stored, seq: r.nextSeq()}
+
+	// Update the last activity timestamp of the conversation
+	r.keepConversation(conversationID)
+	conv.lastActivity = msg.Timestamp
+
+	// Bring the conversation back from the archives of the participants not muting it
+	r.keepParticipants(conversationID)
+	for i, p := range r.participants[conversationID] {
+		if p.settings.Archived && !p.settings.MutedAt(msg.Timestamp) {
+			settings := copySettings(p.settings)
+			settings.Archived = false
+			r.participants[conversationID][i].settings = settings
+		}
+	}
+
+	created := r.messagesWhere(func(m *message) bool { return m.msg.ID == msg.ID }, false)
+	return &created[0], nil
+}
+
+// GetMessageByClientID implements MessageRepository.GetMessageByClientID
+func (r *MemoryRepository) GetMessageByClientID(ctx context.Context, senderID, clientMessageID string) (*models.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	messages := r.messagesWhere(func(m *message) bool {
+		return clientMessageID != "" && m.msg.Sender.ID == senderID && m.msg.ClientMessageID == clientMessageID
+	}, false)
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	return &messages[0], nil
+}
+
+// GetMessagesByConversationID implements MessageRepository.GetMessagesByConversationID
+func (r *MemoryRepository) GetMessagesByConversationID(ctx context.Context, conversationID string) ([]models.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.messagesWhere(func(m *message) bool {
+		return m.msg.ConversationID == conversationID
+	}, false), nil
+}
+
+// messagesWhere returns the messages matching keep with their sender, reactions,
+// mentions and link preview, oldest first unless newestFirst. The caller must hold the lock.
+func (r *MemoryRepository) messagesWhere(keep func(m *message) bool, newestFirst bool) []models.Message {
+	var matched []*message
+	for _, m := range r.messages {
+		if keep(m) {
+			matched = append(matched, m)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if newestFirst {
+			a, b = b, a
+		}
+		if !a.msg.Timestamp.Equal(b.msg.Timestamp) {
+			return a.msg.Timestamp.Before(b.msg.Timestamp)
+		}
+		return a.seq < b.seq
+	})
+
+	var messages []models.Message
+	for _, m := range matched {
+		msg := copyMessage(m.msg)
+		msg.Sender = currentUser(r.users[msg.Sender.ID]).Public()
+		msg.Reactions = append([]models.Reaction(nil), r.reactions[msg.ID]...)
+
+		// The content of hidden messages is kept for unhiding them, but never read back
+		if msg.HiddenAt != nil {
+			msg.Content = ""
+			msg.Mentions = nil
+		} else if preview, ok := r.linkPreviews[m.linkPreviewURL]; ok {
+			preview.FetchedAt = time.Time{}
+			msg.LinkPreview = &preview
+		}
+		if msg.ReplyTo != nil {
+			msg.ReplyPreview = r.replyPreview(*msg.ReplyTo)
+		}
+
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// replyPreview returns the preview of the message replied to, nil when it is gone.
+// The caller must hold the lock.
+func (r *MemoryRepository) replyPreview(id string) *models.ReplyPreview {
+	m, ok := r.messages[id]
+	if !ok {
+		return nil
+	}
+	preview := &models.ReplyPreview{
+		Sender: models.User{ID: m.msg.Sender.ID, Name: r.users[m.msg.Sender.ID].Name},
+		Type:   m.msg.Type,
+	}
+	if m.msg.DeletedAt == nil && m.msg.HiddenAt == nil {
+		preview.Content = m.msg.Content
+		if content := []rune(preview.Content); len(content) > models.ReplyPreviewLength {
+			preview.Content = string(content[:models.ReplyPreviewLength])
+		}
+	}
+	return preview
+}
+
+// GetMessageByID implements MessageRepository.GetMessageByID
+func (r *MemoryRepository) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	messages := r.messagesWhere(func(m *message) bool { return m.msg.ID == id }, false)
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	return &messages[0], nil
+}
+
+// DeleteMessage implements MessageRepository.DeleteMessage
+func (r *MemoryRepository) DeleteMessage(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Soft delete by setting the deleted timestamp
+	if m, ok := r.messages[id]; ok {
+		r.keepMessage(id)
+		now := time.Now()
+		m.msg.DeletedAt = &now
+	}
+	return nil
+}
+
+// UpdateMessageStatus implements MessageRepository.UpdateMessageStatus
+func (r *MemoryRepository) UpdateMessageStatus(ctx context.Context, id string, status models.MessageStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.messages[id]; ok {
+		r.keepMessage(id)
+		m.msg.Status = status
+	}
+	return nil
+}
+
+// UpdateMessageContent implements MessageRepository.UpdateMessageContent
+func (r *MemoryRepository) UpdateMessageContent(ctx context.Context, id string, content string, mentions []models.Mention) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.messages[id]; ok {
+		r.keepMessage(id)
+		m.msg.Content = content
+		// Replace the mentions of the previous content
+		m.msg.Mentions = sortedMentions(mentions)
+	}
+	return nil
+}
+
+// SaveMessagePhoto implements MessageRepository.SaveMessagePhoto
+func (r *MemoryRepository) SaveMessagePhoto(ctx context.Context, senderID string, photo multipart.File) (string, error) {
+	return uploads.SavePhoto(r.uploadPath, uploads.MessagePhotos, senderID, photo)
+}
+
+// AddReaction implements ReactionRepository.AddReaction
+func (r *MemoryRepository) AddReaction(ctx context.Context, messageID, userID, emoji string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.messages[messageID]; !ok {
+		return fmt.Errorf("message %w", repository.ErrNotFound)
+	}
+	if err := r.checkUsersExist(userID); err != nil {
+		return err
+	}
+
+	// Update the existing reaction of the user, if any
+	r.keepReactions(messageID)
+	reactions := r.reactions[messageID]
+	for i := range reactions {
+		if reactions[i].UserID == userID {
+			reactions[i].Emoji = emoji
+			return nil
+		}
+	}
+
+	r.reactions[messageID] = append(reactions, models.Reaction{MessageID: messageID, UserID: userID, Emoji: emoji})
+	return nil
+}
+
+// RemoveReaction implements ReactionRepository.RemoveReaction
+func (r *MemoryRepository) RemoveReaction(ctx context.Context, messageID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reactions := r.reactions[messageID]
+	for i, reaction := range reactions {
+		if reaction.UserID == userID {
+			r.keepReactions(messageID)
+			r.reactions[messageID] = append(reactions[:i:i], reactions[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("reaction %w", repository.ErrNotFound)
+}
+
+// GetReactionsByMessageID implements ReactionRepository.GetReactionsByMessageID
+func (r *MemoryRepository) GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]models.Reaction(nil), r.reactions[messageID]...), nil
+}
+
+// GetMentionsByMessageID implements MentionRepository.GetMentionsByMessageID
+func (r *MemoryRepository) GetMentionsByMessageID(ctx context.Context, messageID string) ([]models.Mention, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.messages[messageID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]models.Mention(nil), m.msg.Mentions...), nil
+}
+
+// GetMentionedMessages implements MentionRepository.GetMentionedMessages
+func (r *MemoryRepository) GetMentionedMessages(ctx context.Context, userID string) ([]models.Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.messagesWhere(func(m *message) bool {
+		// @all mentions only count for conversations the user is still part of
+		if m.msg.DeletedAt != nil || m.msg.HiddenAt != nil || m.msg.Sender.ID == userID ||
+			!r.isParticipant(m.msg.ConversationID, userID) {
+			return false
+		}
+		for _, mention := range m.msg.Mentions {
+			if mention.All || mention.UserID == userID {
+				return true
+			}
+		}
+		return false
+	}, true), nil
+}
+
+// GetLinkPreview implements LinkPreviewRepository.GetLinkPreview
+func (r *MemoryRepository) GetLinkPreview(ctx context.Context, url string) (*models.LinkPreview, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	preview, ok := r.linkPreviews[url]
+	if !ok {
+		return nil, nil
+	}
+	return &preview, nil
+}
+
+// SaveLinkPreview implements LinkPreviewRepository.SaveLinkPreview
+func (r *MemoryRepository) SaveLinkPreview(ctx context.Context, preview models.LinkPreview) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if preview.FetchedAt.IsZero() {
+		preview.FetchedAt = time.Now()
+	}
+	r.keepLinkPreview(preview.URL)
+	r.linkPreviews[preview.URL] = preview
+	return nil
+}
+
+// SetMessageLinkPreview implements LinkPreviewRepository.SetMessageLinkPreview
+func (r *MemoryRepository) SetMessageLinkPreview(ctx context.Context, messageID, url string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if url != "" {
+		if _, ok := r.linkPreviews[url]; !ok {
+			return fmt.Errorf("link preview %w", repository.ErrNotFound)
+		}
+	}
+	if m, ok := r.messages[messageID]; ok {
+		r.keepMessage(messageID)
+		m.linkPreviewURL = url
+	}
+	return nil
+}
+
+// BlockUser implements BlockRepository.BlockUser
+func (r *MemoryRepository) BlockUser(ctx context.Context, blockerID, blockedID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if blockerID == blockedID {
+		return errors.New("users cannot block themselves")
+	}
+	if err := r.checkUsersExist(blockerID, blockedID); err != nil {
+		return err
+	}
+
+	r.keepBlocks(blockerID)
+	if r.blocks[blockerID] == nil {
+		r.blocks[blockerID] = make(map[string]bool)
+	}
+	r.blocks[blockerID][blockedID] = true
+	return nil
+}
+
+// UnblockUser implements BlockRepository.UnblockUser
+func (r *MemoryRepository) UnblockUser(ctx context.Context, blockerID, blockedID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.blocks[blockerID][blockedID] {
+		return fmt.Errorf("%w: user is not blocked", repository.ErrNotFound)
+	}
+	r.keepBlocks(blockerID)
+	delete(r.blocks[blockerID], blockedID)
+	return nil
+}
+
+// IsBlocked implements BlockRepository.IsBlocked
+func (r *MemoryRepository) IsBlocked(ctx context.Context, blockerID, blockedID string) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.blocks[blockerID][blockedID], nil
+}
+
+// GetBlockedUserIDs implements BlockRepository.GetBlockedUserIDs
+func (r *MemoryRepository) GetBlockedUserIDs(ctx context.Context, blockerID string) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var blockedIDs []string
+	for blockedID := range r.blocks[blockerID] {
+		blockedIDs = append(blockedIDs, blockedID)
+	}
+	sort.Strings(blockedIDs)
+	return blockedIDs, nil
+}
+
+// GetBlockerIDs implements BlockRepository.GetBlockerIDs
+func (r *MemoryRepository) GetBlockerIDs(ctx context.Context, blockedID string) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var blockerIDs []string
+	for blockerID, blocked := range r.blocks {
+		if blocked[blockedID] {
+			blockerIDs = append(blockerIDs, blockerID)
+		}
+	}
+	sort.Strings(blockerIDs)
+	return blockerIDs, nil
+}
+
+// CreateReport implements ModerationRepository.CreateReport
+func (r *MemoryRepository) CreateReport(ctx context.Context, report models.Report) (*models.Report, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report.ID = uuid.New().String()
+	report.Status = models.OpenReport
+	report.CreatedAt = time.Now()
+
+	stored := copyReport(report)
+	r.keepReport(report.ID)
+	r.reports[report.ID] = &stored
+	r.reportOrder = append(r.reportOrder, report.ID)
+
+	return &report, nil
+}
+
+// GetReportByID implements ModerationRepository.GetReportByID
+func (r *MemoryRepository) GetReportByID(ctx context.Context, id string) (*models.Report, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	report, ok := r.reports[id]
+	if !ok {
+		return nil, nil
+	}
+
+	rep := copyReport(*report)
+	return &rep, nil
+}
+
+// GetReports implements ModerationRepository.GetReports
+func (r *MemoryRepository) GetReports(ctx context.Context, status models.ReportStatus) ([]models.Report, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Reports are stored oldest first
+	var reports []models.Report
+	for _, id := range r.reportOrder {
+		report := r.reports[id]
+		if status == "" || report.Status == status {
+			reports = append(reports, copyReport(*report))
+		}
+	}
+	return reports, nil
+}
+
+// CloseReport implements ModerationRepository.CloseReport
+func (r *MemoryRepository) CloseReport(ctx context.Context, id string, status models.ReportStatus, moderatorID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report, ok := r.reports[id]
+	if !ok {
+		return fmt.Errorf("report %w", repository.ErrNotFound)
+	}
+
+	r.keepReport(id)
+	now := time.Now()
+	report.Status = status
+	report.ResolvedAt = &now
+	report.ResolvedBy = moderatorID
+	return nil
+}
+
+// SetMessageHidden implements ModerationRepository.SetMessageHidden
+func (r *MemoryRepository) SetMessageHidden(ctx context.Context, messageID string, hidden bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.messages[messageID]; ok {
+		r.keepMessage(messageID)
+		m.msg.HiddenAt = nil
+		if hidden {
+			now := time.Now()
+			m.msg.HiddenAt = &now
+		}
+	}
+	return nil
+}
+
+// SetUserSuspended implements ModerationRepository.SetUserSuspended
+func (r *MemoryRepository) SetUserSuspended(ctx context.Context, userID string, suspended bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.users[userID]; ok {
+		r.keepUser(userID)
+		user.SuspendedAt = nil
+		if suspended {
+			now := time.Now()
+			user.SuspendedAt = &now
+		}
+	}
+	return nil
+}
+
+// CreateModerationAction implements ModerationRepository.CreateModerationAction
+func (r *MemoryRepository) CreateModerationAction(ctx context.Context, action models.ModerationAction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if action.ID == "" {
+		action.ID = uuid.New().String()
+	}
+	if action.CreatedAt.IsZero() {
+		action.CreatedAt = time.Now()
+	}
+	r.actions = append(r.actions, action)
+	return nil
+}
+
+// GetModerationActions implements ModerationRepository.GetModerationActions
+func (r *MemoryRepository) GetModerationActions(ctx context.Context) ([]models.ModerationAction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Newest first, actions being appended in creation order
+	var actions []models.ModerationAction
+	for i := len(r.actions) - 1; i >= 0; i-- {
+		actions = append(actions, r.actions[i])
+	}
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].CreatedAt.After(actions[j].CreatedAt)
+	})
+	return actions, nil
+}
+
+// copyUser returns a copy of a user sharing no memory with it
+func copyUser(user models.User) models.User {
+	if user.SuspendedAt != nil {
+		suspendedAt := *user.SuspendedAt
+		user.SuspendedAt = &suspendedAt
+	}
+	user.Profile = copyProfile(user.Profile)
+	return user
+}
+
+// currentUser returns a copy of a stored user as it stands now, see models.Profile.Current
+func currentUser(user *models.User) models.User {
+	u := copyUser(*user)
+	u.Profile = u.Profile.Current(time.Now())
+	return u
+}
+
+// copyProfile returns a copy of a profile sharing no memory with it
+func copyProfile(profile models.Profile) models.Profile {
+	if profile.StatusExpiresAt != nil {
+		expiresAt := *profile.StatusExpiresAt
+		profile.StatusExpiresAt = &expiresAt
+	}
+	return profile
+}
+
+// copySettings returns a copy of conversation settings sharing no memory with them
+func copySettings(settings models.ConversationSettings) models.ConversationSettings {
+	if settings.MutedUntil != nil {
+		mutedUntil := *settings.MutedUntil
+		settings.MutedUntil = &mutedUntil
+	}
+	if settings.PinPosition != nil {
+		position := *settings.PinPosition
+		settings.PinPosition = &position
+	}
+	return settings
+}
+
+// copyMessage returns a copy of a message sharing no memory with it
+func copyMessage(msg models.Message) models.Message {
+	if msg.ReplyTo != nil {
+		replyTo := *msg.ReplyTo
+		msg.ReplyTo = &replyTo
+	}
+	if msg.DeletedAt != nil {
+		deletedAt := *msg.DeletedAt
+		msg.DeletedAt = &deletedAt
+	}
+	if msg.HiddenAt != nil {
+		hiddenAt := *msg.HiddenAt
+		msg.HiddenAt = &hiddenAt
+	}
+	if msg.LinkPreview != nil {
+		preview := *msg.LinkPreview
+		msg.LinkPreview = &preview
+	}
+	if msg.ReplyPreview != nil {
+		preview := *msg.ReplyPreview
+		msg.ReplyPreview = &preview
+	}
+	msg.Sender = copyUser(msg.Sender)
+	msg.Reactions = append([]models.Reaction(nil), msg.Reactions...)
+	msg.Mentions = append([]models.Mention(nil), msg.Mentions...)
+	return msg
+}
+
+// copyReport returns a copy of a report sharing no memory with it
+func copyReport(report models.Report) models.Report {
+	if report.ResolvedAt != nil {
+		resolvedAt := *report.ResolvedAt
+		report.ResolvedAt = &resolvedAt
+	}
+	report.Snapshot = append([]byte(nil), report.Snapshot...)
+	return report
+}
+
+// sortedMentions returns a copy of mentions ordered by offset
+func sortedMentions(mentions []models.Mention) []models.Mention {
+	sorted := append([]models.Mention(nil), mentions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+	return sorted
+}
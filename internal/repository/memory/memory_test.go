@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repository.Repository {
+		return NewMemoryRepository(t.TempDir())
+	})
+}
@@ -0,0 +1,130 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// undoLog restores the entries changed by a transaction, undone in reverse order
+type undoLog []func()
+
+// WithTx implements repository.Transactor.WithTx. The transaction holds the lock of
+// the repository, so other calls wait for it, and changes its content in place, keeping
+// the previous value of every entry it changes to restore them when fn fails. Transactions
+// are therefore serializable and never retried. fn must not call the repository the
+// transaction was started from.
+func (r *MemoryRepository) WithTx(ctx context.Context, fn func(repo repository.Repository) error) error {
+	if r.undo != nil {
+		return fn(r)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The transaction shares the maps of r, but has its own lock since r's is held
+	txRepo := &MemoryRepository{
+		uploadPath:    r.uploadPath,
+		seq:           r.seq,
+		undo:          &undoLog{},
+		users:         r.users,
+		conversations: r.conversations,
+		participants:  r.participants,
+		messages:      r.messages,
+		reactions:     r.reactions,
+		linkPreviews:  r.linkPreviews,
+		blocks:        r.blocks,
+		reports:       r.reports,
+		reportOrder:   r.reportOrder,
+		actions:       r.actions,
+	}
+	if err := fn(txRepo); err != nil {
+		undo := *txRepo.undo
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return err
+	}
+
+	r.seq = txRepo.seq
+	r.reportOrder = txRepo.reportOrder
+	r.actions = txRepo.actions
+	return nil
+}
+
+// keep records in the undo log of the transaction how to restore the entry of key in m,
+// saving a copy of its value made by copyValue. Outside of transactions it does nothing.
+func keep[K comparable, V any](r *MemoryRepository, m map[K]V, key K, copyValue func(V) V) {
+	if r.undo == nil {
+		return
+	}
+	saved, ok := m[key]
+	if ok {
+		saved = copyValue(saved)
+	}
+	*r.undo = append(*r.undo, func() {
+		if ok {
+			m[key] = saved
+		} else {
+			delete(m, key)
+		}
+	})
+}
+
+// The methods below record an entry about to be changed with keep, the caller must hold the lock
+
+func (r *MemoryRepository) keepUser(id string) {
+	keep(r, r.users, id, func(user *models.User) *models.User {
+		copied := copyUser(*user)
+		return &copied
+	})
+}
+
+func (r *MemoryRepository) keepConversation(id string) {
+	keep(r, r.conversations, id, func(conv *conversation) *conversation {
+		copied := *conv
+		return &copied
+	})
+}
+
+func (r *MemoryRepository) keepParticipants(conversationID string) {
+	keep(r, r.participants, conversationID, func(participants []participant) []participant {
+		return append([]participant(nil), participants...)
+	})
+}
+
+func (r *MemoryRepository) keepMessage(id string) {
+	keep(r, r.messages, id, func(m *message) *message {
+		return &message{msg: copyMessage(m.msg), linkPreviewURL: m.linkPreviewURL, seq: m.seq}
+	})
+}
+
+func (r *MemoryRepository) keepReactions(messageID string) {
+	keep(r, r.reactions, messageID, func(reactions []models.Reaction) []models.Reaction {
+		return append([]models.Reaction(nil), reactions...)
+	})
+}
+
+func (r *MemoryRepository) keepLinkPreview(url string) {
+	keep(r, r.linkPreviews, url, func(preview models.LinkPreview) models.LinkPreview {
+		return preview
+	})
+}
+
+func (r *MemoryRepository) keepBlocks(blockerID string) {
+	keep(r, r.blocks, blockerID, func(blocked map[string]bool) map[string]bool {
+		copied := make(map[string]bool, len(blocked))
+		for blockedID := range blocked {
+			copied[blockedID] = true
+		}
+		return copied
+	})
+}
+
+func (r *MemoryRepository) keepReport(id string) {
+	keep(r, r.reports, id, func(report *models.Report) *models.Report {
+		copied := copyReport(*report)
+		return &copied
+	})
+}
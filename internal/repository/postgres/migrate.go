@@ -0,0 +1,285 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations, named <version>_<name>.up.sql and
+// <version>_<name>.down.sql. Versions are applied in increasing order.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of the advisory lock held while migrating, so that
+// several server replicas starting together don't apply the same migration twice
+const migrationLockID int64 = 0x77617361 // "wasa"
+
+// Migration is a versioned change of the database schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells whether a migration has been applied, and when
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations ordered by version
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(fileName, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name: %s", fileName)
+		}
+		versionPart, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name: %s", fileName)
+		}
+		version, err := strconv.Atoi(versionPart)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version: %s", fileName)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// MigrateUp applies the pending migrations and returns how many were applied
+func MigrateUp(ctx context.Context, db *sql.DB) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+			)`)
+		if err != nil {
+			return err
+		}
+
+		done, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			err := runInTx(ctx, conn, m.Up,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// MigrateDown rolls back the last steps applied migrations and returns how many were rolled back
+func MigrateDown(ctx context.Context, db *sql.DB, steps int) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	rolledBack := 0
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		done, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && rolledBack < steps; i-- {
+			m := migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+			err := runInTx(ctx, conn, m.Down,
+				"DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			if err != nil {
+				return fmt.Errorf("rollback of migration %d_%s failed: %w", m.Version, m.Name, err)
+			}
+			rolledBack++
+		}
+		return nil
+	})
+
+	return rolledBack, err
+}
+
+// GetMigrationStatus lists every known migration along with when it was applied
+func GetMigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	done, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if appliedAt, ok := done[m.Version]; ok {
+			s.AppliedAt = &appliedAt
+		}
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration advisory lock.
+// Advisory locks belong to a session, so the lock and the migrations must share the connection.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	// Unlock even if ctx was cancelled, otherwise the lock lives as long as the pooled connection
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	return fn(conn)
+}
+
+// appliedMigrations returns the applied migration versions with the time they were applied.
+// It only reads, as it also serves the readiness probe: before the first migration, the
+// table of the applied migrations does not exist and none is applied.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	var exists bool
+	if err := conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	done := make(map[int]time.Time)
+	if !exists {
+		return done, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		done[version] = appliedAt
+	}
+
+	return done, rows.Err()
+}
+
+// runInTx runs a migration script and the statement recording it in one transaction
+func runInTx(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CheckMigrations reports an error when some schema migrations are not applied, as
+// after rolling them back with "server migrate down"
+func (r *PostgresRepository) CheckMigrations(ctx context.Context) error {
+	status, err := GetMigrationStatus(ctx, r.db)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			pending = append(pending, fmt.Sprintf("%04d_%s", s.Version, s.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("pending migrations: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
@@ -1,3 +1,6 @@
+-- Schema of the databases created before migrations existed, from the former
+-- schema.sql. Every statement is idempotent so those databases are adopted as is.
+
 CREATE TABLE IF NOT EXISTS users (
     id VARCHAR(36) PRIMARY KEY,
     name VARCHAR(16) NOT NULL UNIQUE,
@@ -55,4 +58,4 @@ CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation
 CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp);
 CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to);
 CREATE INDEX IF NOT EXISTS idx_messages_sender_id ON messages(sender_id);
-CREATE INDEX IF NOT EXISTS idx_reactions_message_id ON reactions(message_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_reactions_message_id ON reactions(message_id);
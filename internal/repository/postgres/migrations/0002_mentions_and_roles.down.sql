@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS message_mentions;
+ALTER TABLE conversation_participants DROP COLUMN IF EXISTS role;
@@ -0,0 +1,14 @@
+-- Role of a participant in a conversation, the creator of a group is its admin
+ALTER TABLE conversation_participants
+    ADD COLUMN IF NOT EXISTS role VARCHAR(10) NOT NULL DEFAULT 'member' CHECK (role IN ('member', 'admin'));
+
+-- Mentions of users inside text messages
+CREATE TABLE IF NOT EXISTS message_mentions (
+    message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE, -- NULL for @all
+    start_offset INTEGER NOT NULL,
+    length INTEGER NOT NULL,
+    PRIMARY KEY (message_id, start_offset)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_mentions_user_id ON message_mentions(user_id);
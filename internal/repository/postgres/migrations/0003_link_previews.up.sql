@@ -0,0 +1,11 @@
+-- Link previews cache, keyed by URL
+CREATE TABLE IF NOT EXISTS link_previews (
+    url TEXT PRIMARY KEY,
+    title TEXT,
+    description TEXT,
+    image_url TEXT,
+    fetched_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS link_preview_url TEXT REFERENCES link_previews(url) ON DELETE SET NULL;
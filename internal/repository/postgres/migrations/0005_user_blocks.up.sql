@@ -0,0 +1,10 @@
+-- Users blocked by other users
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    blocked_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (blocker_id, blocked_id),
+    CHECK (blocker_id <> blocked_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked_id ON user_blocks(blocked_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS moderation_actions;
+DROP TABLE IF EXISTS reports;
+ALTER TABLE messages DROP COLUMN IF EXISTS hidden_at;
+ALTER TABLE users DROP COLUMN IF EXISTS suspended_at, DROP COLUMN IF EXISTS role;
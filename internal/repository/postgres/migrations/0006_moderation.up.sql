@@ -0,0 +1,36 @@
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS role VARCHAR(10) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator')),
+    ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP WITH TIME ZONE;
+
+-- Reports of messages and users, with a snapshot of the reported content
+CREATE TABLE IF NOT EXISTS reports (
+    id VARCHAR(36) PRIMARY KEY,
+    reporter_id VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL,
+    target_type VARCHAR(10) NOT NULL CHECK (target_type IN ('message', 'user')),
+    message_id VARCHAR(36) REFERENCES messages(id) ON DELETE SET NULL,
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL,
+    reason VARCHAR(20) NOT NULL CHECK (reason IN ('spam', 'harassment', 'inappropriate', 'other')),
+    details TEXT,
+    snapshot JSONB NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved', 'dismissed')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    resolved_by VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Audit log of moderator actions
+CREATE TABLE IF NOT EXISTS moderation_actions (
+    id VARCHAR(36) PRIMARY KEY,
+    moderator_id VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('hide_message', 'unhide_message', 'suspend_user', 'unsuspend_user', 'resolve_report', 'dismiss_report')),
+    target_id VARCHAR(36) NOT NULL,
+    report_id VARCHAR(36) REFERENCES reports(id) ON DELETE SET NULL,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_reports_status_created_at ON reports(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_moderation_actions_created_at ON moderation_actions(created_at);
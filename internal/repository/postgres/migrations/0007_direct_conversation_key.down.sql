@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_conversations_direct_key;
+ALTER TABLE conversations DROP COLUMN IF EXISTS direct_key;
@@ -0,0 +1,22 @@
+-- Key of a direct conversation, the IDs of its two users in increasing order joined
+-- by ':'. The unique index allows a single direct conversation per pair of users.
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS direct_key TEXT;
+
+-- Only the oldest conversation of each pair gets its key. Duplicates created before
+-- the index keep a NULL key until "server repair-direct" merges them into it.
+UPDATE conversations
+SET direct_key = keyed.direct_key
+FROM (
+    SELECT id, direct_key,
+           ROW_NUMBER() OVER (PARTITION BY direct_key ORDER BY created_at, id) AS position
+    FROM (
+        SELECT c.id, c.created_at, MIN(p.user_id) || ':' || MAX(p.user_id) AS direct_key
+        FROM conversations c
+        JOIN conversation_participants p ON p.conversation_id = c.id
+        WHERE c.type = 'direct'
+        GROUP BY c.id, c.created_at
+    ) pairs
+) keyed
+WHERE conversations.id = keyed.id AND keyed.position = 1;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_conversations_direct_key ON conversations(direct_key);
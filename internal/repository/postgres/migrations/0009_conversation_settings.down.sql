@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_conversation_participants_user_archived;
+ALTER TABLE conversation_participants
+    DROP COLUMN IF EXISTS pin_position,
+    DROP COLUMN IF EXISTS muted_until,
+    DROP COLUMN IF EXISTS archived;
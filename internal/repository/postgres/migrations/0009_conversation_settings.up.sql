@@ -0,0 +1,10 @@
+-- Preferences of each participant for a conversation: archived conversations are
+-- listed apart, muted ones stay archived when a message arrives, and pinned ones are
+-- listed first by position.
+ALTER TABLE conversation_participants
+    ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS muted_until TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS pin_position INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_conversation_participants_user_archived
+    ON conversation_participants(user_id, archived);
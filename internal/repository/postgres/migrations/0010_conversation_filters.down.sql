@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_conversations_last_activity_id;
+DROP INDEX IF EXISTS idx_messages_conversation_unread;
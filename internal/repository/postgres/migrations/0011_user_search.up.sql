@@ -0,0 +1,5 @@
+-- The user directory matches any part of the names, in any case, which a trigram
+-- index serves for ILIKE, prefixes included.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING GIN (name gin_trgm_ops);
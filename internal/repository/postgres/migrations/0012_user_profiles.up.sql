@@ -0,0 +1,7 @@
+-- What users tell the others about themselves, next to the unique name they log in
+-- with. The status text is no longer shown after status_expires_at.
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS display_name VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS bio TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS status_text VARCHAR(100) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS status_expires_at TIMESTAMP WITH TIME ZONE;
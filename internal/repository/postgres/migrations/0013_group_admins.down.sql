@@ -0,0 +1,2 @@
+-- The admins given by the up migration are kept, as nothing tells them apart
+-- from the others.
@@ -0,0 +1,14 @@
+-- Groups created before roles existed, or whose admins all left, have no admin, so
+-- nobody could use @all in them. The member who joined first becomes their admin.
+UPDATE conversation_participants SET role = 'admin'
+WHERE conversation_id IN (SELECT id FROM conversations WHERE type = 'group')
+    AND user_id = (
+        SELECT fp.user_id FROM conversation_participants fp
+        WHERE fp.conversation_id = conversation_participants.conversation_id
+        ORDER BY fp.joined_at, fp.user_id
+        LIMIT 1
+    )
+    AND NOT EXISTS (
+        SELECT 1 FROM conversation_participants ap
+        WHERE ap.conversation_id = conversation_participants.conversation_id AND ap.role = 'admin'
+    );
@@ -5,26 +5,32 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"mime/multipart"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/sqlrepo"
+	"github.com/fallenkarma/wasatext/internal/repository/uploads"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // PostgresRepository implements the Repository interface
 type PostgresRepository struct {
-	db          *sql.DB
-	uploadPath  string
+	db         *sql.DB
+	q          sqlrepo.Queryer // db, or tx inside WithTx
+	tx         *sql.Tx
+	uploadPath string
 }
 
-// NewPostgresRepository creates a new PostgresRepository
-func NewPostgresRepository(connStr string, uploadPath string) (*PostgresRepository, error) {
+// Open connects to the database, without touching its schema
+func Open(connStr string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -32,27 +38,40 @@ func NewPostgresRepository(connStr string, uploadPath string) (*PostgresReposito
 
 	// Check connection
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	ex, err := os.Executable()
-    if err != nil {
-        return nil, fmt.Errorf("failed to get executable path: %w", err)
-    }
-    exPath := filepath.Dir(ex) // This gives you C:\progettiPersonali\wasaProject\bin (if you build to bin)
+	return db, nil
+}
 
-    // Define your desired uploads directory relative to the executable
-    // Example: Create an "uploads" folder next to your executable
-    uploadsDir := filepath.Join(exPath, "uploads")
+// NewPostgresRepository creates a new PostgresRepository, applying the pending schema
+// migrations and logging how many were applied to logger
+func NewPostgresRepository(connStr string, uploadPath string, logger *slog.Logger) (*PostgresRepository, error) {
+	db, err := Open(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := MigrateUp(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if applied > 0 {
+		logger.Info("Applied schema migrations", "count", applied)
+	}
 
 	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+	if err := os.MkdirAll(uploadPath, 0755); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return &PostgresRepository{
-		db:          db,
-		uploadPath:  uploadsDir,
+		db:         db,
+		q:          dialect.Instrument(db),
+		uploadPath: uploadPath,
 	}, nil
 }
 
@@ -61,6 +80,21 @@ func (r *PostgresRepository) Close() error {
 	return r.db.Close()
 }
 
+// DB returns the connection pool of the repository
+func (r *PostgresRepository) DB() *sql.DB {
+	return r.db
+}
+
+// Ping checks the connection to the database
+func (r *PostgresRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+// UploadPath returns the directory the uploaded photos are stored in
+func (r *PostgresRepository) UploadPath() string {
+	return r.uploadPath
+}
+
 // CreateUser implements UserRepository.CreateUser
 func (r *PostgresRepository) CreateUser(ctx context.Context, name string) (*models.User, error) {
 	// Check if user with this name already exists
@@ -74,7 +108,7 @@ func (r *PostgresRepository) CreateUser(ctx context.Context, name string) (*mode
 
 	// Insert the new user
 	query := "INSERT INTO users (id, name) VALUES ($1, $2)"
-	_, err := r.db.ExecContext(ctx, query, id, name)
+	_, err := r.q.ExecContext(ctx, query, id, name)
 	if err != nil {
 		return nil, err
 	}
@@ -85,36 +119,36 @@ func (r *PostgresRepository) CreateUser(ctx context.Context, name string) (*mode
 	}, nil
 }
 
-// GetUserByID implements UserRepository.GetUserByID
-func (r *PostgresRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
-	query := "SELECT id, name, photo_url FROM users WHERE id = $1"
-	row := r.db.QueryRowContext(ctx, query, id)
+// userColumns are the users columns scanned by scanUser
+const userColumns = "id, name, photo_url, hide_last_seen, role, suspended_at, display_name, bio, status_text, status_expires_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanUser scans a user selected with userColumns, then the extra columns selected after them
+func scanUser(row rowScanner, extra ...interface{}) (*models.User, error) {
 	var user models.User
 	var photoURL sql.NullString
-	err := row.Scan(&user.ID, &user.Name, &photoURL)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
+	dest := append([]interface{}{&user.ID, &user.Name, &photoURL, &user.HideLastSeen, &user.Role, &user.SuspendedAt,
+		&user.DisplayName, &user.Bio, &user.StatusText, &user.StatusExpiresAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
 		return nil, err
 	}
 
 	if photoURL.Valid {
 		user.PhotoURL = photoURL.String
 	}
+	user.Profile = user.Profile.Current(time.Now())
 
 	return &user, nil
 }
 
-// GetUserByName implements UserRepository.GetUserByName
-func (r *PostgresRepository) GetUserByName(ctx context.Context, name string) (*models.User, error) {
-	query := "SELECT id, name, photo_url FROM users WHERE name = $1"
-	row := r.db.QueryRowContext(ctx, query, name)
-
-	var user models.User
-	var photoURL sql.NullString
-	err := row.Scan(&user.ID, &user.Name, &photoURL)
+// GetUserByID implements UserRepository.GetUserByID
+func (r *PostgresRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE id = $1"
+	user, err := scanUser(r.q.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -122,11 +156,21 @@ func (r *PostgresRepository) GetUserByName(ctx context.Context, name string) (*m
 		return nil, err
 	}
 
-	if photoURL.Valid {
-		user.PhotoURL = photoURL.String
+	return user, nil
+}
+
+// GetUserByName implements UserRepository.GetUserByName
+func (r *PostgresRepository) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE name = $1"
+	user, err := scanUser(r.q.QueryRowContext(ctx, query, name))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 // UpdateUsername implements UserRepository.UpdateUsername
@@ -134,42 +178,24 @@ func (r *PostgresRepository) UpdateUsername(ctx context.Context, userID string,
 	// Check if name is already in use
 	existingUser, _ := r.GetUserByName(ctx, newName)
 	if existingUser != nil && existingUser.ID != userID {
-		return errors.New("username already in use")
+		return fmt.Errorf("%w: username already in use", repository.ErrConflict)
 	}
 
 	query := "UPDATE users SET name = $1 WHERE id = $2"
-	_, err := r.db.ExecContext(ctx, query, newName, userID)
+	_, err := r.q.ExecContext(ctx, query, newName, userID)
 	return err
 }
 
 // SaveUserPhoto implements UserRepository.SaveUserPhoto
 func (r *PostgresRepository) SaveUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error) {
-	// Create user photos directory if it doesn't exist
-	userPhotosDir := filepath.Join(r.uploadPath, "user_photos")
-	log.Println("User photos directory:", userPhotosDir)
-	if err := os.MkdirAll(userPhotosDir, 0755); err != nil {
-		return "", err
-	}
-
-	// Generate a unique filename
-	filename := fmt.Sprintf("%s_%d.jpg", userID, time.Now().Unix())
-	filepath := filepath.Join(userPhotosDir, filename)
-
-	// Save the file
-	dst, err := os.Create(filepath)
+	relativePath, err := uploads.SavePhoto(r.uploadPath, uploads.UserPhotos, userID, photo)
 	if err != nil {
 		return "", err
 	}
-	defer dst.Close()
-
-	if _, err = io.Copy(dst, photo); err != nil {
-		return "", err
-	}
 
 	// Update the user's photo URL in the database
-	relativePath := fmt.Sprintf("/uploads/user_photos/%s", filename)
 	query := "UPDATE users SET photo_url = $1 WHERE id = $2"
-	_, err = r.db.ExecContext(ctx, query, relativePath, userID)
+	_, err = r.q.ExecContext(ctx, query, relativePath, userID)
 	if err != nil {
 		return "", err
 	}
@@ -177,101 +203,146 @@ func (r *PostgresRepository) SaveUserPhoto(ctx context.Context, userID string, p
 	return relativePath, nil
 }
 
-// GetAllUsers implements UserRepository.GetAllUsers
-func (r *PostgresRepository) GetAllUsers(ctx context.Context) ([]models.User, error) {
-	query := "SELECT id, name, photo_url FROM users"
-	rows, err := r.db.QueryContext(ctx, query)
+// SearchUsers implements UserRepository.SearchUsers
+func (r *PostgresRepository) SearchUsers(ctx context.Context, viewerID string, filter models.UserFilter) ([]models.User, string, error) {
+	pattern := escapeLike(filter.Query)
+	args := []interface{}{viewerID, filter.Query, pattern + "%", "%" + pattern + "%"}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := ""
+	if filter.Cursor != "" {
+		after, err := repository.DecodeUserCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = "WHERE (match_rank, name) > (" + arg(after.Rank) + ", " + arg(after.Name) + ")"
+	}
+	query := `
+		SELECT ` + userColumns + `, match_rank FROM (
+			SELECT u.*, CASE
+				WHEN LOWER(u.name) = LOWER($2) THEN 0
+				WHEN u.name ILIKE $3 ESCAPE '\' THEN 1
+				ELSE 2
+			END AS match_rank
+			FROM users u
+			WHERE u.id <> $1 AND u.name ILIKE $4 ESCAPE '\'
+				AND NOT EXISTS (
+					SELECT 1 FROM user_blocks b
+					WHERE (b.blocker_id = $1 AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = $1)
+				)
+		) ranked
+		` + where + `
+		ORDER BY match_rank, name
+	`
+	if filter.Limit > 0 {
+		// One more than the page tells whether there is a next page
+		query += "LIMIT " + arg(filter.Limit+1)
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
 	var users []models.User
+	var ranks []int
 	for rows.Next() {
-		var user models.User
-		var photoURL sql.NullString
-		if err := rows.Scan(&user.ID, &user.Name, &photoURL); err != nil {
-			return nil, err
-		}
-		if photoURL.Valid {
-			user.PhotoURL = photoURL.String
+		var rank int
+		user, err := scanUser(rows, &rank)
+		if err != nil {
+			return nil, "", err
 		}
-		users = append(users, user)
+		users = append(users, *user)
+		ranks = append(ranks, rank)
 	}
-
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return users, nil
+	var next string
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+		next = repository.EncodeCursor(repository.UserCursor{Rank: ranks[filter.Limit-1], Name: users[filter.Limit-1].Name})
+	}
+	return users, next, nil
 }
 
-// CreateDirectConversation implements ConversationRepository.CreateDirectConversation
-func (r *PostgresRepository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
-	// Check if a direct conversation already exists between these users
-	log.Print("Users", userID1, userID2)
-	query := `
-		    SELECT 
-        		conversation_id
-			FROM 
-				conversation_participants
-			JOIN conversations ON conversation_participants.conversation_id = conversations.id
-			WHERE 
-				user_id IN ($1,$2) AND conversations.type = 'direct'
-			GROUP BY 
-				conversation_id
-			HAVING 
-				COUNT(DISTINCT user_id) = 2
-	`
-	row := r.db.QueryRowContext(ctx, query, userID1, userID2)
+// UpdatePrivacySettings implements UserRepository.UpdatePrivacySettings
+func (r *PostgresRepository) UpdatePrivacySettings(ctx context.Context, userID string, hideLastSeen bool) error {
+	query := "UPDATE users SET hide_last_seen = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, hideLastSeen, userID)
+	return err
+}
 
-	var conversationID string
-	err := row.Scan(&conversationID)
-	if err == nil {
-		// Conversation exists, return it
-		return r.GetConversationByID(ctx, conversationID)
-	} else if !errors.Is(err, sql.ErrNoRows) {
-		// Unexpected error
-		return nil, err
-	}
+// UpdateProfile implements UserRepository.UpdateProfile
+func (r *PostgresRepository) UpdateProfile(ctx context.Context, userID string, profile models.Profile) error {
+	query := "UPDATE users SET display_name = $1, bio = $2, status_text = $3, status_expires_at = $4 WHERE id = $5"
+	_, err := r.q.ExecContext(ctx, query, profile.DisplayName, profile.Bio, profile.StatusText, profile.StatusExpiresAt, userID)
+	return err
+}
+
+// CreateDirectConversation implements ConversationRepository.CreateDirectConversation
+func (r *PostgresRepository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, bool, error) {
+	key := repository.DirectKey(userID1, userID2)
 
 	// Start a transaction
-	tx, err := r.db.BeginTx(ctx, nil)
+	tx, err := r.begin(ctx)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer tx.Rollback()
 
-	// Create a new conversation
+	// The unique direct key lets a single one of concurrent requests create the conversation
 	id := uuid.New().String()
-	insertConvQuery := "INSERT INTO conversations (id, type) VALUES ($1, $2)"
-	_, err = tx.ExecContext(ctx, insertConvQuery, id, models.DirectConversation)
+	insertConvQuery := "INSERT INTO conversations (id, type, direct_key) VALUES ($1, $2, $3) ON CONFLICT (direct_key) DO NOTHING"
+	result, err := tx.ExecContext(ctx, insertConvQuery, id, models.DirectConversation, key)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if inserted == 0 {
+		// Conversation exists, return it
+		var conversationID string
+		err := tx.QueryRowContext(ctx, "SELECT id FROM conversations WHERE direct_key = $1", key).Scan(&conversationID)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+		conv, err := r.GetConversationByID(ctx, conversationID)
+		return conv, false, err
 	}
 
 	// Add participants
 	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)"
 	_, err = tx.ExecContext(ctx, insertPartQuery, id, userID1)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	_, err = tx.ExecContext(ctx, insertPartQuery, id, userID2)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return r.GetConversationByID(ctx, id)
+	conv, err := r.GetConversationByID(ctx, id)
+	return conv, true, err
 }
 
 // CreateGroupConversation implements ConversationRepository.CreateGroupConversation
-func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name string, participants []string) (*models.Conversation, error) {
+func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error) {
 	// Start a transaction
-	tx, err := r.db.BeginTx(ctx, nil)
+	tx, err := r.begin(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -285,10 +356,14 @@ func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name s
 		return nil, err
 	}
 
-	// Add participants
-	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)"
+	// Add participants, the creator being the group admin
+	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id, role) VALUES ($1, $2, $3)"
 	for _, userID := range participants {
-		_, err = tx.ExecContext(ctx, insertPartQuery, id, userID)
+		role := models.MemberRole
+		if userID == creatorID {
+			role = models.AdminRole
+		}
+		_, err = tx.ExecContext(ctx, insertPartQuery, id, userID, role)
 		if err != nil {
 			return nil, err
 		}
@@ -305,7 +380,7 @@ func (r *PostgresRepository) CreateGroupConversation(ctx context.Context, name s
 func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string) (*models.Conversation, error) {
 	// Get conversation details
 	convQuery := "SELECT id, name, type, photo_url FROM conversations WHERE id = $1"
-	convRow := r.db.QueryRowContext(ctx, convQuery, id)
+	convRow := r.q.QueryRowContext(ctx, convQuery, id)
 
 	var conv models.Conversation
 	var name, photoURL sql.NullString
@@ -327,36 +402,11 @@ func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string)
 	conv.Type = models.ConversationType(convType)
 
 	// Get participants
-	partQuery := "SELECT cp.user_id, u.name, u.photo_url FROM conversation_participants cp JOIN users u ON u.id = cp.user_id  WHERE cp.conversation_id = $1"
-	partRows, err := r.db.QueryContext(ctx, partQuery, id)
+	participants, err := r.queryParticipants(ctx, "cp.conversation_id = $1", id)
 	if err != nil {
 		return nil, err
 	}
-	defer partRows.Close()
-
-	for partRows.Next() {
-		var userID string
-		var userName string
-		var photo_url sql.NullString
-		if err := partRows.Scan(&userID,&userName, &photo_url); err != nil {
-			return nil, err
-		}
-		
-		userPhotoUrl := ""
-		if photo_url.Valid {
-			userPhotoUrl = photo_url.String
-		}
-		
-		conv.Participants = append(conv.Participants, models.Participant{
-            ID:   userID,
-            Name: userName,
-			PhotoURL: userPhotoUrl,
-        })
-
-	}
-	if err := partRows.Err(); err != nil {
-		return nil, err
-	}
+	conv.Participants = participants[id]
 
 	// Get messages
 	messages, err := r.GetMessagesByConversationID(ctx, id)
@@ -367,70 +417,190 @@ func (r *PostgresRepository) GetConversationByID(ctx context.Context, id string)
 
 	// Set the last message if there are any messages
 	if len(messages) > 0 {
-		lastMsg := messages[len(messages)-1]  // Assuming messages are ordered by timestamp desc
+		lastMsg := messages[len(messages)-1] // Assuming messages are ordered by timestamp desc
 		conv.LastMessage = &lastMsg
 	}
 
-	// If this is a direct conversation and has no name, set the name to the other user's name
-	if conv.Type == models.DirectConversation && !name.Valid && len(conv.Participants) == 2 {
-		// Find the other user in the conversation
-		var otherUserID string
-		for _, participant := range conv.Participants {
-			if participant.ID != ctx.Value("userID").(string) {
-				otherUserID = participant.ID
-				break
-			}
-		}
-
-		// Get the other user's name
-		if otherUserID != "" {
-			otherUser, err := r.GetUserByID(ctx, otherUserID)
-			if err == nil && otherUser != nil {
-				conv.Name = otherUser.Name
-			}
-		}
-	}
-
 	return &conv, nil
 }
 
-// GetConversationsByUserID implements ConversationRepository.GetConversationsByUserID
-func (r *PostgresRepository) GetConversationsByUserID(ctx context.Context, userID string) ([]models.Conversation, error) {
-	// Find all conversations where the user is a participant
+// queryParticipants loads the participants of the conversations matching where, by conversation
+func (r *PostgresRepository) queryParticipants(ctx context.Context, where string, args ...interface{}) (map[string][]models.Participant, error) {
 	query := `
-		SELECT c.id 
-		FROM conversations c
-		JOIN conversation_participants cp ON c.id = cp.conversation_id
-		WHERE cp.user_id = $1
-		ORDER BY c.last_activity DESC
-	`
-	rows, err := r.db.QueryContext(ctx, query, userID)
+		SELECT cp.conversation_id, cp.user_id, u.name, u.photo_url, cp.role, u.hide_last_seen, cp.archived, cp.muted_until, cp.pin_position,
+			u.display_name, u.bio, u.status_text, u.status_expires_at
+		FROM conversation_participants cp
+		JOIN users u ON u.id = cp.user_id
+		WHERE ` + where
+	rows, err := r.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var conversations []models.Conversation
+	participants := make(map[string][]models.Participant)
 	for rows.Next() {
-		var convID string
-		if err := rows.Scan(&convID); err != nil {
+		var conversationID string
+		var participant models.Participant
+		var photoURL sql.NullString
+		var role string
+		var profile models.Profile
+		if err := rows.Scan(&conversationID, &participant.ID, &participant.Name, &photoURL, &role, &participant.HideLastSeen,
+			&participant.Settings.Archived, &participant.Settings.MutedUntil, &participant.Settings.PinPosition,
+			&profile.DisplayName, &profile.Bio, &profile.StatusText, &profile.StatusExpiresAt); err != nil {
 			return nil, err
 		}
+		participant.PhotoURL = photoURL.String
+		participant.Role = models.ParticipantRole(role)
+		participant.Profile = profile.Current(time.Now())
+		participants[conversationID] = append(participants[conversationID], participant)
+	}
+	return participants, rows.Err()
+}
 
-		conv, err := r.GetConversationByID(ctx, convID)
+// GetConversationsByUserID implements ConversationRepository.GetConversationsByUserID.
+// One query selects the page, then one the participants and one the last messages of all of
+// its conversations.
+func (r *PostgresRepository) GetConversationsByUserID(ctx context.Context, userID string, filter models.ConversationFilter) ([]models.Conversation, string, error) {
+	args := []interface{}{userID, filter.Archived}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"cp.user_id = $1", "cp.archived = $2"}
+	if filter.Type != "" {
+		where = append(where, "c.type = "+arg(string(filter.Type)))
+	}
+	if filter.Query != "" {
+		// The user's own name would match all of their conversations
+		pattern := arg("%" + escapeLike(filter.Query) + "%")
+		where = append(where, `(c.name ILIKE `+pattern+` ESCAPE '\' OR EXISTS (
+			SELECT 1 FROM conversation_participants op
+			JOIN users ou ON ou.id = op.user_id
+			WHERE op.conversation_id = c.id AND op.user_id <> $1 AND ou.name ILIKE `+pattern+` ESCAPE '\'
+		))`)
+	}
+	if filter.Unread {
+		where = append(where, `EXISTS (
+			SELECT 1 FROM messages um
+			WHERE um.conversation_id = c.id AND um.sender_id <> $1 AND um.status <> 'read'
+				AND um.deleted_at IS NULL AND um.hidden_at IS NULL
+		)`)
+	}
+	if filter.Cursor != "" {
+		after, err := repository.DecodeConversationCursor(filter.Cursor)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		if conv != nil {
-			conversations = append(conversations, *conv)
+		// After the last conversation of the previous page, in the order of the list
+		older := "(c.last_activity, c.id) < (" + arg(after.LastActivity) + ", " + arg(after.ID) + ")"
+		if after.PinPosition != nil {
+			position := arg(*after.PinPosition)
+			where = append(where, "(cp.pin_position IS NULL OR cp.pin_position > "+position+" OR (cp.pin_position = "+position+" AND "+older+"))")
+		} else {
+			where = append(where, "cp.pin_position IS NULL AND "+older)
 		}
 	}
 
+	query := `
+		SELECT c.id, c.name, c.type, c.photo_url, c.last_activity, cp.pin_position
+		FROM conversations c
+		JOIN conversation_participants cp ON c.id = cp.conversation_id
+		WHERE ` + strings.Join(where, "\n\t\t\tAND ") + `
+		ORDER BY cp.pin_position IS NULL, cp.pin_position, c.last_activity DESC, c.id DESC
+	`
+	if filter.Limit > 0 {
+		// One more than the page tells whether there is a next page
+		query += "LIMIT " + arg(filter.Limit+1)
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var conversations []models.Conversation
+	var positions []repository.ConversationCursor
+	for rows.Next() {
+		var conv models.Conversation
+		var name, photoURL sql.NullString
+		var position repository.ConversationCursor
+		if err := rows.Scan(&conv.ID, &name, &conv.Type, &photoURL, &position.LastActivity, &position.PinPosition); err != nil {
+			return nil, "", err
+		}
+		conv.Name = name.String
+		conv.PhotoURL = photoURL.String
+		position.ID = conv.ID
+		conversations = append(conversations, conv)
+		positions = append(positions, position)
+	}
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	// The rows must be closed before running other queries on the same transaction
+	rows.Close()
+
+	var next string
+	if filter.Limit > 0 && len(positions) > filter.Limit {
+		conversations = conversations[:filter.Limit]
+		next = repository.EncodeCursor(positions[filter.Limit-1])
+	}
+	if len(conversations) == 0 {
+		return conversations, next, nil
+	}
+
+	ids := make([]string, len(conversations))
+	for i, conv := range conversations {
+		ids[i] = conv.ID
+	}
+	participants, err := r.queryParticipants(ctx, "cp.conversation_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, "", err
+	}
+	lastMessages, err := r.queryMessages(ctx, messageSelect+`
+		WHERE m.id IN (
+			SELECT DISTINCT ON (conversation_id) id FROM messages
+			WHERE conversation_id = ANY($1)
+			ORDER BY conversation_id, timestamp DESC
+		)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, "", err
+	}
+	last := make(map[string]*models.Message, len(lastMessages))
+	for i := range lastMessages {
+		last[lastMessages[i].ConversationID] = &lastMessages[i]
+	}
+	for i := range conversations {
+		conversations[i].Participants = participants[conversations[i].ID]
+		conversations[i].LastMessage = last[conversations[i].ID]
 	}
 
-	return conversations, nil
+	return conversations, next, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, with backslashes
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// UpdateConversationSettings implements ConversationRepository.UpdateConversationSettings
+func (r *PostgresRepository) UpdateConversationSettings(ctx context.Context, conversationID, userID string, settings models.ConversationSettings) error {
+	query := `
+		UPDATE conversation_participants SET archived = $1, muted_until = $2, pin_position = $3
+		WHERE conversation_id = $4 AND user_id = $5
+	`
+	_, err := r.q.ExecContext(ctx, query, settings.Archived, settings.MutedUntil, settings.PinPosition, conversationID, userID)
+	return err
+}
+
+// GetLastPinPosition implements ConversationRepository.GetLastPinPosition
+func (r *PostgresRepository) GetLastPinPosition(ctx context.Context, userID string) (int, error) {
+	query := "SELECT COALESCE(MAX(pin_position), 0) FROM conversation_participants WHERE user_id = $1"
+	var last int
+	err := r.q.QueryRowContext(ctx, query, userID).Scan(&last)
+	return last, err
 }
 
 // AddUserToGroup implements ConversationRepository.AddUserToGroup
@@ -438,7 +608,7 @@ func (r *PostgresRepository) AddUserToGroup(ctx context.Context, groupID, userID
 	// Check if the conversation is a group
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
-	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
 	if err != nil {
 		return err
 	}
@@ -449,17 +619,17 @@ func (r *PostgresRepository) AddUserToGroup(ctx context.Context, groupID, userID
 	// Check if user is already in the group
 	checkQuery := "SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2"
 	var count int
-	err = r.db.QueryRowContext(ctx, checkQuery, groupID, userID).Scan(&count)
+	err = r.q.QueryRowContext(ctx, checkQuery, groupID, userID).Scan(&count)
 	if err != nil {
 		return err
 	}
 	if count > 0 {
-		return errors.New("user is already in the group")
+		return fmt.Errorf("%w: user is already in the group", repository.ErrConflict)
 	}
 
 	// Add user to the group
 	insertQuery := "INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)"
-	_, err = r.db.ExecContext(ctx, insertQuery, groupID, userID)
+	_, err = r.q.ExecContext(ctx, insertQuery, groupID, userID)
 	return err
 }
 
@@ -468,7 +638,7 @@ func (r *PostgresRepository) RemoveUserFromGroup(ctx context.Context, groupID, u
 	// Check if the conversation is a group
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
-	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
 	if err != nil {
 		return err
 	}
@@ -478,7 +648,7 @@ func (r *PostgresRepository) RemoveUserFromGroup(ctx context.Context, groupID, u
 
 	// Remove user from the group
 	deleteQuery := "DELETE FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2"
-	result, err := r.db.ExecContext(ctx, deleteQuery, groupID, userID)
+	result, err := r.q.ExecContext(ctx, deleteQuery, groupID, userID)
 	if err != nil {
 		return err
 	}
@@ -489,10 +659,18 @@ func (r *PostgresRepository) RemoveUserFromGroup(ctx context.Context, groupID, u
 		return err
 	}
 	if rowsAffected == 0 {
-		return errors.New("user is not in the group")
+		return fmt.Errorf("%w: user is not in the group", repository.ErrNotFound)
 	}
 
-	return nil
+	// A group keeps an admin: when the last one leaves, the member who joined first takes over
+	promoteQuery := `
+		UPDATE conversation_participants SET role = 'admin'
+		WHERE conversation_id = $1
+			AND user_id = (SELECT user_id FROM conversation_participants WHERE conversation_id = $1 ORDER BY joined_at, user_id LIMIT 1)
+			AND NOT EXISTS (SELECT 1 FROM conversation_participants WHERE conversation_id = $1 AND role = 'admin')
+	`
+	_, err = r.q.ExecContext(ctx, promoteQuery, groupID)
+	return err
 }
 
 // UpdateGroupName implements ConversationRepository.UpdateGroupName
@@ -500,7 +678,7 @@ func (r *PostgresRepository) UpdateGroupName(ctx context.Context, groupID, name
 	// Check if the conversation is a group
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
-	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
 	if err != nil {
 		return err
 	}
@@ -510,7 +688,7 @@ func (r *PostgresRepository) UpdateGroupName(ctx context.Context, groupID, name
 
 	// Update the group name
 	updateQuery := "UPDATE conversations SET name = $1 WHERE id = $2"
-	_, err = r.db.ExecContext(ctx, updateQuery, name, groupID)
+	_, err = r.q.ExecContext(ctx, updateQuery, name, groupID)
 	return err
 }
 
@@ -519,7 +697,7 @@ func (r *PostgresRepository) SaveGroupPhoto(ctx context.Context, groupID string,
 	// Check if the conversation is a group
 	convQuery := "SELECT type FROM conversations WHERE id = $1"
 	var convType string
-	err := r.db.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
 	if err != nil {
 		return "", err
 	}
@@ -527,31 +705,14 @@ func (r *PostgresRepository) SaveGroupPhoto(ctx context.Context, groupID string,
 		return "", errors.New("conversation is not a group")
 	}
 
-	// Create group photos directory if it doesn't exist
-	groupPhotosDir := filepath.Join(r.uploadPath, "group_photos")
-	if err := os.MkdirAll(groupPhotosDir, 0755); err != nil {
-		return "", err
-	}
-
-	// Generate a unique filename
-	filename := fmt.Sprintf("%s_%d.jpg", groupID, time.Now().Unix())
-	filepath := filepath.Join(groupPhotosDir, filename)
-
-	// Save the file
-	dst, err := os.Create(filepath)
+	relativePath, err := uploads.SavePhoto(r.uploadPath, uploads.GroupPhotos, groupID, photo)
 	if err != nil {
 		return "", err
 	}
-	defer dst.Close()
-
-	if _, err = io.Copy(dst, photo); err != nil {
-		return "", err
-	}
 
 	// Update the group's photo URL in the database
-	relativePath := fmt.Sprintf("/uploads/group_photos/%s", filename)
 	query := "UPDATE conversations SET photo_url = $1 WHERE id = $2"
-	_, err = r.db.ExecContext(ctx, query, relativePath, groupID)
+	_, err = r.q.ExecContext(ctx, query, relativePath, groupID)
 	if err != nil {
 		return "", err
 	}
@@ -562,58 +723,190 @@ func (r *PostgresRepository) SaveGroupPhoto(ctx context.Context, groupID string,
 // CreateMessage implements MessageRepository.CreateMessage
 func (r *PostgresRepository) CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error) {
 	// Start a transaction
-	tx, err := r.db.BeginTx(ctx, nil)
+	tx, err := r.begin(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
-	// If no ID provided, generate one
-	if msg.ConversationID == "" {
-		msg.ConversationID = uuid.New().String()
-	}
-
 	// If no timestamp provided, use current time
 	if msg.Timestamp.IsZero() {
 		msg.Timestamp = time.Now()
 	}
 
-	// Insert the message
+	// Insert the message and read it back as stored, joined as messageSelect does
 	msgQuery := `
-		INSERT INTO messages (id, sender_id, conversation_id, content, type, status, reply_to, timestamp)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	`
-	_, err = tx.ExecContext(ctx, msgQuery, msg.ConversationID, msg.Sender.ID, conversationID, msg.Content, msg.Type, msg.Status, msg.ReplyTo, msg.Timestamp)
+		WITH m AS (
+			INSERT INTO messages (id, sender_id, conversation_id, content, type, status, reply_to, timestamp, client_message_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING *
+		)
+		SELECT ` + messageColumns + `
+		FROM m` + messageJoins
+	row := tx.QueryRowContext(ctx, msgQuery, uuid.New().String(), msg.Sender.ID, conversationID, msg.Content, msg.Type, msg.Status, msg.ReplyTo, msg.Timestamp, nullString(msg.ClientMessageID))
+	created, err := scanMessage(row)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := insertMentions(ctx, tx, created.ID, msg.Mentions); err != nil {
+		return nil, err
+	}
+	created.Mentions = sortedMentions(msg.Mentions)
+
 	// Update the last activity timestamp of the conversation
 	updateConvQuery := "UPDATE conversations SET last_activity = $1 WHERE id = $2"
-	_, err = tx.ExecContext(ctx, updateConvQuery, msg.Timestamp, conversationID)
+	_, err = tx.ExecContext(ctx, updateConvQuery, created.Timestamp, conversationID)
 	if err != nil {
 		return nil, err
 	}
 
+	// Bring the conversation back from the archives of the participants not muting it
+	unarchiveQuery := `
+		UPDATE conversation_participants SET archived = FALSE
+		WHERE conversation_id = $1 AND archived AND (muted_until IS NULL OR muted_until <= $2)
+	`
+	if _, err := tx.ExecContext(ctx, unarchiveQuery, conversationID, created.Timestamp); err != nil {
+		return nil, err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 
-	return &msg, nil
+	return &created, nil
+}
+
+// sortedMentions returns a copy of mentions in the order GetMentionsByMessageID reads them
+func sortedMentions(mentions []models.Mention) []models.Mention {
+	sorted := append([]models.Mention(nil), mentions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+	return sorted
+}
+
+// insertMentions stores the mentions of a message inside the given transaction
+func insertMentions(ctx context.Context, tx sqlrepo.Queryer, messageID string, mentions []models.Mention) error {
+	query := "INSERT INTO message_mentions (message_id, user_id, start_offset, length) VALUES ($1, $2, $3, $4)"
+	for _, mention := range mentions {
+		var userID sql.NullString
+		if !mention.All {
+			userID = sql.NullString{String: mention.UserID, Valid: true}
+		}
+		if _, err := tx.ExecContext(ctx, query, messageID, userID, mention.Offset, mention.Length); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetMessagesByConversationID implements MessageRepository.GetMessagesByConversationID
 func (r *PostgresRepository) GetMessagesByConversationID(ctx context.Context, conversationID string) ([]models.Message, error) {
 	// Get messages with user information
-	query := `
-		SELECT m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, m.content, m.type, m.status, m.reply_to, m.timestamp, m.deleted_at
-		FROM messages m
-		INNER JOIN users u ON m.sender_id = u.id
+	query := messageSelect + `
 		WHERE m.conversation_id = $1
 		ORDER BY m.timestamp ASC
 	`
-	
-	rows, err := r.db.QueryContext(ctx, query, conversationID)
+	return r.queryMessages(ctx, query, conversationID)
+}
+
+// messageColumns are the columns of a message row scanned by scanMessage, with its
+// sender, link preview and the preview of the message it replies to
+var messageColumns = `
+	m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, u.display_name, u.bio, u.status_text, u.status_expires_at, m.content, m.type, m.status, m.reply_to, m.timestamp, m.deleted_at, m.hidden_at,
+	m.client_message_id, lp.url, lp.title, lp.description, lp.image_url,
+	rm.sender_id, ru.name, rm.type,
+	CASE WHEN rm.deleted_at IS NULL AND rm.hidden_at IS NULL THEN LEFT(rm.content, ` + replyPreviewLength + `) ELSE '' END`
+
+// messageJoins joins the tables of messageColumns to the messages m
+const messageJoins = `
+	INNER JOIN users u ON m.sender_id = u.id
+	LEFT JOIN link_previews lp ON lp.url = m.link_preview_url
+	LEFT JOIN messages rm ON rm.id = m.reply_to
+	LEFT JOIN users ru ON ru.id = rm.sender_id
+`
+
+// replyPreviewLength is models.ReplyPreviewLength, to be written in queries
+var replyPreviewLength = strconv.Itoa(models.ReplyPreviewLength)
+
+// messageSelect selects the message rows scanned by queryMessages
+var messageSelect = "SELECT " + messageColumns + "\nFROM messages m" + messageJoins
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage scans a row of messageColumns
+func scanMessage(row scanner) (models.Message, error) {
+	var msg models.Message
+	var photoURL sql.NullString // Handle potential NULL photo_url
+	var previewURL, previewTitle, previewDescription, previewImage sql.NullString
+	var clientMessageID sql.NullString
+	var replySenderID, replySenderName, replyType, replyContent sql.NullString
+
+	if err := row.Scan(
+		&msg.ID,                     // m.id
+		&msg.ConversationID,         // m.conversation_id
+		&msg.Sender.ID,              // m.sender_id (User.ID)
+		&msg.Sender.Name,            // u.name (User.Name)
+		&photoURL,                   // u.photo_url (User.PhotoURL)
+		&msg.Sender.DisplayName,     // u.display_name
+		&msg.Sender.Bio,             // u.bio
+		&msg.Sender.StatusText,      // u.status_text
+		&msg.Sender.StatusExpiresAt, // u.status_expires_at
+		&msg.Content,                // m.content
+		&msg.Type,                   // m.type
+		&msg.Status,                 // m.status
+		&msg.ReplyTo,                // m.reply_to
+		&msg.Timestamp,              // m.timestamp
+		&msg.DeletedAt,              // m.deleted_at
+		&msg.HiddenAt,               // m.hidden_at
+		&clientMessageID,            // m.client_message_id
+		&previewURL,                 // lp.url
+		&previewTitle,               // lp.title
+		&previewDescription,         // lp.description
+		&previewImage,               // lp.image_url
+		&replySenderID,              // rm.sender_id
+		&replySenderName,            // ru.name
+		&replyType,                  // rm.type
+		&replyContent,               // rm.content, cut
+	); err != nil {
+		return msg, err
+	}
+
+	// Handle nullable photo URL
+	if photoURL.Valid {
+		msg.Sender.PhotoURL = photoURL.String
+	}
+	msg.Sender.Profile = msg.Sender.Profile.Current(time.Now())
+
+	msg.ClientMessageID = clientMessageID.String
+
+	if previewURL.Valid {
+		msg.LinkPreview = &models.LinkPreview{
+			URL:         previewURL.String,
+			Title:       previewTitle.String,
+			Description: previewDescription.String,
+			ImageURL:    previewImage.String,
+		}
+	}
+
+	if replyType.Valid {
+		msg.ReplyPreview = &models.ReplyPreview{
+			Sender:  models.User{ID: replySenderID.String, Name: replySenderName.String},
+			Type:    models.MessageType(replyType.String),
+			Content: replyContent.String,
+		}
+	}
+
+	return msg, nil
+}
+
+// queryMessages runs a query selecting message rows and loads their reactions and mentions
+func (r *PostgresRepository) queryMessages(ctx context.Context, query string, args ...interface{}) ([]models.Message, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -621,119 +914,117 @@ func (r *PostgresRepository) GetMessagesByConversationID(ctx context.Context, co
 
 	var messages []models.Message
 	for rows.Next() {
-		var msg models.Message
-		var photoURL sql.NullString // Handle potential NULL photo_url
-
-		
-		if err := rows.Scan(   
-			&msg.ID,                    // m.id              
-			&msg.ConversationID,        // m.conversation_id
-			&msg.Sender.ID,             // m.sender_id (User.ID)
-			&msg.Sender.Name,           // u.name (User.Name)
-			&photoURL,                  // u.photo_url (User.PhotoURL)
-			&msg.Content,               // m.content
-			&msg.Type,                  // m.type
-			&msg.Status,                // m.status
-			&msg.ReplyTo,                   // m.reply_to
-			&msg.Timestamp,             // m.timestamp
-			&msg.DeletedAt,             // m.deleted_at
-		); err != nil {
-			return nil, err
-		}
-
-		// Handle nullable photo URL
-		if photoURL.Valid {
-			msg.Sender.PhotoURL = photoURL.String
-		}
-
-		reactions, err := r.GetReactionsByMessageID(ctx, msg.ID)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		msg.Reactions = reactions
-
-
 		messages = append(messages, msg)
 	}
-
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	// The rows must be closed before running other queries on the same transaction
+	rows.Close()
+
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	reactions, err := r.queryReactions(ctx, "message_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	mentions, err := r.queryMentions(ctx, "message_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		msg := &messages[i]
+		msg.Reactions = reactions[msg.ID]
+
+		// The content of hidden messages is kept for unhiding them, but never read back
+		if msg.HiddenAt != nil {
+			msg.Content = ""
+			msg.LinkPreview = nil
+			continue
+		}
+		msg.Mentions = mentions[msg.ID]
+	}
 
 	return messages, nil
 }
+
+// GetMessageByClientID implements MessageRepository.GetMessageByClientID
+func (r *PostgresRepository) GetMessageByClientID(ctx context.Context, senderID, clientMessageID string) (*models.Message, error) {
+	query := messageSelect + `
+		WHERE m.sender_id = $1 AND m.client_message_id = $2
+	`
+	messages, err := r.queryMessages(ctx, query, senderID, clientMessageID)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
 // GetMessageByID implements MessageRepository.GetMessageByID
 func (r *PostgresRepository) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
-	query := `
-		SELECT m.id, m.sender_id, u.name, m.content, m.type, m.status, m.reply_to, m.timestamp, m.conversation_id
-		FROM messages m
-		INNER JOIN users u ON m.sender_id = u.id
-		WHERE m.id = $1 
+	query := messageSelect + `
+		WHERE m.id = $1
 	`
-	row := r.db.QueryRowContext(ctx, query, id)
-
-	var msg models.Message
-	var conversationID sql.NullString
-	err := row.Scan(&msg.ConversationID, &msg.Sender.ID, &msg.Sender.Name, &msg.Content, &msg.Type, &msg.Status, &msg.ReplyTo, &msg.Timestamp, &conversationID)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
+	messages, err := r.queryMessages(ctx, query, id)
+	if err != nil || len(messages) == 0 {
 		return nil, err
 	}
-
-	return &msg, nil
+	return &messages[0], nil
 }
 
 // DeleteMessage implements MessageRepository.DeleteMessage
 func (r *PostgresRepository) DeleteMessage(ctx context.Context, id string) error {
 	// Soft delete by setting the deleted_at timestamp
 	query := "UPDATE messages SET deleted_at = $1 WHERE id = $2"
-	_, err := r.db.ExecContext(ctx, query, time.Now(), id)
+	_, err := r.q.ExecContext(ctx, query, time.Now(), id)
 	return err
 }
 
 // UpdateMessageStatus implements MessageRepository.UpdateMessageStatus
 func (r *PostgresRepository) UpdateMessageStatus(ctx context.Context, id string, status models.MessageStatus) error {
 	query := "UPDATE messages SET status = $1 WHERE id = $2"
-	_, err := r.db.ExecContext(ctx, query, status, id)
+	_, err := r.q.ExecContext(ctx, query, status, id)
 	return err
 }
 
-// UpdateMessageStatus implements MessageRepository.UpdateMessageStatus
-func (r *PostgresRepository) UpdateMessageContent(ctx context.Context, id string, content string) error {
-	query := "UPDATE messages SET content = $1 WHERE id = $2"
-	_, err := r.db.ExecContext(ctx, query, content, id)
-	return err
-}
-
-
-// SaveMessagePhoto implements MessageRepository.SaveMessagePhoto
-func (r *PostgresRepository) SaveMessagePhoto(ctx context.Context, senderID string, photo multipart.File) (string, error) {
-	// Create message photos directory if it doesn't exist
-	msgPhotosDir := filepath.Join(r.uploadPath, "message_photos")
-	if err := os.MkdirAll(msgPhotosDir, 0755); err != nil {
-		return "", err
+// UpdateMessageContent implements MessageRepository.UpdateMessageContent
+func (r *PostgresRepository) UpdateMessageContent(ctx context.Context, id string, content string, mentions []models.Mention) error {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	// Generate a unique filename
-	filename := fmt.Sprintf("%s_%d.jpg", senderID, time.Now().Unix())
-	filepath := filepath.Join(msgPhotosDir, filename)
-
-	// Save the file
-	dst, err := os.Create(filepath)
-	if err != nil {
-		return "", err
+	query := "UPDATE messages SET content = $1 WHERE id = $2"
+	if _, err := tx.ExecContext(ctx, query, content, id); err != nil {
+		return err
 	}
-	defer dst.Close()
 
-	if _, err = io.Copy(dst, photo); err != nil {
-		return "", err
+	// Replace the mentions of the previous content
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_mentions WHERE message_id = $1", id); err != nil {
+		return err
+	}
+	if err := insertMentions(ctx, tx, id, mentions); err != nil {
+		return err
 	}
 
-	// Return the relative path to the file
-	relativePath := fmt.Sprintf("/uploads/message_photos/%s", filename)
-	return relativePath, nil
+	return tx.Commit()
+}
+
+// SaveMessagePhoto implements MessageRepository.SaveMessagePhoto
+func (r *PostgresRepository) SaveMessagePhoto(ctx context.Context, senderID string, photo multipart.File) (string, error) {
+	return uploads.SavePhoto(r.uploadPath, uploads.MessagePhotos, senderID, photo)
 }
 
 // AddReaction implements ReactionRepository.AddReaction
@@ -741,7 +1032,7 @@ func (r *PostgresRepository) AddReaction(ctx context.Context, messageID, userID,
 	// Check if reaction already exists
 	checkQuery := "SELECT COUNT(*) FROM reactions WHERE message_id = $1 AND user_id = $2"
 	var count int
-	err := r.db.QueryRowContext(ctx, checkQuery, messageID, userID).Scan(&count)
+	err := r.q.QueryRowContext(ctx, checkQuery, messageID, userID).Scan(&count)
 	if err != nil {
 		return err
 	}
@@ -749,20 +1040,20 @@ func (r *PostgresRepository) AddReaction(ctx context.Context, messageID, userID,
 	if count > 0 {
 		// Update existing reaction
 		updateQuery := "UPDATE reactions SET emoji = $1 WHERE message_id = $2 AND user_id = $3"
-		_, err = r.db.ExecContext(ctx, updateQuery, emoji, messageID, userID)
+		_, err = r.q.ExecContext(ctx, updateQuery, emoji, messageID, userID)
 		return err
 	}
 
 	// Insert new reaction
 	insertQuery := "INSERT INTO reactions (message_id, user_id, emoji) VALUES ($1, $2, $3)"
-	_, err = r.db.ExecContext(ctx, insertQuery, messageID, userID, emoji)
+	_, err = r.q.ExecContext(ctx, insertQuery, messageID, userID, emoji)
 	return err
 }
 
 // RemoveReaction implements ReactionRepository.RemoveReaction
 func (r *PostgresRepository) RemoveReaction(ctx context.Context, messageID, userID string) error {
 	deleteQuery := "DELETE FROM reactions WHERE message_id = $1 AND user_id = $2"
-	result, err := r.db.ExecContext(ctx, deleteQuery, messageID, userID)
+	result, err := r.q.ExecContext(ctx, deleteQuery, messageID, userID)
 	if err != nil {
 		return err
 	}
@@ -773,7 +1064,7 @@ func (r *PostgresRepository) RemoveReaction(ctx context.Context, messageID, user
 		return err
 	}
 	if rowsAffected == 0 {
-		return errors.New("reaction not found")
+		return fmt.Errorf("reaction %w", repository.ErrNotFound)
 	}
 
 	return nil
@@ -781,24 +1072,399 @@ func (r *PostgresRepository) RemoveReaction(ctx context.Context, messageID, user
 
 // GetReactionsByMessageID implements ReactionRepository.GetReactionsByMessageID
 func (r *PostgresRepository) GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error) {
-	query := "SELECT message_id, user_id, emoji FROM reactions WHERE message_id = $1"
-	rows, err := r.db.QueryContext(ctx, query, messageID)
+	reactions, err := r.queryReactions(ctx, "message_id = $1", messageID)
+	return reactions[messageID], err
+}
+
+// queryReactions loads the reactions matching where, by message
+func (r *PostgresRepository) queryReactions(ctx context.Context, where string, args ...interface{}) (map[string][]models.Reaction, error) {
+	query := "SELECT message_id, user_id, emoji FROM reactions WHERE " + where
+	rows, err := r.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var reactions []models.Reaction
+	reactions := make(map[string][]models.Reaction)
 	for rows.Next() {
 		var reaction models.Reaction
 		if err := rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Emoji); err != nil {
 			return nil, err
 		}
-		reactions = append(reactions, reaction)
+		reactions[reaction.MessageID] = append(reactions[reaction.MessageID], reaction)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
 	return reactions, nil
-}
\ No newline at end of file
+}
+
+// GetMentionsByMessageID implements MentionRepository.GetMentionsByMessageID
+func (r *PostgresRepository) GetMentionsByMessageID(ctx context.Context, messageID string) ([]models.Mention, error) {
+	mentions, err := r.queryMentions(ctx, "message_id = $1", messageID)
+	return mentions[messageID], err
+}
+
+// queryMentions loads the mentions matching where, by message and in the order of the text
+func (r *PostgresRepository) queryMentions(ctx context.Context, where string, args ...interface{}) (map[string][]models.Mention, error) {
+	query := "SELECT message_id, user_id, start_offset, length FROM message_mentions WHERE " + where + " ORDER BY start_offset"
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := make(map[string][]models.Mention)
+	for rows.Next() {
+		var messageID string
+		var mention models.Mention
+		var userID sql.NullString
+		if err := rows.Scan(&messageID, &userID, &mention.Offset, &mention.Length); err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			mention.UserID = userID.String
+		} else {
+			mention.All = true
+		}
+		mentions[messageID] = append(mentions[messageID], mention)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return mentions, nil
+}
+
+// GetMentionedMessages implements MentionRepository.GetMentionedMessages
+func (r *PostgresRepository) GetMentionedMessages(ctx context.Context, userID string) ([]models.Message, error) {
+	// @all mentions only count for conversations the user is still part of
+	query := messageSelect + `
+		INNER JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = $1
+		WHERE m.deleted_at IS NULL
+			AND m.hidden_at IS NULL
+			AND m.sender_id <> $1
+			AND EXISTS (
+				SELECT 1 FROM message_mentions mm
+				WHERE mm.message_id = m.id AND (mm.user_id = $1 OR mm.user_id IS NULL)
+			)
+		ORDER BY m.timestamp DESC
+	`
+	return r.queryMessages(ctx, query, userID)
+}
+
+// GetLinkPreview implements LinkPreviewRepository.GetLinkPreview
+func (r *PostgresRepository) GetLinkPreview(ctx context.Context, url string) (*models.LinkPreview, error) {
+	query := "SELECT url, title, description, image_url, fetched_at FROM link_previews WHERE url = $1"
+	row := r.q.QueryRowContext(ctx, query, url)
+
+	var preview models.LinkPreview
+	var title, description, imageURL sql.NullString
+	err := row.Scan(&preview.URL, &title, &description, &imageURL, &preview.FetchedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	preview.Title = title.String
+	preview.Description = description.String
+	preview.ImageURL = imageURL.String
+
+	return &preview, nil
+}
+
+// SaveLinkPreview implements LinkPreviewRepository.SaveLinkPreview
+func (r *PostgresRepository) SaveLinkPreview(ctx context.Context, preview models.LinkPreview) error {
+	if preview.FetchedAt.IsZero() {
+		preview.FetchedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO link_previews (url, title, description, image_url, fetched_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (url) DO UPDATE
+		SET title = EXCLUDED.title, description = EXCLUDED.description, image_url = EXCLUDED.image_url, fetched_at = EXCLUDED.fetched_at
+	`
+	_, err := r.q.ExecContext(ctx, query, preview.URL, preview.Title, preview.Description, preview.ImageURL, preview.FetchedAt)
+	return err
+}
+
+// SetMessageLinkPreview implements LinkPreviewRepository.SetMessageLinkPreview
+func (r *PostgresRepository) SetMessageLinkPreview(ctx context.Context, messageID, url string) error {
+	var previewURL sql.NullString
+	if url != "" {
+		previewURL = sql.NullString{String: url, Valid: true}
+	}
+
+	query := "UPDATE messages SET link_preview_url = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, previewURL, messageID)
+	return err
+}
+
+// BlockUser implements BlockRepository.BlockUser
+func (r *PostgresRepository) BlockUser(ctx context.Context, blockerID, blockedID string) error {
+	query := "INSERT INTO user_blocks (blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	_, err := r.q.ExecContext(ctx, query, blockerID, blockedID)
+	return err
+}
+
+// UnblockUser implements BlockRepository.UnblockUser
+func (r *PostgresRepository) UnblockUser(ctx context.Context, blockerID, blockedID string) error {
+	query := "DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2"
+	result, err := r.q.ExecContext(ctx, query, blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: user is not blocked", repository.ErrNotFound)
+	}
+
+	return nil
+}
+
+// IsBlocked implements BlockRepository.IsBlocked
+func (r *PostgresRepository) IsBlocked(ctx context.Context, blockerID, blockedID string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2)"
+	var blocked bool
+	err := r.q.QueryRowContext(ctx, query, blockerID, blockedID).Scan(&blocked)
+	return blocked, err
+}
+
+// GetBlockedUserIDs implements BlockRepository.GetBlockedUserIDs
+func (r *PostgresRepository) GetBlockedUserIDs(ctx context.Context, blockerID string) ([]string, error) {
+	query := "SELECT blocked_id FROM user_blocks WHERE blocker_id = $1"
+	rows, err := r.q.QueryContext(ctx, query, blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blockedIDs []string
+	for rows.Next() {
+		var blockedID string
+		if err := rows.Scan(&blockedID); err != nil {
+			return nil, err
+		}
+		blockedIDs = append(blockedIDs, blockedID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blockedIDs, nil
+}
+
+// GetBlockerIDs implements BlockRepository.GetBlockerIDs
+func (r *PostgresRepository) GetBlockerIDs(ctx context.Context, blockedID string) ([]string, error) {
+	query := "SELECT blocker_id FROM user_blocks WHERE blocked_id = $1"
+	rows, err := r.q.QueryContext(ctx, query, blockedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blockerIDs []string
+	for rows.Next() {
+		var blockerID string
+		if err := rows.Scan(&blockerID); err != nil {
+			return nil, err
+		}
+		blockerIDs = append(blockerIDs, blockerID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blockerIDs, nil
+}
+
+// reportColumns are the reports columns scanned by scanReport
+const reportColumns = "id, reporter_id, target_type, message_id, user_id, reason, details, snapshot, status, created_at, resolved_at, resolved_by"
+
+// scanReport scans a report selected with reportColumns
+func scanReport(row rowScanner) (*models.Report, error) {
+	var report models.Report
+	var reporterID, messageID, userID, details, resolvedBy sql.NullString
+	var snapshot []byte
+	err := row.Scan(&report.ID, &reporterID, &report.TargetType, &messageID, &userID, &report.Reason, &details,
+		&snapshot, &report.Status, &report.CreatedAt, &report.ResolvedAt, &resolvedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	report.ReporterID = reporterID.String
+	report.MessageID = messageID.String
+	report.UserID = userID.String
+	report.Details = details.String
+	report.Snapshot = snapshot
+	report.ResolvedBy = resolvedBy.String
+
+	return &report, nil
+}
+
+// nullString maps an empty string to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// CreateReport implements ModerationRepository.CreateReport
+func (r *PostgresRepository) CreateReport(ctx context.Context, report models.Report) (*models.Report, error) {
+	report.ID = uuid.New().String()
+	report.Status = models.OpenReport
+	report.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO reports (id, reporter_id, target_type, message_id, user_id, reason, details, snapshot, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	_, err := r.q.ExecContext(ctx, query, report.ID, report.ReporterID, report.TargetType, nullString(report.MessageID),
+		nullString(report.UserID), report.Reason, nullString(report.Details), []byte(report.Snapshot), report.Status, report.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// GetReportByID implements ModerationRepository.GetReportByID
+func (r *PostgresRepository) GetReportByID(ctx context.Context, id string) (*models.Report, error) {
+	query := "SELECT " + reportColumns + " FROM reports WHERE id = $1"
+	report, err := scanReport(r.q.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// GetReports implements ModerationRepository.GetReports
+func (r *PostgresRepository) GetReports(ctx context.Context, status models.ReportStatus) ([]models.Report, error) {
+	query := "SELECT " + reportColumns + " FROM reports WHERE $1 = '' OR status = $1 ORDER BY created_at ASC"
+	rows, err := r.q.QueryContext(ctx, query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// CloseReport implements ModerationRepository.CloseReport
+func (r *PostgresRepository) CloseReport(ctx context.Context, id string, status models.ReportStatus, moderatorID string) error {
+	query := "UPDATE reports SET status = $1, resolved_at = $2, resolved_by = $3 WHERE id = $4"
+	result, err := r.q.ExecContext(ctx, query, status, time.Now(), moderatorID, id)
+	if err != nil {
+		return err
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("report %w", repository.ErrNotFound)
+	}
+
+	return nil
+}
+
+// SetMessageHidden implements ModerationRepository.SetMessageHidden
+func (r *PostgresRepository) SetMessageHidden(ctx context.Context, messageID string, hidden bool) error {
+	var hiddenAt *time.Time
+	if hidden {
+		now := time.Now()
+		hiddenAt = &now
+	}
+
+	query := "UPDATE messages SET hidden_at = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, hiddenAt, messageID)
+	return err
+}
+
+// SetUserSuspended implements ModerationRepository.SetUserSuspended
+func (r *PostgresRepository) SetUserSuspended(ctx context.Context, userID string, suspended bool) error {
+	var suspendedAt *time.Time
+	if suspended {
+		now := time.Now()
+		suspendedAt = &now
+	}
+
+	query := "UPDATE users SET suspended_at = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, suspendedAt, userID)
+	return err
+}
+
+// CreateModerationAction implements ModerationRepository.CreateModerationAction
+func (r *PostgresRepository) CreateModerationAction(ctx context.Context, action models.ModerationAction) error {
+	if action.ID == "" {
+		action.ID = uuid.New().String()
+	}
+	if action.CreatedAt.IsZero() {
+		action.CreatedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO moderation_actions (id, moderator_id, action, target_id, report_id, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := r.q.ExecContext(ctx, query, action.ID, action.ModeratorID, action.Action, action.TargetID,
+		nullString(action.ReportID), nullString(action.Reason), action.CreatedAt)
+	return err
+}
+
+// GetModerationActions implements ModerationRepository.GetModerationActions
+func (r *PostgresRepository) GetModerationActions(ctx context.Context) ([]models.ModerationAction, error) {
+	query := `
+		SELECT id, moderator_id, action, target_id, report_id, reason, created_at
+		FROM moderation_actions
+		ORDER BY created_at DESC
+	`
+	rows, err := r.q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []models.ModerationAction
+	for rows.Next() {
+		var action models.ModerationAction
+		var moderatorID, reportID, reason sql.NullString
+		if err := rows.Scan(&action.ID, &moderatorID, &action.Action, &action.TargetID, &reportID, &reason, &action.CreatedAt); err != nil {
+			return nil, err
+		}
+		action.ModeratorID = moderatorID.String
+		action.ReportID = reportID.String
+		action.Reason = reason.String
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
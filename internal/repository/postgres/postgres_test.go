@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/repotest"
+)
+
+// TestConformance runs against the database of WASATEXT_TEST_DB, which it empties
+// before every test. It is skipped when the variable is not set.
+func TestConformance(t *testing.T) {
+	connStr := os.Getenv("WASATEXT_TEST_DB")
+	if connStr == "" {
+		t.Skip("WASATEXT_TEST_DB is not set")
+	}
+
+	repotest.Run(t, func(t *testing.T) repository.Repository {
+		repo, err := NewPostgresRepository(connStr, t.TempDir(), slog.New(slog.DiscardHandler))
+		if err != nil {
+			t.Fatalf("NewPostgresRepository() error = %v", err)
+		}
+		t.Cleanup(func() { repo.Close() })
+
+		_, err = repo.db.Exec(`TRUNCATE users, conversations, conversation_participants, messages, reactions,
+			message_mentions, link_previews, user_blocks, reports, moderation_actions CASCADE`)
+		if err != nil {
+			t.Fatalf("failed to empty the test database: %v", err)
+		}
+		return repo
+	})
+}
+
+// TestMigrationStatusReadOnly checks that the status of the migrations, read by the
+// readiness probe, does not create the table of the applied migrations
+func TestMigrationStatusReadOnly(t *testing.T) {
+	connStr := os.Getenv("WASATEXT_TEST_DB")
+	if connStr == "" {
+		t.Skip("WASATEXT_TEST_DB is not set")
+	}
+	ctx := context.Background()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	defer db.Close()
+	// A single connection keeps the search path to an empty schema
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, "CREATE SCHEMA readiness_test; SET search_path TO readiness_test"); err != nil {
+		t.Fatalf("failed to create an empty schema: %v", err)
+	}
+	defer db.ExecContext(ctx, "DROP SCHEMA readiness_test CASCADE")
+
+	status, err := GetMigrationStatus(ctx, db)
+	if err != nil {
+		t.Fatalf("GetMigrationStatus() error = %v", err)
+	}
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			t.Errorf("migration %d is applied in an empty schema", s.Version)
+		}
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("GetMigrationStatus() created the table of the applied migrations")
+	}
+}
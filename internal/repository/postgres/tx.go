@@ -0,0 +1,57 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/sqlrepo"
+	"github.com/lib/pq"
+)
+
+// dialect describes PostgreSQL to the code shared with the other SQL repositories.
+// Transactions are serializable, and run again when they fail on a conflict.
+var dialect = sqlrepo.Dialect{
+	Driver:    "postgres",
+	System:    "postgresql",
+	TxOptions: &sql.TxOptions{Isolation: sql.LevelSerializable},
+	Retryable: isRetryable,
+}
+
+// begin starts the transaction of a repository method, or joins the one of WithTx
+func (r *PostgresRepository) begin(ctx context.Context) (*sqlrepo.ScopedTx, error) {
+	return dialect.Begin(ctx, r.db, r.tx)
+}
+
+// WithTx implements repository.Transactor.WithTx. Transactions are serializable and
+// run again, up to sqlrepo.MaxTxAttempts times, when they fail on a serialization failure
+// or a deadlock. Calling WithTx on the repository of a transaction joins that transaction.
+func (r *PostgresRepository) WithTx(ctx context.Context, fn func(repo repository.Repository) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+
+	return dialect.WithTx(ctx, r.db, func(tx *sql.Tx) error {
+		return fn(&PostgresRepository{
+			db:         r.db,
+			q:          dialect.Instrument(tx),
+			tx:         tx,
+			uploadPath: r.uploadPath,
+		})
+	})
+}
+
+// isRetryable reports whether err aborted a transaction that may succeed if run again
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", // serialization_failure
+		"40P01": // deadlock_detected
+		return true
+	}
+	return false
+}
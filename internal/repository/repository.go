@@ -7,73 +7,112 @@ import (
 	"github.com/fallenkarma/wasatext/internal/models"
 )
 
+// DirectKey returns the key identifying the direct conversation between two users,
+// which is the same whatever the order of the users
+func DirectKey(userID1, userID2 string) string {
+	if userID2 < userID1 {
+		userID1, userID2 = userID2, userID1
+	}
+	return userID1 + ":" + userID2
+}
+
 // UserRepository defines operations for user management
 type UserRepository interface {
 	// CreateUser creates a new user with the given name
 	CreateUser(ctx context.Context, name string) (*models.User, error)
-	
+
 	// GetUserByID retrieves a user by their ID
 	GetUserByID(ctx context.Context, id string) (*models.User, error)
-	
+
 	// GetUserByName retrieves a user by their name
 	GetUserByName(ctx context.Context, name string) (*models.User, error)
-	
+
 	// UpdateUsername updates a user's name
 	UpdateUsername(ctx context.Context, userID string, newName string) error
-	
+
 	// SaveUserPhoto saves a user's profile photo
 	SaveUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error)
-	
-	// GetAllUsers retrieves all users
-	GetAllUsers(ctx context.Context) ([]models.User, error)
+
+	// SearchUsers retrieves a page of the users whose name contains the query, leaving
+	// out the viewer, the users they blocked and the ones who blocked them. Exact
+	// matches come first, then the names starting with the query, then the others,
+	// each by name. It also returns the cursor of the next page, empty on the last one.
+	SearchUsers(ctx context.Context, viewerID string, filter models.UserFilter) ([]models.User, string, error)
+
+	// UpdatePrivacySettings updates whether a user hides their last seen time
+	UpdatePrivacySettings(ctx context.Context, userID string, hideLastSeen bool) error
+
+	// UpdateProfile replaces the profile of a user
+	UpdateProfile(ctx context.Context, userID string, profile models.Profile) error
 }
 
 // ConversationRepository defines operations for conversation management
 type ConversationRepository interface {
-	// CreateDirectConversation creates a new direct conversation between two users
-	CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error)
-	
-	// CreateGroupConversation creates a new group conversation
-	CreateGroupConversation(ctx context.Context, name string, participants []string) (*models.Conversation, error)
-	
-	// GetConversationByID retrieves a conversation by its ID
+	// CreateDirectConversation returns the direct conversation between two users, creating
+	// it unless it exists. The boolean reports whether the conversation is new.
+	CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, bool, error)
+
+	// CreateGroupConversation creates a new group conversation with the creator as its admin
+	CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error)
+
+	// GetConversationByID retrieves a conversation by its ID. Direct conversations have
+	// no name, each participant seeing the name of the other one.
 	GetConversationByID(ctx context.Context, id string) (*models.Conversation, error)
-	
-	// GetConversationsByUserID retrieves all conversations for a user
-	GetConversationsByUserID(ctx context.Context, userID string) ([]models.Conversation, error)
-	
+
+	// GetConversationsByUserID retrieves a page of the conversations of a user matching
+	// filter: the ones they pinned first by pin position, then the most recently active
+	// first. The conversations come with their participants and last message but without
+	// their messages. It also returns the cursor of the next page, empty on the last page.
+	GetConversationsByUserID(ctx context.Context, userID string, filter models.ConversationFilter) ([]models.Conversation, string, error)
+
+	// UpdateConversationSettings replaces the settings of a participant for a conversation
+	UpdateConversationSettings(ctx context.Context, conversationID, userID string, settings models.ConversationSettings) error
+
+	// GetLastPinPosition retrieves the highest pin position among the conversations of
+	// a user, 0 when none is pinned
+	GetLastPinPosition(ctx context.Context, userID string) (int, error)
+
 	// AddUserToGroup adds a user to a group conversation
 	AddUserToGroup(ctx context.Context, groupID, userID string) error
-	
-	// RemoveUserFromGroup removes a user from a group conversation
+
+	// RemoveUserFromGroup removes a user from a group conversation. When the last admin
+	// leaves, the member who joined first becomes admin.
 	RemoveUserFromGroup(ctx context.Context, groupID, userID string) error
-	
+
 	// UpdateGroupName updates a group's name
 	UpdateGroupName(ctx context.Context, groupID, name string) error
-	
+
 	// SaveGroupPhoto saves a group's photo
 	SaveGroupPhoto(ctx context.Context, groupID string, photo multipart.File) (string, error)
 }
 
 // MessageRepository defines operations for message management
 type MessageRepository interface {
-	// CreateMessage creates a new message
+	// CreateMessage creates a new message along with its mentions, under an ID it
+	// generates whatever the ID of msg, and returns it as stored, with its sender
+	// and the preview of the message it replies to. The participants who archived
+	// the conversation without muting it get it back among their conversations.
 	CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error)
-	
+
 	// GetMessagesByConversationID retrieves all messages for a conversation
 	GetMessagesByConversationID(ctx context.Context, conversationID string) ([]models.Message, error)
-	
-	// GetMessageByID retrieves a message by its ID
+
+	// GetMessageByID retrieves a message by its ID, as GetMessagesByConversationID would
 	GetMessageByID(ctx context.Context, id string) (*models.Message, error)
-	
+
+	// GetMessageByClientID retrieves the message a sender sent with the given client
+	// message ID, nil when there is none
+	GetMessageByClientID(ctx context.Context, senderID, clientMessageID string) (*models.Message, error)
+
 	// DeleteMessage marks a message as deleted
 	DeleteMessage(ctx context.Context, id string) error
-	
+
 	// UpdateMessageStatus updates the status of a message
 	UpdateMessageStatus(ctx context.Context, id string, status models.MessageStatus) error
 
-	UpdateMessageContent(ctx context.Context, id string, content string) error
-	
+	// UpdateMessageContent updates the content of a message and replaces its mentions
+	UpdateMessageContent(ctx context.Context, id string, content string, mentions []models.Mention) error
+
 	// SaveMessagePhoto saves a photo message
 	SaveMessagePhoto(ctx context.Context, senderID string, photo multipart.File) (string, error)
 }
@@ -82,18 +121,98 @@ type MessageRepository interface {
 type ReactionRepository interface {
 	// AddReaction adds a reaction to a message
 	AddReaction(ctx context.Context, messageID, userID, emoji string) error
-	
+
 	// RemoveReaction removes a reaction from a message
 	RemoveReaction(ctx context.Context, messageID, userID string) error
-	
+
 	// GetReactionsByMessageID retrieves all reactions for a message
 	GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error)
 }
 
+// MentionRepository defines operations for message mentions
+type MentionRepository interface {
+	// GetMentionsByMessageID retrieves all mentions in a message
+	GetMentionsByMessageID(ctx context.Context, messageID string) ([]models.Mention, error)
+
+	// GetMentionedMessages retrieves the messages mentioning a user, newest first
+	GetMentionedMessages(ctx context.Context, userID string) ([]models.Message, error)
+}
+
+// LinkPreviewRepository defines operations for link previews
+type LinkPreviewRepository interface {
+	// GetLinkPreview retrieves the cached preview of a URL
+	GetLinkPreview(ctx context.Context, url string) (*models.LinkPreview, error)
+
+	// SaveLinkPreview stores or refreshes the cached preview of a URL
+	SaveLinkPreview(ctx context.Context, preview models.LinkPreview) error
+
+	// SetMessageLinkPreview attaches the preview of a URL to a message, an empty URL detaches it
+	SetMessageLinkPreview(ctx context.Context, messageID, url string) error
+}
+
+// BlockRepository defines operations for users blocking other users
+type BlockRepository interface {
+	// BlockUser blocks a user, blocking an already blocked user does nothing
+	BlockUser(ctx context.Context, blockerID, blockedID string) error
+
+	// UnblockUser removes a block
+	UnblockUser(ctx context.Context, blockerID, blockedID string) error
+
+	// IsBlocked reports whether blockerID blocked blockedID
+	IsBlocked(ctx context.Context, blockerID, blockedID string) (bool, error)
+
+	// GetBlockedUserIDs retrieves the IDs of the users blocked by a user
+	GetBlockedUserIDs(ctx context.Context, blockerID string) ([]string, error)
+
+	// GetBlockerIDs retrieves the IDs of the users who blocked a user
+	GetBlockerIDs(ctx context.Context, blockedID string) ([]string, error)
+}
+
+// ModerationRepository defines operations for reports and moderator actions
+type ModerationRepository interface {
+	// CreateReport stores a new report
+	CreateReport(ctx context.Context, report models.Report) (*models.Report, error)
+
+	// GetReportByID retrieves a report by its ID
+	GetReportByID(ctx context.Context, id string) (*models.Report, error)
+
+	// GetReports retrieves the reports with the given status, oldest first, or all of them when status is empty
+	GetReports(ctx context.Context, status models.ReportStatus) ([]models.Report, error)
+
+	// CloseReport marks a report as resolved or dismissed by a moderator
+	CloseReport(ctx context.Context, id string, status models.ReportStatus, moderatorID string) error
+
+	// SetMessageHidden hides or unhides a message
+	SetMessageHidden(ctx context.Context, messageID string, hidden bool) error
+
+	// SetUserSuspended suspends or reinstates a user
+	SetUserSuspended(ctx context.Context, userID string, suspended bool) error
+
+	// CreateModerationAction records a moderator action in the audit log
+	CreateModerationAction(ctx context.Context, action models.ModerationAction) error
+
+	// GetModerationActions retrieves the audit log, newest first
+	GetModerationActions(ctx context.Context) ([]models.ModerationAction, error)
+}
+
+// Transactor runs several repository calls as a single unit of work
+type Transactor interface {
+	// WithTx runs fn in a transaction, committed when fn returns nil and rolled back
+	// otherwise. Every call belonging to the transaction must go through the repository
+	// passed to fn. fn may run more than once when the transaction conflicts with a
+	// concurrent one, so it must not have side effects outside of that repository.
+	WithTx(ctx context.Context, fn func(repo Repository) error) error
+}
+
 // Repository combines all repository interfaces
 type Repository interface {
+	Transactor
 	UserRepository
 	ConversationRepository
 	MessageRepository
 	ReactionRepository
-}
\ No newline at end of file
+	MentionRepository
+	LinkPreviewRepository
+	BlockRepository
+	ModerationRepository
+}
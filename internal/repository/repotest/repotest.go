@@ -0,0 +1,1416 @@
+// Package repotest is a conformance suite for the implementations of repository.Repository.
+// Every backend runs it from its own tests, so that they all keep the same semantics.
+package repotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// Factory returns a new, empty repository for a single test
+type Factory func(t *testing.T) repository.Repository
+
+// Run runs the conformance suite against the repositories created by newRepo
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo repository.Repository)
+	}{
+		{"Users", testUsers},
+		{"UserSearch", testUserSearch},
+		{"Profiles", testProfiles},
+		{"UserPhoto", testUserPhoto},
+		{"DirectConversations", testDirectConversations},
+		{"GroupConversations", testGroupConversations},
+		{"ConversationOrder", testConversationOrder},
+		{"ConversationSettings", testConversationSettings},
+		{"ConversationFilters", testConversationFilters},
+		{"Messages", testMessages},
+		{"MessageRoundTrip", testMessageRoundTrip},
+		{"ReplyPreviews", testReplyPreviews},
+		{"ClientMessageIDs", testClientMessageIDs},
+		{"SoftDelete", testSoftDelete},
+		{"Reactions", testReactions},
+		{"Mentions", testMentions},
+		{"LinkPreviews", testLinkPreviews},
+		{"Blocks", testBlocks},
+		{"Moderation", testModeration},
+		{"Transactions", testTransactions},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+func mustCreateUser(t *testing.T, repo repository.Repository, name string) *models.User {
+	t.Helper()
+	user, err := repo.CreateUser(context.Background(), name)
+	if err != nil {
+		t.Fatalf("CreateUser(%q) error = %v", name, err)
+	}
+	return user
+}
+
+func mustSend(t *testing.T, repo repository.Repository, conversationID, senderID, content string, timestamp time.Time) *models.Message {
+	t.Helper()
+	msg, err := repo.CreateMessage(context.Background(), models.Message{
+		Sender:    models.User{ID: senderID},
+		Content:   content,
+		Type:      models.TextMessage,
+		Status:    models.Sent,
+		Timestamp: timestamp,
+	}, conversationID)
+	if err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+	return msg
+}
+
+func participantIDs(conv *models.Conversation) []string {
+	var ids []string
+	for _, p := range conv.Participants {
+		ids = append(ids, p.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sorted(ids ...string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testUsers(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+
+	alice := mustCreateUser(t, repo, "alice")
+	if alice.ID == "" || alice.Name != "alice" {
+		t.Fatalf("CreateUser() = %+v, want an ID and the name alice", alice)
+	}
+
+	// Creating an existing name returns the existing user
+	again := mustCreateUser(t, repo, "alice")
+	if again.ID != alice.ID {
+		t.Errorf("CreateUser() of an existing name returned ID %s, want %s", again.ID, alice.ID)
+	}
+
+	got, err := repo.GetUserByID(ctx, alice.ID)
+	if err != nil || got == nil || got.Name != "alice" || got.Role != models.RegularUser {
+		t.Errorf("GetUserByID() = %+v, %v, want alice with the user role", got, err)
+	}
+	if got, err := repo.GetUserByID(ctx, "missing"); got != nil || err != nil {
+		t.Errorf("GetUserByID() of a missing user = %+v, %v, want nil, nil", got, err)
+	}
+	if got, err := repo.GetUserByName(ctx, "nobody"); got != nil || err != nil {
+		t.Errorf("GetUserByName() of a missing user = %+v, %v, want nil, nil", got, err)
+	}
+
+	bob := mustCreateUser(t, repo, "bob")
+	if err := repo.UpdateUsername(ctx, bob.ID, "alice"); err == nil {
+		t.Error("UpdateUsername() to a name in use succeeded, want an error")
+	}
+	if err := repo.UpdateUsername(ctx, bob.ID, "robert"); err != nil {
+		t.Fatalf("UpdateUsername() error = %v", err)
+	}
+	if got, _ := repo.GetUserByName(ctx, "robert"); got == nil || got.ID != bob.ID {
+		t.Errorf("GetUserByName(robert) = %+v, want bob", got)
+	}
+
+	if err := repo.UpdatePrivacySettings(ctx, bob.ID, true); err != nil {
+		t.Fatalf("UpdatePrivacySettings() error = %v", err)
+	}
+	if got, _ := repo.GetUserByID(ctx, bob.ID); !got.HideLastSeen {
+		t.Error("HideLastSeen = false after UpdatePrivacySettings(true)")
+	}
+
+	users, _, err := repo.SearchUsers(ctx, "", models.UserFilter{})
+	if err != nil {
+		t.Fatalf("SearchUsers() error = %v", err)
+	}
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	if want := sorted("alice", "robert"); !equal(sorted(names...), want) {
+		t.Errorf("SearchUsers() names = %v, want %v", names, want)
+	}
+}
+
+func testUserSearch(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	viewer := mustCreateUser(t, repo, "ann")
+	for _, name := range []string{"anna", "Annabel", "joanna", "bob", "an_a", "hannah"} {
+		mustCreateUser(t, repo, name)
+	}
+	blocked := mustCreateUser(t, repo, "annie")
+	if err := repo.BlockUser(ctx, viewer.ID, blocked.ID); err != nil {
+		t.Fatalf("BlockUser() error = %v", err)
+	}
+	blocker := mustCreateUser(t, repo, "annalise")
+	if err := repo.BlockUser(ctx, blocker.ID, viewer.ID); err != nil {
+		t.Fatalf("BlockUser() error = %v", err)
+	}
+
+	search := func(filter models.UserFilter) ([]string, string) {
+		t.Helper()
+		users, next, err := repo.SearchUsers(ctx, viewer.ID, filter)
+		if err != nil {
+			t.Fatalf("SearchUsers(%+v) error = %v", filter, err)
+		}
+		var names []string
+		for _, u := range users {
+			names = append(names, u.Name)
+		}
+		return names, next
+	}
+
+	// The exact match comes first, then the prefix matches, then the others, leaving
+	// out the viewer, the users they blocked and the ones who blocked them
+	all, next := search(models.UserFilter{Query: "ANNA"})
+	if want := []string{"anna", "Annabel", "hannah", "joanna"}; !equal(all, want) || next != "" {
+		t.Errorf("SearchUsers(ANNA) = %v, next = %q, want %v on a single page", all, next, want)
+	}
+	if got, _ := search(models.UserFilter{Query: "an_"}); !equal(got, []string{"an_a"}) {
+		t.Errorf("SearchUsers(an_) = %v, want an_a only, as _ is no wildcard", got)
+	}
+	if got, _ := search(models.UserFilter{}); len(got) != 6 {
+		t.Errorf("SearchUsers() = %v, want all the users but ann, annie and annalise", got)
+	}
+
+	// Pages follow one another without gaps nor repeats, across ranks
+	var paged []string
+	cursor := ""
+	for page := 0; page < len(all); page++ {
+		names, next := search(models.UserFilter{Query: "anna", Limit: 1, Cursor: cursor})
+		paged = append(paged, names...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if !equal(paged, all) || cursor != "" {
+		t.Errorf("SearchUsers(anna) a page at a time = %v, want %v then no cursor", paged, all)
+	}
+
+	if _, _, err := repo.SearchUsers(ctx, viewer.ID, models.UserFilter{Cursor: "nonsense"}); !errors.Is(err, repository.ErrInvalidCursor) {
+		t.Errorf("SearchUsers() with a bad cursor error = %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testProfiles(t *testing.T, repo repository.Repository) {
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	ctx := context.Background()
+	conv, _, err := repo.CreateDirectConversation(ctx, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	mustSend(t, repo, conv.ID, alice.ID, "hi", time.Now())
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	profile := models.Profile{DisplayName: "Alice Liddell", Bio: "Curiouser and curiouser", StatusText: "Down the rabbit hole", StatusExpiresAt: &expiresAt}
+	if err := repo.UpdateProfile(ctx, alice.ID, profile); err != nil {
+		t.Fatalf("UpdateProfile() error = %v", err)
+	}
+	same := func(got models.Profile) bool {
+		return got.DisplayName == profile.DisplayName && got.Bio == profile.Bio && got.StatusText == profile.StatusText &&
+			got.StatusExpiresAt != nil && got.StatusExpiresAt.Equal(expiresAt)
+	}
+
+	if got, _ := repo.GetUserByID(ctx, alice.ID); got == nil || !same(got.Profile) {
+		t.Errorf("GetUserByID() = %+v, want the profile %+v", got, profile)
+	}
+	got, err := repo.GetConversationByID(ctx, conv.ID)
+	if err != nil {
+		t.Fatalf("GetConversationByID() error = %v", err)
+	}
+	for _, p := range got.Participants {
+		if p.ID == alice.ID && !same(p.Profile) {
+			t.Errorf("participant alice = %+v, want the profile %+v", p, profile)
+		}
+	}
+	if len(got.Messages) != 1 || !same(got.Messages[0].Sender.Profile) {
+		t.Errorf("messages = %+v, want one sent by alice with her profile", got.Messages)
+	}
+
+	// An expired status is no longer shown
+	expired := time.Now().Add(-time.Minute)
+	profile.StatusExpiresAt = &expired
+	if err := repo.UpdateProfile(ctx, alice.ID, profile); err != nil {
+		t.Fatalf("UpdateProfile() error = %v", err)
+	}
+	if got, _ := repo.GetUserByID(ctx, alice.ID); got.StatusText != "" || got.StatusExpiresAt != nil || got.Bio != profile.Bio {
+		t.Errorf("profile with an expired status = %+v, want the bio without the status", got.Profile)
+	}
+	if msgs, _ := repo.GetMessagesByConversationID(ctx, conv.ID); len(msgs) != 1 || msgs[0].Sender.StatusText != "" {
+		t.Errorf("messages = %+v, want a sender without the expired status", msgs)
+	}
+}
+
+// photoFile is an in-memory multipart.File
+type photoFile struct {
+	*bytes.Reader
+}
+
+func (photoFile) Close() error { return nil }
+
+func testUserPhoto(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+
+	path, err := repo.SaveUserPhoto(ctx, alice.ID, photoFile{bytes.NewReader([]byte("jpeg"))})
+	if err != nil {
+		t.Fatalf("SaveUserPhoto() error = %v", err)
+	}
+	if !strings.HasPrefix(path, "/uploads/user_photos/") {
+		t.Errorf("SaveUserPhoto() = %q, want a path under /uploads/user_photos/", path)
+	}
+	if got, _ := repo.GetUserByID(ctx, alice.ID); got.PhotoURL != path {
+		t.Errorf("PhotoURL = %q, want %q", got.PhotoURL, path)
+	}
+}
+
+func testDirectConversations(t *testing.T, repo repository.Repository) {
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+
+	conv, created, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	if !created {
+		t.Error("CreateDirectConversation() created = false for a new conversation")
+	}
+	if conv.Type != models.DirectConversation {
+		t.Errorf("Type = %s, want %s", conv.Type, models.DirectConversation)
+	}
+	if got, want := participantIDs(conv), sorted(alice.ID, bob.ID); !equal(got, want) {
+		t.Errorf("participants = %v, want %v", got, want)
+	}
+
+	// A direct conversation has no name of its own, whoever reads it
+	if conv.Name != "" {
+		t.Errorf("Name = %q, want none", conv.Name)
+	}
+	if got, err := repo.GetConversationByID(context.Background(), conv.ID); err != nil || got == nil || got.Name != "" {
+		t.Errorf("GetConversationByID() = %+v, %v, want no name", got, err)
+	}
+
+	// There is only one direct conversation between two users, whoever creates it
+	again, created, err := repo.CreateDirectConversation(context.Background(), bob.ID, alice.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() again error = %v", err)
+	}
+	if again.ID != conv.ID || created {
+		t.Errorf("CreateDirectConversation() again = %s, %t, want the existing %s, false", again.ID, created, conv.ID)
+	}
+
+	// Concurrent requests for a new pair create a single conversation
+	carol := mustCreateUser(t, repo, "carol")
+	const requests = 8
+	ids := make(chan string, requests)
+	creations := make(chan bool, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conv, created, err := repo.CreateDirectConversation(context.Background(), alice.ID, carol.ID)
+			if err != nil {
+				t.Errorf("concurrent CreateDirectConversation() error = %v", err)
+				return
+			}
+			ids <- conv.ID
+			creations <- created
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	close(creations)
+	distinct := make(map[string]bool)
+	for id := range ids {
+		distinct[id] = true
+	}
+	createdCount := 0
+	for created := range creations {
+		if created {
+			createdCount++
+		}
+	}
+	if len(distinct) != 1 || createdCount != 1 {
+		t.Errorf("concurrent CreateDirectConversation() made %d conversations, %d reported created, want 1 and 1", len(distinct), createdCount)
+	}
+
+	// Without an authenticated user the repository must not fail
+	if _, err := repo.GetConversationByID(context.Background(), conv.ID); err != nil {
+		t.Errorf("GetConversationByID() without a user error = %v", err)
+	}
+
+	if got, err := repo.GetConversationByID(context.Background(), "missing"); got != nil || err != nil {
+		t.Errorf("GetConversationByID() of a missing conversation = %+v, %v, want nil, nil", got, err)
+	}
+
+	if err := repo.AddUserToGroup(context.Background(), conv.ID, mustCreateUser(t, repo, "carol").ID); err == nil {
+		t.Error("AddUserToGroup() on a direct conversation succeeded, want an error")
+	}
+}
+
+func testGroupConversations(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	carol := mustCreateUser(t, repo, "carol")
+
+	group, err := repo.CreateGroupConversation(context.Background(), "friends", alice.ID, []string{alice.ID, bob.ID})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation() error = %v", err)
+	}
+	if group.Type != models.GroupConversation || group.Name != "friends" {
+		t.Errorf("CreateGroupConversation() = %s %q, want a group named friends", group.Type, group.Name)
+	}
+	for _, p := range group.Participants {
+		want := models.MemberRole
+		if p.ID == alice.ID {
+			want = models.AdminRole
+		}
+		if p.Role != want {
+			t.Errorf("role of %s = %s, want %s", p.Name, p.Role, want)
+		}
+	}
+
+	if err := repo.AddUserToGroup(ctx, group.ID, carol.ID); err != nil {
+		t.Fatalf("AddUserToGroup() error = %v", err)
+	}
+	if err := repo.AddUserToGroup(ctx, group.ID, carol.ID); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("AddUserToGroup() of a member error = %v, want ErrConflict", err)
+	}
+	if err := repo.RemoveUserFromGroup(ctx, group.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup() error = %v", err)
+	}
+	if err := repo.RemoveUserFromGroup(ctx, group.ID, bob.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("RemoveUserFromGroup() of a non member error = %v, want ErrNotFound", err)
+	}
+
+	if err := repo.UpdateGroupName(ctx, group.ID, "best friends"); err != nil {
+		t.Fatalf("UpdateGroupName() error = %v", err)
+	}
+	path, err := repo.SaveGroupPhoto(ctx, group.ID, photoFile{bytes.NewReader([]byte("jpeg"))})
+	if err != nil {
+		t.Fatalf("SaveGroupPhoto() error = %v", err)
+	}
+
+	group, err = repo.GetConversationByID(context.Background(), group.ID)
+	if err != nil {
+		t.Fatalf("GetConversationByID() error = %v", err)
+	}
+	if group.Name != "best friends" || group.PhotoURL != path {
+		t.Errorf("group = %q with photo %q, want %q with photo %q", group.Name, group.PhotoURL, "best friends", path)
+	}
+	if got, want := participantIDs(group), sorted(alice.ID, carol.ID); !equal(got, want) {
+		t.Errorf("participants = %v, want %v", got, want)
+	}
+
+	convs, _, err := repo.GetConversationsByUserID(ctx, bob.ID, models.ConversationFilter{})
+	if err != nil {
+		t.Fatalf("GetConversationsByUserID() error = %v", err)
+	}
+	if len(convs) != 0 {
+		t.Errorf("bob still sees %d conversations after leaving the group", len(convs))
+	}
+
+	// The group keeps an admin when alice, the only one, leaves
+	if err := repo.RemoveUserFromGroup(ctx, group.ID, alice.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup() error = %v", err)
+	}
+	left, err := repo.GetConversationByID(ctx, group.ID)
+	if err != nil {
+		t.Fatalf("GetConversationByID() error = %v", err)
+	}
+	if len(left.Participants) != 1 || left.Participants[0].ID != carol.ID || left.Participants[0].Role != models.AdminRole {
+		t.Errorf("participants after the admin left = %+v, want carol as admin", left.Participants)
+	}
+}
+
+func testConversationOrder(t *testing.T, repo repository.Repository) {
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	carol := mustCreateUser(t, repo, "carol")
+	ctx := context.Background()
+
+	first, _, err := repo.CreateDirectConversation(ctx, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	second, _, err := repo.CreateDirectConversation(ctx, alice.ID, carol.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+
+	// A new message moves its conversation first
+	mustSend(t, repo, first.ID, alice.ID, "hello", time.Now().Add(time.Second))
+	hi := mustSend(t, repo, first.ID, bob.ID, "hi", time.Now().Add(time.Minute))
+	if err := repo.AddReaction(ctx, hi.ID, alice.ID, "👋"); err != nil {
+		t.Fatalf("AddReaction() error = %v", err)
+	}
+
+	convs, _, err := repo.GetConversationsByUserID(ctx, alice.ID, models.ConversationFilter{})
+	if err != nil {
+		t.Fatalf("GetConversationsByUserID() error = %v", err)
+	}
+	if len(convs) != 2 || convs[0].ID != first.ID || convs[1].ID != second.ID {
+		t.Fatalf("GetConversationsByUserID() returned %d conversations, want %s then %s", len(convs), first.ID, second.ID)
+	}
+	if convs[0].LastMessage == nil || convs[0].LastMessage.Content != "hi" || len(convs[0].LastMessage.Reactions) != 1 {
+		t.Errorf("LastMessage = %+v, want the message hi with its reaction", convs[0].LastMessage)
+	}
+	if convs[1].LastMessage != nil {
+		t.Errorf("LastMessage = %+v, want none in a conversation without messages", convs[1].LastMessage)
+	}
+	// The list carries the participants but not the messages, loaded with the conversation
+	for _, conv := range convs {
+		if len(conv.Participants) != 2 || len(conv.Messages) != 0 {
+			t.Errorf("conversation %s has %d participants and %d messages, want 2 and none", conv.ID, len(conv.Participants), len(conv.Messages))
+		}
+	}
+}
+
+func testConversationSettings(t *testing.T, repo repository.Repository) {
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	carol := mustCreateUser(t, repo, "carol")
+	ctx := context.Background()
+
+	withBob, _, err := repo.CreateDirectConversation(ctx, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	withCarol, _, err := repo.CreateDirectConversation(ctx, alice.ID, carol.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	group, err := repo.CreateGroupConversation(ctx, "group", alice.ID, []string{alice.ID, bob.ID, carol.ID})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation() error = %v", err)
+	}
+	now := time.Now()
+	mustSend(t, repo, withBob.ID, bob.ID, "latest", now.Add(3*time.Second))
+
+	update := func(conversationID string, settings models.ConversationSettings) {
+		t.Helper()
+		if err := repo.UpdateConversationSettings(ctx, conversationID, alice.ID, settings); err != nil {
+			t.Fatalf("UpdateConversationSettings() error = %v", err)
+		}
+	}
+	list := func(archived bool) []string {
+		t.Helper()
+		convs, _, err := repo.GetConversationsByUserID(ctx, alice.ID, models.ConversationFilter{Archived: archived})
+		if err != nil {
+			t.Fatalf("GetConversationsByUserID() error = %v", err)
+		}
+		var ids []string
+		for _, conv := range convs {
+			ids = append(ids, conv.ID)
+		}
+		return ids
+	}
+	position := func(n int) *int { return &n }
+
+	// Pinned conversations come first by position, whatever their activity
+	update(group.ID, models.ConversationSettings{PinPosition: position(2)})
+	update(withCarol.ID, models.ConversationSettings{PinPosition: position(1)})
+	if got, want := list(false), []string{withCarol.ID, group.ID, withBob.ID}; !equal(got, want) {
+		t.Errorf("conversations = %v, want carol, group then bob", got)
+	}
+	if last, err := repo.GetLastPinPosition(ctx, alice.ID); err != nil || last != 2 {
+		t.Errorf("GetLastPinPosition(alice) = %d, %v, want 2", last, err)
+	}
+	if last, err := repo.GetLastPinPosition(ctx, bob.ID); err != nil || last != 0 {
+		t.Errorf("GetLastPinPosition(bob) = %d, %v, want 0", last, err)
+	}
+
+	// Settings belong to the participant who set them
+	conv, err := repo.GetConversationByID(ctx, group.ID)
+	if err != nil {
+		t.Fatalf("GetConversationByID() error = %v", err)
+	}
+	for _, p := range conv.Participants {
+		pinned := p.Settings.PinPosition != nil && *p.Settings.PinPosition == 2
+		if pinned != (p.ID == alice.ID) {
+			t.Errorf("settings of %s = %+v, want the group pinned by alice only", p.Name, p.Settings)
+		}
+	}
+	if convs, _, _ := repo.GetConversationsByUserID(ctx, bob.ID, models.ConversationFilter{}); len(convs) != 2 || convs[0].ID != withBob.ID {
+		t.Errorf("bob's conversations start with %v, want his direct conversation, pinned by alice only", convs)
+	}
+
+	// Archived conversations are listed apart
+	update(withBob.ID, models.ConversationSettings{Archived: true})
+	if got, want := list(false), []string{withCarol.ID, group.ID}; !equal(got, want) {
+		t.Errorf("conversations = %v, want carol then group", got)
+	}
+	if got, want := list(true), []string{withBob.ID}; !equal(got, want) {
+		t.Errorf("archived conversations = %v, want bob", got)
+	}
+
+	// A new message brings it back, unless it is muted
+	mutedUntil := now.Add(time.Hour)
+	update(withBob.ID, models.ConversationSettings{Archived: true, MutedUntil: &mutedUntil})
+	mustSend(t, repo, withBob.ID, bob.ID, "while muted", now.Add(4*time.Second))
+	if got, want := list(true), []string{withBob.ID}; !equal(got, want) {
+		t.Errorf("archived conversations after a message while muted = %v, want bob", got)
+	}
+	conv, err = repo.GetConversationByID(ctx, withBob.ID)
+	if err != nil {
+		t.Fatalf("GetConversationByID() error = %v", err)
+	}
+	for _, p := range conv.Participants {
+		if p.ID == alice.ID && (p.Settings.MutedUntil == nil || !p.Settings.MutedUntil.Equal(mutedUntil)) {
+			t.Errorf("MutedUntil = %v, want %v", p.Settings.MutedUntil, mutedUntil)
+		}
+	}
+
+	mustSend(t, repo, withBob.ID, bob.ID, "after the mute", now.Add(2*time.Hour))
+	if got := list(true); len(got) != 0 {
+		t.Errorf("archived conversations after a message once unmuted = %v, want none", got)
+	}
+	if got, want := list(false), []string{withCarol.ID, group.ID, withBob.ID}; !equal(got, want) {
+		t.Errorf("conversations = %v, want carol, group then bob", got)
+	}
+}
+
+func testConversationFilters(t *testing.T, repo repository.Repository) {
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	carol := mustCreateUser(t, repo, "carol")
+	dave := mustCreateUser(t, repo, "dave")
+	ctx := context.Background()
+
+	withBob, _, err := repo.CreateDirectConversation(ctx, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	withCarol, _, err := repo.CreateDirectConversation(ctx, alice.ID, carol.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	books, err := repo.CreateGroupConversation(ctx, "Book club", alice.ID, []string{alice.ID, bob.ID, carol.ID})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation() error = %v", err)
+	}
+	hiking, err := repo.CreateGroupConversation(ctx, "Hiking", alice.ID, []string{alice.ID, dave.ID})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation() error = %v", err)
+	}
+
+	// Only the message of bob is left unread by alice. The two groups were last active
+	// at the same time, so that their IDs break the tie.
+	now := time.Now()
+	mustSend(t, repo, withBob.ID, bob.ID, "unread", now.Add(time.Second))
+	mustSend(t, repo, withCarol.ID, alice.ID, "sent by alice", now.Add(2*time.Second))
+	read := mustSend(t, repo, books.ID, carol.ID, "read", now.Add(3*time.Second))
+	if err := repo.UpdateMessageStatus(ctx, read.ID, models.Read); err != nil {
+		t.Fatalf("UpdateMessageStatus() error = %v", err)
+	}
+	deleted := mustSend(t, repo, hiking.ID, dave.ID, "deleted", now.Add(3*time.Second))
+	if err := repo.DeleteMessage(ctx, deleted.ID); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	position := 1
+	if err := repo.UpdateConversationSettings(ctx, withCarol.ID, alice.ID, models.ConversationSettings{PinPosition: &position}); err != nil {
+		t.Fatalf("UpdateConversationSettings() error = %v", err)
+	}
+
+	list := func(filter models.ConversationFilter) ([]string, string) {
+		t.Helper()
+		convs, next, err := repo.GetConversationsByUserID(ctx, alice.ID, filter)
+		if err != nil {
+			t.Fatalf("GetConversationsByUserID(%+v) error = %v", filter, err)
+		}
+		var ids []string
+		for _, conv := range convs {
+			ids = append(ids, conv.ID)
+		}
+		return ids, next
+	}
+	sameSet := func(got []string, want ...string) bool {
+		got, want = append([]string(nil), got...), append([]string(nil), want...)
+		sort.Strings(got)
+		sort.Strings(want)
+		return equal(got, want)
+	}
+
+	all, next := list(models.ConversationFilter{})
+	if len(all) != 4 || all[0] != withCarol.ID || all[3] != withBob.ID || next != "" {
+		t.Fatalf("conversations = %v, next = %q, want carol, the groups then bob on a single page", all, next)
+	}
+
+	// The query matches the name of the conversation or of another participant, in any case
+	if got, _ := list(models.ConversationFilter{Query: "CAR"}); !sameSet(got, withCarol.ID, books.ID) {
+		t.Errorf("conversations matching CAR = %v, want carol and the book club", got)
+	}
+	if got, _ := list(models.ConversationFilter{Query: "book"}); !equal(got, []string{books.ID}) {
+		t.Errorf("conversations matching book = %v, want the book club", got)
+	}
+	if got, _ := list(models.ConversationFilter{Query: "alice"}); len(got) != 0 {
+		t.Errorf("conversations matching the name of their user = %v, want none", got)
+	}
+	if got, _ := list(models.ConversationFilter{Query: "%"}); len(got) != 0 {
+		t.Errorf("conversations matching %% = %v, want none, as it is no wildcard", got)
+	}
+
+	if got, _ := list(models.ConversationFilter{Type: models.GroupConversation}); !sameSet(got, books.ID, hiking.ID) {
+		t.Errorf("group conversations = %v, want the groups", got)
+	}
+	if got, _ := list(models.ConversationFilter{Unread: true}); !equal(got, []string{withBob.ID}) {
+		t.Errorf("unread conversations = %v, want bob", got)
+	}
+
+	// Pages follow one another without gaps nor repeats, pinned conversations included
+	var paged []string
+	cursor := ""
+	for page := 0; page < len(all); page++ {
+		ids, next := list(models.ConversationFilter{Limit: 1, Cursor: cursor})
+		paged = append(paged, ids...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if !equal(paged, all) || cursor != "" {
+		t.Errorf("conversations a page at a time = %v, want %v then no cursor", paged, all)
+	}
+	if got, next := list(models.ConversationFilter{Type: models.GroupConversation, Limit: 2}); len(got) != 2 || next != "" {
+		t.Errorf("groups by pages of 2 = %v, next = %q, want both and no next page", got, next)
+	}
+
+	if _, _, err := repo.GetConversationsByUserID(ctx, alice.ID, models.ConversationFilter{Cursor: "nonsense"}); !errors.Is(err, repository.ErrInvalidCursor) {
+		t.Errorf("GetConversationsByUserID() with a bad cursor error = %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testMessages(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+
+	now := time.Now()
+	second := mustSend(t, repo, conv.ID, bob.ID, "second", now.Add(time.Second))
+	first := mustSend(t, repo, conv.ID, alice.ID, "first", now)
+	if first.ID == "" || first.ConversationID != conv.ID {
+		t.Errorf("CreateMessage() = %+v, want an ID and the conversation ID", first)
+	}
+
+	messages, err := repo.GetMessagesByConversationID(ctx, conv.ID)
+	if err != nil {
+		t.Fatalf("GetMessagesByConversationID() error = %v", err)
+	}
+	if len(messages) != 2 || messages[0].ID != first.ID || messages[1].ID != second.ID {
+		t.Fatalf("GetMessagesByConversationID() = %d messages, want first then second by timestamp", len(messages))
+	}
+	if messages[0].Sender.Name != "alice" {
+		t.Errorf("sender name = %q, want alice", messages[0].Sender.Name)
+	}
+
+	got, err := repo.GetMessageByID(ctx, first.ID)
+	if err != nil || got == nil {
+		t.Fatalf("GetMessageByID() = %v, %v", got, err)
+	}
+	if got.Content != "first" || got.Sender.ID != alice.ID || got.ConversationID != conv.ID {
+		t.Errorf("GetMessageByID() = %+v, want the first message", got)
+	}
+	if got, err := repo.GetMessageByID(ctx, "missing"); got != nil || err != nil {
+		t.Errorf("GetMessageByID() of a missing message = %+v, %v, want nil, nil", got, err)
+	}
+
+	if err := repo.UpdateMessageStatus(ctx, first.ID, models.Read); err != nil {
+		t.Fatalf("UpdateMessageStatus() error = %v", err)
+	}
+	if got, _ := repo.GetMessageByID(ctx, first.ID); got.Status != models.Read {
+		t.Errorf("Status = %s, want %s", got.Status, models.Read)
+	}
+
+	// Replies keep the ID of the message they answer
+	replyTo := first.ID
+	reply, err := repo.CreateMessage(ctx, models.Message{
+		Sender:  models.User{ID: bob.ID},
+		Content: "reply",
+		Type:    models.TextMessage,
+		Status:  models.Sent,
+		ReplyTo: &replyTo,
+	}, conv.ID)
+	if err != nil {
+		t.Fatalf("CreateMessage() of a reply error = %v", err)
+	}
+	if got, _ := repo.GetMessageByID(ctx, reply.ID); got.ReplyTo == nil || *got.ReplyTo != first.ID {
+		t.Errorf("ReplyTo = %v, want %s", got.ReplyTo, first.ID)
+	}
+
+	if _, err := repo.CreateMessage(ctx, models.Message{Sender: models.User{ID: alice.ID}, Content: "lost", Type: models.TextMessage, Status: models.Sent}, "missing"); err == nil {
+		t.Error("CreateMessage() in a missing conversation succeeded, want an error")
+	}
+
+	path, err := repo.SaveMessagePhoto(ctx, alice.ID, photoFile{bytes.NewReader([]byte("jpeg"))})
+	if err != nil {
+		t.Fatalf("SaveMessagePhoto() error = %v", err)
+	}
+	if !strings.HasPrefix(path, "/uploads/message_photos/") {
+		t.Errorf("SaveMessagePhoto() = %q, want a path under /uploads/message_photos/", path)
+	}
+}
+
+// assertSameMessage fails unless got and want read the same to clients
+func assertSameMessage(t *testing.T, name string, got, want *models.Message) {
+	t.Helper()
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("%s = %s\nwant %s", name, gotJSON, wantJSON)
+	}
+}
+
+func testMessageRoundTrip(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	photo, err := repo.SaveUserPhoto(ctx, alice.ID, photoFile{bytes.NewReader([]byte("jpeg"))})
+	if err != nil {
+		t.Fatalf("SaveUserPhoto() error = %v", err)
+	}
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+
+	first := mustSend(t, repo, conv.ID, bob.ID, "first", time.Now())
+	replyTo := first.ID
+	sent := models.Message{
+		ID:              "chosen-by-the-caller",
+		Sender:          models.User{ID: alice.ID},
+		Content:         "@bob and @all",
+		Type:            models.TextMessage,
+		Status:          models.Sent,
+		ReplyTo:         &replyTo,
+		ClientMessageID: "round-trip",
+		// Given out of order, read back by offset
+		Mentions: []models.Mention{{All: true, Offset: 9, Length: 4}, {UserID: bob.ID, Offset: 0, Length: 4}},
+	}
+	created, err := repo.CreateMessage(ctx, sent, conv.ID)
+	if err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+
+	// The repository chooses the ID, and fills in what it knows about the message
+	if created.ID == "" || created.ID == sent.ID || created.ID == first.ID {
+		t.Errorf("ID = %q, want a new ID generated by the repository", created.ID)
+	}
+	if created.ConversationID != conv.ID || created.Timestamp.IsZero() {
+		t.Errorf("CreateMessage() = %+v, want the conversation ID and a timestamp", created)
+	}
+	if created.Sender.ID != alice.ID || created.Sender.Name != "alice" || created.Sender.PhotoURL != photo {
+		t.Errorf("Sender = %+v, want alice with her name and photo", created.Sender)
+	}
+	if created.ReplyPreview == nil || created.ReplyPreview.Content != "first" || created.ReplyPreview.Sender.Name != "bob" {
+		t.Errorf("ReplyPreview = %+v, want the preview of the first message", created.ReplyPreview)
+	}
+	if len(created.Mentions) != 2 || created.Mentions[0].UserID != bob.ID || !created.Mentions[1].All {
+		t.Errorf("Mentions = %+v, want @bob then @all", created.Mentions)
+	}
+
+	// Reading it back gives the same message
+	got, err := repo.GetMessageByID(ctx, created.ID)
+	if err != nil || got == nil {
+		t.Fatalf("GetMessageByID() = %v, %v", got, err)
+	}
+	assertSameMessage(t, "GetMessageByID()", got, created)
+
+	messages, err := repo.GetMessagesByConversationID(ctx, conv.ID)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("GetMessagesByConversationID() = %d messages, %v, want 2", len(messages), err)
+	}
+	assertSameMessage(t, "GetMessagesByConversationID()[0]", &messages[0], first)
+	assertSameMessage(t, "GetMessagesByConversationID()[1]", &messages[1], created)
+
+	byClientID, err := repo.GetMessageByClientID(ctx, alice.ID, "round-trip")
+	if err != nil || byClientID == nil {
+		t.Fatalf("GetMessageByClientID() = %v, %v", byClientID, err)
+	}
+	assertSameMessage(t, "GetMessageByClientID()", byClientID, created)
+}
+
+func testReplyPreviews(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+
+	reply := func(to *models.Message) *models.Message {
+		t.Helper()
+		replyTo := to.ID
+		msg, err := repo.CreateMessage(ctx, models.Message{
+			Sender:  models.User{ID: alice.ID},
+			Content: "reply",
+			Type:    models.TextMessage,
+			Status:  models.Sent,
+			ReplyTo: &replyTo,
+		}, conv.ID)
+		if err != nil {
+			t.Fatalf("CreateMessage() of a reply error = %v", err)
+		}
+		return msg
+	}
+
+	// Previews are cut after a number of characters, not bytes
+	long := mustSend(t, repo, conv.ID, bob.ID, strings.Repeat("é", models.ReplyPreviewLength+10), time.Now())
+	got := reply(long).ReplyPreview
+	if got == nil || got.Content != strings.Repeat("é", models.ReplyPreviewLength) || got.Type != models.TextMessage || got.Sender.ID != bob.ID {
+		t.Errorf("ReplyPreview of a long message = %+v, want its first %d characters", got, models.ReplyPreviewLength)
+	}
+	if plain := mustSend(t, repo, conv.ID, bob.ID, "plain", time.Now()); plain.ReplyPreview != nil {
+		t.Errorf("ReplyPreview of a message replying to nothing = %+v, want nil", plain.ReplyPreview)
+	}
+
+	// The content of deleted and hidden messages is not shown in the replies
+	deleted := mustSend(t, repo, conv.ID, bob.ID, "deleted", time.Now())
+	deletedReply := reply(deleted)
+	hidden := mustSend(t, repo, conv.ID, bob.ID, "hidden", time.Now())
+	hiddenReply := reply(hidden)
+	if err := repo.DeleteMessage(ctx, deleted.ID); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	if err := repo.SetMessageHidden(ctx, hidden.ID, true); err != nil {
+		t.Fatalf("SetMessageHidden() error = %v", err)
+	}
+	for _, id := range []string{deletedReply.ID, hiddenReply.ID} {
+		got, err := repo.GetMessageByID(ctx, id)
+		if err != nil || got == nil {
+			t.Fatalf("GetMessageByID() = %v, %v", got, err)
+		}
+		if got.ReplyPreview == nil || got.ReplyPreview.Content != "" || got.ReplyPreview.Sender.ID != bob.ID {
+			t.Errorf("ReplyPreview = %+v, want bob's message without its content", got.ReplyPreview)
+		}
+	}
+}
+
+func testClientMessageIDs(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+
+	send := func(senderID, clientMessageID string) (*models.Message, error) {
+		return repo.CreateMessage(ctx, models.Message{
+			Sender:          models.User{ID: senderID},
+			Content:         "hello",
+			Type:            models.TextMessage,
+			Status:          models.Sent,
+			ClientMessageID: clientMessageID,
+		}, conv.ID)
+	}
+
+	sent, err := send(alice.ID, "key-1")
+	if err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+	got, err := repo.GetMessageByClientID(ctx, alice.ID, "key-1")
+	if err != nil || got == nil {
+		t.Fatalf("GetMessageByClientID() = %v, %v", got, err)
+	}
+	if got.ID != sent.ID || got.ClientMessageID != "key-1" || got.Sender.ID != alice.ID {
+		t.Errorf("GetMessageByClientID() = %+v, want the message sent with key-1", got)
+	}
+
+	// Keys are unique per sender only
+	if got, err := repo.GetMessageByClientID(ctx, bob.ID, "key-1"); got != nil || err != nil {
+		t.Errorf("GetMessageByClientID() of another sender = %+v, %v, want nil, nil", got, err)
+	}
+	if _, err := send(bob.ID, "key-1"); err != nil {
+		t.Errorf("CreateMessage() with the key of another sender error = %v", err)
+	}
+	if _, err := send(alice.ID, "key-1"); err == nil {
+		t.Error("CreateMessage() with a key used twice succeeded, want an error")
+	}
+
+	// Messages without a key never collide
+	for i := 0; i < 2; i++ {
+		if _, err := send(alice.ID, ""); err != nil {
+			t.Fatalf("CreateMessage() without a key error = %v", err)
+		}
+	}
+	if got, err := repo.GetMessageByClientID(ctx, alice.ID, ""); got != nil || err != nil {
+		t.Errorf("GetMessageByClientID() of an empty key = %+v, %v, want nil, nil", got, err)
+	}
+}
+
+func testSoftDelete(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	msg := mustSend(t, repo, conv.ID, alice.ID, "oops", time.Now())
+
+	if err := repo.DeleteMessage(ctx, msg.ID); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+
+	// Deleted messages stay in the conversation, marked as deleted
+	messages, err := repo.GetMessagesByConversationID(ctx, conv.ID)
+	if err != nil {
+		t.Fatalf("GetMessagesByConversationID() error = %v", err)
+	}
+	if len(messages) != 1 || messages[0].DeletedAt == nil {
+		t.Errorf("messages after delete = %+v, want the message with DeletedAt set", messages)
+	}
+}
+
+func testReactions(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	msg := mustSend(t, repo, conv.ID, alice.ID, "hello", time.Now())
+
+	if err := repo.AddReaction(ctx, msg.ID, bob.ID, "👍"); err != nil {
+		t.Fatalf("AddReaction() error = %v", err)
+	}
+	// A second reaction of the same user replaces the first one
+	if err := repo.AddReaction(ctx, msg.ID, bob.ID, "❤️"); err != nil {
+		t.Fatalf("AddReaction() again error = %v", err)
+	}
+
+	reactions, err := repo.GetReactionsByMessageID(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetReactionsByMessageID() error = %v", err)
+	}
+	if len(reactions) != 1 || reactions[0].Emoji != "❤️" || reactions[0].UserID != bob.ID {
+		t.Errorf("reactions = %+v, want a single ❤️ of bob", reactions)
+	}
+
+	messages, _ := repo.GetMessagesByConversationID(ctx, conv.ID)
+	if len(messages) != 1 || len(messages[0].Reactions) != 1 {
+		t.Errorf("conversation messages = %+v, want the message with its reaction", messages)
+	}
+
+	if err := repo.RemoveReaction(ctx, msg.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveReaction() error = %v", err)
+	}
+	if err := repo.RemoveReaction(ctx, msg.ID, bob.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("RemoveReaction() of a missing reaction error = %v, want ErrNotFound", err)
+	}
+	if reactions, _ := repo.GetReactionsByMessageID(ctx, msg.ID); len(reactions) != 0 {
+		t.Errorf("reactions after removal = %+v, want none", reactions)
+	}
+}
+
+func testMentions(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	carol := mustCreateUser(t, repo, "carol")
+	group, err := repo.CreateGroupConversation(ctx, "team", alice.ID, []string{alice.ID, bob.ID, carol.ID})
+	if err != nil {
+		t.Fatalf("CreateGroupConversation() error = %v", err)
+	}
+
+	now := time.Now()
+	direct, err := repo.CreateMessage(ctx, models.Message{
+		Sender:    models.User{ID: alice.ID},
+		Content:   "hi @bob",
+		Type:      models.TextMessage,
+		Status:    models.Sent,
+		Timestamp: now,
+		Mentions:  []models.Mention{{UserID: bob.ID, Offset: 3, Length: 4}},
+	}, group.ID)
+	if err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+	all, err := repo.CreateMessage(ctx, models.Message{
+		Sender:    models.User{ID: carol.ID},
+		Content:   "@all lunch?",
+		Type:      models.TextMessage,
+		Status:    models.Sent,
+		Timestamp: now.Add(time.Second),
+		Mentions:  []models.Mention{{All: true, Offset: 0, Length: 4}},
+	}, group.ID)
+	if err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+
+	mentions, err := repo.GetMentionsByMessageID(ctx, direct.ID)
+	if err != nil {
+		t.Fatalf("GetMentionsByMessageID() error = %v", err)
+	}
+	if len(mentions) != 1 || mentions[0].UserID != bob.ID || mentions[0].Offset != 3 || mentions[0].Length != 4 {
+		t.Errorf("mentions = %+v, want @bob at 3", mentions)
+	}
+
+	// Newest first, @all included
+	mentioned, err := repo.GetMentionedMessages(ctx, bob.ID)
+	if err != nil {
+		t.Fatalf("GetMentionedMessages() error = %v", err)
+	}
+	if len(mentioned) != 2 || mentioned[0].ID != all.ID || mentioned[1].ID != direct.ID {
+		t.Errorf("GetMentionedMessages(bob) = %d messages, want the @all then the @bob message", len(mentioned))
+	}
+
+	// Senders don't see their own @all messages
+	if mentioned, _ := repo.GetMentionedMessages(ctx, carol.ID); len(mentioned) != 0 {
+		t.Errorf("GetMentionedMessages(carol) = %d messages, want 0", len(mentioned))
+	}
+
+	// Editing the content replaces the mentions
+	if err := repo.UpdateMessageContent(ctx, direct.ID, "hi @carol", []models.Mention{{UserID: carol.ID, Offset: 3, Length: 6}}); err != nil {
+		t.Fatalf("UpdateMessageContent() error = %v", err)
+	}
+	if got, _ := repo.GetMessageByID(ctx, direct.ID); got.Content != "hi @carol" {
+		t.Errorf("Content = %q, want %q", got.Content, "hi @carol")
+	}
+	if mentioned, _ := repo.GetMentionedMessages(ctx, bob.ID); len(mentioned) != 1 {
+		t.Errorf("GetMentionedMessages(bob) after edit = %d messages, want 1", len(mentioned))
+	}
+
+	// Deleted messages and people who left the group don't count
+	if err := repo.DeleteMessage(ctx, direct.ID); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	if mentioned, _ := repo.GetMentionedMessages(ctx, carol.ID); len(mentioned) != 0 {
+		t.Errorf("GetMentionedMessages(carol) after delete = %d messages, want 0", len(mentioned))
+	}
+	if err := repo.RemoveUserFromGroup(ctx, group.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveUserFromGroup() error = %v", err)
+	}
+	if mentioned, _ := repo.GetMentionedMessages(ctx, bob.ID); len(mentioned) != 0 {
+		t.Errorf("GetMentionedMessages(bob) after leaving = %d messages, want 0", len(mentioned))
+	}
+}
+
+func testLinkPreviews(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	msg := mustSend(t, repo, conv.ID, alice.ID, "look https://example.com", time.Now())
+
+	if got, err := repo.GetLinkPreview(ctx, "https://example.com"); got != nil || err != nil {
+		t.Errorf("GetLinkPreview() of an unknown URL = %+v, %v, want nil, nil", got, err)
+	}
+
+	preview := models.LinkPreview{URL: "https://example.com", Title: "Old"}
+	if err := repo.SaveLinkPreview(ctx, preview); err != nil {
+		t.Fatalf("SaveLinkPreview() error = %v", err)
+	}
+	// Saving again refreshes the cached preview
+	preview.Title = "Example"
+	if err := repo.SaveLinkPreview(ctx, preview); err != nil {
+		t.Fatalf("SaveLinkPreview() again error = %v", err)
+	}
+	cached, err := repo.GetLinkPreview(ctx, preview.URL)
+	if err != nil || cached == nil || cached.Title != "Example" || cached.FetchedAt.IsZero() {
+		t.Errorf("GetLinkPreview() = %+v, %v, want the refreshed preview with its fetch time", cached, err)
+	}
+
+	if err := repo.SetMessageLinkPreview(ctx, msg.ID, preview.URL); err != nil {
+		t.Fatalf("SetMessageLinkPreview() error = %v", err)
+	}
+	messages, _ := repo.GetMessagesByConversationID(ctx, conv.ID)
+	if len(messages) != 1 || messages[0].LinkPreview == nil || messages[0].LinkPreview.Title != "Example" {
+		t.Errorf("messages = %+v, want the message with its preview", messages)
+	}
+
+	if err := repo.SetMessageLinkPreview(ctx, msg.ID, ""); err != nil {
+		t.Fatalf("SetMessageLinkPreview() detach error = %v", err)
+	}
+	messages, _ = repo.GetMessagesByConversationID(ctx, conv.ID)
+	if len(messages) != 1 || messages[0].LinkPreview != nil {
+		t.Errorf("messages = %+v, want the message without preview", messages)
+	}
+}
+
+func testBlocks(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+
+	if err := repo.BlockUser(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatalf("BlockUser() error = %v", err)
+	}
+	// Blocking twice does nothing
+	if err := repo.BlockUser(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatalf("BlockUser() again error = %v", err)
+	}
+
+	if blocked, err := repo.IsBlocked(ctx, alice.ID, bob.ID); err != nil || !blocked {
+		t.Errorf("IsBlocked(alice, bob) = %t, %v, want true", blocked, err)
+	}
+	if blocked, err := repo.IsBlocked(ctx, bob.ID, alice.ID); err != nil || blocked {
+		t.Errorf("IsBlocked(bob, alice) = %t, %v, want false", blocked, err)
+	}
+	if ids, err := repo.GetBlockedUserIDs(ctx, alice.ID); err != nil || !equal(ids, []string{bob.ID}) {
+		t.Errorf("GetBlockedUserIDs() = %v, %v, want [%s]", ids, err, bob.ID)
+	}
+	if ids, err := repo.GetBlockerIDs(ctx, bob.ID); err != nil || !equal(ids, []string{alice.ID}) {
+		t.Errorf("GetBlockerIDs() = %v, %v, want [%s]", ids, err, alice.ID)
+	}
+
+	if err := repo.UnblockUser(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatalf("UnblockUser() error = %v", err)
+	}
+	if err := repo.UnblockUser(ctx, alice.ID, bob.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UnblockUser() of a user not blocked error = %v, want ErrNotFound", err)
+	}
+	if ids, _ := repo.GetBlockedUserIDs(ctx, alice.ID); len(ids) != 0 {
+		t.Errorf("GetBlockedUserIDs() after unblock = %v, want none", ids)
+	}
+	if ids, _ := repo.GetBlockerIDs(ctx, bob.ID); len(ids) != 0 {
+		t.Errorf("GetBlockerIDs() after unblock = %v, want none", ids)
+	}
+}
+
+func testModeration(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+	mod := mustCreateUser(t, repo, "mod")
+	conv, _, err := repo.CreateDirectConversation(context.Background(), alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	msg := mustSend(t, repo, conv.ID, bob.ID, "spam spam", time.Now())
+
+	snapshot, _ := json.Marshal(msg)
+	first, err := repo.CreateReport(ctx, models.Report{
+		ReporterID: alice.ID,
+		TargetType: models.MessageReport,
+		MessageID:  msg.ID,
+		UserID:     bob.ID,
+		Reason:     models.SpamReason,
+		Snapshot:   snapshot,
+	})
+	if err != nil {
+		t.Fatalf("CreateReport() error = %v", err)
+	}
+	if first.ID == "" || first.Status != models.OpenReport {
+		t.Errorf("CreateReport() = %+v, want an open report with an ID", first)
+	}
+	second, err := repo.CreateReport(ctx, models.Report{
+		ReporterID: alice.ID,
+		TargetType: models.UserReport,
+		UserID:     bob.ID,
+		Reason:     models.HarassmentReason,
+		Details:    "keeps writing",
+		Snapshot:   json.RawMessage(`{}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateReport() error = %v", err)
+	}
+
+	if err := repo.CloseReport(ctx, first.ID, models.ResolvedReport, mod.ID); err != nil {
+		t.Fatalf("CloseReport() error = %v", err)
+	}
+	if err := repo.CloseReport(ctx, "missing", models.ResolvedReport, mod.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("CloseReport() of a missing report error = %v, want ErrNotFound", err)
+	}
+
+	closed, err := repo.GetReportByID(ctx, first.ID)
+	if err != nil || closed == nil || closed.Status != models.ResolvedReport || closed.ResolvedBy != mod.ID || closed.ResolvedAt == nil {
+		t.Errorf("GetReportByID() = %+v, %v, want the report resolved by mod", closed, err)
+	}
+	if got, err := repo.GetReportByID(ctx, "missing"); got != nil || err != nil {
+		t.Errorf("GetReportByID() of a missing report = %+v, %v, want nil, nil", got, err)
+	}
+
+	if open, _ := repo.GetReports(ctx, models.OpenReport); len(open) != 1 || open[0].ID != second.ID || open[0].Details != "keeps writing" {
+		t.Errorf("GetReports(open) = %+v, want only the second report", open)
+	}
+	if all, _ := repo.GetReports(ctx, ""); len(all) != 2 || all[0].ID != first.ID {
+		t.Errorf("GetReports() = %d reports, want both, oldest first", len(all))
+	}
+
+	// Hidden messages keep their place but lose their content
+	if err := repo.SetMessageHidden(ctx, msg.ID, true); err != nil {
+		t.Fatalf("SetMessageHidden() error = %v", err)
+	}
+	messages, _ := repo.GetMessagesByConversationID(ctx, conv.ID)
+	if len(messages) != 1 || messages[0].HiddenAt == nil || messages[0].Content != "" {
+		t.Errorf("messages = %+v, want the message hidden and without content", messages)
+	}
+	if err := repo.SetMessageHidden(ctx, msg.ID, false); err != nil {
+		t.Fatalf("SetMessageHidden(false) error = %v", err)
+	}
+	messages, _ = repo.GetMessagesByConversationID(ctx, conv.ID)
+	if len(messages) != 1 || messages[0].HiddenAt != nil || messages[0].Content != "spam spam" {
+		t.Errorf("messages = %+v, want the message visible again", messages)
+	}
+
+	if err := repo.SetUserSuspended(ctx, bob.ID, true); err != nil {
+		t.Fatalf("SetUserSuspended() error = %v", err)
+	}
+	if got, _ := repo.GetUserByID(ctx, bob.ID); got.SuspendedAt == nil {
+		t.Error("SuspendedAt = nil after SetUserSuspended(true)")
+	}
+	if err := repo.SetUserSuspended(ctx, bob.ID, false); err != nil {
+		t.Fatalf("SetUserSuspended(false) error = %v", err)
+	}
+	if got, _ := repo.GetUserByID(ctx, bob.ID); got.SuspendedAt != nil {
+		t.Error("SuspendedAt set after SetUserSuspended(false)")
+	}
+
+	now := time.Now()
+	older := models.ModerationAction{ModeratorID: mod.ID, Action: models.HideMessageAction, TargetID: msg.ID, CreatedAt: now.Add(-time.Minute)}
+	newer := models.ModerationAction{ModeratorID: mod.ID, Action: models.ResolveReportAction, TargetID: first.ID, ReportID: first.ID, CreatedAt: now}
+	for _, action := range []models.ModerationAction{older, newer} {
+		if err := repo.CreateModerationAction(ctx, action); err != nil {
+			t.Fatalf("CreateModerationAction() error = %v", err)
+		}
+	}
+	actions, err := repo.GetModerationActions(ctx)
+	if err != nil {
+		t.Fatalf("GetModerationActions() error = %v", err)
+	}
+	if len(actions) != 2 || actions[0].Action != models.ResolveReportAction || actions[0].ReportID != first.ID || actions[1].Action != models.HideMessageAction {
+		t.Errorf("GetModerationActions() = %+v, want the resolve then the hide action", actions)
+	}
+}
+
+func testTransactions(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	alice := mustCreateUser(t, repo, "alice")
+	bob := mustCreateUser(t, repo, "bob")
+
+	// A failed transaction leaves nothing behind
+	errAbort := errors.New("abort")
+	err := repo.WithTx(ctx, func(tx repository.Repository) error {
+		if _, err := tx.CreateUser(ctx, "carol"); err != nil {
+			return err
+		}
+		if err := tx.BlockUser(ctx, alice.ID, bob.ID); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("WithTx() error = %v, want %v", err, errAbort)
+	}
+	if got, _ := repo.GetUserByName(ctx, "carol"); got != nil {
+		t.Error("user created by a rolled back transaction exists")
+	}
+	if blocked, _ := repo.IsBlocked(ctx, alice.ID, bob.ID); blocked {
+		t.Error("block created by a rolled back transaction exists")
+	}
+
+	// A successful one commits every call, and sees its own writes
+	var conv *models.Conversation
+	err = repo.WithTx(ctx, func(tx repository.Repository) error {
+		carol, err := tx.CreateUser(ctx, "carol")
+		if err != nil {
+			return err
+		}
+		conv, err = tx.CreateGroupConversation(ctx, "trio", alice.ID, []string{alice.ID, bob.ID, carol.ID})
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateMessage(ctx, models.Message{Sender: models.User{ID: carol.ID}, Content: "hi", Type: models.TextMessage, Status: models.Sent}, conv.ID); err != nil {
+			return err
+		}
+		// Nested transactions join the enclosing one
+		return tx.WithTx(ctx, func(nested repository.Repository) error {
+			got, err := nested.GetConversationByID(ctx, conv.ID)
+			if err != nil {
+				return err
+			}
+			if got == nil || len(got.Messages) != 1 {
+				return errors.New("the transaction does not see its own writes")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("WithTx() error = %v", err)
+	}
+	got, err := repo.GetConversationByID(ctx, conv.ID)
+	if err != nil || got == nil || len(got.Participants) != 3 || len(got.Messages) != 1 {
+		t.Errorf("GetConversationByID() after commit = %+v, %v, want 3 participants and 1 message", got, err)
+	}
+
+	// Rolling back restores the rows the transaction changed, not only the ones it created
+	err = repo.WithTx(ctx, func(tx repository.Repository) error {
+		if err := tx.UpdateUsername(ctx, alice.ID, "alicia"); err != nil {
+			return err
+		}
+		if err := tx.UpdateGroupName(ctx, conv.ID, "duo"); err != nil {
+			return err
+		}
+		if err := tx.RemoveUserFromGroup(ctx, conv.ID, alice.ID); err != nil {
+			return err
+		}
+		if err := tx.AddReaction(ctx, got.Messages[0].ID, bob.ID, "👍"); err != nil {
+			return err
+		}
+		if err := tx.UpdateMessageStatus(ctx, got.Messages[0].ID, models.Read); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("WithTx() error = %v, want %v", err, errAbort)
+	}
+	if user, _ := repo.GetUserByID(ctx, alice.ID); user == nil || user.Name != "alice" {
+		t.Errorf("user after rollback = %+v, want alice", user)
+	}
+	rolledBack, err := repo.GetConversationByID(ctx, conv.ID)
+	if err != nil {
+		t.Fatalf("GetConversationByID() error = %v", err)
+	}
+	if rolledBack.Name != "trio" || len(rolledBack.Participants) != 3 {
+		t.Errorf("group after rollback = %q with %d participants, want trio with 3", rolledBack.Name, len(rolledBack.Participants))
+	}
+	for _, p := range rolledBack.Participants {
+		if p.ID == alice.ID && p.Role != models.AdminRole {
+			t.Errorf("alice is %s after rollback, want admin", p.Role)
+		}
+	}
+	if msg := rolledBack.Messages[0]; len(msg.Reactions) != 0 || msg.Status != models.Sent {
+		t.Errorf("message after rollback has %d reactions and status %s, want none and sent", len(msg.Reactions), msg.Status)
+	}
+}
@@ -0,0 +1,121 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the schema migrations, named <version>_<name>.sql.
+// They mirror the PostgreSQL migrations, without the down scripts.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a schema migration file of a given version
+type migration struct {
+	version  int
+	fileName string
+}
+
+// migrations returns the embedded migrations ordered by version
+func migrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []migration
+	for _, entry := range entries {
+		versionPart, _, ok := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(versionPart)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		list = append(list, migration{version: version, fileName: entry.Name()})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+
+	return list, nil
+}
+
+// migrate applies the migrations newer than the user_version of the database, each
+// one in a transaction that also bumps user_version, and returns how many were applied.
+// Write transactions are immediate, so concurrent servers on the same file wait for each other.
+func migrate(ctx context.Context, db *sql.DB) (int, error) {
+	list, err := migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range list {
+		script, err := migrationFiles.ReadFile(path.Join("migrations", m.fileName))
+		if err != nil {
+			return applied, err
+		}
+
+		ok, err := applyMigration(ctx, db, m.version, string(script))
+		if err != nil {
+			return applied, fmt.Errorf("migration %s failed: %w", m.fileName, err)
+		}
+		if ok {
+			applied++
+		}
+	}
+
+	return applied, nil
+}
+
+// CheckMigrations reports an error when the database is behind the latest migration
+func (r *SQLiteRepository) CheckMigrations(ctx context.Context) error {
+	list, err := migrations()
+	if err != nil || len(list) == 0 {
+		return err
+	}
+
+	var current int
+	if err := r.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&current); err != nil {
+		return err
+	}
+	if latest := list[len(list)-1].version; current < latest {
+		return fmt.Errorf("database at version %d, want %d", current, latest)
+	}
+	return nil
+}
+
+// applyMigration runs a migration unless the database is already at its version or later
+func applyMigration(ctx context.Context, db *sql.DB, version int, script string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Read inside the transaction, which holds the write lock
+	var current int
+	if err := tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&current); err != nil {
+		return false, err
+	}
+	if current >= version {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return false, err
+	}
+	// PRAGMA does not accept parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,125 @@
+-- Schema of the PostgreSQL migrations up to 0006, translated to SQLite.
+-- Times are DATETIME columns holding UTC text, JSON is stored as TEXT.
+
+CREATE TABLE IF NOT EXISTS users (
+    id VARCHAR(36) PRIMARY KEY,
+    name VARCHAR(16) NOT NULL UNIQUE,
+    photo_url TEXT,
+    hide_last_seen BOOLEAN NOT NULL DEFAULT FALSE,
+    role VARCHAR(10) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator')),
+    suspended_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Conversations table
+CREATE TABLE IF NOT EXISTS conversations (
+    id VARCHAR(36) PRIMARY KEY,
+    name TEXT,
+    type VARCHAR(10) NOT NULL CHECK (type IN ('direct', 'group')),
+    photo_url TEXT,
+    last_activity DATETIME DEFAULT CURRENT_TIMESTAMP,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Conversation participants
+CREATE TABLE IF NOT EXISTS conversation_participants (
+    conversation_id VARCHAR(36) REFERENCES conversations(id) ON DELETE CASCADE,
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL DEFAULT 'member' CHECK (role IN ('member', 'admin')),
+    joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+-- Link previews cache, keyed by URL
+CREATE TABLE IF NOT EXISTS link_previews (
+    url TEXT PRIMARY KEY,
+    title TEXT,
+    description TEXT,
+    image_url TEXT,
+    fetched_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Messages table
+CREATE TABLE IF NOT EXISTS messages (
+    id VARCHAR(36) PRIMARY KEY,
+    conversation_id VARCHAR(36) REFERENCES conversations(id) ON DELETE CASCADE,
+    sender_id VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL,
+    content TEXT NOT NULL,
+    type VARCHAR(10) NOT NULL CHECK (type IN ('text', 'photo')),
+    status VARCHAR(10) NOT NULL CHECK (status IN ('sent', 'received', 'read')),
+    reply_to VARCHAR(36) REFERENCES messages(id) ON DELETE SET NULL,
+    timestamp DATETIME NOT NULL,
+    deleted_at DATETIME,
+    hidden_at DATETIME,
+    link_preview_url TEXT REFERENCES link_previews(url) ON DELETE SET NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Reactions (comments) table
+CREATE TABLE IF NOT EXISTS reactions (
+    message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, user_id)
+);
+
+-- Mentions of users inside text messages
+CREATE TABLE IF NOT EXISTS message_mentions (
+    message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE, -- NULL for @all
+    start_offset INTEGER NOT NULL,
+    length INTEGER NOT NULL,
+    PRIMARY KEY (message_id, start_offset)
+);
+
+-- Users blocked by other users
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    blocked_id VARCHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker_id, blocked_id),
+    CHECK (blocker_id <> blocked_id)
+);
+
+-- Reports of messages and users, with a snapshot of the reported content
+CREATE TABLE IF NOT EXISTS reports (
+    id VARCHAR(36) PRIMARY KEY,
+    reporter_id VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL,
+    target_type VARCHAR(10) NOT NULL CHECK (target_type IN ('message', 'user')),
+    message_id VARCHAR(36) REFERENCES messages(id) ON DELETE SET NULL,
+    user_id VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL,
+    reason VARCHAR(20) NOT NULL CHECK (reason IN ('spam', 'harassment', 'inappropriate', 'other')),
+    details TEXT,
+    snapshot TEXT NOT NULL CHECK (json_valid(snapshot)),
+    status VARCHAR(10) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved', 'dismissed')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    resolved_at DATETIME,
+    resolved_by VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Audit log of moderator actions
+CREATE TABLE IF NOT EXISTS moderation_actions (
+    id VARCHAR(36) PRIMARY KEY,
+    moderator_id VARCHAR(36) REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('hide_message', 'unhide_message', 'suspend_user', 'unsuspend_user', 'resolve_report', 'dismiss_report')),
+    target_id VARCHAR(36) NOT NULL,
+    report_id VARCHAR(36) REFERENCES reports(id) ON DELETE SET NULL,
+    reason TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX IF NOT EXISTS idx_users_name ON users(name);
+CREATE INDEX IF NOT EXISTS idx_conversations_last_activity ON conversations(last_activity);
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id);
+CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp);
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to);
+CREATE INDEX IF NOT EXISTS idx_messages_sender_id ON messages(sender_id);
+CREATE INDEX IF NOT EXISTS idx_reactions_message_id ON reactions(message_id);
+CREATE INDEX IF NOT EXISTS idx_message_mentions_user_id ON message_mentions(user_id);
+CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked_id ON user_blocks(blocked_id);
+CREATE INDEX IF NOT EXISTS idx_reports_status_created_at ON reports(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_moderation_actions_created_at ON moderation_actions(created_at);
@@ -0,0 +1,7 @@
+-- ID a client gives to a message it sends, so that sending it again after a failure
+-- returns the message instead of creating a duplicate. It is unique per sender.
+ALTER TABLE messages ADD COLUMN client_message_id TEXT;
+
+CREATE UNIQUE INDEX idx_messages_sender_client_message_id
+    ON messages(sender_id, client_message_id)
+    WHERE client_message_id IS NOT NULL;
@@ -0,0 +1,9 @@
+-- Preferences of each participant for a conversation: archived conversations are
+-- listed apart, muted ones stay archived when a message arrives, and pinned ones are
+-- listed first by position.
+ALTER TABLE conversation_participants ADD COLUMN archived BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE conversation_participants ADD COLUMN muted_until DATETIME;
+ALTER TABLE conversation_participants ADD COLUMN pin_position INTEGER;
+
+CREATE INDEX idx_conversation_participants_user_archived
+    ON conversation_participants(user_id, archived);
@@ -0,0 +1,10 @@
+-- The unread filter of the conversation list looks for the messages not read yet,
+-- which are few next to the others.
+CREATE INDEX idx_messages_conversation_unread
+    ON messages(conversation_id, sender_id)
+    WHERE status <> 'read' AND deleted_at IS NULL AND hidden_at IS NULL;
+
+-- Pages of the conversation list go on from the last activity and ID of the
+-- conversation ending the previous page.
+CREATE INDEX idx_conversations_last_activity_id
+    ON conversations(last_activity DESC, id DESC);
@@ -0,0 +1,3 @@
+-- The user directory matches the names in any case, which a NOCASE index serves for
+-- prefixes.
+CREATE INDEX idx_users_name_nocase ON users(name COLLATE NOCASE);
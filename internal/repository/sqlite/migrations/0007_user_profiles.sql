@@ -0,0 +1,6 @@
+-- What users tell the others about themselves, next to the unique name they log in
+-- with. The status text is no longer shown after status_expires_at.
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN status_text TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN status_expires_at DATETIME;
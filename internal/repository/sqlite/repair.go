@@ -0,0 +1,28 @@
+package sqlite
+
+import (
+	"context"
+
+	"github.com/fallenkarma/wasatext/internal/repository/sqlrepo"
+)
+
+// MergeDuplicateDirectConversations merges the direct conversations duplicating another
+// one between the same users, see sqlrepo.MergeDuplicateDirectConversations. It returns
+// how many conversations were merged away.
+func (r *SQLiteRepository) MergeDuplicateDirectConversations(ctx context.Context) (int, error) {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	merged, err := sqlrepo.MergeDuplicateDirectConversations(ctx, tx)
+	if err != nil {
+		return merged, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,70 @@
+package sqlite
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+func TestMergeDuplicateDirectConversations(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewSQLiteRepository(filepath.Join(dir, "wasatext.db"), filepath.Join(dir, "uploads"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	defer repo.Close()
+
+	alice, _ := repo.CreateUser(ctx, "alice")
+	bob, _ := repo.CreateUser(ctx, "bob")
+
+	// Two unkeyed conversations between the same users, as created before the unique key
+	for i, id := range []string{"old", "new"} {
+		_, err := repo.db.ExecContext(ctx, "INSERT INTO conversations (id, type, created_at, last_activity) VALUES ($1, 'direct', $2, $2)",
+			id, time.Date(2024, 1, 1+i, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, userID := range []string{alice.ID, bob.ID} {
+			if _, err := repo.db.ExecContext(ctx, "INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)", id, userID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := models.Message{Sender: *alice, Content: id, Type: models.TextMessage, Status: models.Sent}
+		if _, err := repo.CreateMessage(ctx, msg, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	merged, err := repo.MergeDuplicateDirectConversations(ctx)
+	if err != nil {
+		t.Fatalf("MergeDuplicateDirectConversations() error = %v", err)
+	}
+	if merged != 1 {
+		t.Errorf("MergeDuplicateDirectConversations() = %d, want 1", merged)
+	}
+
+	// The oldest conversation is kept with every message, and is found by its key
+	conv, created, err := repo.CreateDirectConversation(ctx, bob.ID, alice.ID)
+	if err != nil {
+		t.Fatalf("CreateDirectConversation() error = %v", err)
+	}
+	if conv.ID != "old" || created {
+		t.Errorf("CreateDirectConversation() = %s, %t, want old, false", conv.ID, created)
+	}
+	if len(conv.Messages) != 2 {
+		t.Errorf("messages of the kept conversation = %d, want 2", len(conv.Messages))
+	}
+	if gone, _ := repo.GetConversationByID(ctx, "new"); gone != nil {
+		t.Error("the duplicate conversation still exists")
+	}
+
+	// Running it again changes nothing
+	if merged, err := repo.MergeDuplicateDirectConversations(ctx); err != nil || merged != 0 {
+		t.Errorf("MergeDuplicateDirectConversations() again = %d, %v, want 0, nil", merged, err)
+	}
+}
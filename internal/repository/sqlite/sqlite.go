@@ -0,0 +1,1546 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/sqlrepo"
+	"github.com/fallenkarma/wasatext/internal/repository/uploads"
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteRepository implements the Repository interface on a single SQLite file.
+// Times are stored in UTC, so that their text form sorts chronologically.
+type SQLiteRepository struct {
+	db         *sql.DB
+	q          sqlrepo.Queryer // db, or tx inside WithTx
+	tx         *sql.Tx
+	uploadPath string
+}
+
+// NewSQLiteRepository opens or creates the database file at path and applies the
+// pending schema migrations, logging how many were applied to logger. The database
+// runs in WAL mode with foreign keys enforced.
+func NewSQLiteRepository(path string, uploadPath string, logger *slog.Logger) (*SQLiteRepository, error) {
+	source, err := dsn(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", source)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	applied, err := migrate(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if applied > 0 {
+		logger.Info("Applied schema migrations", "count", applied)
+	}
+
+	// Create upload directory if it doesn't exist
+	if err := os.MkdirAll(uploadPath, 0755); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteRepository{
+		db:         db,
+		q:          dialect.Instrument(db),
+		uploadPath: uploadPath,
+	}, nil
+}
+
+// dsn builds the connection string of a database file, with the pragmas set on every
+// connection of the pool. Write transactions take the write lock when they begin, so
+// that they wait for each other instead of failing when upgrading a read lock. The
+// parameters of path, such as mode or cache, are kept, but it cannot change these
+// settings.
+func dsn(path string) (string, error) {
+	path = strings.TrimPrefix(path, "sqlite://")
+	path = strings.TrimPrefix(path, "file:")
+	params := url.Values{}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		var err error
+		if params, err = url.ParseQuery(path[i+1:]); err != nil {
+			return "", fmt.Errorf("invalid database parameters: %w", err)
+		}
+		path = path[:i]
+	}
+
+	for _, name := range []string{"_time_format", "_txlock"} {
+		if params.Has(name) {
+			return "", fmt.Errorf("the database parameter %s cannot be changed", name)
+		}
+	}
+	for _, pragma := range params["_pragma"] {
+		name := strings.ToLower(pragma)
+		if i := strings.IndexAny(name, "(="); i >= 0 {
+			name = name[:i]
+		}
+		switch name = strings.TrimSpace(name); name {
+		case "foreign_keys", "journal_mode", "busy_timeout":
+			return "", fmt.Errorf("the database pragma %s cannot be changed", name)
+		}
+	}
+
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Set("_time_format", "sqlite")
+	params.Set("_txlock", "immediate")
+
+	return fmt.Sprintf("file:%s?%s", path, params.Encode()), nil
+}
+
+// Close closes the database connection
+func (r *SQLiteRepository) Close() error {
+	return r.db.Close()
+}
+
+// DB returns the connection pool of the repository
+func (r *SQLiteRepository) DB() *sql.DB {
+	return r.db
+}
+
+// Ping checks the connection to the database
+func (r *SQLiteRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+// UploadPath returns the directory the uploaded photos are stored in
+func (r *SQLiteRepository) UploadPath() string {
+	return r.uploadPath
+}
+
+// CreateUser implements UserRepository.CreateUser
+func (r *SQLiteRepository) CreateUser(ctx context.Context, name string) (*models.User, error) {
+	// Check if user with this name already exists
+	existingUser, _ := r.GetUserByName(ctx, name)
+	if existingUser != nil {
+		return existingUser, nil
+	}
+
+	// Generate a unique ID
+	id := uuid.New().String()
+
+	// Insert the new user
+	query := "INSERT INTO users (id, name) VALUES ($1, $2)"
+	_, err := r.q.ExecContext(ctx, query, id, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.User{
+		ID:   id,
+		Name: name,
+	}, nil
+}
+
+// userColumns are the users columns scanned by scanUser
+const userColumns = "id, name, photo_url, hide_last_seen, role, suspended_at, display_name, bio, status_text, status_expires_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser scans a user selected with userColumns, then the extra columns selected after them
+func scanUser(row rowScanner, extra ...interface{}) (*models.User, error) {
+	var user models.User
+	var photoURL sql.NullString
+	dest := append([]interface{}{&user.ID, &user.Name, &photoURL, &user.HideLastSeen, &user.Role, &user.SuspendedAt,
+		&user.DisplayName, &user.Bio, &user.StatusText, &user.StatusExpiresAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	if photoURL.Valid {
+		user.PhotoURL = photoURL.String
+	}
+	user.Profile = user.Profile.Current(time.Now())
+
+	return &user, nil
+}
+
+// GetUserByID implements UserRepository.GetUserByID
+func (r *SQLiteRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE id = $1"
+	user, err := scanUser(r.q.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserByName implements UserRepository.GetUserByName
+func (r *SQLiteRepository) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE name = $1"
+	user, err := scanUser(r.q.QueryRowContext(ctx, query, name))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// UpdateUsername implements UserRepository.UpdateUsername
+func (r *SQLiteRepository) UpdateUsername(ctx context.Context, userID string, newName string) error {
+	// Check if name is already in use
+	existingUser, _ := r.GetUserByName(ctx, newName)
+	if existingUser != nil && existingUser.ID != userID {
+		return fmt.Errorf("%w: username already in use", repository.ErrConflict)
+	}
+
+	query := "UPDATE users SET name = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, newName, userID)
+	return err
+}
+
+// SaveUserPhoto implements UserRepository.SaveUserPhoto
+func (r *SQLiteRepository) SaveUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error) {
+	relativePath, err := uploads.SavePhoto(r.uploadPath, uploads.UserPhotos, userID, photo)
+	if err != nil {
+		return "", err
+	}
+
+	// Update the user's photo URL in the database
+	query := "UPDATE users SET photo_url = $1 WHERE id = $2"
+	_, err = r.q.ExecContext(ctx, query, relativePath, userID)
+	if err != nil {
+		return "", err
+	}
+
+	return relativePath, nil
+}
+
+// SearchUsers implements UserRepository.SearchUsers
+func (r *SQLiteRepository) SearchUsers(ctx context.Context, viewerID string, filter models.UserFilter) ([]models.User, string, error) {
+	pattern := escapeLike(filter.Query)
+	args := []interface{}{viewerID, filter.Query, pattern + "%", "%" + pattern + "%"}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := ""
+	if filter.Cursor != "" {
+		after, err := repository.DecodeUserCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = "WHERE (match_rank, name) > (" + arg(after.Rank) + ", " + arg(after.Name) + ")"
+	}
+	query := `
+		SELECT ` + userColumns + `, match_rank FROM (
+			SELECT u.*, CASE
+				WHEN LOWER(u.name) = LOWER($2) THEN 0
+				WHEN u.name LIKE $3 ESCAPE '\' THEN 1
+				ELSE 2
+			END AS match_rank
+			FROM users u
+			WHERE u.id <> $1 AND u.name LIKE $4 ESCAPE '\'
+				AND NOT EXISTS (
+					SELECT 1 FROM user_blocks b
+					WHERE (b.blocker_id = $1 AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = $1)
+				)
+		) ranked
+		` + where + `
+		ORDER BY match_rank, name
+	`
+	if filter.Limit > 0 {
+		// One more than the page tells whether there is a next page
+		query += "LIMIT " + arg(filter.Limit+1)
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	var ranks []int
+	for rows.Next() {
+		var rank int
+		user, err := scanUser(rows, &rank)
+		if err != nil {
+			return nil, "", err
+		}
+		users = append(users, *user)
+		ranks = append(ranks, rank)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+		next = repository.EncodeCursor(repository.UserCursor{Rank: ranks[filter.Limit-1], Name: users[filter.Limit-1].Name})
+	}
+	return users, next, nil
+}
+
+// UpdatePrivacySettings implements UserRepository.UpdatePrivacySettings
+func (r *SQLiteRepository) UpdatePrivacySettings(ctx context.Context, userID string, hideLastSeen bool) error {
+	query := "UPDATE users SET hide_last_seen = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, hideLastSeen, userID)
+	return err
+}
+
+// UpdateProfile implements UserRepository.UpdateProfile
+func (r *SQLiteRepository) UpdateProfile(ctx context.Context, userID string, profile models.Profile) error {
+	var expiresAt *time.Time
+	if profile.StatusExpiresAt != nil {
+		utc := profile.StatusExpiresAt.UTC()
+		expiresAt = &utc
+	}
+	query := "UPDATE users SET display_name = $1, bio = $2, status_text = $3, status_expires_at = $4 WHERE id = $5"
+	_, err := r.q.ExecContext(ctx, query, profile.DisplayName, profile.Bio, profile.StatusText, expiresAt, userID)
+	return err
+}
+
+// CreateDirectConversation implements ConversationRepository.CreateDirectConversation
+func (r *SQLiteRepository) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, bool, error) {
+	key := repository.DirectKey(userID1, userID2)
+
+	// Start a transaction
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// The unique direct key lets a single one of concurrent requests create the conversation
+	id := uuid.New().String()
+	insertConvQuery := "INSERT INTO conversations (id, type, direct_key, last_activity) VALUES ($1, $2, $3, $4) ON CONFLICT (direct_key) DO NOTHING"
+	result, err := tx.ExecContext(ctx, insertConvQuery, id, models.DirectConversation, key, time.Now().UTC())
+	if err != nil {
+		return nil, false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if inserted == 0 {
+		// Conversation exists, return it
+		var conversationID string
+		err := tx.QueryRowContext(ctx, "SELECT id FROM conversations WHERE direct_key = $1", key).Scan(&conversationID)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+		conv, err := r.GetConversationByID(ctx, conversationID)
+		return conv, false, err
+	}
+
+	// Add participants
+	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)"
+	_, err = tx.ExecContext(ctx, insertPartQuery, id, userID1)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = tx.ExecContext(ctx, insertPartQuery, id, userID2)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	conv, err := r.GetConversationByID(ctx, id)
+	return conv, true, err
+}
+
+// CreateGroupConversation implements ConversationRepository.CreateGroupConversation
+func (r *SQLiteRepository) CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error) {
+	// Start a transaction
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Create a new conversation
+	id := uuid.New().String()
+	insertConvQuery := "INSERT INTO conversations (id, name, type, last_activity) VALUES ($1, $2, $3, $4)"
+	_, err = tx.ExecContext(ctx, insertConvQuery, id, name, models.GroupConversation, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	// Add participants, the creator being the group admin
+	insertPartQuery := "INSERT INTO conversation_participants (conversation_id, user_id, role) VALUES ($1, $2, $3)"
+	for _, userID := range participants {
+		role := models.MemberRole
+		if userID == creatorID {
+			role = models.AdminRole
+		}
+		_, err = tx.ExecContext(ctx, insertPartQuery, id, userID, role)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return r.GetConversationByID(ctx, id)
+}
+
+// GetConversationByID implements ConversationRepository.GetConversationByID
+func (r *SQLiteRepository) GetConversationByID(ctx context.Context, id string) (*models.Conversation, error) {
+	// Get conversation details
+	convQuery := "SELECT id, name, type, photo_url FROM conversations WHERE id = $1"
+	convRow := r.q.QueryRowContext(ctx, convQuery, id)
+
+	var conv models.Conversation
+	var name, photoURL sql.NullString
+	var convType string
+	err := convRow.Scan(&conv.ID, &name, &convType, &photoURL)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if name.Valid {
+		conv.Name = name.String
+	}
+	if photoURL.Valid {
+		conv.PhotoURL = photoURL.String
+	}
+	conv.Type = models.ConversationType(convType)
+
+	// Get participants
+	participants, err := r.queryParticipants(ctx, "cp.conversation_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	conv.Participants = participants[id]
+
+	// Get messages
+	messages, err := r.GetMessagesByConversationID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	conv.Messages = messages
+
+	// Set the last message if there are any messages
+	if len(messages) > 0 {
+		lastMsg := messages[len(messages)-1] // Assuming messages are ordered by timestamp desc
+		conv.LastMessage = &lastMsg
+	}
+
+	return &conv, nil
+}
+
+// queryParticipants loads the participants of the conversations matching where, by conversation
+func (r *SQLiteRepository) queryParticipants(ctx context.Context, where string, args ...interface{}) (map[string][]models.Participant, error) {
+	query := `
+		SELECT cp.conversation_id, cp.user_id, u.name, u.photo_url, cp.role, u.hide_last_seen, cp.archived, cp.muted_until, cp.pin_position,
+			u.display_name, u.bio, u.status_text, u.status_expires_at
+		FROM conversation_participants cp
+		JOIN users u ON u.id = cp.user_id
+		WHERE ` + where
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	participants := make(map[string][]models.Participant)
+	for rows.Next() {
+		var conversationID string
+		var participant models.Participant
+		var photoURL sql.NullString
+		var role string
+		var profile models.Profile
+		if err := rows.Scan(&conversationID, &participant.ID, &participant.Name, &photoURL, &role, &participant.HideLastSeen,
+			&participant.Settings.Archived, &participant.Settings.MutedUntil, &participant.Settings.PinPosition,
+			&profile.DisplayName, &profile.Bio, &profile.StatusText, &profile.StatusExpiresAt); err != nil {
+			return nil, err
+		}
+		participant.PhotoURL = photoURL.String
+		participant.Role = models.ParticipantRole(role)
+		participant.Profile = profile.Current(time.Now())
+		participants[conversationID] = append(participants[conversationID], participant)
+	}
+	return participants, rows.Err()
+}
+
+// GetConversationsByUserID implements ConversationRepository.GetConversationsByUserID.
+// One query selects the page, then one the participants and one the last messages of all of
+// its conversations.
+func (r *SQLiteRepository) GetConversationsByUserID(ctx context.Context, userID string, filter models.ConversationFilter) ([]models.Conversation, string, error) {
+	args := []interface{}{userID, filter.Archived}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"cp.user_id = $1", "cp.archived = $2"}
+	if filter.Type != "" {
+		where = append(where, "c.type = "+arg(string(filter.Type)))
+	}
+	if filter.Query != "" {
+		// The user's own name would match all of their conversations
+		pattern := arg("%" + escapeLike(filter.Query) + "%")
+		where = append(where, `(c.name LIKE `+pattern+` ESCAPE '\' OR EXISTS (
+			SELECT 1 FROM conversation_participants op
+			JOIN users ou ON ou.id = op.user_id
+			WHERE op.conversation_id = c.id AND op.user_id <> $1 AND ou.name LIKE `+pattern+` ESCAPE '\'
+		))`)
+	}
+	if filter.Unread {
+		where = append(where, `EXISTS (
+			SELECT 1 FROM messages um
+			WHERE um.conversation_id = c.id AND um.sender_id <> $1 AND um.status <> 'read'
+				AND um.deleted_at IS NULL AND um.hidden_at IS NULL
+		)`)
+	}
+	if filter.Cursor != "" {
+		after, err := repository.DecodeConversationCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		// After the last conversation of the previous page, in the order of the list
+		older := "(c.last_activity, c.id) < (" + arg(after.LastActivity.UTC()) + ", " + arg(after.ID) + ")"
+		if after.PinPosition != nil {
+			position := arg(*after.PinPosition)
+			where = append(where, "(cp.pin_position IS NULL OR cp.pin_position > "+position+" OR (cp.pin_position = "+position+" AND "+older+"))")
+		} else {
+			where = append(where, "cp.pin_position IS NULL AND "+older)
+		}
+	}
+
+	query := `
+		SELECT c.id, c.name, c.type, c.photo_url, c.last_activity, cp.pin_position
+		FROM conversations c
+		JOIN conversation_participants cp ON c.id = cp.conversation_id
+		WHERE ` + strings.Join(where, "\n\t\t\tAND ") + `
+		ORDER BY cp.pin_position IS NULL, cp.pin_position, c.last_activity DESC, c.id DESC
+	`
+	if filter.Limit > 0 {
+		// One more than the page tells whether there is a next page
+		query += "LIMIT " + arg(filter.Limit+1)
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var conversations []models.Conversation
+	var positions []repository.ConversationCursor
+	for rows.Next() {
+		var conv models.Conversation
+		var name, photoURL sql.NullString
+		var position repository.ConversationCursor
+		if err := rows.Scan(&conv.ID, &name, &conv.Type, &photoURL, &position.LastActivity, &position.PinPosition); err != nil {
+			return nil, "", err
+		}
+		conv.Name = name.String
+		conv.PhotoURL = photoURL.String
+		position.ID = conv.ID
+		conversations = append(conversations, conv)
+		positions = append(positions, position)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	// The rows must be closed before running other queries on the same transaction
+	rows.Close()
+
+	var next string
+	if filter.Limit > 0 && len(positions) > filter.Limit {
+		conversations = conversations[:filter.Limit]
+		next = repository.EncodeCursor(positions[filter.Limit-1])
+	}
+	if len(conversations) == 0 {
+		return conversations, next, nil
+	}
+
+	ids := make([]string, len(conversations))
+	for i, conv := range conversations {
+		ids[i] = conv.ID
+	}
+	list, listArgs := inList(ids)
+	participants, err := r.queryParticipants(ctx, "cp.conversation_id IN ("+list+")", listArgs...)
+	if err != nil {
+		return nil, "", err
+	}
+	lastMessages, err := r.queryMessages(ctx, messageSelect+`
+		WHERE m.id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY conversation_id ORDER BY timestamp DESC) AS n
+				FROM messages
+				WHERE conversation_id IN (`+list+`)
+			) WHERE n = 1
+		)
+	`, listArgs...)
+	if err != nil {
+		return nil, "", err
+	}
+	last := make(map[string]*models.Message, len(lastMessages))
+	for i := range lastMessages {
+		last[lastMessages[i].ConversationID] = &lastMessages[i]
+	}
+	for i := range conversations {
+		conversations[i].Participants = participants[conversations[i].ID]
+		conversations[i].LastMessage = last[conversations[i].ID]
+	}
+
+	return conversations, next, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, with backslashes
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// maxInList is the most ids put in an IN list, well below the limit of SQLite on the
+// arguments of a query
+const maxInList = 500
+
+// inList returns the placeholders of an IN list of ids, numbered from $1, and ids as arguments
+func inList(ids []string) (string, []interface{}) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = id
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// UpdateConversationSettings implements ConversationRepository.UpdateConversationSettings
+func (r *SQLiteRepository) UpdateConversationSettings(ctx context.Context, conversationID, userID string, settings models.ConversationSettings) error {
+	// Times are stored in UTC, to compare as text with the message timestamps
+	var mutedUntil *time.Time
+	if settings.MutedUntil != nil {
+		until := settings.MutedUntil.UTC()
+		mutedUntil = &until
+	}
+	query := `
+		UPDATE conversation_participants SET archived = $1, muted_until = $2, pin_position = $3
+		WHERE conversation_id = $4 AND user_id = $5
+	`
+	_, err := r.q.ExecContext(ctx, query, settings.Archived, mutedUntil, settings.PinPosition, conversationID, userID)
+	return err
+}
+
+// GetLastPinPosition implements ConversationRepository.GetLastPinPosition
+func (r *SQLiteRepository) GetLastPinPosition(ctx context.Context, userID string) (int, error) {
+	query := "SELECT COALESCE(MAX(pin_position), 0) FROM conversation_participants WHERE user_id = $1"
+	var last int
+	err := r.q.QueryRowContext(ctx, query, userID).Scan(&last)
+	return last, err
+}
+
+// AddUserToGroup implements ConversationRepository.AddUserToGroup
+func (r *SQLiteRepository) AddUserToGroup(ctx context.Context, groupID, userID string) error {
+	// Check if the conversation is a group
+	convQuery := "SELECT type FROM conversations WHERE id = $1"
+	var convType string
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if err != nil {
+		return err
+	}
+	if convType != string(models.GroupConversation) {
+		return errors.New("conversation is not a group")
+	}
+
+	// Check if user is already in the group
+	checkQuery := "SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2"
+	var count int
+	err = r.q.QueryRowContext(ctx, checkQuery, groupID, userID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: user is already in the group", repository.ErrConflict)
+	}
+
+	// Add user to the group
+	insertQuery := "INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)"
+	_, err = r.q.ExecContext(ctx, insertQuery, groupID, userID)
+	return err
+}
+
+// RemoveUserFromGroup implements ConversationRepository.RemoveUserFromGroup
+func (r *SQLiteRepository) RemoveUserFromGroup(ctx context.Context, groupID, userID string) error {
+	// Check if the conversation is a group
+	convQuery := "SELECT type FROM conversations WHERE id = $1"
+	var convType string
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if err != nil {
+		return err
+	}
+	if convType != string(models.GroupConversation) {
+		return errors.New("conversation is not a group")
+	}
+
+	// Remove user from the group
+	deleteQuery := "DELETE FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2"
+	result, err := r.q.ExecContext(ctx, deleteQuery, groupID, userID)
+	if err != nil {
+		return err
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: user is not in the group", repository.ErrNotFound)
+	}
+
+	// A group keeps an admin: when the last one leaves, the member who joined first takes over
+	promoteQuery := `
+		UPDATE conversation_participants SET role = 'admin'
+		WHERE conversation_id = $1
+			AND user_id = (SELECT user_id FROM conversation_participants WHERE conversation_id = $1 ORDER BY joined_at, rowid LIMIT 1)
+			AND NOT EXISTS (SELECT 1 FROM conversation_participants WHERE conversation_id = $1 AND role = 'admin')
+	`
+	_, err = r.q.ExecContext(ctx, promoteQuery, groupID)
+	return err
+}
+
+// UpdateGroupName implements ConversationRepository.UpdateGroupName
+func (r *SQLiteRepository) UpdateGroupName(ctx context.Context, groupID, name string) error {
+	// Check if the conversation is a group
+	convQuery := "SELECT type FROM conversations WHERE id = $1"
+	var convType string
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if err != nil {
+		return err
+	}
+	if convType != string(models.GroupConversation) {
+		return errors.New("conversation is not a group")
+	}
+
+	// Update the group name
+	updateQuery := "UPDATE conversations SET name = $1 WHERE id = $2"
+	_, err = r.q.ExecContext(ctx, updateQuery, name, groupID)
+	return err
+}
+
+// SaveGroupPhoto implements ConversationRepository.SaveGroupPhoto
+func (r *SQLiteRepository) SaveGroupPhoto(ctx context.Context, groupID string, photo multipart.File) (string, error) {
+	// Check if the conversation is a group
+	convQuery := "SELECT type FROM conversations WHERE id = $1"
+	var convType string
+	err := r.q.QueryRowContext(ctx, convQuery, groupID).Scan(&convType)
+	if err != nil {
+		return "", err
+	}
+	if convType != string(models.GroupConversation) {
+		return "", errors.New("conversation is not a group")
+	}
+
+	relativePath, err := uploads.SavePhoto(r.uploadPath, uploads.GroupPhotos, groupID, photo)
+	if err != nil {
+		return "", err
+	}
+
+	// Update the group's photo URL in the database
+	query := "UPDATE conversations SET photo_url = $1 WHERE id = $2"
+	_, err = r.q.ExecContext(ctx, query, relativePath, groupID)
+	if err != nil {
+		return "", err
+	}
+
+	return relativePath, nil
+}
+
+// CreateMessage implements MessageRepository.CreateMessage
+func (r *SQLiteRepository) CreateMessage(ctx context.Context, msg models.Message, conversationID string) (*models.Message, error) {
+	// Start a transaction
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// If no timestamp provided, use current time
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	// Insert the message. SQLite can't join the row returned by an INSERT, so it is
+	// read back as messageSelect does.
+	msgQuery := `
+		INSERT INTO messages (id, sender_id, conversation_id, content, type, status, reply_to, timestamp, client_message_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+	var id string
+	err = tx.QueryRowContext(ctx, msgQuery, uuid.New().String(), msg.Sender.ID, conversationID, msg.Content, msg.Type, msg.Status, msg.ReplyTo, msg.Timestamp.UTC(), nullString(msg.ClientMessageID)).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	created, err := scanMessage(tx.QueryRowContext(ctx, messageSelect+"WHERE m.id = $1", id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertMentions(ctx, tx, created.ID, msg.Mentions); err != nil {
+		return nil, err
+	}
+	created.Mentions = sortedMentions(msg.Mentions)
+
+	// Update the last activity timestamp of the conversation
+	updateConvQuery := "UPDATE conversations SET last_activity = $1 WHERE id = $2"
+	_, err = tx.ExecContext(ctx, updateConvQuery, created.Timestamp.UTC(), conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring the conversation back from the archives of the participants not muting it
+	unarchiveQuery := `
+		UPDATE conversation_participants SET archived = FALSE
+		WHERE conversation_id = $1 AND archived AND (muted_until IS NULL OR muted_until <= $2)
+	`
+	if _, err := tx.ExecContext(ctx, unarchiveQuery, conversationID, created.Timestamp.UTC()); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// sortedMentions returns a copy of mentions in the order GetMentionsByMessageID reads them
+func sortedMentions(mentions []models.Mention) []models.Mention {
+	sorted := append([]models.Mention(nil), mentions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+	return sorted
+}
+
+// insertMentions stores the mentions of a message inside the given transaction
+func insertMentions(ctx context.Context, tx sqlrepo.Queryer, messageID string, mentions []models.Mention) error {
+	query := "INSERT INTO message_mentions (message_id, user_id, start_offset, length) VALUES ($1, $2, $3, $4)"
+	for _, mention := range mentions {
+		var userID sql.NullString
+		if !mention.All {
+			userID = sql.NullString{String: mention.UserID, Valid: true}
+		}
+		if _, err := tx.ExecContext(ctx, query, messageID, userID, mention.Offset, mention.Length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMessagesByConversationID implements MessageRepository.GetMessagesByConversationID
+func (r *SQLiteRepository) GetMessagesByConversationID(ctx context.Context, conversationID string) ([]models.Message, error) {
+	// Get messages with user information
+	query := messageSelect + `
+		WHERE m.conversation_id = $1
+		ORDER BY m.timestamp ASC
+	`
+	return r.queryMessages(ctx, query, conversationID)
+}
+
+// messageColumns are the columns of a message row scanned by scanMessage, with its
+// sender, link preview and the preview of the message it replies to
+var messageColumns = `
+	m.id, m.conversation_id, m.sender_id, u.name, u.photo_url, u.display_name, u.bio, u.status_text, u.status_expires_at, m.content, m.type, m.status, m.reply_to, m.timestamp, m.deleted_at, m.hidden_at,
+	m.client_message_id, lp.url, lp.title, lp.description, lp.image_url,
+	rm.sender_id, ru.name, rm.type,
+	CASE WHEN rm.deleted_at IS NULL AND rm.hidden_at IS NULL THEN substr(rm.content, 1, ` + replyPreviewLength + `) ELSE '' END`
+
+// replyPreviewLength is models.ReplyPreviewLength, to be written in queries
+var replyPreviewLength = strconv.Itoa(models.ReplyPreviewLength)
+
+// messageSelect selects the message rows scanned by queryMessages
+var messageSelect = "SELECT " + messageColumns + `
+	FROM messages m
+	INNER JOIN users u ON m.sender_id = u.id
+	LEFT JOIN link_previews lp ON lp.url = m.link_preview_url
+	LEFT JOIN messages rm ON rm.id = m.reply_to
+	LEFT JOIN users ru ON ru.id = rm.sender_id
+`
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage scans a row of messageColumns
+func scanMessage(row scanner) (models.Message, error) {
+	var msg models.Message
+	var photoURL sql.NullString // Handle potential NULL photo_url
+	var previewURL, previewTitle, previewDescription, previewImage sql.NullString
+	var clientMessageID sql.NullString
+	var replySenderID, replySenderName, replyType, replyContent sql.NullString
+
+	if err := row.Scan(
+		&msg.ID,                     // m.id
+		&msg.ConversationID,         // m.conversation_id
+		&msg.Sender.ID,              // m.sender_id (User.ID)
+		&msg.Sender.Name,            // u.name (User.Name)
+		&photoURL,                   // u.photo_url (User.PhotoURL)
+		&msg.Sender.DisplayName,     // u.display_name
+		&msg.Sender.Bio,             // u.bio
+		&msg.Sender.StatusText,      // u.status_text
+		&msg.Sender.StatusExpiresAt, // u.status_expires_at
+		&msg.Content,                // m.content
+		&msg.Type,                   // m.type
+		&msg.Status,                 // m.status
+		&msg.ReplyTo,                // m.reply_to
+		&msg.Timestamp,              // m.timestamp
+		&msg.DeletedAt,              // m.deleted_at
+		&msg.HiddenAt,               // m.hidden_at
+		&clientMessageID,            // m.client_message_id
+		&previewURL,                 // lp.url
+		&previewTitle,               // lp.title
+		&previewDescription,         // lp.description
+		&previewImage,               // lp.image_url
+		&replySenderID,              // rm.sender_id
+		&replySenderName,            // ru.name
+		&replyType,                  // rm.type
+		&replyContent,               // rm.content, cut
+	); err != nil {
+		return msg, err
+	}
+
+	// Handle nullable photo URL
+	if photoURL.Valid {
+		msg.Sender.PhotoURL = photoURL.String
+	}
+	msg.Sender.Profile = msg.Sender.Profile.Current(time.Now())
+
+	msg.ClientMessageID = clientMessageID.String
+
+	if previewURL.Valid {
+		msg.LinkPreview = &models.LinkPreview{
+			URL:         previewURL.String,
+			Title:       previewTitle.String,
+			Description: previewDescription.String,
+			ImageURL:    previewImage.String,
+		}
+	}
+
+	if replyType.Valid {
+		msg.ReplyPreview = &models.ReplyPreview{
+			Sender:  models.User{ID: replySenderID.String, Name: replySenderName.String},
+			Type:    models.MessageType(replyType.String),
+			Content: replyContent.String,
+		}
+	}
+
+	return msg, nil
+}
+
+// queryMessages runs a query selecting message rows and loads their reactions and mentions
+func (r *SQLiteRepository) queryMessages(ctx context.Context, query string, args ...interface{}) ([]models.Message, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The rows must be closed before running other queries on the same transaction
+	rows.Close()
+
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	reactions := make(map[string][]models.Reaction)
+	mentions := make(map[string][]models.Mention)
+	for start := 0; start < len(messages); start += maxInList {
+		var ids []string
+		for _, msg := range messages[start:min(start+maxInList, len(messages))] {
+			ids = append(ids, msg.ID)
+		}
+		list, listArgs := inList(ids)
+		chunkReactions, err := r.queryReactions(ctx, "message_id IN ("+list+")", listArgs...)
+		if err != nil {
+			return nil, err
+		}
+		chunkMentions, err := r.queryMentions(ctx, "message_id IN ("+list+")", listArgs...)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(reactions, chunkReactions)
+		maps.Copy(mentions, chunkMentions)
+	}
+
+	for i := range messages {
+		msg := &messages[i]
+		msg.Reactions = reactions[msg.ID]
+
+		// The content of hidden messages is kept for unhiding them, but never read back
+		if msg.HiddenAt != nil {
+			msg.Content = ""
+			msg.LinkPreview = nil
+			continue
+		}
+		msg.Mentions = mentions[msg.ID]
+	}
+
+	return messages, nil
+}
+
+// GetMessageByClientID implements MessageRepository.GetMessageByClientID
+func (r *SQLiteRepository) GetMessageByClientID(ctx context.Context, senderID, clientMessageID string) (*models.Message, error) {
+	query := messageSelect + `
+		WHERE m.sender_id = $1 AND m.client_message_id = $2
+	`
+	messages, err := r.queryMessages(ctx, query, senderID, clientMessageID)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// GetMessageByID implements MessageRepository.GetMessageByID
+func (r *SQLiteRepository) GetMessageByID(ctx context.Context, id string) (*models.Message, error) {
+	query := messageSelect + `
+		WHERE m.id = $1
+	`
+	messages, err := r.queryMessages(ctx, query, id)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// DeleteMessage implements MessageRepository.DeleteMessage
+func (r *SQLiteRepository) DeleteMessage(ctx context.Context, id string) error {
+	// Soft delete by setting the deleted_at timestamp
+	query := "UPDATE messages SET deleted_at = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, time.Now().UTC(), id)
+	return err
+}
+
+// UpdateMessageStatus implements MessageRepository.UpdateMessageStatus
+func (r *SQLiteRepository) UpdateMessageStatus(ctx context.Context, id string, status models.MessageStatus) error {
+	query := "UPDATE messages SET status = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, status, id)
+	return err
+}
+
+// UpdateMessageContent implements MessageRepository.UpdateMessageContent
+func (r *SQLiteRepository) UpdateMessageContent(ctx context.Context, id string, content string, mentions []models.Mention) error {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE messages SET content = $1 WHERE id = $2"
+	if _, err := tx.ExecContext(ctx, query, content, id); err != nil {
+		return err
+	}
+
+	// Replace the mentions of the previous content
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_mentions WHERE message_id = $1", id); err != nil {
+		return err
+	}
+	if err := insertMentions(ctx, tx, id, mentions); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SaveMessagePhoto implements MessageRepository.SaveMessagePhoto
+func (r *SQLiteRepository) SaveMessagePhoto(ctx context.Context, senderID string, photo multipart.File) (string, error) {
+	return uploads.SavePhoto(r.uploadPath, uploads.MessagePhotos, senderID, photo)
+}
+
+// AddReaction implements ReactionRepository.AddReaction
+func (r *SQLiteRepository) AddReaction(ctx context.Context, messageID, userID, emoji string) error {
+	// Check if reaction already exists
+	checkQuery := "SELECT COUNT(*) FROM reactions WHERE message_id = $1 AND user_id = $2"
+	var count int
+	err := r.q.QueryRowContext(ctx, checkQuery, messageID, userID).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		// Update existing reaction
+		updateQuery := "UPDATE reactions SET emoji = $1 WHERE message_id = $2 AND user_id = $3"
+		_, err = r.q.ExecContext(ctx, updateQuery, emoji, messageID, userID)
+		return err
+	}
+
+	// Insert new reaction
+	insertQuery := "INSERT INTO reactions (message_id, user_id, emoji) VALUES ($1, $2, $3)"
+	_, err = r.q.ExecContext(ctx, insertQuery, messageID, userID, emoji)
+	return err
+}
+
+// RemoveReaction implements ReactionRepository.RemoveReaction
+func (r *SQLiteRepository) RemoveReaction(ctx context.Context, messageID, userID string) error {
+	deleteQuery := "DELETE FROM reactions WHERE message_id = $1 AND user_id = $2"
+	result, err := r.q.ExecContext(ctx, deleteQuery, messageID, userID)
+	if err != nil {
+		return err
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("reaction %w", repository.ErrNotFound)
+	}
+
+	return nil
+}
+
+// GetReactionsByMessageID implements ReactionRepository.GetReactionsByMessageID
+func (r *SQLiteRepository) GetReactionsByMessageID(ctx context.Context, messageID string) ([]models.Reaction, error) {
+	reactions, err := r.queryReactions(ctx, "message_id = $1", messageID)
+	return reactions[messageID], err
+}
+
+// queryReactions loads the reactions matching where, by message
+func (r *SQLiteRepository) queryReactions(ctx context.Context, where string, args ...interface{}) (map[string][]models.Reaction, error) {
+	query := "SELECT message_id, user_id, emoji FROM reactions WHERE " + where
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[string][]models.Reaction)
+	for rows.Next() {
+		var reaction models.Reaction
+		if err := rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Emoji); err != nil {
+			return nil, err
+		}
+		reactions[reaction.MessageID] = append(reactions[reaction.MessageID], reaction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reactions, nil
+}
+
+// GetMentionsByMessageID implements MentionRepository.GetMentionsByMessageID
+func (r *SQLiteRepository) GetMentionsByMessageID(ctx context.Context, messageID string) ([]models.Mention, error) {
+	mentions, err := r.queryMentions(ctx, "message_id = $1", messageID)
+	return mentions[messageID], err
+}
+
+// queryMentions loads the mentions matching where, by message and in the order of the text
+func (r *SQLiteRepository) queryMentions(ctx context.Context, where string, args ...interface{}) (map[string][]models.Mention, error) {
+	query := "SELECT message_id, user_id, start_offset, length FROM message_mentions WHERE " + where + " ORDER BY start_offset"
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := make(map[string][]models.Mention)
+	for rows.Next() {
+		var messageID string
+		var mention models.Mention
+		var userID sql.NullString
+		if err := rows.Scan(&messageID, &userID, &mention.Offset, &mention.Length); err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			mention.UserID = userID.String
+		} else {
+			mention.All = true
+		}
+		mentions[messageID] = append(mentions[messageID], mention)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return mentions, nil
+}
+
+// GetMentionedMessages implements MentionRepository.GetMentionedMessages
+func (r *SQLiteRepository) GetMentionedMessages(ctx context.Context, userID string) ([]models.Message, error) {
+	// @all mentions only count for conversations the user is still part of
+	query := messageSelect + `
+		INNER JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = $1
+		WHERE m.deleted_at IS NULL
+			AND m.hidden_at IS NULL
+			AND m.sender_id <> $1
+			AND EXISTS (
+				SELECT 1 FROM message_mentions mm
+				WHERE mm.message_id = m.id AND (mm.user_id = $1 OR mm.user_id IS NULL)
+			)
+		ORDER BY m.timestamp DESC
+	`
+	return r.queryMessages(ctx, query, userID)
+}
+
+// GetLinkPreview implements LinkPreviewRepository.GetLinkPreview
+func (r *SQLiteRepository) GetLinkPreview(ctx context.Context, url string) (*models.LinkPreview, error) {
+	query := "SELECT url, title, description, image_url, fetched_at FROM link_previews WHERE url = $1"
+	row := r.q.QueryRowContext(ctx, query, url)
+
+	var preview models.LinkPreview
+	var title, description, imageURL sql.NullString
+	err := row.Scan(&preview.URL, &title, &description, &imageURL, &preview.FetchedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	preview.Title = title.String
+	preview.Description = description.String
+	preview.ImageURL = imageURL.String
+
+	return &preview, nil
+}
+
+// SaveLinkPreview implements LinkPreviewRepository.SaveLinkPreview
+func (r *SQLiteRepository) SaveLinkPreview(ctx context.Context, preview models.LinkPreview) error {
+	if preview.FetchedAt.IsZero() {
+		preview.FetchedAt = time.Now().UTC()
+	}
+
+	query := `
+		INSERT INTO link_previews (url, title, description, image_url, fetched_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (url) DO UPDATE
+		SET title = EXCLUDED.title, description = EXCLUDED.description, image_url = EXCLUDED.image_url, fetched_at = EXCLUDED.fetched_at
+	`
+	_, err := r.q.ExecContext(ctx, query, preview.URL, preview.Title, preview.Description, preview.ImageURL, preview.FetchedAt.UTC())
+	return err
+}
+
+// SetMessageLinkPreview implements LinkPreviewRepository.SetMessageLinkPreview
+func (r *SQLiteRepository) SetMessageLinkPreview(ctx context.Context, messageID, url string) error {
+	var previewURL sql.NullString
+	if url != "" {
+		previewURL = sql.NullString{String: url, Valid: true}
+	}
+
+	query := "UPDATE messages SET link_preview_url = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, previewURL, messageID)
+	return err
+}
+
+// BlockUser implements BlockRepository.BlockUser
+func (r *SQLiteRepository) BlockUser(ctx context.Context, blockerID, blockedID string) error {
+	query := "INSERT INTO user_blocks (blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	_, err := r.q.ExecContext(ctx, query, blockerID, blockedID)
+	return err
+}
+
+// UnblockUser implements BlockRepository.UnblockUser
+func (r *SQLiteRepository) UnblockUser(ctx context.Context, blockerID, blockedID string) error {
+	query := "DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2"
+	result, err := r.q.ExecContext(ctx, query, blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: user is not blocked", repository.ErrNotFound)
+	}
+
+	return nil
+}
+
+// IsBlocked implements BlockRepository.IsBlocked
+func (r *SQLiteRepository) IsBlocked(ctx context.Context, blockerID, blockedID string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2)"
+	var blocked bool
+	err := r.q.QueryRowContext(ctx, query, blockerID, blockedID).Scan(&blocked)
+	return blocked, err
+}
+
+// GetBlockedUserIDs implements BlockRepository.GetBlockedUserIDs
+func (r *SQLiteRepository) GetBlockedUserIDs(ctx context.Context, blockerID string) ([]string, error) {
+	query := "SELECT blocked_id FROM user_blocks WHERE blocker_id = $1"
+	rows, err := r.q.QueryContext(ctx, query, blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blockedIDs []string
+	for rows.Next() {
+		var blockedID string
+		if err := rows.Scan(&blockedID); err != nil {
+			return nil, err
+		}
+		blockedIDs = append(blockedIDs, blockedID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blockedIDs, nil
+}
+
+// GetBlockerIDs implements BlockRepository.GetBlockerIDs
+func (r *SQLiteRepository) GetBlockerIDs(ctx context.Context, blockedID string) ([]string, error) {
+	query := "SELECT blocker_id FROM user_blocks WHERE blocked_id = $1"
+	rows, err := r.q.QueryContext(ctx, query, blockedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blockerIDs []string
+	for rows.Next() {
+		var blockerID string
+		if err := rows.Scan(&blockerID); err != nil {
+			return nil, err
+		}
+		blockerIDs = append(blockerIDs, blockerID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blockerIDs, nil
+}
+
+// reportColumns are the reports columns scanned by scanReport
+const reportColumns = "id, reporter_id, target_type, message_id, user_id, reason, details, snapshot, status, created_at, resolved_at, resolved_by"
+
+// scanReport scans a report selected with reportColumns
+func scanReport(row rowScanner) (*models.Report, error) {
+	var report models.Report
+	var reporterID, messageID, userID, details, resolvedBy sql.NullString
+	var snapshot []byte
+	err := row.Scan(&report.ID, &reporterID, &report.TargetType, &messageID, &userID, &report.Reason, &details,
+		&snapshot, &report.Status, &report.CreatedAt, &report.ResolvedAt, &resolvedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	report.ReporterID = reporterID.String
+	report.MessageID = messageID.String
+	report.UserID = userID.String
+	report.Details = details.String
+	report.Snapshot = snapshot
+	report.ResolvedBy = resolvedBy.String
+
+	return &report, nil
+}
+
+// nullString maps an empty string to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// CreateReport implements ModerationRepository.CreateReport
+func (r *SQLiteRepository) CreateReport(ctx context.Context, report models.Report) (*models.Report, error) {
+	report.ID = uuid.New().String()
+	report.Status = models.OpenReport
+	report.CreatedAt = time.Now().UTC()
+
+	query := `
+		INSERT INTO reports (id, reporter_id, target_type, message_id, user_id, reason, details, snapshot, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	_, err := r.q.ExecContext(ctx, query, report.ID, report.ReporterID, report.TargetType, nullString(report.MessageID),
+		nullString(report.UserID), report.Reason, nullString(report.Details), string(report.Snapshot), report.Status, report.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// GetReportByID implements ModerationRepository.GetReportByID
+func (r *SQLiteRepository) GetReportByID(ctx context.Context, id string) (*models.Report, error) {
+	query := "SELECT " + reportColumns + " FROM reports WHERE id = $1"
+	report, err := scanReport(r.q.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// GetReports implements ModerationRepository.GetReports
+func (r *SQLiteRepository) GetReports(ctx context.Context, status models.ReportStatus) ([]models.Report, error) {
+	query := "SELECT " + reportColumns + " FROM reports WHERE $1 = '' OR status = $1 ORDER BY created_at ASC"
+	rows, err := r.q.QueryContext(ctx, query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// CloseReport implements ModerationRepository.CloseReport
+func (r *SQLiteRepository) CloseReport(ctx context.Context, id string, status models.ReportStatus, moderatorID string) error {
+	query := "UPDATE reports SET status = $1, resolved_at = $2, resolved_by = $3 WHERE id = $4"
+	result, err := r.q.ExecContext(ctx, query, status, time.Now().UTC(), moderatorID, id)
+	if err != nil {
+		return err
+	}
+
+	// Check if any rows were affected
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("report %w", repository.ErrNotFound)
+	}
+
+	return nil
+}
+
+// SetMessageHidden implements ModerationRepository.SetMessageHidden
+func (r *SQLiteRepository) SetMessageHidden(ctx context.Context, messageID string, hidden bool) error {
+	var hiddenAt *time.Time
+	if hidden {
+		now := time.Now().UTC()
+		hiddenAt = &now
+	}
+
+	query := "UPDATE messages SET hidden_at = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, hiddenAt, messageID)
+	return err
+}
+
+// SetUserSuspended implements ModerationRepository.SetUserSuspended
+func (r *SQLiteRepository) SetUserSuspended(ctx context.Context, userID string, suspended bool) error {
+	var suspendedAt *time.Time
+	if suspended {
+		now := time.Now().UTC()
+		suspendedAt = &now
+	}
+
+	query := "UPDATE users SET suspended_at = $1 WHERE id = $2"
+	_, err := r.q.ExecContext(ctx, query, suspendedAt, userID)
+	return err
+}
+
+// CreateModerationAction implements ModerationRepository.CreateModerationAction
+func (r *SQLiteRepository) CreateModerationAction(ctx context.Context, action models.ModerationAction) error {
+	if action.ID == "" {
+		action.ID = uuid.New().String()
+	}
+	if action.CreatedAt.IsZero() {
+		action.CreatedAt = time.Now().UTC()
+	}
+
+	query := `
+		INSERT INTO moderation_actions (id, moderator_id, action, target_id, report_id, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := r.q.ExecContext(ctx, query, action.ID, action.ModeratorID, action.Action, action.TargetID,
+		nullString(action.ReportID), nullString(action.Reason), action.CreatedAt.UTC())
+	return err
+}
+
+// GetModerationActions implements ModerationRepository.GetModerationActions
+func (r *SQLiteRepository) GetModerationActions(ctx context.Context) ([]models.ModerationAction, error) {
+	query := `
+		SELECT id, moderator_id, action, target_id, report_id, reason, created_at
+		FROM moderation_actions
+		ORDER BY created_at DESC
+	`
+	rows, err := r.q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []models.ModerationAction
+	for rows.Next() {
+		var action models.ModerationAction
+		var moderatorID, reportID, reason sql.NullString
+		if err := rows.Scan(&action.ID, &moderatorID, &action.Action, &action.TargetID, &reportID, &reason, &action.CreatedAt); err != nil {
+			return nil, err
+		}
+		action.ModeratorID = moderatorID.String
+		action.ReportID = reportID.String
+		action.Reason = reason.String
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
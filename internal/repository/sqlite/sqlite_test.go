@@ -0,0 +1,173 @@
+package sqlite
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/repotest"
+	"github.com/fallenkarma/wasatext/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repository.Repository {
+		dir := t.TempDir()
+		repo, err := NewSQLiteRepository(filepath.Join(dir, "wasatext.db"), filepath.Join(dir, "uploads"), slog.New(slog.DiscardHandler))
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository() error = %v", err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
+
+func TestDSNParameters(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wasatext.db")
+	repo, err := NewSQLiteRepository(path, filepath.Join(dir, "uploads"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	repo.Close()
+
+	// The parameters of the path are kept
+	readOnly, err := NewSQLiteRepository("file:"+path+"?mode=ro", filepath.Join(dir, "uploads"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() read-only error = %v", err)
+	}
+	defer readOnly.Close()
+	if _, err := readOnly.CreateUser(ctx, "alice"); err == nil {
+		t.Error("CreateUser() succeeded on a read-only database")
+	}
+
+	// except the ones the repository relies on
+	for _, params := range []string{"_pragma=foreign_keys(0)", "_pragma=journal_mode=DELETE", "_txlock=deferred", "_time_format=x"} {
+		if _, err := dsn(path + "?" + params); err == nil {
+			t.Errorf("dsn() accepted %s", params)
+		}
+	}
+}
+
+func TestLongConversation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewSQLiteRepository(filepath.Join(dir, "wasatext.db"), filepath.Join(dir, "uploads"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	defer repo.Close()
+
+	alice, err := repo.CreateUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := repo.CreateUser(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv, _, err := repo.CreateDirectConversation(ctx, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More messages than an IN list holds, with a reaction to the last one
+	start := time.Now()
+	var last *models.Message
+	for i := 0; i <= maxInList; i++ {
+		last, err = repo.CreateMessage(ctx, models.Message{
+			Sender:    models.User{ID: alice.ID},
+			Content:   "hi",
+			Type:      models.TextMessage,
+			Status:    models.Sent,
+			Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+		}, conv.ID)
+		if err != nil {
+			t.Fatalf("CreateMessage() error = %v", err)
+		}
+	}
+	if err := repo.AddReaction(ctx, last.ID, bob.ID, "👍"); err != nil {
+		t.Fatalf("AddReaction() error = %v", err)
+	}
+
+	messages, err := repo.GetMessagesByConversationID(ctx, conv.ID)
+	if err != nil {
+		t.Fatalf("GetMessagesByConversationID() error = %v", err)
+	}
+	if len(messages) != maxInList+1 || messages[maxInList].ID != last.ID || len(messages[maxInList].Reactions) != 1 {
+		t.Errorf("GetMessagesByConversationID() returned %d messages, want %d with a reaction to the last one", len(messages), maxInList+1)
+	}
+}
+
+func TestStatementSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracing.NewProvider(recorder))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	dir := t.TempDir()
+	repo, err := NewSQLiteRepository(filepath.Join(dir, "wasatext.db"), filepath.Join(dir, "uploads"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	defer repo.Close()
+	recorder.Reset()
+
+	ctx, parent := tracing.Start(context.Background(), "test")
+	if _, err := repo.CreateUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	var statements int
+	for _, span := range recorder.Ended() {
+		if span.Name() == "test" {
+			continue
+		}
+		statements++
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span %s is not a child of the calling span", span.Name())
+		}
+		attrs := make(map[string]string)
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		if attrs["db.system"] != "sqlite" || attrs["db.operation.name"] != span.Name() || attrs["db.query.text"] == "" {
+			t.Errorf("span %s attributes = %v", span.Name(), attrs)
+		}
+	}
+	if statements == 0 {
+		t.Error("no statement span recorded")
+	}
+}
+
+func TestCheckMigrations(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewSQLiteRepository(filepath.Join(dir, "wasatext.db"), filepath.Join(dir, "uploads"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	defer repo.Close()
+
+	if err := repo.Ping(ctx); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	if err := repo.CheckMigrations(ctx); err != nil {
+		t.Errorf("CheckMigrations() error = %v after opening", err)
+	}
+
+	// As a database left behind by an older server
+	if _, err := repo.db.ExecContext(ctx, "PRAGMA user_version = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CheckMigrations(ctx); err == nil {
+		t.Error("CheckMigrations() succeeded on an outdated database")
+	}
+}
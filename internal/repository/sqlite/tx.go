@@ -0,0 +1,40 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/sqlrepo"
+)
+
+// dialect describes SQLite to the code shared with the other SQL repositories.
+// Transactions take the write lock when they begin (see dsn), so they never conflict.
+var dialect = sqlrepo.Dialect{
+	Driver: "sqlite",
+	System: "sqlite",
+}
+
+// begin starts the transaction of a repository method, or joins the one of WithTx
+func (r *SQLiteRepository) begin(ctx context.Context) (*sqlrepo.ScopedTx, error) {
+	return dialect.Begin(ctx, r.db, r.tx)
+}
+
+// WithTx implements repository.Transactor.WithTx. Transactions take the write lock of
+// the database when they begin (see dsn), so they never conflict and are not retried:
+// concurrent ones wait for each other up to the busy timeout. Calling WithTx on the
+// repository of a transaction joins that transaction.
+func (r *SQLiteRepository) WithTx(ctx context.Context, fn func(repo repository.Repository) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+
+	return dialect.WithTx(ctx, r.db, func(tx *sql.Tx) error {
+		return fn(&SQLiteRepository{
+			db:         r.db,
+			q:          dialect.Instrument(tx),
+			tx:         tx,
+			uploadPath: r.uploadPath,
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package sqlrepo
+
+import (
+	"context"
+)
+
+// MergeDuplicateDirectConversations merges, inside tx, the direct conversations duplicating
+// another one between the same users, which could be created before direct conversations
+// had a unique key. Each pair keeps its keyed conversation, or its oldest one, which
+// receives the messages of the duplicates. It returns how many conversations were merged away.
+func MergeDuplicateDirectConversations(ctx context.Context, tx Queryer) (int, error) {
+	query := `
+		SELECT c.id, c.direct_key IS NOT NULL, MIN(p.user_id) || ':' || MAX(p.user_id)
+		FROM conversations c
+		JOIN conversation_participants p ON p.conversation_id = c.id
+		WHERE c.type = 'direct'
+		GROUP BY c.id, c.direct_key, c.created_at
+		ORDER BY c.created_at, c.id
+	`
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	// Conversations of each pair, the one to keep first
+	var keys []string
+	byKey := make(map[string][]string)
+	for rows.Next() {
+		var id, key string
+		var keyed bool
+		if err := rows.Scan(&id, &keyed, &key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		if keyed {
+			byKey[key] = append([]string{id}, byKey[key]...)
+		} else {
+			byKey[key] = append(byKey[key], id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	merged := 0
+	for _, key := range keys {
+		keep, duplicates := byKey[key][0], byKey[key][1:]
+		for _, duplicate := range duplicates {
+			if _, err := tx.ExecContext(ctx, "UPDATE messages SET conversation_id = $1 WHERE conversation_id = $2", keep, duplicate); err != nil {
+				return merged, err
+			}
+			updateActivityQuery := `
+				UPDATE conversations
+				SET last_activity = (SELECT MAX(last_activity) FROM conversations WHERE id IN ($1, $2))
+				WHERE id = $1
+			`
+			if _, err := tx.ExecContext(ctx, updateActivityQuery, keep, duplicate); err != nil {
+				return merged, err
+			}
+			// The participants are deleted along with the conversation
+			if _, err := tx.ExecContext(ctx, "DELETE FROM conversations WHERE id = $1", duplicate); err != nil {
+				return merged, err
+			}
+			merged++
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE conversations SET direct_key = $1 WHERE id = $2 AND direct_key IS NULL", key, keep); err != nil {
+			return merged, err
+		}
+	}
+
+	return merged, nil
+}
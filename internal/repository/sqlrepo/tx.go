@@ -0,0 +1,134 @@
+// Package sqlrepo is the plumbing shared by the repositories on SQL databases: the
+// instrumented statements, the transactions and the repairs of the data. Each backend
+// describes the differences of its database with a Dialect.
+package sqlrepo
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/metrics"
+	"github.com/fallenkarma/wasatext/internal/tracing"
+)
+
+// MaxTxAttempts bounds how many times WithTx runs a transaction failing on conflicts
+const MaxTxAttempts = 5
+
+// Dialect describes a database to the shared code
+type Dialect struct {
+	Driver    string               // label of the database in the metrics
+	System    string               // db.system of the statement spans
+	TxOptions *sql.TxOptions       // options of the transactions of WithTx
+	Retryable func(err error) bool // whether a transaction failing with err may succeed again, nil if none may
+}
+
+// Queryer is implemented by both *sql.DB and *sql.Tx
+type Queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Instrument returns q running every statement in a span and recording its duration in the
+// metrics. Both cover the execution of a query, not the reading of its rows.
+func (d Dialect) Instrument(q Queryer) Queryer {
+	return instrumentedQueryer{q: q, dialect: d}
+}
+
+type instrumentedQueryer struct {
+	q       Queryer
+	dialect Dialect
+}
+
+func (t instrumentedQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	defer metrics.ObserveQuery(t.dialect.Driver, query, time.Now())
+	ctx, span := tracing.StartQuery(ctx, t.dialect.System, query)
+	defer func() { tracing.End(span, err) }()
+	return t.q.ExecContext(ctx, query, args...)
+}
+
+func (t instrumentedQueryer) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	defer metrics.ObserveQuery(t.dialect.Driver, query, time.Now())
+	ctx, span := tracing.StartQuery(ctx, t.dialect.System, query)
+	defer func() { tracing.End(span, err) }()
+	return t.q.QueryContext(ctx, query, args...)
+}
+
+func (t instrumentedQueryer) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	defer metrics.ObserveQuery(t.dialect.Driver, query, time.Now())
+	ctx, span := tracing.StartQuery(ctx, t.dialect.System, query)
+	row := t.q.QueryRowContext(ctx, query, args...)
+	tracing.End(span, row.Err())
+	return row
+}
+
+// ScopedTx is the transaction of a repository method writing several rows. Inside
+// WithTx the method joins the enclosing transaction and leaves committing it to WithTx.
+type ScopedTx struct {
+	Queryer
+	owned *sql.Tx
+}
+
+// Commit commits the transaction if the method started it
+func (t *ScopedTx) Commit() error {
+	if t.owned == nil {
+		return nil
+	}
+	return t.owned.Commit()
+}
+
+// Rollback rolls back the transaction if the method started it
+func (t *ScopedTx) Rollback() error {
+	if t.owned == nil {
+		return nil
+	}
+	return t.owned.Rollback()
+}
+
+// Begin starts the transaction of a repository method on db, or joins tx, the one of
+// WithTx, when it is not nil
+func (d Dialect) Begin(ctx context.Context, db *sql.DB, tx *sql.Tx) (*ScopedTx, error) {
+	if tx != nil {
+		return &ScopedTx{Queryer: d.Instrument(tx)}, nil
+	}
+
+	owned, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ScopedTx{Queryer: d.Instrument(owned), owned: owned}, nil
+}
+
+// WithTx runs fn in a transaction on db, committed when fn succeeds. When it fails with an
+// error d.Retryable, it runs again up to MaxTxAttempts times.
+func (d Dialect) WithTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := d.runTx(ctx, db, fn)
+		if err == nil || d.Retryable == nil || !d.Retryable(err) || attempt == MaxTxAttempts {
+			return err
+		}
+
+		// Back off a little, longer after each conflict
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt*attempt) * 10 * time.Millisecond):
+		}
+	}
+}
+
+// runTx runs fn in a single transaction
+func (d Dialect) runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, d.TxOptions)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
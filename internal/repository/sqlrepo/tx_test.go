@@ -0,0 +1,69 @@
+package sqlrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestWithTxRetries(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "tx.db"))
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE attempts (n INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	errConflict := errors.New("conflict")
+	dialect := Dialect{Driver: "sqlite", System: "sqlite", Retryable: func(err error) bool {
+		return errors.Is(err, errConflict)
+	}}
+
+	// A conflicting transaction runs again, and only its successful run is committed
+	runs := 0
+	err = dialect.WithTx(ctx, db, func(tx *sql.Tx) error {
+		runs++
+		if _, err := tx.ExecContext(ctx, "INSERT INTO attempts (n) VALUES ($1)", runs); err != nil {
+			return err
+		}
+		if runs < 3 {
+			return errConflict
+		}
+		return nil
+	})
+	if err != nil || runs != 3 {
+		t.Fatalf("WithTx() = %v after %d runs, want success after 3", err, runs)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT n FROM attempts").Scan(&n); err != nil || n != 3 {
+		t.Errorf("committed run = %d, %v, want the third one only", n, err)
+	}
+
+	// Giving up after MaxTxAttempts runs
+	runs = 0
+	err = dialect.WithTx(ctx, db, func(tx *sql.Tx) error {
+		runs++
+		return errConflict
+	})
+	if !errors.Is(err, errConflict) || runs != MaxTxAttempts {
+		t.Errorf("WithTx() = %v after %d runs, want %v after %d", err, runs, errConflict, MaxTxAttempts)
+	}
+
+	// Other errors are not retried
+	runs = 0
+	errOther := errors.New("other")
+	err = dialect.WithTx(ctx, db, func(tx *sql.Tx) error {
+		runs++
+		return errOther
+	})
+	if !errors.Is(err, errOther) || runs != 1 {
+		t.Errorf("WithTx() = %v after %d runs, want %v after 1", err, runs, errOther)
+	}
+}
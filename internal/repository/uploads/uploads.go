@@ -0,0 +1,46 @@
+package uploads
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/metrics"
+)
+
+// Directories of the uploaded photos, relative to the uploads base path
+const (
+	UserPhotos    = "user_photos"
+	GroupPhotos   = "group_photos"
+	MessagePhotos = "message_photos"
+)
+
+// SavePhoto stores a photo owned by ownerID under basePath/dir and returns the
+// URL path it is served at, /uploads/<dir>/<file>
+func SavePhoto(basePath, dir, ownerID string, photo io.Reader) (string, error) {
+	// Create the photos directory if it doesn't exist
+	photosDir := filepath.Join(basePath, dir)
+	if err := os.MkdirAll(photosDir, 0755); err != nil {
+		return "", err
+	}
+
+	// Generate a unique filename
+	filename := fmt.Sprintf("%s_%d.jpg", ownerID, time.Now().Unix())
+
+	// Save the file
+	dst, err := os.Create(filepath.Join(photosDir, filename))
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	written, err := io.Copy(dst, photo)
+	metrics.UploadBytes.WithLabelValues(dir).Add(float64(written))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("/uploads/%s/%s", dir, filename), nil
+}
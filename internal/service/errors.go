@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// Kinds of the errors returned by the service. Errors are wrapped with %w around one
+// of them, so callers match the kind with errors.Is and show the message to the user.
+// The missing and conflicting records are the kinds of the repository errors, which
+// keep their kind when returned as is.
+var (
+	// ErrNotFound is returned when a user, conversation, message or report does not exist
+	ErrNotFound = repository.ErrNotFound
+
+	// ErrForbidden is returned when the user is not allowed to perform the operation
+	ErrForbidden = errors.New("not allowed")
+
+	// ErrValidation is returned when the input of an operation is invalid
+	ErrValidation = errors.New("invalid request")
+
+	// ErrConflict is returned when an operation conflicts with the current state
+	ErrConflict = repository.ErrConflict
+)
+
+// notFound returns an ErrNotFound error naming what was not found
+func notFound(what string) error {
+	return fmt.Errorf("%s %w", what, ErrNotFound)
+}
+
+// forbidden returns an ErrForbidden error with the reason of the refusal
+func forbidden(reason string) error {
+	return fmt.Errorf("%w: %s", ErrForbidden, reason)
+}
+
+// invalid returns an ErrValidation error describing the invalid input
+func invalid(reason string) error {
+	return fmt.Errorf("%w: %s", ErrValidation, reason)
+}
+
+// conflict returns an ErrConflict error describing the conflicting state
+func conflict(reason string) error {
+	return fmt.Errorf("%w: %s", ErrConflict, reason)
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// mentionAll is the keyword group admins can use to mention every participant
+const mentionAll = "all"
+
+// parseMentions finds the @name references to participants in a message content.
+// When allowAll is set, @all is recognised as a mention of the whole conversation.
+func parseMentions(content string, participants []models.Participant, allowAll bool) []models.Mention {
+	runes := []rune(content)
+
+	var mentions []models.Mention
+	for i := 0; i < len(runes); i++ {
+		// A mention starts with '@' at the beginning of the content or after a non-word character
+		if runes[i] != '@' || (i > 0 && isMentionRune(runes[i-1])) {
+			continue
+		}
+		rest := runes[i+1:]
+
+		var mention *models.Mention
+		if allowAll && matchesName(rest, mentionAll) {
+			mention = &models.Mention{All: true, Length: len(mentionAll)}
+		} else {
+			// Prefer the longest name so that "@anna" is not taken for "@ann"
+			for _, participant := range participants {
+				length := len([]rune(participant.Name))
+				if matchesName(rest, participant.Name) && (mention == nil || length > mention.Length) {
+					mention = &models.Mention{UserID: participant.ID, Length: length}
+				}
+			}
+		}
+		if mention == nil {
+			continue
+		}
+
+		mention.Offset = i
+		mention.Length++ // Include the '@'
+		mentions = append(mentions, *mention)
+		i += mention.Length - 1
+	}
+
+	return mentions
+}
+
+// matchesName reports whether text starts with name, ignoring case, followed by a word boundary
+func matchesName(text []rune, name string) bool {
+	nameRunes := []rune(name)
+	if len(nameRunes) == 0 || len(text) < len(nameRunes) {
+		return false
+	}
+	if !strings.EqualFold(string(text[:len(nameRunes)]), name) {
+		return false
+	}
+	return len(text) == len(nameRunes) || !isMentionRune(text[len(nameRunes)])
+}
+
+// isMentionRune reports whether r can be part of a mentioned name
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// conversationMentions parses the mentions of a text sent by senderID in conv
+func conversationMentions(conv *models.Conversation, senderID, content string) []models.Mention {
+	allowAll := false
+	if conv.Type == models.GroupConversation {
+		for _, participant := range conv.Participants {
+			if participant.ID == senderID && participant.Role == models.AdminRole {
+				allowAll = true
+				break
+			}
+		}
+	}
+
+	return parseMentions(content, conv.Participants, allowAll)
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+func TestParseMentions(t *testing.T) {
+	participants := []models.Participant{
+		{ID: "1", Name: "ann"},
+		{ID: "2", Name: "anna"},
+		{ID: "3", Name: "bob"},
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		allowAll bool
+		want     []models.Mention
+	}{
+		{"at the start", "@bob hi", false, []models.Mention{{UserID: "3", Offset: 0, Length: 4}}},
+		{"any case", "hi @BOB", false, []models.Mention{{UserID: "3", Offset: 3, Length: 4}}},
+		{"offsets in runes", "ciao 👋 @bob", false, []models.Mention{{UserID: "3", Offset: 7, Length: 4}}},
+		{"around punctuation", "(@ann), @bob.", false, []models.Mention{
+			{UserID: "1", Offset: 1, Length: 4},
+			{UserID: "3", Offset: 8, Length: 4},
+		}},
+		{"longest name", "@anna!", false, []models.Mention{{UserID: "2", Offset: 0, Length: 5}}},
+		{"unknown name", "@dave hi", false, nil},
+		{"longer word", "@bobby", false, nil},
+		{"inside a word", "mail@bob.com", false, nil},
+		{"lone at sign", "@ @", false, nil},
+		{"all allowed", "@all look", true, []models.Mention{{All: true, Offset: 0, Length: 4}}},
+		{"all not allowed", "@all look", false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMentions(tt.content, participants, tt.allowAll); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMentions(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConversationMentionsAll(t *testing.T) {
+	group := &models.Conversation{
+		Type: models.GroupConversation,
+		Participants: []models.Participant{
+			{ID: "1", Name: "ann", Role: models.AdminRole},
+			{ID: "2", Name: "bob", Role: models.MemberRole},
+		},
+	}
+	direct := &models.Conversation{Type: models.DirectConversation, Participants: group.Participants}
+
+	tests := []struct {
+		name     string
+		conv     *models.Conversation
+		senderID string
+		want     bool
+	}{
+		{"group admin", group, "1", true},
+		{"group member", group, "2", false},
+		{"direct conversation", direct, "1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mentions := conversationMentions(tt.conv, tt.senderID, "@all")
+			if got := len(mentions) == 1 && mentions[0].All; got != tt.want {
+				t.Errorf("conversationMentions(@all) = %+v, want a mention of all: %v", mentions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// ErrNotModerator is returned when a moderation operation is requested by a regular user
+var ErrNotModerator = fmt.Errorf("%w: moderator role required", ErrForbidden)
+
+// validReportReason reports whether reason is one of the known report reasons
+func validReportReason(reason models.ReportReason) bool {
+	switch reason {
+	case models.SpamReason, models.HarassmentReason, models.InappropriateReason, models.OtherReason:
+		return true
+	}
+	return false
+}
+
+// ReportMessage reports a message the reporter can see to the moderators
+func (s *WASATextService) ReportMessage(ctx context.Context, reporterID, messageID string, reason models.ReportReason, details string) (*models.Report, error) {
+	if !validReportReason(reason) {
+		return nil, invalid("unknown report reason")
+	}
+
+	// Only the participants of the conversation can see, and so report, the message
+	msg, err := s.policy.CanReadMessage(ctx, reporterID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Sender.ID == reporterID {
+		return nil, forbidden("users cannot report their own messages")
+	}
+	// The content of a hidden message is no longer read, and moderators already acted on it
+	if msg.HiddenAt != nil {
+		return nil, conflict("the message is already hidden")
+	}
+
+	snapshot, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repo.CreateReport(ctx, models.Report{
+		ReporterID: reporterID,
+		TargetType: models.MessageReport,
+		MessageID:  msg.ID,
+		UserID:     msg.Sender.ID,
+		Reason:     reason,
+		Details:    details,
+		Snapshot:   snapshot,
+	})
+}
+
+// ReportUser reports a user to the moderators
+func (s *WASATextService) ReportUser(ctx context.Context, reporterID, userID string, reason models.ReportReason, details string) (*models.Report, error) {
+	if !validReportReason(reason) {
+		return nil, invalid("unknown report reason")
+	}
+	if reporterID == userID {
+		return nil, invalid("users cannot report themselves")
+	}
+
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, notFound("user")
+	}
+
+	snapshot, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repo.CreateReport(ctx, models.Report{
+		ReporterID: reporterID,
+		TargetType: models.UserReport,
+		UserID:     user.ID,
+		Reason:     reason,
+		Details:    details,
+		Snapshot:   snapshot,
+	})
+}
+
+// GetReports lists the reports with the given status, or all of them when status is empty
+func (s *WASATextService) GetReports(ctx context.Context, moderatorID string, status models.ReportStatus) ([]models.Report, error) {
+	if err := s.policy.CanModerate(ctx, moderatorID); err != nil {
+		return nil, err
+	}
+	switch status {
+	case "", models.OpenReport, models.ResolvedReport, models.DismissedReport:
+	default:
+		return nil, invalid("unknown report status")
+	}
+
+	return s.repo.GetReports(ctx, status)
+}
+
+// CloseReport marks a report as resolved or dismissed
+func (s *WASATextService) CloseReport(ctx context.Context, moderatorID, reportID string, status models.ReportStatus, reason string) error {
+	if err := s.policy.CanModerate(ctx, moderatorID); err != nil {
+		return err
+	}
+
+	action := models.ResolveReportAction
+	switch status {
+	case models.ResolvedReport:
+	case models.DismissedReport:
+		action = models.DismissReportAction
+	default:
+		return invalid("status must be resolved or dismissed")
+	}
+
+	// The report is never closed without its entry in the audit log
+	return s.inTx(ctx, func(tx *WASATextService) error {
+		if err := tx.repo.CloseReport(ctx, reportID, status, moderatorID); err != nil {
+			return err
+		}
+
+		return tx.repo.CreateModerationAction(ctx, models.ModerationAction{
+			ModeratorID: moderatorID,
+			Action:      action,
+			TargetID:    reportID,
+			ReportID:    reportID,
+			Reason:      reason,
+		})
+	})
+}
+
+// SetMessageHidden hides a message from every participant, or shows it again
+func (s *WASATextService) SetMessageHidden(ctx context.Context, moderatorID, messageID string, hidden bool, reason, reportID string) error {
+	if err := s.policy.CanModerate(ctx, moderatorID); err != nil {
+		return err
+	}
+
+	action := models.HideMessageAction
+	if !hidden {
+		action = models.UnhideMessageAction
+	}
+
+	return s.inTx(ctx, func(tx *WASATextService) error {
+		msg, err := tx.repo.GetMessageByID(ctx, messageID)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			return notFound("message")
+		}
+		if err := tx.checkReport(ctx, reportID, func(report *models.Report) bool {
+			return report.TargetType == models.MessageReport && report.MessageID == messageID
+		}); err != nil {
+			return err
+		}
+
+		if err := tx.repo.SetMessageHidden(ctx, messageID, hidden); err != nil {
+			return err
+		}
+
+		return tx.repo.CreateModerationAction(ctx, models.ModerationAction{
+			ModeratorID: moderatorID,
+			Action:      action,
+			TargetID:    messageID,
+			ReportID:    reportID,
+			Reason:      reason,
+		})
+	})
+}
+
+// SetUserSuspended suspends a user, who can no longer use the API, or reinstates them
+func (s *WASATextService) SetUserSuspended(ctx context.Context, moderatorID, userID string, suspended bool, reason, reportID string) error {
+	if err := s.policy.CanModerate(ctx, moderatorID); err != nil {
+		return err
+	}
+	if moderatorID == userID {
+		return forbidden("moderators cannot suspend themselves")
+	}
+
+	action := models.SuspendUserAction
+	if !suspended {
+		action = models.UnsuspendUserAction
+	}
+
+	return s.inTx(ctx, func(tx *WASATextService) error {
+		user, err := tx.repo.GetUserByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return notFound("user")
+		}
+		// A report of one of their messages is about the user too
+		if err := tx.checkReport(ctx, reportID, func(report *models.Report) bool {
+			return report.UserID == userID
+		}); err != nil {
+			return err
+		}
+
+		if err := tx.repo.SetUserSuspended(ctx, userID, suspended); err != nil {
+			return err
+		}
+
+		return tx.repo.CreateModerationAction(ctx, models.ModerationAction{
+			ModeratorID: moderatorID,
+			Action:      action,
+			TargetID:    userID,
+			ReportID:    reportID,
+			Reason:      reason,
+		})
+	})
+}
+
+// checkReport returns an error unless reportID is empty or names an existing report
+// for which about is true, the report a moderation action is taken on
+func (s *WASATextService) checkReport(ctx context.Context, reportID string, about func(report *models.Report) bool) error {
+	if reportID == "" {
+		return nil
+	}
+	report, err := s.repo.GetReportByID(ctx, reportID)
+	if err != nil {
+		return err
+	}
+	if report == nil {
+		return notFound("report")
+	}
+	if !about(report) {
+		return invalid("the report is about another target")
+	}
+	return nil
+}
+
+// GetModerationLog lists the moderator actions, newest first
+func (s *WASATextService) GetModerationLog(ctx context.Context, moderatorID string) ([]models.ModerationAction, error) {
+	if err := s.policy.CanModerate(ctx, moderatorID); err != nil {
+		return nil, err
+	}
+
+	return s.repo.GetModerationActions(ctx)
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+	"github.com/fallenkarma/wasatext/internal/repository/memory"
+)
+
+// moderatorRepo grants the moderator role to one user, which the repositories
+// otherwise leave to the database administrator
+type moderatorRepo struct {
+	repository.Repository
+	moderatorID string
+}
+
+func (r *moderatorRepo) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	user, err := r.Repository.GetUserByID(ctx, id)
+	if user != nil && user.ID == r.moderatorID {
+		user.Role = models.Moderator
+	}
+	return user, err
+}
+
+func (r *moderatorRepo) WithTx(ctx context.Context, fn func(repo repository.Repository) error) error {
+	return r.Repository.WithTx(ctx, func(tx repository.Repository) error {
+		return fn(&moderatorRepo{Repository: tx, moderatorID: r.moderatorID})
+	})
+}
+
+// newModerationFixture returns a service in which alice reported a message bob sent
+// to their group ("message"), and carol ("user"), along with the IDs of the users,
+// the messages and the reports. mod is a moderator.
+func newModerationFixture(t *testing.T) (*WASATextService, map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+	mem := memory.NewMemoryRepository(t.TempDir())
+
+	ids := make(map[string]string)
+	for _, name := range []string{"alice", "bob", "carol", "mod"} {
+		user, err := mem.CreateUser(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = user.ID
+	}
+	svc := New(&moderatorRepo{Repository: mem, moderatorID: ids["mod"]}, nil)
+
+	group, err := svc.CreateGroupConversation(ctx, "group", ids["alice"], []string{ids["bob"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := svc.SendTextMessage(ctx, ids["bob"], group.ID, "hello", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["message"] = msg.ID
+	answer, err := svc.SendTextMessage(ctx, ids["alice"], group.ID, "hi bob", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["answer"] = answer.ID
+
+	report, err := svc.ReportMessage(ctx, ids["alice"], msg.ID, models.SpamReason, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["messageReport"] = report.ID
+	report, err = svc.ReportUser(ctx, ids["alice"], ids["carol"], models.HarassmentReason, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids["userReport"] = report.ID
+
+	return svc, ids
+}
+
+func TestModerationActionReports(t *testing.T) {
+	tests := []struct {
+		name   string
+		action func(svc *WASATextService, ids map[string]string) error
+		want   error
+	}{
+		{"hide with a missing report", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetMessageHidden(context.Background(), ids["mod"], ids["message"], true, "", "missing")
+		}, ErrNotFound},
+		{"hide with the report of another message", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetMessageHidden(context.Background(), ids["mod"], ids["answer"], true, "", ids["messageReport"])
+		}, ErrValidation},
+		{"hide with the report of a user", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetMessageHidden(context.Background(), ids["mod"], ids["message"], true, "", ids["userReport"])
+		}, ErrValidation},
+		{"hide with the report of the message", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetMessageHidden(context.Background(), ids["mod"], ids["message"], true, "", ids["messageReport"])
+		}, nil},
+		{"suspend with a missing report", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetUserSuspended(context.Background(), ids["mod"], ids["bob"], true, "", "missing")
+		}, ErrNotFound},
+		{"suspend with the report of another user", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetUserSuspended(context.Background(), ids["mod"], ids["bob"], true, "", ids["userReport"])
+		}, ErrValidation},
+		{"suspend with the report of the user", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetUserSuspended(context.Background(), ids["mod"], ids["carol"], true, "", ids["userReport"])
+		}, nil},
+		{"suspend with the report of a message of the user", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetUserSuspended(context.Background(), ids["mod"], ids["bob"], true, "", ids["messageReport"])
+		}, nil},
+		{"suspend without a report", func(svc *WASATextService, ids map[string]string) error {
+			return svc.SetUserSuspended(context.Background(), ids["mod"], ids["bob"], true, "", "")
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, ids := newModerationFixture(t)
+			err := tt.action(svc, ids)
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+
+			// A refused action changes nothing, and leaves no entry in the audit log
+			actions, err := svc.GetModerationLog(context.Background(), ids["mod"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.want == nil; (len(actions) == 1) != want {
+				t.Errorf("audit log = %+v, want an entry: %t", actions, want)
+			}
+		})
+	}
+}
+
+func TestReportHiddenMessage(t *testing.T) {
+	svc, ids := newModerationFixture(t)
+	ctx := context.Background()
+
+	if err := svc.SetMessageHidden(ctx, ids["mod"], ids["message"], true, "spam", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ReportMessage(ctx, ids["alice"], ids["message"], models.SpamReason, ""); !errors.Is(err, ErrConflict) {
+		t.Errorf("ReportMessage() of a hidden message error = %v, want ErrConflict", err)
+	}
+}
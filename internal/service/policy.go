@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/repository"
+)
+
+// Policy decides what a user is allowed to do. The service asks it before every operation
+// performed on behalf of a user, except those on the user's own account. Each check loads
+// what the decision depends on and returns it, so that the caller doesn't load it again.
+// Refusals are ErrForbidden errors, and missing resources ErrNotFound ones.
+type Policy struct {
+	repo repository.Repository
+}
+
+// NewPolicy creates a policy reading from repo
+func NewPolicy(repo repository.Repository) *Policy {
+	return &Policy{repo: repo}
+}
+
+// CanReadConversation allows the participants of a conversation to read it
+func (p *Policy) CanReadConversation(ctx context.Context, userID, conversationID string) (*models.Conversation, error) {
+	conv, err := p.repo.GetConversationByID(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conv == nil {
+		return nil, notFound("conversation")
+	}
+	if !isParticipant(conv, userID) {
+		return nil, forbidden("user is not a participant in the conversation")
+	}
+	return conv, nil
+}
+
+// CanPostTo allows the participants of a conversation to write in it, unless it is a
+// direct conversation and the other user blocked them
+func (p *Policy) CanPostTo(ctx context.Context, userID, conversationID string) (*models.Conversation, error) {
+	conv, err := p.CanReadConversation(ctx, userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.Type == models.DirectConversation {
+		for _, participant := range conv.Participants {
+			if participant.ID != userID {
+				if err := p.checkNotBlockedBy(ctx, userID, participant.ID); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return conv, nil
+}
+
+// CanStartConversation allows a user to start a conversation with existing users who
+// didn't block them
+func (p *Policy) CanStartConversation(ctx context.Context, creatorID string, participantIDs []string) error {
+	if err := p.checkUsersExist(ctx, participantIDs...); err != nil {
+		return err
+	}
+	return p.checkNotBlockedBy(ctx, creatorID, participantIDs...)
+}
+
+// CanModifyGroup allows the members of a group to change it, and to leave it
+func (p *Policy) CanModifyGroup(ctx context.Context, userID, groupID string) (*models.Conversation, error) {
+	group, err := p.repo.GetConversationByID(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil || group.Type != models.GroupConversation {
+		return nil, notFound("group")
+	}
+	if !isParticipant(group, userID) {
+		return nil, forbidden("user is not a participant in the group")
+	}
+	return group, nil
+}
+
+// CanAddToGroup allows the members of a group to add an existing user who didn't block them
+func (p *Policy) CanAddToGroup(ctx context.Context, userID, groupID, newMemberID string) (*models.Conversation, error) {
+	group, err := p.CanModifyGroup(ctx, userID, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkUsersExist(ctx, newMemberID); err != nil {
+		return nil, err
+	}
+	if err := p.checkNotBlockedBy(ctx, userID, newMemberID); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// CanReadMessage allows the participants of the conversation of a message to read it
+func (p *Policy) CanReadMessage(ctx context.Context, userID, messageID string) (*models.Message, error) {
+	msg, err := p.repo.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, notFound("message")
+	}
+	if _, err := p.CanReadConversation(ctx, userID, msg.ConversationID); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// CanReactTo allows the participants of the conversation of a message to react to it,
+// unless a moderator hid it
+func (p *Policy) CanReactTo(ctx context.Context, userID, messageID string) (*models.Message, error) {
+	msg, err := p.CanReadMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.HiddenAt != nil {
+		return nil, notFound("message")
+	}
+	return msg, nil
+}
+
+// CanModifyMessage allows the sender of a message to update or delete it while they can
+// still read its conversation, unless a moderator hid it
+func (p *Policy) CanModifyMessage(ctx context.Context, userID, messageID string) (*models.Message, error) {
+	msg, err := p.CanReadMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.HiddenAt != nil {
+		return nil, notFound("message")
+	}
+	if msg.Sender.ID != userID {
+		return nil, forbidden("only the sender can modify a message")
+	}
+	return msg, nil
+}
+
+// CanModerate allows the users with the moderator role to use the moderation operations
+func (p *Policy) CanModerate(ctx context.Context, userID string) error {
+	user, err := p.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Role != models.Moderator {
+		return ErrNotModerator
+	}
+	return nil
+}
+
+// checkUsersExist returns an ErrNotFound error unless all the users exist
+func (p *Policy) checkUsersExist(ctx context.Context, userIDs ...string) error {
+	for _, userID := range userIDs {
+		user, err := p.repo.GetUserByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return notFound(fmt.Sprintf("user %s", userID))
+		}
+	}
+	return nil
+}
+
+// checkNotBlockedBy returns ErrBlocked when any of the given users blocked userID
+func (p *Policy) checkNotBlockedBy(ctx context.Context, userID string, blockerIDs ...string) error {
+	for _, blockerID := range blockerIDs {
+		if blockerID == userID {
+			continue
+		}
+		blocked, err := p.repo.IsBlocked(ctx, blockerID, userID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return ErrBlocked
+		}
+	}
+	return nil
+}
+
+// isParticipant reports whether the user takes part in the conversation
+func isParticipant(conv *models.Conversation, userID string) bool {
+	for _, participant := range conv.Participants {
+		if participant.ID == userID {
+			return true
+		}
+	}
+	return false
+}
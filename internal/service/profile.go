@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// GetUserProfile gets what a user shows the others: their name, photo and profile.
+// Users viewing themselves get all of their account.
+func (s *WASATextService) GetUserProfile(ctx context.Context, viewerID, userID string) (*models.User, error) {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, notFound("user")
+	}
+	if userID == viewerID {
+		return user, nil
+	}
+
+	public := user.Public()
+	return &public, nil
+}
+
+// UpdateProfile changes the name and the profile fields given in req, and returns the
+// user as updated
+func (s *WASATextService) UpdateProfile(ctx context.Context, userID string, req models.UpdateProfileRequest) (*models.User, error) {
+	var updated *models.User
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		user, err := tx.repo.GetUserByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return notFound("user")
+		}
+
+		profile, err := patchProfile(user.Profile, req, time.Now())
+		if err != nil {
+			return err
+		}
+		if req.Name != nil && *req.Name != user.Name {
+			if err := tx.UpdateUsername(ctx, userID, *req.Name); err != nil {
+				return err
+			}
+		}
+		if err := tx.repo.UpdateProfile(ctx, userID, profile); err != nil {
+			return err
+		}
+
+		updated, err = tx.repo.GetUserByID(ctx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// patchProfile returns profile with the fields given in req. A new status text comes
+// with its own expiry, none when req leaves it out.
+func patchProfile(profile models.Profile, req models.UpdateProfileRequest, now time.Time) (models.Profile, error) {
+	if req.DisplayName != nil {
+		profile.DisplayName = strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(profile.DisplayName) > models.MaxDisplayNameLength {
+			return profile, invalid(fmt.Sprintf("the display name must be at most %d characters", models.MaxDisplayNameLength))
+		}
+	}
+	if req.Bio != nil {
+		profile.Bio = strings.TrimSpace(*req.Bio)
+		if utf8.RuneCountInString(profile.Bio) > models.MaxBioLength {
+			return profile, invalid(fmt.Sprintf("the bio must be at most %d characters", models.MaxBioLength))
+		}
+	}
+
+	if req.StatusText == nil {
+		if req.StatusExpiresAt != nil {
+			return profile, invalid("the status expiry can only be set along the status text")
+		}
+		return profile, nil
+	}
+	profile.StatusText = strings.TrimSpace(*req.StatusText)
+	profile.StatusExpiresAt = req.StatusExpiresAt
+	if utf8.RuneCountInString(profile.StatusText) > models.MaxStatusTextLength {
+		return profile, invalid(fmt.Sprintf("the status must be at most %d characters", models.MaxStatusTextLength))
+	}
+	if profile.StatusText == "" {
+		profile.StatusExpiresAt = nil
+	} else if profile.StatusExpiresAt != nil && !profile.StatusExpiresAt.After(now) {
+		return profile, invalid("a status can only expire at a time to come")
+	}
+	return profile, nil
+}
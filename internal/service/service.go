@@ -2,29 +2,129 @@ package service
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"mime/multipart"
+	"time"
 
+	"github.com/fallenkarma/wasatext/internal/linkpreview"
+	"github.com/fallenkarma/wasatext/internal/metrics"
 	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/presence"
 	"github.com/fallenkarma/wasatext/internal/repository"
 )
 
-// Service defines the business logic for the WASAText application
-type Service struct {
-	repo repository.Repository
+// ErrBlocked is returned when an operation is refused because a user blocked another
+var ErrBlocked = fmt.Errorf("%w: blocked by the user", ErrForbidden)
+
+// LinkUnfurler queues the preview of a link found in a message
+type LinkUnfurler interface {
+	Enqueue(messageID, url string) bool
+}
+
+// Service defines the business logic for the WASAText application. Every method
+// acting on behalf of a user takes their ID and checks what they are allowed to do.
+type Service interface {
+	UserService
+	ConversationService
+	GroupService
+	MessageService
+	ModerationService
+}
+
+// UserService manages the users, their profile, blocks and presence
+type UserService interface {
+	Login(ctx context.Context, username string) (*models.LoginResponse, error)
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	GetUserByName(ctx context.Context, username string) (*models.User, error)
+	SearchUsers(ctx context.Context, userID string, filter models.UserFilter) (*models.UserPage, error)
+	GetUserProfile(ctx context.Context, viewerID, userID string) (*models.User, error)
+	UpdateProfile(ctx context.Context, userID string, req models.UpdateProfileRequest) (*models.User, error)
+	UpdateUsername(ctx context.Context, userID string, newUsername string) error
+	SetUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error)
+	UpdatePrivacySettings(ctx context.Context, userID string, hideLastSeen bool) error
+	BlockUser(ctx context.Context, userID, blockedID string) error
+	UnblockUser(ctx context.Context, userID, blockedID string) error
+	TouchPresence(userID string)
+	Heartbeat(ctx context.Context, userID string, status models.PresenceStatus) error
+	GetPresence(ctx context.Context, viewerID, userID string) (*models.Presence, error)
+}
+
+// ConversationService manages the conversations of a user
+type ConversationService interface {
+	GetConversations(ctx context.Context, userID string, filter models.ConversationFilter) ([]models.Conversation, string, error)
+	GetConversation(ctx context.Context, conversationID, userID string) (*models.Conversation, error)
+	CreateConversation(ctx context.Context, creatorID string, participantIDs []string, Type models.ConversationType, Name string) (*models.Conversation, bool, error)
+	CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, bool, error)
+	CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error)
+	SetTyping(ctx context.Context, userID, conversationID string, typing bool) error
+	SetConversationArchived(ctx context.Context, userID, conversationID string, archived bool) error
+	SetConversationMuted(ctx context.Context, userID, conversationID string, until *time.Time) error
+	SetConversationPinned(ctx context.Context, userID, conversationID string, pinned bool, position *int) error
+}
+
+// GroupService manages the members and the profile of group conversations
+type GroupService interface {
+	AddToGroup(ctx context.Context, groupID, userID, currentUserID string) error
+	LeaveGroup(ctx context.Context, groupID, userID string) error
+	SetGroupName(ctx context.Context, groupID, name, userID string) error
+	SetGroupPhoto(ctx context.Context, groupID string, photo multipart.File, userID string) (string, error)
+}
+
+// MessageService manages the messages and their reactions
+type MessageService interface {
+	SendTextMessage(ctx context.Context, senderID, conversationID, content string, replyToID *string, clientMessageID string) (*models.Message, error)
+	SendPhotoMessage(ctx context.Context, senderID, conversationID string, photo multipart.File, replyToID, clientMessageID string) (*models.Message, error)
+	ForwardMessage(ctx context.Context, userID, messageID, targetConversationID string) error
+	DeleteMessage(ctx context.Context, userID, messageID string) error
+	UpdateMessage(ctx context.Context, userID, messageID string, content string) error
+	AddReaction(ctx context.Context, userID, messageID, emoji string) error
+	RemoveReaction(ctx context.Context, userID, messageID string) error
+	GetMentions(ctx context.Context, userID string) ([]models.Message, error)
+}
+
+// ModerationService manages the reports and the actions of the moderators
+type ModerationService interface {
+	ReportMessage(ctx context.Context, reporterID, messageID string, reason models.ReportReason, details string) (*models.Report, error)
+	ReportUser(ctx context.Context, reporterID, userID string, reason models.ReportReason, details string) (*models.Report, error)
+	GetReports(ctx context.Context, moderatorID string, status models.ReportStatus) ([]models.Report, error)
+	CloseReport(ctx context.Context, moderatorID, reportID string, status models.ReportStatus, reason string) error
+	SetMessageHidden(ctx context.Context, moderatorID, messageID string, hidden bool, reason, reportID string) error
+	SetUserSuspended(ctx context.Context, moderatorID, userID string, suspended bool, reason, reportID string) error
+	GetModerationLog(ctx context.Context, moderatorID string) ([]models.ModerationAction, error)
+}
+
+// WASATextService implements Service on top of a repository
+type WASATextService struct {
+	repo     repository.Repository
+	policy   *Policy
+	unfurler LinkUnfurler
+	presence *presence.Tracker
 }
 
-// New creates a new service
-func New(repo repository.Repository) *Service {
-	return &Service{
-		repo: repo,
+var _ Service = (*WASATextService)(nil)
+
+// New creates a new service. The unfurler may be nil to disable link previews.
+func New(repo repository.Repository, unfurler LinkUnfurler) *WASATextService {
+	return &WASATextService{
+		repo:     repo,
+		policy:   NewPolicy(repo),
+		unfurler: unfurler,
+		presence: presence.NewTracker(),
 	}
 }
 
+// inTx runs fn with a copy of the service whose repository calls all belong to one
+// transaction. fn may run several times, see repository.Transactor.
+func (s *WASATextService) inTx(ctx context.Context, fn func(tx *WASATextService) error) error {
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		return fn(&WASATextService{repo: repo, policy: NewPolicy(repo), unfurler: s.unfurler, presence: s.presence})
+	})
+}
+
 // Login authenticates a user or creates a new user if the username doesn't exist
-func (s *Service) Login(ctx context.Context, username string) (*models.LoginResponse, error) {
+func (s *WASATextService) Login(ctx context.Context, username string) (*models.LoginResponse, error) {
 	if len(username) < 3 || len(username) > 16 {
-		return nil, errors.New("username must be between 3 and 16 characters")
+		return nil, invalid("username must be between 3 and 16 characters")
 	}
 
 	user, err := s.repo.CreateUser(ctx, username)
@@ -38,61 +138,360 @@ func (s *Service) Login(ctx context.Context, username string) (*models.LoginResp
 }
 
 // UpdateUsername updates a user's username
-func (s *Service) UpdateUsername(ctx context.Context, userID string, newUsername string) error {
+func (s *WASATextService) UpdateUsername(ctx context.Context, userID string, newUsername string) error {
 	if len(newUsername) < 3 || len(newUsername) > 16 {
-		return errors.New("username must be between 3 and 16 characters")
+		return invalid("username must be between 3 and 16 characters")
+	}
+
+	existing, err := s.repo.GetUserByName(ctx, newUsername)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.ID != userID {
+		return conflict("username already taken")
 	}
 
 	return s.repo.UpdateUsername(ctx, userID, newUsername)
 }
 
 // SetUserPhoto sets a user's profile photo
-func (s *Service) SetUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error) {
+func (s *WASATextService) SetUserPhoto(ctx context.Context, userID string, photo multipart.File) (string, error) {
 	return s.repo.SaveUserPhoto(ctx, userID, photo)
 }
 
 // GetUser gets a user by ID
-func (s *Service) GetUser(ctx context.Context, userID string) (*models.User, error) {
+func (s *WASATextService) GetUser(ctx context.Context, userID string) (*models.User, error) {
 	return s.repo.GetUserByID(ctx, userID)
 }
 
 // GetUserByName gets a user by username
-func (s *Service) GetUserByName(ctx context.Context, username string) (*models.User, error) {
+func (s *WASATextService) GetUserByName(ctx context.Context, username string) (*models.User, error) {
 	return s.repo.GetUserByName(ctx, username)
 }
 
-// GetAllUsers gets all users
-func (s *Service) GetAllUsers(ctx context.Context) ([]models.User, error) {
-	return s.repo.GetAllUsers(ctx)
+// DefaultUsersPerPage is the size of a page of the user directory when none is asked for
+const DefaultUsersPerPage = 20
+
+// MaxUsersPerPage is the largest page of the user directory a user can ask for
+const MaxUsersPerPage = 100
+
+// SearchUsers gets a page of the users whose name contains the query, except the
+// requesting user, those they blocked and those who blocked them
+func (s *WASATextService) SearchUsers(ctx context.Context, userID string, filter models.UserFilter) (*models.UserPage, error) {
+	if filter.Limit == 0 {
+		filter.Limit = DefaultUsersPerPage
+	}
+	if filter.Limit < 0 || filter.Limit > MaxUsersPerPage {
+		return nil, invalid(fmt.Sprintf("the limit must be between 1 and %d", MaxUsersPerPage))
+	}
+	if filter.Cursor != "" {
+		if _, err := repository.DecodeUserCursor(filter.Cursor); err != nil {
+			return nil, invalid("invalid cursor")
+		}
+	}
+
+	users, next, err := s.repo.SearchUsers(ctx, userID, filter)
+	if err != nil {
+		return nil, err
+	}
+	if users == nil {
+		users = []models.User{}
+	}
+	for i := range users {
+		users[i] = users[i].Public()
+	}
+	return &models.UserPage{Users: users, HasMore: next != "", NextCursor: next}, nil
+}
+
+// BlockUser blocks a user
+func (s *WASATextService) BlockUser(ctx context.Context, userID, blockedID string) error {
+	if userID == blockedID {
+		return invalid("users cannot block themselves")
+	}
+
+	blockedUser, err := s.repo.GetUserByID(ctx, blockedID)
+	if err != nil {
+		return err
+	}
+	if blockedUser == nil {
+		return notFound("user")
+	}
+
+	return s.repo.BlockUser(ctx, userID, blockedID)
+}
+
+// UnblockUser unblocks a user
+func (s *WASATextService) UnblockUser(ctx context.Context, userID, blockedID string) error {
+	return s.repo.UnblockUser(ctx, userID, blockedID)
 }
 
-// GetConversations gets all conversations for a user
-func (s *Service) GetConversations(ctx context.Context, userID string) ([]models.Conversation, error) {
-	return s.repo.GetConversationsByUserID(ctx, userID)
+// UpdatePrivacySettings updates whether a user hides their last seen time
+func (s *WASATextService) UpdatePrivacySettings(ctx context.Context, userID string, hideLastSeen bool) error {
+	return s.repo.UpdatePrivacySettings(ctx, userID, hideLastSeen)
 }
 
-// GetConversation gets a specific conversation
-func (s *Service) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
-	return s.repo.GetConversationByID(ctx, conversationID)
+// TouchPresence records activity of an authenticated user
+func (s *WASATextService) TouchPresence(userID string) {
+	s.presence.Touch(userID)
 }
 
-// CreateDirectConversation creates a new direct conversation between two users
-func (s *Service) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, error) {
-	// Validate users exist
-	_, err := s.repo.GetUserByID(ctx, userID1)
+// Heartbeat records that a user is still connected, either online or away
+func (s *WASATextService) Heartbeat(ctx context.Context, userID string, status models.PresenceStatus) error {
+	switch status {
+	case "", models.Online:
+		s.presence.Heartbeat(userID, false)
+	case models.Away:
+		s.presence.Heartbeat(userID, true)
+	default:
+		return invalid("status must be online or away")
+	}
+	return nil
+}
+
+// GetPresence gets the presence of a user as seen by the viewer. Users the subject
+// blocked see them offline, with an unknown last seen time.
+func (s *WASATextService) GetPresence(ctx context.Context, viewerID, userID string) (*models.Presence, error) {
+	user, err := s.repo.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.repo.GetUserByID(ctx, userID2)
+	if user == nil {
+		return nil, notFound("user")
+	}
+
+	blocked, err := s.repo.IsBlocked(ctx, user.ID, viewerID)
 	if err != nil {
 		return nil, err
 	}
+	if blocked {
+		return &models.Presence{Status: models.Offline}, nil
+	}
+
+	p := s.userPresence(user.ID, user.HideLastSeen)
+	return &p, nil
+}
+
+// userPresence returns the presence of a user, without the last seen time if they hide it
+func (s *WASATextService) userPresence(userID string, hideLastSeen bool) models.Presence {
+	p := s.presence.Presence(userID)
+	if hideLastSeen {
+		p.LastSeen = nil
+	}
+	return p
+}
+
+// SetTyping starts or stops the typing notification of a user in a conversation
+func (s *WASATextService) SetTyping(ctx context.Context, userID, conversationID string, typing bool) error {
+	if _, err := s.policy.CanPostTo(ctx, userID, conversationID); err != nil {
+		return err
+	}
+
+	s.presence.SetTyping(conversationID, userID, typing)
+	return nil
+}
+
+// blockersOf returns the set of the users who blocked a user
+func (s *WASATextService) blockersOf(ctx context.Context, userID string) (map[string]bool, error) {
+	blockerIDs, err := s.repo.GetBlockerIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	blockers := make(map[string]bool, len(blockerIDs))
+	for _, id := range blockerIDs {
+		blockers[id] = true
+	}
+	return blockers, nil
+}
+
+// withPresence fills the presence of the participants and the typing state of a
+// conversation, leaving out the viewer from the typing users. As with GetPresence,
+// the participants who blocked the viewer are offline, and never typing.
+func (s *WASATextService) withPresence(conv *models.Conversation, viewerID string, blockers map[string]bool) {
+	for i, participant := range conv.Participants {
+		p := models.Presence{Status: models.Offline}
+		if !blockers[participant.ID] {
+			p = s.userPresence(participant.ID, participant.HideLastSeen)
+		}
+		conv.Participants[i].Presence = &p
+	}
+
+	conv.Typing = nil
+	for _, userID := range s.presence.Typing(conv.ID, viewerID) {
+		if !blockers[userID] {
+			conv.Typing = append(conv.Typing, userID)
+		}
+	}
+}
+
+// withName names a direct conversation after its participant other than the viewer
+func withName(conv *models.Conversation, viewerID string) {
+	if conv.Type != models.DirectConversation || conv.Name != "" {
+		return
+	}
+	for _, participant := range conv.Participants {
+		if participant.ID != viewerID {
+			conv.Name = participant.Name
+			return
+		}
+	}
+}
+
+// MaxConversationsPerPage is the largest page of conversations a user can ask for
+const MaxConversationsPerPage = 100
+
+// GetConversations gets a page of the conversations of the user matching filter, with
+// the cursor of the next page, empty on the last one
+func (s *WASATextService) GetConversations(ctx context.Context, userID string, filter models.ConversationFilter) ([]models.Conversation, string, error) {
+	if filter.Type != "" && filter.Type != models.DirectConversation && filter.Type != models.GroupConversation {
+		return nil, "", invalid(fmt.Sprintf("unknown conversation type %q", filter.Type))
+	}
+	if filter.Limit < 0 || filter.Limit > MaxConversationsPerPage {
+		return nil, "", invalid(fmt.Sprintf("the limit must be between 1 and %d", MaxConversationsPerPage))
+	}
+	if filter.Cursor != "" {
+		if _, err := repository.DecodeConversationCursor(filter.Cursor); err != nil {
+			return nil, "", invalid("invalid cursor")
+		}
+	}
+
+	conversations, next, err := s.repo.GetConversationsByUserID(ctx, userID, filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	blockers, err := s.blockersOf(ctx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range conversations {
+		s.withPresence(&conversations[i], userID, blockers)
+		withSettings(&conversations[i], userID)
+		withName(&conversations[i], userID)
+	}
+	return conversations, next, nil
+}
+
+// GetConversation gets a conversation of the user, marking the messages they received as read
+func (s *WASATextService) GetConversation(ctx context.Context, conversationID, userID string) (*models.Conversation, error) {
+	conv, err := s.policy.CanReadConversation(ctx, userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mark all received messages as read
+	for i, msg := range conv.Messages {
+		if msg.Sender.ID != userID && msg.Status != models.Read {
+			if err := s.repo.UpdateMessageStatus(ctx, msg.ID, models.Read); err != nil {
+				return nil, err
+			}
+			conv.Messages[i].Status = models.Read
+		}
+	}
+
+	blockers, err := s.blockersOf(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	s.withPresence(conv, userID, blockers)
+	withSettings(conv, userID)
+	withName(conv, userID)
+	return conv, nil
+}
+
+// CreateConversation creates a new conversation between users. A direct conversation
+// that already exists is returned instead, the boolean telling whether it was created.
+func (s *WASATextService) CreateConversation(ctx context.Context, creatorID string, participantIDs []string, Type models.ConversationType, Name string) (*models.Conversation, bool, error) {
+	var conv *models.Conversation
+	var created bool
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		var err error
+		conv, created, err = tx.createConversation(ctx, creatorID, participantIDs, Type, Name)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	withName(conv, creatorID)
+	return conv, created, nil
+}
+
+func (s *WASATextService) createConversation(ctx context.Context, creatorID string, participantIDs []string, Type models.ConversationType, Name string) (*models.Conversation, bool, error) {
+	switch Type {
+	case models.DirectConversation:
+		if len(participantIDs) != 1 {
+			return nil, false, invalid("a direct conversation has exactly one other participant")
+		}
+	case models.GroupConversation:
+		if Name == "" {
+			return nil, false, invalid("group name cannot be empty")
+		}
+	default:
+		return nil, false, invalid("unknown conversation type")
+	}
+
+	// The participants must exist, and not have blocked the creator
+	if err := s.policy.CanStartConversation(ctx, creatorID, participantIDs); err != nil {
+		return nil, false, err
+	}
+
+	// Create list of all participants including the creator
+	allParticipants := append([]string{creatorID}, participantIDs...)
+
+	if Type == models.DirectConversation {
+		// The existing DM conversation between these two users is returned if there is one
+		return s.repo.CreateDirectConversation(ctx, creatorID, participantIDs[0])
+	}
+
+	conv, err := s.repo.CreateGroupConversation(ctx, Name, creatorID, allParticipants)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conv, true, nil
+}
+
+// CreateDirectConversation returns the direct conversation between two users, creating it
+// unless it exists. The boolean reports whether the conversation was created.
+func (s *WASATextService) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, bool, error) {
+	var conv *models.Conversation
+	var created bool
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		var err error
+		conv, created, err = tx.createDirectConversation(ctx, userID1, userID2)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	withName(conv, userID1)
+	return conv, created, nil
+}
+
+func (s *WASATextService) createDirectConversation(ctx context.Context, userID1, userID2 string) (*models.Conversation, bool, error) {
+	// A blocked user cannot start a conversation with the user who blocked them
+	if err := s.policy.CanStartConversation(ctx, userID1, []string{userID2}); err != nil {
+		return nil, false, err
+	}
 
 	return s.repo.CreateDirectConversation(ctx, userID1, userID2)
 }
 
 // CreateGroupConversation creates a new group conversation
-func (s *Service) CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error) {
+func (s *WASATextService) CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error) {
+	var conv *models.Conversation
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		var err error
+		conv, err = tx.createGroupConversation(ctx, name, creatorID, participants)
+		return err
+	})
+	return conv, err
+}
+
+func (s *WASATextService) createGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (*models.Conversation, error) {
+	if name == "" {
+		return nil, invalid("group name cannot be empty")
+	}
+
 	// Make sure the creator is included in participants
 	hasCreator := false
 	for _, id := range participants {
@@ -102,25 +501,29 @@ func (s *Service) CreateGroupConversation(ctx context.Context, name string, crea
 		}
 	}
 	if !hasCreator {
-		participants = append(participants, creatorID)
+		// Copy so that a retried transaction starts again from the caller's slice
+		participants = append(participants[:len(participants):len(participants)], creatorID)
 	}
 
-	// Validate all participants exist
-	for _, id := range participants {
-		_, err := s.repo.GetUserByID(ctx, id)
-		if err != nil {
-			return nil, err
-		}
+	// Users who blocked the creator cannot be added to the group
+	if err := s.policy.CanStartConversation(ctx, creatorID, participants); err != nil {
+		return nil, err
 	}
 
-	return s.repo.CreateGroupConversation(ctx, name, participants)
+	return s.repo.CreateGroupConversation(ctx, name, creatorID, participants)
 }
 
-// AddToGroup adds a user to a group
-func (s *Service) AddToGroup(ctx context.Context, groupID, userID string) error {
-	// Check if the user exists
-	_, err := s.repo.GetUserByID(ctx, userID)
-	if err != nil {
+// AddToGroup adds a user to a group on behalf of currentUserID
+func (s *WASATextService) AddToGroup(ctx context.Context, groupID, userID, currentUserID string) error {
+	return s.inTx(ctx, func(tx *WASATextService) error {
+		return tx.addToGroup(ctx, groupID, userID, currentUserID)
+	})
+}
+
+func (s *WASATextService) addToGroup(ctx context.Context, groupID, userID, currentUserID string) error {
+	// Only the current members can add someone, which also refuses groups everybody left,
+	// and a blocked user cannot add the user who blocked them
+	if _, err := s.policy.CanAddToGroup(ctx, currentUserID, groupID, userID); err != nil {
 		return err
 	}
 
@@ -128,227 +531,353 @@ func (s *Service) AddToGroup(ctx context.Context, groupID, userID string) error
 }
 
 // LeaveGroup removes a user from a group
-func (s *Service) LeaveGroup(ctx context.Context, groupID, userID string) error {
-	return s.repo.RemoveUserFromGroup(ctx, groupID, userID)
+func (s *WASATextService) LeaveGroup(ctx context.Context, groupID, userID string) error {
+	return s.inTx(ctx, func(tx *WASATextService) error {
+		if _, err := tx.policy.CanModifyGroup(ctx, userID, groupID); err != nil {
+			return err
+		}
+		return tx.repo.RemoveUserFromGroup(ctx, groupID, userID)
+	})
 }
 
-// SetGroupName sets a group's name
-func (s *Service) SetGroupName(ctx context.Context, groupID, name string) error {
-	return s.repo.UpdateGroupName(ctx, groupID, name)
+// SetGroupName sets the name of a group the user is a member of
+func (s *WASATextService) SetGroupName(ctx context.Context, groupID, name, userID string) error {
+	if name == "" {
+		return invalid("group name cannot be empty")
+	}
+
+	return s.inTx(ctx, func(tx *WASATextService) error {
+		if _, err := tx.policy.CanModifyGroup(ctx, userID, groupID); err != nil {
+			return err
+		}
+		return tx.repo.UpdateGroupName(ctx, groupID, name)
+	})
 }
 
-// SetGroupPhoto sets a group's photo
-func (s *Service) SetGroupPhoto(ctx context.Context, groupID string, photo multipart.File) (string, error) {
+// SetGroupPhoto sets the photo of a group the user is a member of
+func (s *WASATextService) SetGroupPhoto(ctx context.Context, groupID string, photo multipart.File, userID string) (string, error) {
+	if _, err := s.policy.CanModifyGroup(ctx, userID, groupID); err != nil {
+		return "", err
+	}
+
 	return s.repo.SaveGroupPhoto(ctx, groupID, photo)
 }
 
 // SendTextMessage sends a new text message
-func (s *Service) SendTextMessage(ctx context.Context, senderID, conversationID, content string, replyToID *string) (*models.Message, error) {
-	// Verify the conversation exists and the user is a participant
-	conv, err := s.repo.GetConversationByID(ctx, conversationID)
+func (s *WASATextService) SendTextMessage(ctx context.Context, senderID, conversationID, content string, replyToID *string, clientMessageID string) (*models.Message, error) {
+	var created *models.Message
+	var replayed bool
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		var err error
+		created, replayed, err = tx.sendTextMessage(ctx, senderID, conversationID, content, replyToID, clientMessageID)
+		return err
+	})
+	if err != nil || replayed {
+		return created, err
+	}
+	s.presence.SetTyping(conversationID, senderID, false)
+	s.unfurlLinks(created.ID, content)
+	metrics.MessagesSent.WithLabelValues(string(created.Type)).Inc()
+
+	return created, nil
+}
+
+// sendTextMessage creates the message, or returns the one already sent with
+// clientMessageID and true
+func (s *WASATextService) sendTextMessage(ctx context.Context, senderID, conversationID, content string, replyToID *string, clientMessageID string) (*models.Message, bool, error) {
+	// Verify the user can write in the conversation
+	conv, err := s.policy.CanPostTo(ctx, senderID, conversationID)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	if conv == nil {
-		return nil, errors.New("conversation not found")
+	if previous, err := s.sentBefore(ctx, senderID, conversationID, models.TextMessage, clientMessageID); err != nil || previous != nil {
+		return previous, previous != nil, err
+	}
+	if replyToID != nil {
+		if err := s.checkReplyTo(ctx, conversationID, *replyToID); err != nil {
+			return nil, false, err
+		}
 	}
 	sender, err := s.repo.GetUserByID(ctx, senderID)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if sender == nil {
-		return nil, errors.New("sender not found")
-	}
-
-	// Check if the user is a participant in the conversation
-	isParticipant := false
-	for _, participant := range conv.Participants {
-		if participant.ID == senderID {
-			isParticipant = true
-			break
-		}
-	}
-	if !isParticipant {
-		return nil, errors.New("user is not a participant in the conversation")
+		return nil, false, notFound("sender")
 	}
 
 	// Create the message
 	msg := models.Message{
-		Sender:    *sender,
-		Content:   content,
-		Type:      models.TextMessage,
-		Status:    models.Sent,
+		Sender:          *sender,
+		Content:         content,
+		Type:            models.TextMessage,
+		Status:          models.Sent,
+		Mentions:        conversationMentions(conv, senderID, content),
+		ClientMessageID: clientMessageID,
 	}
 
-    if replyToID != nil && *replyToID != "" {
-        msg.ReplyTo = replyToID
-    }
+	if replyToID != nil && *replyToID != "" {
+		msg.ReplyTo = replyToID
+	}
 
-	return s.repo.CreateMessage(ctx, msg, conversationID)
+	created, err := s.repo.CreateMessage(ctx, msg, conversationID)
+	return created, false, err
 }
 
-// SendPhotoMessage sends a new photo message
-func (s *Service) SendPhotoMessage(ctx context.Context, senderID, conversationID string, photo multipart.File, replyToID string) (*models.Message, error) {
-	// Verify the conversation exists and the user is a participant
-	conv, err := s.repo.GetConversationByID(ctx, conversationID)
+// checkReplyTo allows replying to the messages of the same conversation only, since
+// replies show a preview of the message they answer
+func (s *WASATextService) checkReplyTo(ctx context.Context, conversationID, replyToID string) error {
+	if replyToID == "" {
+		return nil
+	}
+	replied, err := s.repo.GetMessageByID(ctx, replyToID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if conv == nil {
-		return nil, errors.New("conversation not found")
+	if replied == nil || replied.ConversationID != conversationID {
+		return invalid("the message replied to is not in the conversation")
 	}
-	sender, err := s.repo.GetUserByID(ctx, senderID)
-	if err != nil {
+	return nil
+}
+
+// maxClientMessageIDLength bounds the IDs clients give to the messages they send
+const maxClientMessageIDLength = 128
+
+// sentBefore returns the message of the given type the sender already sent to the
+// conversation with clientMessageID, nil when there is none or no clientMessageID.
+// Retries find it inside their transaction, which conflicts with a concurrent send
+// of the same message and runs again once it is committed.
+func (s *WASATextService) sentBefore(ctx context.Context, senderID, conversationID string, msgType models.MessageType, clientMessageID string) (*models.Message, error) {
+	if clientMessageID == "" {
+		return nil, nil
+	}
+	if len(clientMessageID) > maxClientMessageIDLength {
+		return nil, invalid(fmt.Sprintf("the client message ID is longer than %d characters", maxClientMessageIDLength))
+	}
+	for _, c := range clientMessageID {
+		if c < 0x21 || c > 0x7e {
+			return nil, invalid("the client message ID must be made of printable ASCII characters")
+		}
+	}
+
+	previous, err := s.repo.GetMessageByClientID(ctx, senderID, clientMessageID)
+	if err != nil || previous == nil {
 		return nil, err
 	}
-	if sender == nil {
-		return nil, errors.New("sender not found")
+	if previous.ConversationID != conversationID || previous.Type != msgType {
+		return nil, conflict("the client message ID was already used for another message")
 	}
+	return previous, nil
+}
 
-	// Check if the user is a participant in the conversation
-	isParticipant := false
-	for _, participant := range conv.Participants {
-		if participant.ID == senderID {
-			isParticipant = true
-			break
-		}
+// unfurlLinks queues the preview of the first link of a text message
+func (s *WASATextService) unfurlLinks(messageID, content string) {
+	if s.unfurler == nil {
+		return
 	}
-	if !isParticipant {
-		return nil, errors.New("user is not a participant in the conversation")
+	if url := linkpreview.ExtractURL(content); url != "" {
+		s.unfurler.Enqueue(messageID, url)
 	}
+}
 
-	// Save the photo and get the path
-	photoPath, err := s.repo.SaveMessagePhoto(ctx, senderID, photo)
+// SendPhotoMessage sends a new photo message
+func (s *WASATextService) SendPhotoMessage(ctx context.Context, senderID, conversationID string, photo multipart.File, replyToID, clientMessageID string) (*models.Message, error) {
+	var created *models.Message
+	var replayed bool
+	var photoPath string
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		var err error
+		created, replayed, err = tx.sendPhotoMessage(ctx, senderID, conversationID, photo, &photoPath, replyToID, clientMessageID)
+		return err
+	})
+	if err != nil || replayed {
+		return created, err
+	}
+	s.presence.SetTyping(conversationID, senderID, false)
+	metrics.MessagesSent.WithLabelValues(string(created.Type)).Inc()
+
+	return created, nil
+}
+
+// sendPhotoMessage saves the photo in *photoPath unless a previous attempt already did.
+// A message already sent with clientMessageID is returned along with true, without
+// saving the photo again.
+func (s *WASATextService) sendPhotoMessage(ctx context.Context, senderID, conversationID string, photo multipart.File, photoPath *string, replyToID, clientMessageID string) (*models.Message, bool, error) {
+	// Verify the user can write in the conversation
+	if _, err := s.policy.CanPostTo(ctx, senderID, conversationID); err != nil {
+		return nil, false, err
+	}
+	if previous, err := s.sentBefore(ctx, senderID, conversationID, models.PhotoMessage, clientMessageID); err != nil || previous != nil {
+		return previous, previous != nil, err
+	}
+	if err := s.checkReplyTo(ctx, conversationID, replyToID); err != nil {
+		return nil, false, err
+	}
+	sender, err := s.repo.GetUserByID(ctx, senderID)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if sender == nil {
+		return nil, false, notFound("sender")
+	}
+
+	// Save the photo and get the path
+	if *photoPath == "" {
+		*photoPath, err = s.repo.SaveMessagePhoto(ctx, senderID, photo)
+		if err != nil {
+			return nil, false, err
+		}
 	}
 
 	// Create the message
 	msg := models.Message{
-		Sender:    *sender,
-		Content:   photoPath,
-		Type:      models.PhotoMessage,
-		Status:    models.Sent,
+		Sender:          *sender,
+		Content:         *photoPath,
+		Type:            models.PhotoMessage,
+		Status:          models.Sent,
+		ClientMessageID: clientMessageID,
 	}
 
-
 	if replyToID != "" {
 		msg.ReplyTo = &replyToID
 	}
-	return s.repo.CreateMessage(ctx, msg, conversationID)
+
+	created, err := s.repo.CreateMessage(ctx, msg, conversationID)
+	return created, false, err
 }
 
 // ForwardMessage forwards a message to another conversation
-func (s *Service) ForwardMessage(ctx context.Context, userID, messageID, targetConversationID string) error {
-	// Get the original message
-	msg, err := s.repo.GetMessageByID(ctx, messageID)
+func (s *WASATextService) ForwardMessage(ctx context.Context, userID, messageID, targetConversationID string) error {
+	var created *models.Message
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		var err error
+		created, err = tx.forwardMessage(ctx, userID, messageID, targetConversationID)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	if msg == nil {
-		return errors.New("message not found")
+	if created.Type == models.TextMessage {
+		s.unfurlLinks(created.ID, created.Content)
 	}
+	metrics.MessagesSent.WithLabelValues(string(created.Type)).Inc()
 
-	// Verify the target conversation exists and the user is a participant
-	targetConv, err := s.repo.GetConversationByID(ctx, targetConversationID)
+	return nil
+}
+
+func (s *WASATextService) forwardMessage(ctx context.Context, userID, messageID, targetConversationID string) (*models.Message, error) {
+	// The user can only forward the visible messages they can read
+	msg, err := s.policy.CanReactTo(ctx, userID, messageID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if targetConv == nil {
-		return errors.New("target conversation not found")
+
+	// Verify the user can write in the target conversation
+	if _, err := s.policy.CanPostTo(ctx, userID, targetConversationID); err != nil {
+		return nil, err
 	}
 	sender, err := s.repo.GetUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if sender == nil {
-		return errors.New("sender not found")
-	}
-
-	// Check if the user is a participant in the target conversation
-	isParticipant := false
-	for _, participant := range targetConv.Participants {
-		if participant.ID == userID {
-			isParticipant = true
-			break
-		}
-	}
-	if !isParticipant {
-		return errors.New("user is not a participant in the target conversation")
+		return nil, notFound("sender")
 	}
 
 	// Create a new message in the target conversation with the same content
 	newMsg := models.Message{
-		Sender:    *sender,
-		Content:   msg.Content,
-		Type:      msg.Type,
-		Status:    models.Sent,
+		Sender:  *sender,
+		Content: msg.Content,
+		Type:    msg.Type,
+		Status:  models.Sent,
 	}
 
-	_, err = s.repo.CreateMessage(ctx, newMsg, targetConversationID)
-	return err
+	return s.repo.CreateMessage(ctx, newMsg, targetConversationID)
 }
 
 // DeleteMessage deletes a message
-func (s *Service) DeleteMessage(ctx context.Context, userID, messageID string) error {
-	// Get the message
-	msg, err := s.repo.GetMessageByID(ctx, messageID)
-	if err != nil {
+func (s *WASATextService) DeleteMessage(ctx context.Context, userID, messageID string) error {
+	// Only the sender can delete a message
+	if _, err := s.policy.CanModifyMessage(ctx, userID, messageID); err != nil {
 		return err
 	}
-	if msg == nil {
-		return errors.New("message not found")
-	}
-	
-
-	// Check if the user is the sender of the message
-	if msg.Sender.ID != userID {
-		return errors.New("only the sender can delete a message")
-	}
 
 	return s.repo.DeleteMessage(ctx, messageID)
 }
 
 // UpdateMessage updates a message
-func (s *Service) UpdateMessage(ctx context.Context, userID, messageID string, content string) error {
-	// Get the message
-	msg, err := s.repo.GetMessageByID(ctx, messageID)
+func (s *WASATextService) UpdateMessage(ctx context.Context, userID, messageID string, content string) error {
+	var msgType models.MessageType
+	err := s.inTx(ctx, func(tx *WASATextService) error {
+		var err error
+		msgType, err = tx.updateMessage(ctx, userID, messageID, content)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	if msg == nil {
-		return errors.New("message not found")
+	if msgType == models.TextMessage {
+		s.unfurlLinks(messageID, content)
+	}
+
+	return nil
+}
+
+// updateMessage returns the type of the updated message
+func (s *WASATextService) updateMessage(ctx context.Context, userID, messageID string, content string) (models.MessageType, error) {
+	// Only the sender can update a message
+	msg, err := s.policy.CanModifyMessage(ctx, userID, messageID)
+	if err != nil {
+		return "", err
+	}
+
+	// Mentions are parsed again against the current participants
+	var mentions []models.Mention
+	if msg.Type == models.TextMessage {
+		conv, err := s.repo.GetConversationByID(ctx, msg.ConversationID)
+		if err != nil {
+			return "", err
+		}
+		if conv == nil {
+			return "", notFound("conversation")
+		}
+		mentions = conversationMentions(conv, userID, content)
 	}
-	
 
-	// Check if the user is the sender of the message
-	if msg.Sender.ID != userID {
-		return errors.New("only the sender can update a message")
+	if err := s.repo.UpdateMessageContent(ctx, messageID, content, mentions); err != nil {
+		return "", err
 	}
 
-	return s.repo.UpdateMessageContent(ctx, messageID, content)
+	// The previous preview no longer matches the content, the new one is fetched in the background
+	if msg.Type == models.TextMessage {
+		if err := s.repo.SetMessageLinkPreview(ctx, messageID, ""); err != nil {
+			return "", err
+		}
+	}
+
+	return msg.Type, nil
 }
 
 // AddReaction adds a reaction to a message
-func (s *Service) AddReaction(ctx context.Context, userID, messageID, emoji string) error {
-	// Get the message
-	msg, err := s.repo.GetMessageByID(ctx, messageID)
-	if err != nil {
+func (s *WASATextService) AddReaction(ctx context.Context, userID, messageID, emoji string) error {
+	// Only the participants can react to the visible messages of their conversations
+	if _, err := s.policy.CanReactTo(ctx, userID, messageID); err != nil {
 		return err
 	}
-	if msg == nil {
-		return errors.New("message not found")
-	}
 
 	return s.repo.AddReaction(ctx, messageID, userID, emoji)
 }
 
 // RemoveReaction removes a reaction from a message
-func (s *Service) RemoveReaction(ctx context.Context, userID, messageID string) error {
+func (s *WASATextService) RemoveReaction(ctx context.Context, userID, messageID string) error {
+	if _, err := s.policy.CanReadMessage(ctx, userID, messageID); err != nil {
+		return err
+	}
+
 	return s.repo.RemoveReaction(ctx, messageID, userID)
 }
 
-// UpdateMessageStatus updates the status of a message
-func (s *Service) UpdateMessageStatus(ctx context.Context, messageID string, status models.MessageStatus) error {
-	return s.repo.UpdateMessageStatus(ctx, messageID, status)
-}
\ No newline at end of file
+// GetMentions gets the messages in which a user was mentioned
+func (s *WASATextService) GetMentions(ctx context.Context, userID string) ([]models.Message, error) {
+	return s.repo.GetMentionedMessages(ctx, userID)
+}
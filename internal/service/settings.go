@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+)
+
+// viewerSettings returns the settings of the user viewing a conversation
+func viewerSettings(conv *models.Conversation, userID string) models.ConversationSettings {
+	for _, participant := range conv.Participants {
+		if participant.ID == userID {
+			return participant.Settings
+		}
+	}
+	return models.ConversationSettings{}
+}
+
+// withSettings shows the viewer their own settings for a conversation
+func withSettings(conv *models.Conversation, viewerID string) {
+	settings := viewerSettings(conv, viewerID)
+	conv.Settings = &settings
+}
+
+// updateSettings changes the settings of a participant for a conversation
+func (s *WASATextService) updateSettings(ctx context.Context, userID, conversationID string, change func(tx *WASATextService, settings *models.ConversationSettings) error) error {
+	return s.inTx(ctx, func(tx *WASATextService) error {
+		conv, err := tx.policy.CanReadConversation(ctx, userID, conversationID)
+		if err != nil {
+			return err
+		}
+		settings := viewerSettings(conv, userID)
+		if err := change(tx, &settings); err != nil {
+			return err
+		}
+		return tx.repo.UpdateConversationSettings(ctx, conversationID, userID, settings)
+	})
+}
+
+// SetConversationArchived archives or unarchives a conversation for the user. Archiving
+// unpins it, since archived conversations are listed apart.
+func (s *WASATextService) SetConversationArchived(ctx context.Context, userID, conversationID string, archived bool) error {
+	return s.updateSettings(ctx, userID, conversationID, func(tx *WASATextService, settings *models.ConversationSettings) error {
+		settings.Archived = archived
+		if archived {
+			settings.PinPosition = nil
+		}
+		return nil
+	})
+}
+
+// SetConversationMuted mutes a conversation for the user until the given time, or
+// unmutes it when until is nil. A muted conversation stays archived when a message arrives.
+func (s *WASATextService) SetConversationMuted(ctx context.Context, userID, conversationID string, until *time.Time) error {
+	if until != nil && !until.After(time.Now()) {
+		return invalid("a conversation can only be muted until a time to come")
+	}
+	return s.updateSettings(ctx, userID, conversationID, func(tx *WASATextService, settings *models.ConversationSettings) error {
+		settings.MutedUntil = until
+		return nil
+	})
+}
+
+// SetConversationPinned pins a conversation to the top of the list of the user, at
+// position or else after the conversations already pinned, or unpins it. Pinning a
+// conversation unarchives it.
+func (s *WASATextService) SetConversationPinned(ctx context.Context, userID, conversationID string, pinned bool, position *int) error {
+	if position != nil && *position < 1 {
+		return invalid("the pin position must be at least 1")
+	}
+	return s.updateSettings(ctx, userID, conversationID, func(tx *WASATextService, settings *models.ConversationSettings) error {
+		if !pinned {
+			settings.PinPosition = nil
+			return nil
+		}
+		settings.Archived = false
+		if position != nil {
+			settings.PinPosition = position
+			return nil
+		}
+		if settings.PinPosition != nil {
+			return nil // already pinned, where it stays
+		}
+		last, err := tx.repo.GetLastPinPosition(ctx, userID)
+		if err != nil {
+			return err
+		}
+		next := last + 1
+		settings.PinPosition = &next
+		return nil
+	})
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"mime/multipart"
+	"time"
+
+	"github.com/fallenkarma/wasatext/internal/models"
+	"github.com/fallenkarma/wasatext/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedService runs every method of the wrapped service in a span named after the
+// method, along with the IDs of the user, conversation and message it is about
+type tracedService struct {
+	next Service
+}
+
+// WithTracing returns svc with its methods traced
+func WithTracing(svc Service) Service {
+	return &tracedService{next: svc}
+}
+
+var _ Service = (*tracedService)(nil)
+
+// start starts the span of a method
+func start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "Service."+method, trace.WithAttributes(attrs...))
+}
+
+func userAttr(userID string) attribute.KeyValue {
+	return tracing.UserIDKey.String(userID)
+}
+
+func conversationAttr(conversationID string) attribute.KeyValue {
+	return tracing.ConversationIDKey.String(conversationID)
+}
+
+func messageAttr(messageID string) attribute.KeyValue {
+	return tracing.MessageIDKey.String(messageID)
+}
+
+func (t *tracedService) Login(ctx context.Context, username string) (res *models.LoginResponse, err error) {
+	ctx, span := start(ctx, "Login")
+	defer func() { tracing.End(span, err) }()
+	return t.next.Login(ctx, username)
+}
+
+func (t *tracedService) GetUser(ctx context.Context, userID string) (user *models.User, err error) {
+	ctx, span := start(ctx, "GetUser", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetUser(ctx, userID)
+}
+
+func (t *tracedService) GetUserByName(ctx context.Context, username string) (user *models.User, err error) {
+	ctx, span := start(ctx, "GetUserByName")
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetUserByName(ctx, username)
+}
+
+func (t *tracedService) GetUserProfile(ctx context.Context, viewerID, userID string) (user *models.User, err error) {
+	ctx, span := start(ctx, "GetUserProfile", userAttr(viewerID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetUserProfile(ctx, viewerID, userID)
+}
+
+func (t *tracedService) UpdateProfile(ctx context.Context, userID string, req models.UpdateProfileRequest) (user *models.User, err error) {
+	ctx, span := start(ctx, "UpdateProfile", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.UpdateProfile(ctx, userID, req)
+}
+
+func (t *tracedService) SearchUsers(ctx context.Context, userID string, filter models.UserFilter) (page *models.UserPage, err error) {
+	ctx, span := start(ctx, "SearchUsers", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SearchUsers(ctx, userID, filter)
+}
+
+func (t *tracedService) UpdateUsername(ctx context.Context, userID string, newUsername string) (err error) {
+	ctx, span := start(ctx, "UpdateUsername", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.UpdateUsername(ctx, userID, newUsername)
+}
+
+func (t *tracedService) SetUserPhoto(ctx context.Context, userID string, photo multipart.File) (url string, err error) {
+	ctx, span := start(ctx, "SetUserPhoto", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetUserPhoto(ctx, userID, photo)
+}
+
+func (t *tracedService) UpdatePrivacySettings(ctx context.Context, userID string, hideLastSeen bool) (err error) {
+	ctx, span := start(ctx, "UpdatePrivacySettings", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.UpdatePrivacySettings(ctx, userID, hideLastSeen)
+}
+
+func (t *tracedService) BlockUser(ctx context.Context, userID, blockedID string) (err error) {
+	ctx, span := start(ctx, "BlockUser", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.BlockUser(ctx, userID, blockedID)
+}
+
+func (t *tracedService) UnblockUser(ctx context.Context, userID, blockedID string) (err error) {
+	ctx, span := start(ctx, "UnblockUser", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.UnblockUser(ctx, userID, blockedID)
+}
+
+// TouchPresence only updates memory and has no context to attach a span to
+func (t *tracedService) TouchPresence(userID string) {
+	t.next.TouchPresence(userID)
+}
+
+func (t *tracedService) Heartbeat(ctx context.Context, userID string, status models.PresenceStatus) (err error) {
+	ctx, span := start(ctx, "Heartbeat", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.Heartbeat(ctx, userID, status)
+}
+
+func (t *tracedService) GetPresence(ctx context.Context, viewerID, userID string) (p *models.Presence, err error) {
+	ctx, span := start(ctx, "GetPresence", userAttr(viewerID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetPresence(ctx, viewerID, userID)
+}
+
+func (t *tracedService) GetConversations(ctx context.Context, userID string, filter models.ConversationFilter) (convs []models.Conversation, next string, err error) {
+	ctx, span := start(ctx, "GetConversations", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetConversations(ctx, userID, filter)
+}
+
+func (t *tracedService) GetConversation(ctx context.Context, conversationID, userID string) (conv *models.Conversation, err error) {
+	ctx, span := start(ctx, "GetConversation", userAttr(userID), conversationAttr(conversationID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetConversation(ctx, conversationID, userID)
+}
+
+func (t *tracedService) CreateConversation(ctx context.Context, creatorID string, participantIDs []string, Type models.ConversationType, Name string) (conv *models.Conversation, created bool, err error) {
+	ctx, span := start(ctx, "CreateConversation", userAttr(creatorID))
+	defer func() {
+		if conv != nil {
+			span.SetAttributes(conversationAttr(conv.ID))
+		}
+		tracing.End(span, err)
+	}()
+	return t.next.CreateConversation(ctx, creatorID, participantIDs, Type, Name)
+}
+
+func (t *tracedService) CreateDirectConversation(ctx context.Context, userID1, userID2 string) (conv *models.Conversation, created bool, err error) {
+	ctx, span := start(ctx, "CreateDirectConversation", userAttr(userID1))
+	defer func() {
+		if conv != nil {
+			span.SetAttributes(conversationAttr(conv.ID))
+		}
+		tracing.End(span, err)
+	}()
+	return t.next.CreateDirectConversation(ctx, userID1, userID2)
+}
+
+func (t *tracedService) CreateGroupConversation(ctx context.Context, name string, creatorID string, participants []string) (conv *models.Conversation, err error) {
+	ctx, span := start(ctx, "CreateGroupConversation", userAttr(creatorID))
+	defer func() {
+		if conv != nil {
+			span.SetAttributes(conversationAttr(conv.ID))
+		}
+		tracing.End(span, err)
+	}()
+	return t.next.CreateGroupConversation(ctx, name, creatorID, participants)
+}
+
+func (t *tracedService) SetTyping(ctx context.Context, userID, conversationID string, typing bool) (err error) {
+	ctx, span := start(ctx, "SetTyping", userAttr(userID), conversationAttr(conversationID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetTyping(ctx, userID, conversationID, typing)
+}
+
+func (t *tracedService) SetConversationArchived(ctx context.Context, userID, conversationID string, archived bool) (err error) {
+	ctx, span := start(ctx, "SetConversationArchived", userAttr(userID), conversationAttr(conversationID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetConversationArchived(ctx, userID, conversationID, archived)
+}
+
+func (t *tracedService) SetConversationMuted(ctx context.Context, userID, conversationID string, until *time.Time) (err error) {
+	ctx, span := start(ctx, "SetConversationMuted", userAttr(userID), conversationAttr(conversationID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetConversationMuted(ctx, userID, conversationID, until)
+}
+
+func (t *tracedService) SetConversationPinned(ctx context.Context, userID, conversationID string, pinned bool, position *int) (err error) {
+	ctx, span := start(ctx, "SetConversationPinned", userAttr(userID), conversationAttr(conversationID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetConversationPinned(ctx, userID, conversationID, pinned, position)
+}
+
+func (t *tracedService) AddToGroup(ctx context.Context, groupID, userID, currentUserID string) (err error) {
+	ctx, span := start(ctx, "AddToGroup", userAttr(currentUserID), conversationAttr(groupID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.AddToGroup(ctx, groupID, userID, currentUserID)
+}
+
+func (t *tracedService) LeaveGroup(ctx context.Context, groupID, userID string) (err error) {
+	ctx, span := start(ctx, "LeaveGroup", userAttr(userID), conversationAttr(groupID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.LeaveGroup(ctx, groupID, userID)
+}
+
+func (t *tracedService) SetGroupName(ctx context.Context, groupID, name, userID string) (err error) {
+	ctx, span := start(ctx, "SetGroupName", userAttr(userID), conversationAttr(groupID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetGroupName(ctx, groupID, name, userID)
+}
+
+func (t *tracedService) SetGroupPhoto(ctx context.Context, groupID string, photo multipart.File, userID string) (url string, err error) {
+	ctx, span := start(ctx, "SetGroupPhoto", userAttr(userID), conversationAttr(groupID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetGroupPhoto(ctx, groupID, photo, userID)
+}
+
+func (t *tracedService) SendTextMessage(ctx context.Context, senderID, conversationID, content string, replyToID *string, clientMessageID string) (msg *models.Message, err error) {
+	ctx, span := start(ctx, "SendTextMessage", userAttr(senderID), conversationAttr(conversationID))
+	defer func() {
+		if msg != nil {
+			span.SetAttributes(messageAttr(msg.ID))
+		}
+		tracing.End(span, err)
+	}()
+	return t.next.SendTextMessage(ctx, senderID, conversationID, content, replyToID, clientMessageID)
+}
+
+func (t *tracedService) SendPhotoMessage(ctx context.Context, senderID, conversationID string, photo multipart.File, replyToID, clientMessageID string) (msg *models.Message, err error) {
+	ctx, span := start(ctx, "SendPhotoMessage", userAttr(senderID), conversationAttr(conversationID))
+	defer func() {
+		if msg != nil {
+			span.SetAttributes(messageAttr(msg.ID))
+		}
+		tracing.End(span, err)
+	}()
+	return t.next.SendPhotoMessage(ctx, senderID, conversationID, photo, replyToID, clientMessageID)
+}
+
+func (t *tracedService) ForwardMessage(ctx context.Context, userID, messageID, targetConversationID string) (err error) {
+	ctx, span := start(ctx, "ForwardMessage", userAttr(userID), messageAttr(messageID), conversationAttr(targetConversationID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.ForwardMessage(ctx, userID, messageID, targetConversationID)
+}
+
+func (t *tracedService) DeleteMessage(ctx context.Context, userID, messageID string) (err error) {
+	ctx, span := start(ctx, "DeleteMessage", userAttr(userID), messageAttr(messageID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.DeleteMessage(ctx, userID, messageID)
+}
+
+func (t *tracedService) UpdateMessage(ctx context.Context, userID, messageID string, content string) (err error) {
+	ctx, span := start(ctx, "UpdateMessage", userAttr(userID), messageAttr(messageID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.UpdateMessage(ctx, userID, messageID, content)
+}
+
+func (t *tracedService) AddReaction(ctx context.Context, userID, messageID, emoji string) (err error) {
+	ctx, span := start(ctx, "AddReaction", userAttr(userID), messageAttr(messageID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.AddReaction(ctx, userID, messageID, emoji)
+}
+
+func (t *tracedService) RemoveReaction(ctx context.Context, userID, messageID string) (err error) {
+	ctx, span := start(ctx, "RemoveReaction", userAttr(userID), messageAttr(messageID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.RemoveReaction(ctx, userID, messageID)
+}
+
+func (t *tracedService) GetMentions(ctx context.Context, userID string) (msgs []models.Message, err error) {
+	ctx, span := start(ctx, "GetMentions", userAttr(userID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetMentions(ctx, userID)
+}
+
+func (t *tracedService) ReportMessage(ctx context.Context, reporterID, messageID string, reason models.ReportReason, details string) (report *models.Report, err error) {
+	ctx, span := start(ctx, "ReportMessage", userAttr(reporterID), messageAttr(messageID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.ReportMessage(ctx, reporterID, messageID, reason, details)
+}
+
+func (t *tracedService) ReportUser(ctx context.Context, reporterID, userID string, reason models.ReportReason, details string) (report *models.Report, err error) {
+	ctx, span := start(ctx, "ReportUser", userAttr(reporterID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.ReportUser(ctx, reporterID, userID, reason, details)
+}
+
+func (t *tracedService) GetReports(ctx context.Context, moderatorID string, status models.ReportStatus) (reports []models.Report, err error) {
+	ctx, span := start(ctx, "GetReports", userAttr(moderatorID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetReports(ctx, moderatorID, status)
+}
+
+func (t *tracedService) CloseReport(ctx context.Context, moderatorID, reportID string, status models.ReportStatus, reason string) (err error) {
+	ctx, span := start(ctx, "CloseReport", userAttr(moderatorID), tracing.ReportIDKey.String(reportID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.CloseReport(ctx, moderatorID, reportID, status, reason)
+}
+
+func (t *tracedService) SetMessageHidden(ctx context.Context, moderatorID, messageID string, hidden bool, reason, reportID string) (err error) {
+	ctx, span := start(ctx, "SetMessageHidden", userAttr(moderatorID), messageAttr(messageID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetMessageHidden(ctx, moderatorID, messageID, hidden, reason, reportID)
+}
+
+func (t *tracedService) SetUserSuspended(ctx context.Context, moderatorID, userID string, suspended bool, reason, reportID string) (err error) {
+	ctx, span := start(ctx, "SetUserSuspended", userAttr(moderatorID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.SetUserSuspended(ctx, moderatorID, userID, suspended, reason, reportID)
+}
+
+func (t *tracedService) GetModerationLog(ctx context.Context, moderatorID string) (actions []models.ModerationAction, err error) {
+	ctx, span := start(ctx, "GetModerationLog", userAttr(moderatorID))
+	defer func() { tracing.End(span, err) }()
+	return t.next.GetModerationLog(ctx, moderatorID)
+}
@@ -0,0 +1,89 @@
+// Package tracing sets up OpenTelemetry tracing and starts the spans of the server:
+// one per HTTP route, service method and SQL statement.
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the server's spans
+const instrumentationName = "github.com/fallenkarma/wasatext"
+
+// Attribute keys of the IDs the spans are about
+const (
+	ConversationIDKey = attribute.Key("wasatext.conversation.id")
+	MessageIDKey      = attribute.Key("wasatext.message.id")
+	UserIDKey         = attribute.Key("wasatext.user.id")
+	ReportIDKey       = attribute.Key("wasatext.report.id")
+)
+
+// Setup installs the W3C trace context propagator and, when endpoint is not empty,
+// a tracer provider exporting the spans over OTLP/HTTP to endpoint, such as
+// http://localhost:4318. Without an endpoint the spans are not recorded. The
+// returned function flushes the pending spans and stops the exporter.
+func Setup(ctx context.Context, endpoint string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := NewProvider(sdktrace.NewBatchSpanProcessor(exporter))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// NewProvider returns a tracer provider sending the spans of the server to processor.
+// Tests pass it the span recorder of the sdk/trace/tracetest package.
+func NewProvider(processor sdktrace.SpanProcessor) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("wasatext"))),
+	)
+}
+
+// Start starts a span of the server with the tracer of the global provider
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records err, if any, on span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartQuery starts the span of an SQL statement run by the given database system,
+// such as postgresql or sqlite. The statement is recorded without its arguments.
+func StartQuery(ctx context.Context, system, query string) (context.Context, trace.Span) {
+	query = strings.Join(strings.Fields(query), " ")
+	operation := "SQL"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		operation = strings.ToUpper(fields[0])
+	}
+	return Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(system),
+			semconv.DBOperationName(operation),
+			semconv.DBQueryText(query),
+		))
+}
@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStartQuery(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(NewProvider(recorder))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	_, span := StartQuery(context.Background(), "postgresql", "\n\t\tselect id\n\t\tFROM users WHERE name = $1")
+	End(span, errors.New("boom"))
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans, want 1", len(ended))
+	}
+	got := ended[0]
+	if got.Name() != "SELECT" {
+		t.Errorf("name = %q, want SELECT", got.Name())
+	}
+	attrs := make(map[string]string)
+	for _, attr := range got.Attributes() {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	want := map[string]string{
+		"db.system":         "postgresql",
+		"db.operation.name": "SELECT",
+		"db.query.text":     "select id FROM users WHERE name = $1",
+	}
+	for key, value := range want {
+		if attrs[key] != value {
+			t.Errorf("%s = %q, want %q", key, attrs[key], value)
+		}
+	}
+	if got.Status().Code != codes.Error || len(got.Events()) != 1 {
+		t.Errorf("status = %v with %d events, want the error recorded", got.Status(), len(got.Events()))
+	}
+}
@@ -1,14 +1,24 @@
 import apiClient from '../client'
 
 const usersApi = {
-  fetchUsers() {
-    return apiClient.get('/users')
+  // Searches the user directory, a page at a time: { users, hasMore, nextCursor }
+  fetchUsers({ q, limit, cursor } = {}) {
+    return apiClient.get('/users', { params: { q, limit, cursor } })
   },
 
   fetchCurrentUser() {
     return apiClient.get('/users/me')
   },
 
+  fetchUser(id) {
+    return apiClient.get(`/users/${id}`)
+  },
+
+  // Changes the fields given among name, displayName, bio, statusText and statusExpiresAt
+  updateProfile(fields) {
+    return apiClient.patch('/users/me', fields)
+  },
+
   updateUsername(name) {
     return apiClient.put('/users/me/username', { name })
   },
@@ -7,6 +7,8 @@ export const useUserStore = defineStore('user', {
     isLoading: false,
     error: null,
     users: [],
+    hasMoreUsers: false,
+    nextUsersCursor: null,
   }),
 
   getters: {
@@ -15,7 +17,7 @@ export const useUserStore = defineStore('user', {
     allUsers: (state) => state.users,
     userDisplayName: (state) => {
       if (!state.user) return ''
-      return state.user.name || 'Unknown User'
+      return state.user.displayName || state.user.name || 'Unknown User'
     },
     userProfilePhoto: (state) => {
       if (!state.user || !state.user.photo) return null
@@ -51,15 +53,21 @@ export const useUserStore = defineStore('user', {
       }
     },
 
-    // Fetch all users
-    async fetchUsers() {
+    // Search the user directory, the first page, or the next one with more
+    async fetchUsers(query = '', { more = false } = {}) {
       this.isLoading = true
       this.error = null
 
       try {
-        const response = await usersApi.fetchUsers()
-        this.users = response.data
-        return response.data
+        const response = await usersApi.fetchUsers({
+          q: query || undefined,
+          cursor: more ? this.nextUsersCursor : undefined,
+        })
+        const { users, hasMore, nextCursor } = response.data
+        this.users = more ? [...this.users, ...users] : users
+        this.hasMoreUsers = hasMore
+        this.nextUsersCursor = nextCursor || null
+        return users
       } catch (error) {
         this.error = error.message || 'Failed to fetch users'
         throw error
@@ -68,6 +76,23 @@ export const useUserStore = defineStore('user', {
       }
     },
 
+    // Update the user's name and profile fields
+    async updateProfile(fields) {
+      this.isLoading = true
+      this.error = null
+
+      try {
+        const response = await usersApi.updateProfile(fields)
+        this.user = response.data
+        return response.data
+      } catch (error) {
+        this.error = error.message || 'Failed to update profile'
+        throw error
+      } finally {
+        this.isLoading = false
+      }
+    },
+
     // Update user's username
     async updateUsername(name) {
       this.isLoading = true